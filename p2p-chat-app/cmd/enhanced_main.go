@@ -12,14 +12,25 @@ import (
 	"time"
 
 	"p2p-chat-app/internal/chat"
+	"p2p-chat-app/internal/config"
 	"p2p-chat-app/internal/identity"
 	"p2p-chat-app/internal/network"
+	"p2p-chat-app/internal/notify"
 )
 
+// cfg holds the ports and addresses from flags and P2PCHAT_* variables
+var cfg *config.Config
+
 func main() {
 	fmt.Println("🚀 Starting Enhanced P2P Chat Application...")
 	fmt.Println("=====================================")
 
+	var err error
+	cfg, err = config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	userIdentity, err := getOrCreateIdentity()
 	if err != nil {
 		log.Fatalf("Failed to get user identity: %v", err)
@@ -37,8 +48,41 @@ func main() {
 		log.Fatalf("Failed to create chat system: %v", err)
 	}
 
-	networkSystem := network.NewEnhancedP2PNetwork(userIdentity)
+	networkSystem := network.NewEnhancedP2PNetwork(userIdentity, cfg.DiscoveryPort)
 	networkSystem.SetChat(chatSystem)
+	networkSystem.Discovery().SetBindAddr(cfg.DiscoveryBind)
+	networkSystem.Discovery().EnableIPv6(cfg.DiscoveryIPv6)
+	if err := networkSystem.Discovery().SetBackends(cfg.DiscoveryBackends()); err != nil {
+		log.Fatalf("Invalid discovery backends: %v", err)
+	}
+	networkSystem.SetAdvertisePort(cfg.AdvertisePort)
+	networkSystem.SetBootstrap(cfg.BootstrapPeers())
+
+	bansFile := filepath.Join(os.Getenv("HOME"), ".p2pchat", "bans.json")
+	if err := networkSystem.LoadBans(bansFile); err != nil {
+		log.Printf("Failed to load ban list: %v", err)
+	}
+
+	contactsFile := filepath.Join(os.Getenv("HOME"), ".p2pchat", "contacts.json")
+	if err := networkSystem.LoadContacts(contactsFile); err != nil {
+		log.Printf("Failed to load contacts: %v", err)
+	}
+
+	notifyFile := filepath.Join(os.Getenv("HOME"), ".p2pchat", "notify.json")
+	if err := chatSystem.Notifier().Load(notifyFile); err != nil {
+		log.Printf("Failed to load notification settings: %v", err)
+	}
+	for _, name := range cfg.NotifySinks() {
+		sink, err := notify.NewSink(name, cfg.NotifyWebhook)
+		if err != nil {
+			log.Printf("No %s notifications: %v", name, err)
+			continue
+		}
+		chatSystem.Notifier().AddSink(sink)
+	}
+	chatSystem.SetReadReceipts(cfg.ReadReceipts)
+	chatSystem.SetIdleTimeout(cfg.IdleTimeout)
+	chatSystem.SetTypingDisplay(cfg.ShowTyping)
 
 	if err := networkSystem.Start(); err != nil {
 		log.Fatalf("Failed to start network: %v", err)
@@ -48,10 +92,10 @@ func main() {
 
 	switch mode {
 	case "listen":
-		if err := networkSystem.Listen(":9000"); err != nil {
+		if err := networkSystem.Listen(cfg.ListenAddr); err != nil {
 			log.Fatalf("Failed to start listening: %v", err)
 		}
-		fmt.Println("🎧 Listening for connections on :9000")
+		fmt.Printf("🎧 Listening for connections on %s\n", cfg.ListenAddr)
 
 	case "connect":
 		address := getConnectionAddress()
@@ -65,13 +109,13 @@ func main() {
 		handlePeerDiscovery(networkSystem)
 
 	case "auto":
-		if err := networkSystem.Listen(":9000"); err != nil {
+		if err := networkSystem.Listen(cfg.ListenAddr); err != nil {
 			log.Printf("Failed to start listening: %v", err)
 		} else {
-			fmt.Println("🎧 Listening for connections on :9000")
+			fmt.Printf("🎧 Listening for connections on %s\n", cfg.ListenAddr)
 		}
 		
-		go autoConnectToPeers(networkSystem)
+		go networkSystem.AutoConnect()
 	}
 
 	chatSystem.Start()
@@ -169,7 +213,7 @@ func getUserNetworkMode() string {
 }
 
 func getConnectionAddress() string {
-	fmt.Print("Enter peer address (host:port): ")
+	fmt.Print("Enter peer address (host:port) or p2pchat:// invite link: ")
 	reader := bufio.NewReader(os.Stdin)
 	address, _ := reader.ReadString('\n')
 	return strings.TrimSpace(address)
@@ -183,7 +227,7 @@ func handlePeerDiscovery(network *network.EnhancedP2PNetwork) {
 	peers := network.GetDiscoveredPeers()
 	if len(peers) == 0 {
 		fmt.Println("No peers discovered. Starting in listen mode...")
-		network.Listen(":9000")
+		network.Listen(cfg.ListenAddr)
 		return
 	}
 
@@ -198,7 +242,7 @@ func handlePeerDiscovery(network *network.EnhancedP2PNetwork) {
 	choice = strings.TrimSpace(choice)
 
 	if choice == "0" || choice == "" {
-		network.Listen(":9000")
+		network.Listen(cfg.ListenAddr)
 		return
 	}
 
@@ -212,20 +256,7 @@ func handlePeerDiscovery(network *network.EnhancedP2PNetwork) {
 		}
 	}
 
-	network.Listen(":9000")
-}
-
-func autoConnectToPeers(network *network.EnhancedP2PNetwork) {
-	time.Sleep(3 * time.Second) 
-
-	peers := network.GetDiscoveredPeers()
-	for _, peer := range peers {
-		if err := network.ConnectToPeer(peer); err != nil {
-			fmt.Printf("Auto-connect to %s failed: %v\n", peer.User.Username, err)
-		} else {
-			fmt.Printf("🔗 Auto-connected to %s\n", peer.User.Username)
-		}
-	}
+	network.Listen(cfg.ListenAddr)
 }
 
 func showMainMenu(network *network.EnhancedP2PNetwork) {
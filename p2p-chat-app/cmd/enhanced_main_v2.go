@@ -13,16 +13,28 @@ import (
 
 	"p2p-chat-app/internal/blockchain"
 	"p2p-chat-app/internal/chat"
+	"p2p-chat-app/internal/config"
 	"p2p-chat-app/internal/identity"
 	"p2p-chat-app/internal/mobile"
 	"p2p-chat-app/internal/network"
+	"p2p-chat-app/internal/notify"
+	"p2p-chat-app/internal/transport"
 	"p2p-chat-app/internal/webui"
 )
 
+// cfg holds the ports and addresses from flags and P2PCHAT_* variables
+var cfg *config.Config
+
 func main() {
 	fmt.Println("🚀 starting enhanced p2p chat v2.0...")
 	fmt.Println("=====================================")
 
+	var err error
+	cfg, err = config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
 	userIdentity, err := getOrCreateIdentity()
 	if err != nil {
 		log.Fatalf("failed to get user identity: %v", err)
@@ -48,31 +60,100 @@ func main() {
 		log.Fatalf("failed to create chat system: %v", err)
 	}
 
-	networkSystem := network.NewEnhancedP2PNetwork(userIdentity)
+	// route outbound dials through tor or another socks5 proxy
+	if cfg.Proxy != "" {
+		if err := transport.SetProxy(cfg.Proxy); err != nil {
+			log.Fatalf("invalid proxy: %v", err)
+		}
+		fmt.Printf("🧅 dialing through proxy %s\n", cfg.Proxy)
+	}
+
+	if cfg.SendPolicy != "" {
+		sendConfig := chat.DefaultSendConfig()
+		if sendConfig.Policy, err = chat.ParseQueuePolicy(cfg.SendPolicy); err != nil {
+			log.Fatalf("invalid send policy: %v", err)
+		}
+		chatSystem.SetSendConfig(sendConfig)
+	}
+
+	networkSystem := network.NewEnhancedP2PNetwork(userIdentity, cfg.DiscoveryPort)
 	networkSystem.SetChat(chatSystem)
 	networkSystem.SetBlockchain(bc)
+	networkSystem.Discovery().SetBindAddr(cfg.DiscoveryBind)
+	networkSystem.Discovery().EnableIPv6(cfg.DiscoveryIPv6)
+	if err := networkSystem.Discovery().SetBackends(cfg.DiscoveryBackends()); err != nil {
+		log.Fatalf("invalid discovery backends: %v", err)
+	}
+	networkSystem.SetAdvertisePort(cfg.AdvertisePort)
+	networkSystem.SetBootstrap(cfg.BootstrapPeers())
+
+	bansFile := filepath.Join(os.Getenv("HOME"), ".p2pchat", "bans.json")
+	if err := networkSystem.LoadBans(bansFile); err != nil {
+		log.Printf("failed to load ban list: %v", err)
+	}
+
+	contactsFile := filepath.Join(os.Getenv("HOME"), ".p2pchat", "contacts.json")
+	if err := networkSystem.LoadContacts(contactsFile); err != nil {
+		log.Printf("failed to load contacts: %v", err)
+	}
+
+	notifyFile := filepath.Join(os.Getenv("HOME"), ".p2pchat", "notify.json")
+	if err := chatSystem.Notifier().Load(notifyFile); err != nil {
+		log.Printf("failed to load notification settings: %v", err)
+	}
+	for _, name := range cfg.NotifySinks() {
+		sink, err := notify.NewSink(name, cfg.NotifyWebhook)
+		if err != nil {
+			log.Printf("no %s notifications: %v", name, err)
+			continue
+		}
+		chatSystem.Notifier().AddSink(sink)
+	}
+	chatSystem.SetReadReceipts(cfg.ReadReceipts)
+	chatSystem.SetIdleTimeout(cfg.IdleTimeout)
+	chatSystem.SetTypingDisplay(cfg.ShowTyping)
+
+	if cfg.OnionAddress != "" {
+		if err := networkSystem.SetOnionAddress(cfg.OnionAddress); err != nil {
+			log.Fatalf("invalid onion address: %v", err)
+		}
+		fmt.Printf("🧅 advertising %s\n", cfg.OnionAddress)
+	}
 
 	if err := networkSystem.Start(); err != nil {
 		log.Fatalf("failed to start network: %v", err)
 	}
+	// presence, room adverts and expiry run in every mode, terminal or not
+	chatSystem.StartBackground()
 
 	// start web ui
-	webServer := webui.NewWebServer("8080", chatSystem, networkSystem)
+	webServer := webui.NewWebServer(cfg.WebAddr, chatSystem, networkSystem)
 	go func() {
 		if err := webServer.Start(); err != nil {
 			log.Printf("web server failed: %v", err)
 		}
 	}()
-	fmt.Println("🌐 web ui started on http://localhost:8080")
+	fmt.Printf("🌐 web ui started on %s\n", config.LocalURL("http", cfg.WebAddr))
 
 	// start mobile api
-	mobileAPI := mobile.NewMobileAPI("8081", chatSystem, networkSystem)
+	mobileAPI := mobile.NewMobileAPI(cfg.APIAddr, chatSystem, networkSystem)
+	mobileAPI.ConfigureApp(cfg.WebAddr, cfg.ChatPort(), cfg.DiscoveryPort)
 	go func() {
 		if err := mobileAPI.Start(); err != nil {
 			log.Printf("mobile api failed: %v", err)
 		}
 	}()
-	fmt.Println("📱 mobile api started on http://localhost:8081")
+	fmt.Printf("📱 mobile api started on %s\n", config.LocalURL("http", cfg.APIAddr))
+
+	// a node reachable from everywhere can introduce NATed peers to each other
+	if cfg.RendezvousListen != "" {
+		rendezvous := network.NewRendezvousServer()
+		if err := rendezvous.Listen(cfg.RendezvousListen); err != nil {
+			log.Printf("rendezvous server failed: %v", err)
+		} else {
+			fmt.Printf("🛰️  rendezvous server listening on %s\n", cfg.RendezvousListen)
+		}
+	}
 
 	mode := getUserMode()
 
@@ -115,35 +196,38 @@ func getUserMode() string {
 func runTerminalMode(chat *chat.EnhancedChat, network *network.EnhancedP2PNetwork) {
 	mode := getUserNetworkMode()
 	setupNetwork(network, mode)
+	setupRendezvous(network)
 	chat.Start()
 	showMainMenu(network)
 	select {}
 }
 
 func runWebMode() {
-	fmt.Println("🌐 web mode - open http://localhost:8080")
-	fmt.Println("📱 mobile api available at http://localhost:8081")
+	fmt.Printf("🌐 web mode - open %s\n", config.LocalURL("http", cfg.WebAddr))
+	fmt.Printf("📱 mobile api available at %s\n", config.LocalURL("http", cfg.APIAddr))
 	select {}
 }
 
 func runHeadlessMode(network *network.EnhancedP2PNetwork) {
-	if err := network.Listen(":9000"); err != nil {
+	if err := network.Listen(cfg.ListenAddr); err != nil {
 		log.Printf("failed to start listening: %v", err)
 	}
+	setupRendezvous(network)
 	fmt.Println("🤖 headless mode - api only")
 	select {}
 }
 
 func runAutoMode(chat *chat.EnhancedChat, network *network.EnhancedP2PNetwork) {
-	if err := network.Listen(":9000"); err != nil {
+	if err := network.Listen(cfg.ListenAddr); err != nil {
 		log.Printf("failed to start listening: %v", err)
 	}
+	setupRendezvous(network)
 	
-	go autoConnectToPeers(network)
+	go network.AutoConnect()
 	
 	fmt.Println("🎯 auto mode active:")
-	fmt.Println("   🌐 web ui: http://localhost:8080")
-	fmt.Println("   📱 mobile api: http://localhost:8081")
+	fmt.Printf("   🌐 web ui: %s\n", config.LocalURL("http", cfg.WebAddr))
+	fmt.Printf("   📱 mobile api: %s\n", config.LocalURL("http", cfg.APIAddr))
 	fmt.Println("   💬 terminal: type messages below")
 	fmt.Println("")
 	
@@ -154,10 +238,10 @@ func runAutoMode(chat *chat.EnhancedChat, network *network.EnhancedP2PNetwork) {
 func setupNetwork(network *network.EnhancedP2PNetwork, mode string) {
 	switch mode {
 	case "listen":
-		if err := network.Listen(":9000"); err != nil {
+		if err := network.Listen(cfg.ListenAddr); err != nil {
 			log.Fatalf("failed to start listening: %v", err)
 		}
-		fmt.Println("🎧 listening for connections on :9000")
+		fmt.Printf("🎧 listening for connections on %s\n", cfg.ListenAddr)
 
 	case "connect":
 		address := getConnectionAddress()
@@ -171,12 +255,23 @@ func setupNetwork(network *network.EnhancedP2PNetwork, mode string) {
 		handlePeerDiscovery(network)
 
 	case "auto":
-		if err := network.Listen(":9000"); err != nil {
+		if err := network.Listen(cfg.ListenAddr); err != nil {
 			log.Printf("failed to start listening: %v", err)
 		} else {
-			fmt.Println("🎧 listening for connections on :9000")
+			fmt.Printf("🎧 listening for connections on %s\n", cfg.ListenAddr)
 		}
-		go autoConnectToPeers(network)
+		go network.AutoConnect()
+	}
+}
+
+// setupRendezvous registers with the configured rendezvous server so
+// connections can fall back to hole punching and relay.
+func setupRendezvous(network *network.EnhancedP2PNetwork) {
+	if cfg.Rendezvous == "" {
+		return
+	}
+	if err := network.UseRendezvous(cfg.Rendezvous); err != nil {
+		log.Printf("rendezvous registration failed: %v", err)
 	}
 }
 
@@ -268,7 +363,7 @@ func getUserNetworkMode() string {
 }
 
 func getConnectionAddress() string {
-	fmt.Print("enter peer address (host:port): ")
+	fmt.Print("enter peer address (host:port, tcp:// unix:// ws:// address, or p2pchat:// invite link): ")
 	reader := bufio.NewReader(os.Stdin)
 	address, _ := reader.ReadString('\n')
 	return strings.TrimSpace(address)
@@ -282,7 +377,7 @@ func handlePeerDiscovery(network *network.EnhancedP2PNetwork) {
 	peers := network.GetDiscoveredPeers()
 	if len(peers) == 0 {
 		fmt.Println("no peers discovered. starting in listen mode...")
-		network.Listen(":9000")
+		network.Listen(cfg.ListenAddr)
 		return
 	}
 
@@ -297,7 +392,7 @@ func handlePeerDiscovery(network *network.EnhancedP2PNetwork) {
 	choice = strings.TrimSpace(choice)
 
 	if choice == "0" || choice == "" {
-		network.Listen(":9000")
+		network.Listen(cfg.ListenAddr)
 		return
 	}
 
@@ -311,27 +406,14 @@ func handlePeerDiscovery(network *network.EnhancedP2PNetwork) {
 		}
 	}
 
-	network.Listen(":9000")
-}
-
-func autoConnectToPeers(network *network.EnhancedP2PNetwork) {
-	time.Sleep(3 * time.Second)
-
-	peers := network.GetDiscoveredPeers()
-	for _, peer := range peers {
-		if err := network.ConnectToPeer(peer); err != nil {
-			fmt.Printf("auto-connect to %s failed: %v\n", peer.User.Username, err)
-		} else {
-			fmt.Printf("🔗 auto-connected to %s\n", peer.User.Username)
-		}
-	}
+	network.Listen(cfg.ListenAddr)
 }
 
 func showMainMenu(network *network.EnhancedP2PNetwork) {
 	fmt.Println("\n🎯 enhanced p2p chat v2.0 ready!")
 	fmt.Println("💡 new features:")
-	fmt.Println("   🌐 web ui: http://localhost:8080")
-	fmt.Println("   📱 mobile api: http://localhost:8081/api")
+	fmt.Printf("   🌐 web ui: %s\n", config.LocalURL("http", cfg.WebAddr))
+	fmt.Printf("   📱 mobile api: %s/api\n", config.LocalURL("http", cfg.APIAddr))
 	fmt.Println("   🔗 blockchain identity verification")
 	fmt.Println("   🔐 enhanced ecdh encryption")
 	fmt.Println("   💬 forward secure messaging")
@@ -2,4 +2,7 @@ module p2p-chat-app
 
 go 1.18
 
-require github.com/gorilla/websocket v1.5.0
+require (
+	github.com/gorilla/websocket v1.5.0
+	golang.org/x/sys v0.15.0
+)
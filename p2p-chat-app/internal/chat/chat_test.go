@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestIdentity(t *testing.T, name string) *identity.Identity {
+	t.Helper()
+	id, err := identity.NewIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// newTestChat returns a chat with no peers, storing into a temporary
+// directory.
+func newTestChat(t *testing.T, name string) *EnhancedChat {
+	t.Helper()
+	ec, err := NewEnhancedChat(newTestIdentity(t, name), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ec.Stop)
+	return ec
+}
+
+func TestStartAndStopTwice(t *testing.T) {
+	ec := newTestChat(t, "alice")
+	ec.StartBackground()
+	ec.StartBackground()
+	ec.Stop()
+	ec.Stop()
+}
+
+func TestOwnDevices(t *testing.T) {
+	tests := []struct {
+		name string
+		// device is what our other device does, under our own ID
+		device func(ec *EnhancedChat)
+	}{
+		{"disconnects", func(ec *EnhancedChat) {
+			conn, other := net.Pipe()
+			go io.Copy(ioutil.Discard, other)
+			t.Cleanup(func() { other.Close() })
+			ec.AddPeer(ec.identity.ID, conn)
+			ec.RemovePeer(ec.identity.ID)
+		}},
+		{"leaves our room", func(ec *EnhancedChat) {
+			ec.handleMembership(&protocol.Message{Type: protocol.LeaveMessage, From: ec.identity.ID, Room: defaultRoom})
+		}},
+		{"joins another room", func(ec *EnhancedChat) {
+			ec.handleMembership(&protocol.Message{Type: protocol.JoinMessage, From: ec.identity.ID, Room: "golang"})
+		}},
+		{"lists another room", func(ec *EnhancedChat) {
+			ec.handleMembership(&protocol.Message{Type: protocol.UserListMessage, From: ec.identity.ID, Room: "golang"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec := newTestChat(t, "alice")
+			tt.device(ec)
+
+			ec.mu.RLock()
+			defer ec.mu.RUnlock()
+			if !ec.rooms[defaultRoom][ec.identity.ID] {
+				t.Error("we left the default room")
+			}
+			if ec.rooms["golang"][ec.identity.ID] {
+				t.Error("we joined golang")
+			}
+		})
+	}
+}
+
+func TestReadMarkersBatched(t *testing.T) {
+	dir := t.TempDir()
+	ec, err := NewEnhancedChat(newTestIdentity(t, "alice"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ec.Stop)
+
+	key := storage.RoomKey(defaultRoom)
+	start := time.Now().Add(-time.Minute)
+	var last *protocol.Message
+	for i := 0; i < 3; i++ {
+		last = &protocol.Message{
+			ID:        protocol.GenerateMessageID(),
+			Type:      protocol.TextMessage,
+			From:      "bob",
+			Room:      defaultRoom,
+			Content:   "hi",
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+		}
+		if err := ec.storage.StoreMessage(last); err != nil {
+			t.Fatal(err)
+		}
+		ec.readIfFocused(last)
+	}
+
+	markers := filepath.Join(dir, "read_markers.json")
+	if _, err := os.Stat(markers); !os.IsNotExist(err) {
+		t.Fatal("markers saved before a flush")
+	}
+	ec.mu.RLock()
+	unsent := ec.unsentReads[key]
+	queued := len(ec.unsentReads)
+	ec.mu.RUnlock()
+	if queued != 1 || unsent.marker.MessageID != last.ID {
+		t.Fatalf("%d markers queued, the one for %s at %s", queued, key, unsent.marker.MessageID)
+	}
+	if unread, _ := ec.unreadCounts(key); unread != 0 {
+		t.Fatalf("%d unread before a flush", unread)
+	}
+
+	ec.flushReads()
+	if _, err := os.Stat(markers); err != nil {
+		t.Fatalf("markers not saved: %v", err)
+	}
+	ec.mu.RLock()
+	queued = len(ec.unsentReads)
+	ec.mu.RUnlock()
+	if queued != 0 {
+		t.Fatalf("%d markers still queued", queued)
+	}
+}
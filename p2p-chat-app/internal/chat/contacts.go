@@ -0,0 +1,195 @@
+package chat
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/contacts"
+	"p2p-chat-app/internal/invite"
+	"strings"
+)
+
+// SetContacts shares the network's address book, which checks peer keys as
+// they connect. Call it before any peer is added.
+func (ec *EnhancedChat) SetContacts(book *contacts.Book) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.contacts = book
+}
+
+func (ec *EnhancedChat) Contacts() *contacts.Book {
+	return ec.contacts
+}
+
+// displayName is how userID appears in the terminal: our own username, a
+// contact's nickname or username, or the bare ID.
+func (ec *EnhancedChat) displayName(userID string) string {
+	if userID == ec.identity.ID {
+		return ec.identity.Username
+	}
+	return ec.contacts.Name(userID)
+}
+
+// pinCorrespondent makes a user we exchange private messages with a
+// contact, pinning the key they connected with.
+func (ec *EnhancedChat) pinCorrespondent(userID string) {
+	if userID == ec.identity.ID {
+		return
+	}
+	if err := ec.contacts.Pin(userID); err != nil {
+		fmt.Printf("Error adding %s to contacts: %v\n", userID, err)
+	}
+}
+
+// resolveUser turns a nickname typed in a command into a user ID. Anything
+// else is taken to be an ID already.
+func (ec *EnhancedChat) resolveUser(name string) string {
+	if userID, found := ec.contacts.Resolve(name); found {
+		return userID
+	}
+	return name
+}
+
+// AddContact saves a user ID or invite link as a contact. A link brings
+// the user's key fingerprint, which is pinned, and their addresses.
+func (ec *EnhancedChat) AddContact(target, nickname, notes string) (contacts.Contact, error) {
+	contact := contacts.Contact{UserID: target, Nickname: nickname, Notes: notes}
+	if invite.IsLink(target) {
+		link, err := invite.Parse(target)
+		if err != nil {
+			return contacts.Contact{}, err
+		}
+		contact.UserID = link.UserID
+		contact.Username = link.Username
+		contact.Fingerprint = link.Fingerprint
+		contact.Addresses = link.Addresses
+	}
+	if contact.UserID == ec.identity.ID {
+		return contacts.Contact{}, fmt.Errorf("you can't add yourself")
+	}
+	return ec.contacts.Add(contact)
+}
+
+// ContactRequest is a contact as the APIs receive it. User is a user ID,
+// a nickname when updating, or an invite link when adding.
+type ContactRequest struct {
+	User     string `json:"user"`
+	Nickname string `json:"nickname,omitempty"`
+	Notes    string `json:"notes,omitempty"`
+}
+
+// UpdateContact replaces the nickname and notes of a contact.
+func (ec *EnhancedChat) UpdateContact(req ContactRequest) error {
+	userID := ec.resolveUser(req.User)
+	if err := ec.contacts.Rename(userID, req.Nickname); err != nil {
+		return err
+	}
+	return ec.contacts.SetNotes(userID, req.Notes)
+}
+
+// RemoveContact forgets a contact by ID or nickname.
+func (ec *EnhancedChat) RemoveContact(user string) bool {
+	return ec.contacts.Remove(ec.resolveUser(user))
+}
+
+// ListContacts prints the address book.
+func (ec *EnhancedChat) ListContacts() {
+	list := ec.contacts.List()
+	if len(list) == 0 {
+		fmt.Println("📇 No contacts yet")
+		return
+	}
+
+	ec.mu.RLock()
+	online := make(map[string]bool)
+	for userID := range ec.peers {
+		online[userID] = true
+	}
+	ec.mu.RUnlock()
+
+	fmt.Println("📇 Contacts:")
+	for _, contact := range list {
+		status := "⚪"
+		if online[contact.UserID] {
+			status = "🟢"
+		}
+		name := contact.Name()
+		if contact.Nickname != "" && contact.Username != "" {
+			name += " (" + contact.Username + ")"
+		}
+		switch {
+		case contact.NewKey != "":
+			name += " ⚠️  key changed, see /verify " + contact.UserID
+		case contact.Verified:
+			name += " ✅ verified"
+		}
+		fmt.Printf("  %s %s - %s\n", status, name, contact.UserID)
+
+		key := "not pinned yet"
+		if contact.Fingerprint != "" {
+			key = contact.Fingerprint[:16]
+		}
+		seen := "never"
+		if !contact.LastSeen.IsZero() {
+			seen = contact.LastSeen.Format("2006-01-02 15:04")
+		}
+		fmt.Printf("      key %s, last seen %s\n", key, seen)
+		if len(contact.Addresses) > 0 {
+			fmt.Printf("      at %s\n", strings.Join(contact.Addresses, ", "))
+		}
+		if contact.Notes != "" {
+			fmt.Printf("      📝 %s\n", contact.Notes)
+		}
+	}
+}
+
+// handleContactCommand runs /contacts, /add, /rename and /remove.
+func (ec *EnhancedChat) handleContactCommand(command string, args []string) {
+	switch command {
+	case "contacts":
+		ec.ListContacts()
+
+	case "add":
+		if len(args) == 0 {
+			fmt.Println("Usage: /add <user_id|link> [nickname] [notes]")
+			return
+		}
+		nickname, notes := "", ""
+		if len(args) > 1 {
+			nickname = args[1]
+			notes = strings.Join(args[2:], " ")
+		}
+		contact, err := ec.AddContact(args[0], nickname, notes)
+		if err != nil {
+			fmt.Printf("Error adding contact: %v\n", err)
+			return
+		}
+		fmt.Printf("📇 Added %s (%s)\n", contact.Name(), contact.UserID)
+
+	case "rename":
+		if len(args) == 0 {
+			fmt.Println("Usage: /rename <user> [nickname]")
+			return
+		}
+		nickname := ""
+		if len(args) > 1 {
+			nickname = args[1]
+		}
+		userID := ec.resolveUser(args[0])
+		if err := ec.contacts.Rename(userID, nickname); err != nil {
+			fmt.Printf("Error renaming contact: %v\n", err)
+			return
+		}
+		fmt.Printf("📇 %s is now %s\n", userID, ec.displayName(userID))
+
+	case "remove":
+		if len(args) == 0 {
+			fmt.Println("Usage: /remove <user>")
+			return
+		}
+		userID := ec.resolveUser(args[0])
+		if !ec.RemoveContact(userID) {
+			fmt.Printf("%s is not a contact\n", args[0])
+			return
+		}
+		fmt.Printf("🗑️  Removed %s, they'll be added again if you message them privately or /add them\n", userID)
+	}
+}
@@ -0,0 +1,301 @@
+package chat
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"sort"
+	"time"
+)
+
+const (
+	// advertInterval is how often we tell our peers which rooms we know
+	advertInterval = 1 * time.Minute
+	// directoryTTL is how long a room stays listed without being advertised
+	directoryTTL = 10 * time.Minute
+	// maxAdvertRooms caps how many rooms one advertisement carries
+	maxAdvertRooms = 100
+	maxRoomName    = 64
+	maxTopic       = 256
+	maxClockSkew   = 2 * time.Minute
+)
+
+// Room advertisements are gossiped: every node sends its peers the rooms it
+// is in plus the fresh entries it heard from others, so a room reaches the
+// whole network without a central directory. Entries are signed by the
+// member that advertised them and carry the time it did; the newest one
+// wins and stale ones expire. An entry dated ahead of our clock counts as
+// made when we heard it, so it cannot outrank later ones.
+
+// directoryEntry is a room advertised by a peer and when it counts as
+// advertised.
+type directoryEntry struct {
+	protocol.RoomInfo
+	at time.Time
+}
+
+// RoomDirectory lists every public room known on the network, including our
+// own, busiest first.
+func (ec *EnhancedChat) RoomDirectory() []protocol.RoomInfo {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	rooms := ec.directoryLocked()
+	for i := range rooms {
+		// the key and signature only matter to peers
+		rooms[i].AdvertiserKey, rooms[i].Signature = "", ""
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].Members != rooms[j].Members {
+			return rooms[i].Members > rooms[j].Members
+		}
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+// directoryLocked merges the rooms we are in with the fresh entries heard
+// from peers. Callers hold ec.mu.
+func (ec *EnhancedChat) directoryLocked() []protocol.RoomInfo {
+	now := time.Now()
+	merged := make(map[string]protocol.RoomInfo)
+	for name, entry := range ec.directory {
+		if now.Sub(entry.at) < directoryTTL {
+			merged[name] = entry.RoomInfo
+		}
+	}
+	for name, members := range ec.rooms {
+		if !members[ec.identity.ID] || !ec.publicLocked(name) {
+			continue
+		}
+		merged[name] = protocol.RoomInfo{
+			Name:         name,
+			Topic:        ec.topicLocked(name),
+			Members:      len(ec.membersLocked(name)),
+			UpdatedAt:    now,
+			AdvertisedBy: ec.identity.ID,
+		}
+	}
+
+	rooms := make([]protocol.RoomInfo, 0, len(merged))
+	for _, info := range merged {
+		rooms = append(rooms, info)
+	}
+	return rooms
+}
+
+// ListDirectory prints the network room directory.
+func (ec *EnhancedChat) ListDirectory() {
+	rooms := ec.RoomDirectory()
+
+	ec.mu.RLock()
+	currentRoom := ec.currentRoom
+	ec.mu.RUnlock()
+
+	fmt.Println("🌐 Rooms on the network:")
+	if len(rooms) == 0 {
+		fmt.Println("  (none advertised yet)")
+		return
+	}
+	for _, info := range rooms {
+		current := ""
+		if info.Name == currentRoom {
+			current = " (current)"
+		}
+		topic := ""
+		if info.Topic != "" {
+			topic = " - " + info.Topic
+		}
+		fmt.Printf("  - %s (%d users)%s%s\n", info.Name, info.Members, current, topic)
+	}
+	fmt.Println("  Use /join <room> to join one")
+}
+
+func (ec *EnhancedChat) roomAdvert() *protocol.Message {
+	ec.mu.RLock()
+	rooms := ec.directoryLocked()
+	ec.mu.RUnlock()
+
+	// the newest entries are the most useful to pass on
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].UpdatedAt.After(rooms[j].UpdatedAt)
+	})
+	if len(rooms) > maxAdvertRooms {
+		rooms = rooms[:maxAdvertRooms]
+	}
+	for i := range rooms {
+		if rooms[i].AdvertisedBy != ec.identity.ID {
+			continue
+		}
+		if err := ec.signRoomInfo(&rooms[i]); err != nil {
+			fmt.Printf("Error signing room advertisement: %v\n", err)
+		}
+	}
+
+	return &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.RoomAdvertMessage,
+		From:      ec.identity.ID,
+		Timestamp: time.Now(),
+		Rooms:     rooms,
+	}
+}
+
+// advertiseRooms sends our room advertisement to every peer.
+func (ec *EnhancedChat) advertiseRooms() {
+	advert := ec.roomAdvert()
+	if len(advert.Rooms) == 0 {
+		return
+	}
+	if err := ec.broadcastMessage(advert); err != nil {
+		fmt.Printf("Room advertisement error: %v\n", err)
+	}
+}
+
+func (ec *EnhancedChat) advertiseLoop() {
+	ticker := time.NewTicker(advertInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ec.advertiseRooms()
+		case <-ec.quit:
+			return
+		}
+	}
+}
+
+func roomInfoSignedBytes(info *protocol.RoomInfo) ([]byte, error) {
+	unsigned := *info
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+func (ec *EnhancedChat) signRoomInfo(info *protocol.RoomInfo) error {
+	key, err := ec.identity.ExportPublicKey()
+	if err != nil {
+		return err
+	}
+	info.AdvertisedBy = ec.identity.ID
+	info.AdvertiserKey = key
+	data, err := roomInfoSignedBytes(info)
+	if err != nil {
+		return err
+	}
+	signature, err := ec.identity.Sign(data)
+	if err != nil {
+		return err
+	}
+	info.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+func verifyRoomInfo(info *protocol.RoomInfo) error {
+	signature, err := hex.DecodeString(info.Signature)
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("advertisement of room %s is not signed", info.Name)
+	}
+	data, err := roomInfoSignedBytes(info)
+	if err != nil {
+		return err
+	}
+	if err := identity.VerifyFrom(info.AdvertisedBy, info.AdvertiserKey, data, signature); err != nil {
+		return fmt.Errorf("bad signature on advertisement of room %s: %v", info.Name, err)
+	}
+	return nil
+}
+
+// mergeDirectory takes in the rooms a peer advertised. It returns an error
+// for the first entry with a bad signature.
+func (ec *EnhancedChat) mergeDirectory(rooms []protocol.RoomInfo) error {
+	if len(rooms) > maxAdvertRooms {
+		return fmt.Errorf("room advertisement too long")
+	}
+
+	now := time.Now()
+	var firstErr error
+	for _, info := range rooms {
+		// we know our own rooms best
+		if info.AdvertisedBy == ec.identity.ID {
+			continue
+		}
+		if info.Name == "" || len(info.Name) > maxRoomName || len(info.Topic) > maxTopic || info.Members < 0 {
+			continue
+		}
+		age := now.Sub(info.UpdatedAt)
+		if age > directoryTTL || age < -maxClockSkew {
+			continue
+		}
+		at := info.UpdatedAt
+		if at.After(now) {
+			at = now
+		}
+
+		ec.mu.RLock()
+		known, exists := ec.directory[info.Name]
+		ec.mu.RUnlock()
+		if exists && !at.After(known.at) {
+			continue
+		}
+		if err := verifyRoomInfo(&info); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		ec.mu.Lock()
+		if known, exists := ec.directory[info.Name]; !exists || at.After(known.at) {
+			ec.directory[info.Name] = directoryEntry{RoomInfo: info, at: at}
+		}
+		ec.mu.Unlock()
+	}
+
+	ec.mu.Lock()
+	for name, entry := range ec.directory {
+		if now.Sub(entry.at) > directoryTTL {
+			delete(ec.directory, name)
+		}
+	}
+	ec.mu.Unlock()
+	return firstErr
+}
+
+// handleControlMessage applies messages that update chat state rather than
+// being shown to the user. It reports whether msg was one, and an error if
+// the peer should not have sent it.
+func (ec *EnhancedChat) handleControlMessage(msg *protocol.Message) (bool, error) {
+	switch msg.Type {
+	case protocol.RoomAdvertMessage:
+		return true, ec.mergeDirectory(msg.Rooms)
+	case protocol.JoinMessage, protocol.LeaveMessage, protocol.UserListMessage:
+		return true, ec.handleMembership(msg)
+	case protocol.ReadMessage:
+		return true, ec.handleReadMarker(msg)
+	case protocol.ReactionMessage:
+		return true, ec.handleReaction(msg)
+	case protocol.TypingMessage:
+		return true, ec.handleTyping(msg)
+	case protocol.ExpiryMessage:
+		return true, ec.handleExpiry(msg)
+	case protocol.PresenceMessage:
+		added, err := ec.mergePresence(msg.Presence)
+		if len(added) > 0 {
+			// pass them on so peers we aren't connected to hear of them
+			go ec.sendPresence(added, "")
+		}
+		return true, err
+	case protocol.ModerationMessage:
+		added, err := ec.mergeActions(msg.Room, msg.Actions)
+		if len(added) > 0 {
+			// pass them on so members we aren't connected to hear of them
+			go ec.sendActions(msg.Room, added)
+		}
+		return true, err
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"p2p-chat-app/internal/protocol"
+	"testing"
+	"time"
+)
+
+func TestMergeDirectorySignatures(t *testing.T) {
+	bob := newTestChat(t, "bob")
+	mallory := newTestChat(t, "mallory")
+
+	signed := func(ec *EnhancedChat, info protocol.RoomInfo) protocol.RoomInfo {
+		if err := ec.signRoomInfo(&info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	now := time.Now()
+	room := protocol.RoomInfo{Name: "golang", Topic: "gophers", Members: 3, UpdatedAt: now}
+
+	tests := []struct {
+		name   string
+		info   func() protocol.RoomInfo
+		listed bool
+	}{
+		{"signed", func() protocol.RoomInfo { return signed(bob, room) }, true},
+		{"unsigned", func() protocol.RoomInfo { return room }, false},
+		{"tampered topic", func() protocol.RoomInfo {
+			info := signed(bob, room)
+			info.Topic = "free crypto"
+			return info
+		}, false},
+		{"signed by someone claiming bob", func() protocol.RoomInfo {
+			info := signed(mallory, room)
+			info.AdvertisedBy = bob.identity.ID
+			return info
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			err := alice.mergeDirectory([]protocol.RoomInfo{tt.info()})
+			if tt.listed != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+			_, listed := alice.directory["golang"]
+			if listed != tt.listed {
+				t.Fatalf("listed = %v, want %v", listed, tt.listed)
+			}
+		})
+	}
+}
+
+func TestMergeDirectoryFutureDates(t *testing.T) {
+	alice := newTestChat(t, "alice")
+	bob := newTestChat(t, "bob")
+	mallory := newTestChat(t, "mallory")
+
+	ahead := protocol.RoomInfo{Name: "golang", Topic: "spam", UpdatedAt: time.Now().Add(maxClockSkew / 2)}
+	if err := mallory.signRoomInfo(&ahead); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.mergeDirectory([]protocol.RoomInfo{ahead}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	later := protocol.RoomInfo{Name: "golang", Topic: "gophers", UpdatedAt: time.Now()}
+	if err := bob.signRoomInfo(&later); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.mergeDirectory([]protocol.RoomInfo{later}); err != nil {
+		t.Fatal(err)
+	}
+	if topic := alice.directory["golang"].Topic; topic != "gophers" {
+		t.Fatalf("topic %q: an entry dated ahead outranked a later one", topic)
+	}
+}
@@ -5,24 +5,61 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"p2p-chat-app/internal/contacts"
 	"p2p-chat-app/internal/encryption"
 	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/notify"
 	"p2p-chat-app/internal/protocol"
 	"p2p-chat-app/internal/storage"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+// defaultRoom is where everyone starts. Nobody owns it.
+const defaultRoom = "general"
+
 type EnhancedChat struct {
 	identity    *identity.Identity
-	peers       map[string]net.Conn
-	rooms       map[string]map[string]bool 
-	currentRoom string
+	peers       map[string]*peerWriter
+	rooms       map[string]map[string]bool // directly connected members
+	heard       map[string]map[string][]string
+	currentRoom string // the room with focus
+	acls        map[string]*roomACL // moderation, by room
+	directory   map[string]directoryEntry // rooms advertised by peers
+	contacts    *contacts.Book
+	notifier    *notify.Dispatcher
 	mu          sync.RWMutex
 	incoming    chan *protocol.Message
 	storage     *storage.MessageStore
+	commands    map[string]*chatCommand
+	sendConfig  SendConfig
+	receipts    bool // send read receipts
+	unsentReads map[string]unsentRead // moved read markers not sent yet, by conversation
+	presence    map[string]protocol.Presence // latest signed presence by user, ours included
+	lastActive  time.Time
+	idleAfter   time.Duration
+	onPresence  func(p protocol.Presence) // set by the network layer
+	typers      map[string]map[string]time.Time // who types where, until when
+	typingSent  map[string]time.Time // our last typing start by conversation
+	typingSubs  map[chan TypingEvent]bool
+	showTyping  bool
+	disconnect  func(userID string) // set by the network layer
 	running     bool
+	quit        chan struct{}
+	startOnce   sync.Once
+	stopOnce    sync.Once
+}
+
+// CommandHandler runs a slash command registered from outside the chat
+// package; args are the words after the command name.
+type CommandHandler func(args []string)
+
+type chatCommand struct {
+	usage       string
+	description string
+	handler     CommandHandler
 }
 
 func NewEnhancedChat(userIdentity *identity.Identity, dataDir string) (*EnhancedChat, error) {
@@ -31,74 +68,189 @@ func NewEnhancedChat(userIdentity *identity.Identity, dataDir string) (*Enhanced
 		return nil, err
 	}
 
-	return &EnhancedChat{
+	ec := &EnhancedChat{
 		identity:    userIdentity,
-		peers:       make(map[string]net.Conn),
+		peers:       make(map[string]*peerWriter),
 		rooms:       make(map[string]map[string]bool),
-		currentRoom: "general", // Default room
+		heard:       make(map[string]map[string][]string),
+		currentRoom: defaultRoom,
+		acls:        make(map[string]*roomACL),
+		directory:   make(map[string]directoryEntry),
+		contacts:    contacts.NewBook(),
+		notifier:    notify.NewDispatcher(),
 		incoming:    make(chan *protocol.Message, 100),
 		storage:     store,
-	}, nil
+		commands:    make(map[string]*chatCommand),
+		sendConfig:  DefaultSendConfig(),
+		receipts:    true,
+		unsentReads: make(map[string]unsentRead),
+		presence:    make(map[string]protocol.Presence),
+		lastActive:  time.Now(),
+		idleAfter:   DefaultIdleTimeout,
+		typers:      make(map[string]map[string]time.Time),
+		typingSent:  make(map[string]time.Time),
+		typingSubs:  make(map[chan TypingEvent]bool),
+		quit:        make(chan struct{}),
+	}
+	ec.addMemberLocked(ec.currentRoom, userIdentity.ID)
+	return ec, nil
+}
+
+// RegisterCommand adds /name to the terminal commands. usage is shown in
+// /help next to the description.
+func (ec *EnhancedChat) RegisterCommand(name, usage, description string, handler CommandHandler) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.commands[name] = &chatCommand{usage: usage, description: description, handler: handler}
 }
 
+// Start runs the terminal chat along with the background work.
 func (ec *EnhancedChat) Start() {
+	ec.StartBackground()
 	ec.running = true
 	go ec.messageHandler()
 	go ec.inputHandler()
 }
 
+// StartBackground starts what keeps the chat going without the terminal:
+// room advertisements, presence, typing expiry and deleting expired
+// messages. Calling it again does nothing.
+func (ec *EnhancedChat) StartBackground() {
+	ec.startOnce.Do(func() {
+		go ec.advertiseLoop()
+		go ec.presenceLoop()
+		go ec.typingLoop()
+		go ec.janitorLoop()
+		go ec.readLoop()
+	})
+}
+
+// Stop ends the chat. Calling it again does nothing.
 func (ec *EnhancedChat) Stop() {
-	ec.running = false
-	close(ec.incoming)
+	ec.stopOnce.Do(func() {
+		ec.flushReads()
+		// best effort: peers that miss it see us offline once it expires
+		own := ec.PresenceOf(ec.identity.ID)
+		if err := ec.announcePresence(protocol.PresenceOffline, own.Status, false); err != nil {
+			fmt.Printf("Error announcing presence: %v\n", err)
+		}
+		ec.running = false
+		close(ec.quit)
+		close(ec.incoming)
+	})
 }
 
 func (ec *EnhancedChat) AddPeer(userID string, conn net.Conn) {
 	ec.mu.Lock()
 	defer ec.mu.Unlock()
 	
-	ec.peers[userID] = conn
-	
-	if ec.rooms[ec.currentRoom] == nil {
-		ec.rooms[ec.currentRoom] = make(map[string]bool)
+	if old, exists := ec.peers[userID]; exists {
+		old.stop()
 	}
-	ec.rooms[ec.currentRoom][userID] = true
+	ec.peers[userID] = newPeerWriter(userID, conn, ec.sendConfig, ec.peerWriteFailed)
+	joined := ec.joinedRoomsLocked()
 	
-	fmt.Printf("✅ %s joined the chat\n", userID)
+	fmt.Printf("✅ %s joined the chat\n", ec.displayName(userID))
+
+	// tell the new peer which rooms we are in, and the rooms we know of
+	// without waiting for the next advertisement
+	go func() {
+		for _, room := range joined {
+			ec.sendUserList(room, userID)
+		}
+
+		advert := ec.roomAdvert()
+		advert.To = userID
+		if err := ec.broadcastMessage(advert); err != nil {
+			fmt.Printf("Room advertisement error: %v\n", err)
+		}
+
+		ec.sendPresence(ec.presenceSnapshot(), userID)
+		ec.syncExpiry(userID)
+	}()
 }
 
 func (ec *EnhancedChat) RemovePeer(userID string) {
 	ec.mu.Lock()
 	defer ec.mu.Unlock()
 	
+	if w, exists := ec.peers[userID]; exists {
+		w.stop()
+	}
 	delete(ec.peers, userID)
 	
-	for room := range ec.rooms {
-		delete(ec.rooms[room], userID)
+	var changed []string
+	for room, members := range ec.rooms {
+		// our other devices going away leaves us in our rooms
+		if userID == ec.identity.ID || !members[userID] {
+			continue
+		}
+		if members[ec.identity.ID] {
+			changed = append(changed, room)
+		}
+		ec.removeMemberLocked(room, userID)
 	}
 	
-	fmt.Printf("❌ %s left the chat\n", userID)
+	fmt.Printf("❌ %s left the chat\n", ec.displayName(userID))
+
+	go func() {
+		for _, room := range changed {
+			ec.sendUserList(room, "")
+		}
+	}()
 }
 
 func (ec *EnhancedChat) SendMessage(content string, to string) error {
+	return ec.sendText(content, ec.CurrentRoom(), to)
+}
+
+func (ec *EnhancedChat) sendText(content, room, to string) error {
+	ec.Touch()
+	if to == "" {
+		ec.mu.RLock()
+		silenced := ec.silencedLocked(room, ec.identity.ID)
+		ec.mu.RUnlock()
+		if silenced {
+			return fmt.Errorf("you can't post in %s", room)
+		}
+	}
+
 	msg := &protocol.Message{
 		ID:        protocol.GenerateMessageID(),
 		Type:      protocol.TextMessage,
 		From:      ec.identity.ID,
 		Content:   content,
 		Timestamp: time.Now(),
+		Mentions:  ec.resolveMentions(content),
 	}
 
 	if to != "" {
 		msg.To = to
 	} else {
-		msg.Room = ec.currentRoom
+		msg.Room = room
 	}
+	ec.stampExpiry(msg)
 
 	if err := ec.storage.StoreMessage(msg); err != nil {
 		fmt.Printf("Error storing message: %v\n", err)
 	}
+	if to != "" {
+		ec.doneTyping(storage.PrivateKey(ec.identity.ID, to))
+	} else {
+		ec.doneTyping(storage.RoomKey(room))
+	}
+	if to != "" {
+		// answering means we read what came before
+		ec.markReadUpTo(storage.PrivateKey(ec.identity.ID, to), msg)
+		ec.pinCorrespondent(to)
+	}
 
-	return ec.broadcastMessage(msg)
+	// the store keeps msg, so seal a copy
+	sealed := *msg
+	if err := ec.sealContent(&sealed); err != nil {
+		return err
+	}
+	return ec.broadcastMessage(&sealed)
 }
 
 func (ec *EnhancedChat) SendFile(filename string, to string) error {
@@ -107,8 +259,9 @@ func (ec *EnhancedChat) SendFile(filename string, to string) error {
 	if to != "" {
 		msg.To = to
 	} else {
-		msg.Room = ec.currentRoom
+		msg.Room = ec.CurrentRoom()
 	}
+	ec.stampExpiry(msg)
 
 	if err := ec.storage.StoreMessage(msg); err != nil {
 		fmt.Printf("Error storing file message: %v\n", err)
@@ -117,21 +270,14 @@ func (ec *EnhancedChat) SendFile(filename string, to string) error {
 	return ec.broadcastMessage(msg)
 }
 
+// JoinRoom joins roomName, staying in the rooms we are already in, and
+// gives it focus.
 func (ec *EnhancedChat) JoinRoom(roomName string) {
-	ec.mu.Lock()
-	defer ec.mu.Unlock()
-	
-	oldRoom := ec.currentRoom
-	ec.currentRoom = roomName
-	
-	if ec.rooms[roomName] == nil {
-		ec.rooms[roomName] = make(map[string]bool)
-	}
-	ec.rooms[roomName][ec.identity.ID] = true
-	
-	if oldRoom != roomName && ec.rooms[oldRoom] != nil {
-		delete(ec.rooms[oldRoom], ec.identity.ID)
+	if err := ec.Subscribe(roomName); err != nil {
+		fmt.Printf("Error joining room: %v\n", err)
+		return
 	}
+	ec.SwitchRoom(roomName)
 	
 	fmt.Printf("📋 Joined room: %s\n", roomName)
 	
@@ -158,11 +304,17 @@ func (ec *EnhancedChat) ListRooms() {
 	defer ec.mu.RUnlock()
 	
 	fmt.Println("📋 Available rooms:")
-	for room, users := range ec.rooms {
-		userCount := len(users)
+	for room, members := range ec.rooms {
+		userCount := len(ec.membersLocked(room))
 		current := ""
 		if room == ec.currentRoom {
 			current = " (current)"
+		} else if !members[ec.identity.ID] {
+			current = " (not joined)"
+		} else if unread, mentions := ec.unreadCounts(storage.RoomKey(room)); mentions > 0 {
+			current = fmt.Sprintf(" (%d unread, %d mentioning you)", unread, mentions)
+		} else if unread > 0 {
+			current = fmt.Sprintf(" (%d unread)", unread)
 		}
 		fmt.Printf("  - %s (%d users)%s\n", room, userCount, current)
 	}
@@ -173,14 +325,28 @@ func (ec *EnhancedChat) ListUsers() {
 	defer ec.mu.RUnlock()
 	
 	fmt.Printf("👥 Users in %s:\n", ec.currentRoom)
-	if users, exists := ec.rooms[ec.currentRoom]; exists {
-		for userID := range users {
-			current := ""
-			if userID == ec.identity.ID {
-				current = " (you)"
-			}
-			fmt.Printf("  - %s%s\n", userID, current)
+	for _, userID := range ec.membersLocked(ec.currentRoom) {
+		current := ""
+		if userID == ec.identity.ID {
+			current = " (you)"
+		} else if !ec.rooms[ec.currentRoom][userID] {
+			current = " (via another peer)"
+		}
+		if role := ec.roleLocked(ec.currentRoom, userID); role != RoleMember {
+			current += " [" + string(role) + "]"
+		}
+		if ec.silencedLocked(ec.currentRoom, userID) {
+			current += " (muted)"
 		}
+		current += " " + formatPresence(ec.presenceLocked(userID))
+		if contact, exists := ec.contacts.Get(userID); exists && contact.Verified {
+			current += " ✅"
+		}
+		name := ec.displayName(userID)
+		if name != userID {
+			name += " (" + userID + ")"
+		}
+		fmt.Printf("  - %s%s\n", name, current)
 	}
 }
 
@@ -189,28 +355,66 @@ func (ec *EnhancedChat) SearchMessages(query string, roomKey string) ([]*protoco
 	return ec.storage.SearchMessages(query, roomKey)
 }
 
-func (ec *EnhancedChat) ProcessIncomingMessage(data string) {
+// ProcessIncomingMessage decrypts and queues one frame from the peer
+// peerID. The error reports frames the peer should not have sent.
+func (ec *EnhancedChat) ProcessIncomingMessage(peerID, data string) error {
 	decrypted, err := encryption.Decrypt(strings.TrimSpace(data), key)
 	if err != nil {
-		fmt.Printf("Decryption error: %v\n", err)
-		return
+		return fmt.Errorf("decryption error: %v", err)
 	}
 
 	msg, err := protocol.DeserializeMessage(decrypted)
 	if err != nil {
-		fmt.Printf("Message parsing error: %v\n", err)
-		return
+		return fmt.Errorf("message parsing error: %v", err)
+	}
+
+	// messages are never relayed, so they come from the peer that sent them
+	if msg.From != peerID {
+		return fmt.Errorf("%s message from %s claims to be from %s", msg.Type, peerID, msg.From)
+	}
+
+	if control, err := ec.handleControlMessage(msg); control {
+		return err
+	}
+
+	ec.mu.RLock()
+	silenced := msg.Room != "" && ec.silencedLocked(msg.Room, msg.From)
+	ec.mu.RUnlock()
+	if silenced {
+		return nil
+	}
+	if err := ec.openContent(msg); err != nil {
+		// sealed for a room whose password we don't know
+		return nil
+	}
+	if len(msg.Mentions) == 0 {
+		msg.Mentions = ec.resolveMentions(msg.Content)
+	}
+	// sending what they typed ends their typing
+	key, ours := ec.peerConversation(msg)
+	if ours {
+		ec.stopTyper(key, msg.From)
+	}
+	if !ec.limitExpiry(key, msg) {
+		// it disappeared on the way
+		return nil
 	}
 
 	if err := ec.storage.StoreMessage(msg); err != nil {
 		fmt.Printf("Error storing incoming message: %v\n", err)
 	}
+	if msg.To != "" {
+		ec.pinCorrespondent(msg.From)
+	}
+	ec.readIfFocused(msg)
+	ec.notifyMessage(msg)
 
 	select {
 	case ec.incoming <- msg:
 	default:
 		fmt.Println("Message queue full, dropping message")
 	}
+	return nil
 }
 
 func (ec *EnhancedChat) broadcastMessage(msg *protocol.Message) error {
@@ -224,21 +428,36 @@ func (ec *EnhancedChat) broadcastMessage(msg *protocol.Message) error {
 		return err
 	}
 
+	// collect the writers under the lock but queue outside it, so a full
+	// queue under the block policy never holds up AddPeer or JoinRoom
+	var writers []*peerWriter
 	ec.mu.RLock()
-	defer ec.mu.RUnlock()
-
 	if msg.To != "" {
-		if conn, exists := ec.peers[msg.To]; exists {
-			fmt.Fprintln(conn, encrypted)
+		if w, exists := ec.peers[msg.To]; exists {
+			writers = append(writers, w)
 		}
-	} else {
+	} else if msg.Room != "" && (msg.Type != protocol.JoinMessage && msg.Type != protocol.LeaveMessage || !ec.publicLocked(msg.Room)) {
+		// room messages go to the members, and so do joins and leaves of
+		// private rooms: who is in them is nobody else's business
 		for userID := range ec.rooms[msg.Room] {
 			if userID != ec.identity.ID {
-				if conn, exists := ec.peers[userID]; exists {
-					fmt.Fprintln(conn, encrypted)
+				if w, exists := ec.peers[userID]; exists {
+					writers = append(writers, w)
 				}
 			}
 		}
+	} else {
+		// network-wide messages such as joins and room advertisements
+		for _, w := range ec.peers {
+			writers = append(writers, w)
+		}
+	}
+	ec.mu.RUnlock()
+
+	for _, w := range writers {
+		if err := w.enqueue(encrypted); err != nil {
+			fmt.Printf("Error sending to %s: %v\n", w.userID, err)
+		}
 	}
 
 	return nil
@@ -250,6 +469,21 @@ func (ec *EnhancedChat) messageHandler() {
 			break
 		}
 
+		// other rooms' messages are stored and counted, not shown; only the
+		// first unread one is announced, and those meant for us
+		if msg.Room != "" && msg.Room != ec.CurrentRoom() {
+			if ec.highlighted(msg) {
+				fmt.Printf("\r📣 [%s] %s in %s: %s\n> ", msg.Timestamp.Format("15:04:05"), ec.displayName(msg.From), msg.Room, msg.Content)
+			} else if ec.unreadCount(msg.Room) == 1 {
+				fmt.Printf("\r📨 New messages in %s, /switch %s to read them\n> ", msg.Room, msg.Room)
+			}
+			continue
+		}
+
+		if msg.To != "" && (msg.Type == protocol.TextMessage || msg.Type == protocol.FileMessage) {
+			ec.markReadUpTo(storage.PrivateKey(ec.identity.ID, msg.From), msg)
+		}
+
 		switch msg.Type {
 		case protocol.TextMessage:
 			ec.displayMessage(msg)
@@ -257,6 +491,10 @@ func (ec *EnhancedChat) messageHandler() {
 			ec.displayFileMessage(msg)
 		case protocol.TypingMessage:
 			ec.displayTypingIndicator(msg)
+		case protocol.ReactionMessage:
+			ec.displayReaction(msg)
+		case protocol.ExpiryMessage:
+			ec.displayExpiry(msg)
 		}
 	}
 }
@@ -279,6 +517,7 @@ func (ec *EnhancedChat) inputHandler() {
 			fmt.Print("> ")
 			continue
 		}
+		ec.Touch()
 
 		if ec.handleCommand(input) {
 			fmt.Print("> ")
@@ -305,26 +544,83 @@ func (ec *EnhancedChat) handleCommand(input string) bool {
 	case "help":
 		ec.displayHelp()
 	case "rooms":
-		ec.ListRooms()
+		if len(args) > 0 && args[0] == "--all" {
+			ec.ListDirectory()
+		} else {
+			ec.ListRooms()
+		}
 	case "join":
-		if len(args) > 0 {
+		if len(args) > 1 {
+			ec.JoinRoomWith(args[0], strings.Join(args[1:], " "))
+		} else if len(args) > 0 {
 			ec.JoinRoom(args[0])
 		} else {
-			fmt.Println("Usage: /join <room_name>")
+			fmt.Println("Usage: /join <room_name> [token|password]")
+		}
+	case "create":
+		ec.handleCreateCommand(args)
+	case "invite":
+		ec.handleInviteCommand(args)
+	case "topic":
+		if len(args) > 0 {
+			if err := ec.SetTopic(ec.CurrentRoom(), strings.Join(args, " ")); err != nil {
+				fmt.Printf("Error setting topic: %v\n", err)
+			}
+		} else {
+			fmt.Println("Usage: /topic <text>")
+		}
+	case "kick", "ban", "unban", "mute", "unmute", "op":
+		ec.handleModerationCommand(command, args)
+	case "contacts", "add", "rename", "remove":
+		ec.handleContactCommand(command, args)
+	case "verify":
+		ec.handleVerifyCommand(args)
+	case "status":
+		ec.handleStatusCommand(args)
+	case "typing":
+		ec.handleTypingCommand(args)
+	case "react":
+		ec.handleReactCommand(args)
+	case "disappear":
+		ec.handleDisappearCommand(args)
+	case "unread", "read":
+		ec.handleReadCommand(command, args)
+	case "notify", "highlight", "unhighlight":
+		ec.handleNotifyCommand(command, args)
+	case "switch":
+		if len(args) > 0 {
+			if err := ec.SwitchRoom(args[0]); err != nil {
+				fmt.Printf("Error switching room: %v\n", err)
+			} else {
+				fmt.Printf("📋 Switched to room: %s\n", args[0])
+				ec.displayRecentMessages(args[0])
+			}
+		} else {
+			fmt.Println("Usage: /switch <room_name>")
+		}
+	case "leave":
+		room := ec.CurrentRoom()
+		if len(args) > 0 {
+			room = args[0]
+		}
+		if err := ec.LeaveRoom(room); err != nil {
+			fmt.Printf("Error leaving room: %v\n", err)
+		} else {
+			fmt.Printf("👋 Left room %s, now in %s\n", room, ec.CurrentRoom())
 		}
 	case "users":
 		ec.ListUsers()
 	case "search":
 		if len(args) > 0 {
 			query := strings.Join(args, " ")
-			messages, err := ec.SearchMessages(query, "room:"+ec.currentRoom)
+			messages, err := ec.SearchMessages(query, "room:"+ec.CurrentRoom())
 			if err != nil {
 				fmt.Printf("search error: %v\n", err)
 			} else {
 				fmt.Printf("🔍 search results for '%s':\n", query)
 				for _, msg := range messages {
 					timestamp := msg.Timestamp.Format("15:04:05")
-					fmt.Printf("[%s] %s: %s\n", timestamp, msg.From, msg.Content)
+					fmt.Printf("[%s] %s: %s\n", timestamp, ec.displayName(msg.From), msg.Content)
 				}
 			}
 		} else {
@@ -332,7 +628,7 @@ func (ec *EnhancedChat) handleCommand(input string) bool {
 		}
 	case "private", "pm":
 		if len(args) >= 2 {
-			userID := args[0]
+			userID := ec.resolveUser(args[0])
 			message := strings.Join(args[1:], " ")
 			if err := ec.SendMessage(message, userID); err != nil {
 				fmt.Printf("Error sending private message: %v\n", err)
@@ -357,8 +653,16 @@ func (ec *EnhancedChat) handleCommand(input string) bool {
 		ec.Stop()
 		os.Exit(0)
 	default:
-		fmt.Printf("Unknown command: /%s\n", command)
-		ec.displayHelp()
+		ec.mu.RLock()
+		cmd, exists := ec.commands[command]
+		ec.mu.RUnlock()
+
+		if !exists {
+			fmt.Printf("Unknown command: /%s\n", command)
+			ec.displayHelp()
+			break
+		}
+		cmd.handler(args)
 	}
 
 	return true
@@ -367,36 +671,82 @@ func (ec *EnhancedChat) handleCommand(input string) bool {
 func (ec *EnhancedChat) displayHelp() {
 	fmt.Println("\n📖 Available commands:")
 	fmt.Println("  /help              - Show this help")
-	fmt.Println("  /rooms             - List available rooms")
-	fmt.Println("  /join <room>       - Join a room")
+	fmt.Println("  /rooms [--all]     - List your rooms, or every room on the network")
+	fmt.Println("  /join <room> [token|password] - Join a room and switch to it")
+	fmt.Println("  /create <room> [--private|--password <pw>] - Create a room")
+	fmt.Println("  /invite <user|*> [dur] [uses] - Invite to the current room")
+	fmt.Println("  /switch <room>     - Switch to a room you are in")
+	fmt.Println("  /leave [room]      - Leave a room, the current one by default")
+	fmt.Println("  /topic <text>      - Set the topic of the current room")
+	fmt.Println("  /disappear [user] <dur|off> - Make new messages in the current room, or to a user, disappear")
+	fmt.Println("  /kick <user> [reason] - Remove a user from the current room")
+	fmt.Println("  /ban <user> [dur]  - Ban a user from the current room (e.g. 30m; permanent if omitted)")
+	fmt.Println("  /unban <user>      - Lift a room ban")
+	fmt.Println("  /ban --peer <user> [dur], /unban --peer <user> - Same as /block and /unblock")
+	fmt.Println("  /mute <user> [dur] - Drop a user's messages in the current room")
+	fmt.Println("  /unmute <user>     - Lift a mute")
+	fmt.Println("  /op <user> [role]  - Make a user admin, member or owner of the current room")
 	fmt.Println("  /users             - List users in current room")
+	fmt.Println("  /status [online|away|busy] [text] - Show or set your presence")
+	fmt.Println("  /typing [on|off]   - Show who is typing in the terminal")
+	fmt.Println("  /unread            - List conversations with unread messages")
+	fmt.Println("  /read [room|user]  - Mark a room or private conversation read")
+	fmt.Println("  /contacts          - List your contacts")
+	fmt.Println("  /add <user|link> [nick] [notes] - Add a contact")
+	fmt.Println("  /rename <user> [nick] - Set or clear a contact's nickname")
+	fmt.Println("  /remove <user>     - Forget a contact and their pinned key")
+	fmt.Println("  /verify <user> [--confirm] - Compare safety numbers with a contact")
+	fmt.Println("  /notify [on|off] [room] [dur] - Show notification settings or mute a room")
+	fmt.Println("  /highlight [word]  - List highlight keywords or add one")
+	fmt.Println("  /unhighlight <word> - Stop highlighting a keyword")
 	fmt.Println("  /search <query>    - Search messages")
+	fmt.Println("  /react <msgid> <emoji> - Add or take back a reaction; /react lists message IDs")
 	fmt.Println("  /private <user> <msg> - Send private message")
 	fmt.Println("  /file <filename>   - Share a file")
 	fmt.Println("  /quit              - Exit the chat")
+
+	ec.mu.RLock()
+	names := make([]string, 0, len(ec.commands))
+	for name := range ec.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := ec.commands[name]
+		fmt.Printf("  %-18s - %s\n", cmd.usage, cmd.description)
+	}
+	ec.mu.RUnlock()
+
 	fmt.Println("  Any other text will be sent as a message to the current room")
 }
 
 func (ec *EnhancedChat) displayMessage(msg *protocol.Message) {
 	timestamp := msg.Timestamp.Format("15:04:05")
+	content := msg.Content + ec.reactionSummary(msg)
 	if msg.To != "" {
 		if msg.From == ec.identity.ID {
-			fmt.Printf("\r🔒 [%s] To %s: %s\n> ", timestamp, msg.To, msg.Content)
+			fmt.Printf("\r🔒 [%s] To %s: %s\n> ", timestamp, ec.displayName(msg.To), content)
 		} else {
-			fmt.Printf("\r🔒 [%s] From %s: %s\n> ", timestamp, msg.From, msg.Content)
+			fmt.Printf("\r🔒 [%s] From %s: %s\n> ", timestamp, ec.displayName(msg.From), content)
 		}
+	} else if ec.highlighted(msg) {
+		fmt.Printf("\r📣 [%s] %s: %s\n> ", timestamp, ec.displayName(msg.From), content)
 	} else {
-		fmt.Printf("\r💬 [%s] %s: %s\n> ", timestamp, msg.From, msg.Content)
+		fmt.Printf("\r💬 [%s] %s: %s\n> ", timestamp, ec.displayName(msg.From), content)
 	}
 }
 
 func (ec *EnhancedChat) displayFileMessage(msg *protocol.Message) {
 	timestamp := msg.Timestamp.Format("15:04:05")
-	fmt.Printf("\r📎 [%s] %s shared a file: %s\n> ", timestamp, msg.From, msg.FileInfo.Name)
+	fmt.Printf("\r📎 [%s] %s shared a file: %s\n> ", timestamp, ec.displayName(msg.From), msg.FileInfo.Name)
 }
 
 func (ec *EnhancedChat) displayTypingIndicator(msg *protocol.Message) {
-	fmt.Printf("\r✏️  %s is typing...\n> ", msg.From)
+	if msg.Room != "" {
+		fmt.Printf("\r✏️  %s is typing in %s...\n> ", ec.displayName(msg.From), msg.Room)
+		return
+	}
+	fmt.Printf("\r✏️  %s is typing to you...\n> ", ec.displayName(msg.From))
 }
 
 func (ec *EnhancedChat) displayRecentMessages(room string) {
@@ -0,0 +1,270 @@
+package chat
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"strings"
+	"time"
+)
+
+const (
+	// minExpiry and maxExpiry bound disappearing message timers
+	minExpiry = 10 * time.Second
+	maxExpiry = 28 * 24 * time.Hour
+	// janitorInterval is how often expired messages are deleted
+	janitorInterval = 5 * time.Second
+)
+
+// A conversation with a disappearing message timer gives each message sent
+// in it an ExpiresAt of when it was sent plus the timer, and every peer
+// deletes the message from memory and disk once that passes. A timer only
+// applies to messages sent after it was set.
+//
+// A room's timer is a moderation action, so members replaying the room's
+// log agree on it; once the room has an owner only admins may change it.
+// In a private conversation either side may change it and the newer setting
+// wins on both; whoever made it sends it again whenever the two connect, so
+// a change made while one was away still reaches them. A setting's time is
+// never later than when it arrived. Receivers keep a message no longer
+// than their own timer allows, whatever ExpiresAt the sender gave it.
+
+// ExpiryRequest is the disappearing message timer of a room, or of the
+// private conversation with User, as the APIs receive it. Expiry is like
+// "1h"; "off" turns it off.
+type ExpiryRequest struct {
+	Room   string `json:"room,omitempty"`
+	User   string `json:"user,omitempty"`
+	Expiry string `json:"expiry"`
+}
+
+func parseExpiry(s string) (time.Duration, error) {
+	if s == "off" || s == "0" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiry %q", s)
+	}
+	return ttl, checkExpiry(ttl)
+}
+
+func checkExpiry(ttl time.Duration) error {
+	if ttl != 0 && (ttl < minExpiry || ttl > maxExpiry) {
+		return fmt.Errorf("disappearing messages must last between %s and %s", formatExpiry(minExpiry), formatExpiry(maxExpiry))
+	}
+	return nil
+}
+
+// formatExpiry shows a timer the way it is typed, e.g. "1h" rather than
+// "1h0m0s", or "off".
+func formatExpiry(ttl time.Duration) string {
+	if ttl <= 0 {
+		return "off"
+	}
+	s := ttl.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+func describeExpiry(ttl time.Duration) string {
+	if ttl <= 0 {
+		return "turned off disappearing messages"
+	}
+	return "set messages to disappear after " + formatExpiry(ttl)
+}
+
+// SetExpiry sets the disappearing message timer of the conversation req
+// names and tells the others in it.
+func (ec *EnhancedChat) SetExpiry(req ExpiryRequest) error {
+	ttl, err := parseExpiry(req.Expiry)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case req.Room != "":
+		return ec.moderate(protocol.RoomAction{Room: req.Room, Action: protocol.ActionExpiry, TTL: ttl})
+	case req.User != "":
+		userID := ec.resolveUser(req.User)
+		if userID == ec.identity.ID {
+			return fmt.Errorf("no private conversation with yourself")
+		}
+		s := protocol.ExpirySetting{
+			Conversation: storage.PrivateKey(ec.identity.ID, userID),
+			TTL:          ttl,
+			SetBy:        ec.identity.ID,
+			SetAt:        time.Now(),
+		}
+		if _, err := ec.storage.SetExpiry(s); err != nil {
+			return err
+		}
+		return ec.sendExpiry(s, userID)
+	default:
+		return fmt.Errorf("room or user required")
+	}
+}
+
+func (ec *EnhancedChat) sendExpiry(s protocol.ExpirySetting, to string) error {
+	return ec.broadcastMessage(&protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.ExpiryMessage,
+		From:      ec.identity.ID,
+		To:        to,
+		Timestamp: time.Now(),
+		Expiry:    &s,
+	})
+}
+
+// syncExpiry sends the setting of our private conversation with userID to
+// them, if it has one and we made it.
+func (ec *EnhancedChat) syncExpiry(userID string) {
+	s, exists := ec.storage.Expiry(storage.PrivateKey(ec.identity.ID, userID))
+	if !exists || s.SetBy != ec.identity.ID {
+		return
+	}
+	if err := ec.sendExpiry(s, userID); err != nil {
+		fmt.Printf("Error sending expiry setting: %v\n", err)
+	}
+}
+
+// handleExpiry takes the setting of a private conversation from its other
+// side, unless ours is newer.
+func (ec *EnhancedChat) handleExpiry(msg *protocol.Message) error {
+	s := msg.Expiry
+	if s == nil || msg.To != ec.identity.ID {
+		return fmt.Errorf("expiry setting from %s is not for us", msg.From)
+	}
+	if s.Conversation != storage.PrivateKey(ec.identity.ID, msg.From) {
+		return fmt.Errorf("expiry setting from %s is for another conversation", msg.From)
+	}
+	if s.SetBy != msg.From {
+		return fmt.Errorf("expiry setting from %s was set by %s", msg.From, s.SetBy)
+	}
+	if err := checkExpiry(s.TTL); err != nil {
+		return err
+	}
+	now := time.Now()
+	if s.SetAt.Sub(now) > maxClockSkew {
+		return fmt.Errorf("expiry setting from %s is from the future", msg.From)
+	}
+	// a clock running ahead must not outlast the changes we make next
+	setting := *s
+	if setting.SetAt.After(now) {
+		setting.SetAt = now
+	}
+
+	changed, err := ec.storage.SetExpiry(setting)
+	if err != nil || !changed {
+		return err
+	}
+	select {
+	case ec.incoming <- msg:
+	default:
+	}
+	return nil
+}
+
+// expiryFor returns the disappearing message timer of the conversation key.
+func (ec *EnhancedChat) expiryFor(key string) time.Duration {
+	if ec.otherParty(key) != "" {
+		s, _ := ec.storage.Expiry(key)
+		return s.TTL
+	}
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return ec.expiryLocked(strings.TrimPrefix(key, "room:"))
+}
+
+// stampExpiry sets when msg, which we are about to send, disappears.
+func (ec *EnhancedChat) stampExpiry(msg *protocol.Message) {
+	key := storage.RoomKey(msg.Room)
+	if msg.To != "" {
+		key = storage.PrivateKey(ec.identity.ID, msg.To)
+	}
+	if ttl := ec.expiryFor(key); ttl > 0 {
+		msg.ExpiresAt = msg.Timestamp.Add(ttl)
+	}
+}
+
+// limitExpiry brings the expiry of msg from a peer forward to what our
+// timer for key allows, and reports whether msg is still to be kept.
+func (ec *EnhancedChat) limitExpiry(key string, msg *protocol.Message) bool {
+	now := time.Now()
+	if ttl := ec.expiryFor(key); ttl > 0 {
+		// a sender's clock running ahead must not stretch it
+		sent := msg.Timestamp
+		if sent.After(now) {
+			sent = now
+		}
+		if limit := sent.Add(ttl); msg.ExpiresAt.IsZero() || limit.Before(msg.ExpiresAt) {
+			msg.ExpiresAt = limit
+		}
+	}
+	return msg.ExpiresAt.IsZero() || msg.ExpiresAt.After(now)
+}
+
+// Expiry returns req with the timer of the conversation it names filled in.
+func (ec *EnhancedChat) Expiry(req ExpiryRequest) ExpiryRequest {
+	key := storage.RoomKey(req.Room)
+	if req.Room == "" {
+		req.User = ec.resolveUser(req.User)
+		key = storage.PrivateKey(ec.identity.ID, req.User)
+	}
+	req.Expiry = formatExpiry(ec.expiryFor(key))
+	return req
+}
+
+// janitorLoop deletes expired messages.
+func (ec *EnhancedChat) janitorLoop() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := ec.storage.DeleteExpired(time.Now()); err != nil {
+			fmt.Printf("Error deleting expired messages: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ec.quit:
+			return
+		}
+	}
+}
+
+func (ec *EnhancedChat) displayExpiry(msg *protocol.Message) {
+	s := msg.Expiry
+	fmt.Printf("\r⏳ %s %s in your private conversation\n> ", ec.displayName(s.SetBy), describeExpiry(s.TTL))
+}
+
+// handleDisappearCommand runs /disappear [dur|off] for the current room
+// and /disappear <user> <dur|off> for a private conversation.
+func (ec *EnhancedChat) handleDisappearCommand(args []string) {
+	req := ExpiryRequest{Room: ec.CurrentRoom()}
+	switch len(args) {
+	case 0:
+		fmt.Printf("⏳ Disappearing messages in %s: %s\n", req.Room, ec.Expiry(req).Expiry)
+		return
+	case 1:
+		req.Expiry = args[0]
+	case 2:
+		req = ExpiryRequest{User: args[0], Expiry: args[1]}
+	default:
+		fmt.Println("Usage: /disappear [user] <duration|off>")
+		return
+	}
+
+	if err := ec.SetExpiry(req); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if req.User != "" {
+		ttl, _ := parseExpiry(req.Expiry)
+		fmt.Printf("⏳ You %s with %s\n", describeExpiry(ttl), ec.displayName(ec.resolveUser(req.User)))
+	}
+}
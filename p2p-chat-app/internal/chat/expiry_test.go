@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestHandleExpiry(t *testing.T) {
+	bob := newTestIdentity(t, "bob").ID
+	now := time.Now()
+
+	// each case changes bob's valid setting for our conversation
+	tests := []struct {
+		name   string
+		change func(s *protocol.ExpirySetting, us string)
+		ok     bool
+	}{
+		{"set by bob", func(s *protocol.ExpirySetting, us string) {}, true},
+		{"claimed to be set by us", func(s *protocol.ExpirySetting, us string) { s.SetBy = us }, false},
+		{"set by someone else", func(s *protocol.ExpirySetting, us string) { s.SetBy = "carol" }, false},
+		{"for another conversation", func(s *protocol.ExpirySetting, us string) { s.Conversation = storage.PrivateKey(bob, "carol") }, false},
+		{"too short", func(s *protocol.ExpirySetting, us string) { s.TTL = time.Second }, false},
+		{"too long", func(s *protocol.ExpirySetting, us string) { s.TTL = maxExpiry + time.Hour }, false},
+		{"from the future", func(s *protocol.ExpirySetting, us string) { s.SetAt = now.Add(maxClockSkew + time.Minute) }, false},
+		{"a little ahead", func(s *protocol.ExpirySetting, us string) { s.SetAt = now.Add(time.Minute) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec := newTestChat(t, "alice")
+			us := ec.identity.ID
+			conversation := storage.PrivateKey(us, bob)
+			s := protocol.ExpirySetting{Conversation: conversation, TTL: time.Hour, SetBy: bob, SetAt: now}
+			tt.change(&s, us)
+
+			err := ec.handleExpiry(&protocol.Message{Type: protocol.ExpiryMessage, From: bob, To: us, Expiry: &s})
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+			stored, exists := ec.storage.Expiry(conversation)
+			if exists != tt.ok {
+				t.Fatalf("setting kept = %v, want %v", exists, tt.ok)
+			}
+			if exists && stored.SetAt.After(time.Now()) {
+				t.Fatalf("kept a setting made at %v, after it arrived", stored.SetAt)
+			}
+		})
+	}
+}
+
+func TestExpiryLosesToOurNextChange(t *testing.T) {
+	ec := newTestChat(t, "alice")
+	bob := newTestIdentity(t, "bob").ID
+	conversation := storage.PrivateKey(ec.identity.ID, bob)
+
+	ahead := protocol.ExpirySetting{Conversation: conversation, TTL: time.Hour, SetBy: bob, SetAt: time.Now().Add(time.Minute)}
+	if err := ec.handleExpiry(&protocol.Message{Type: protocol.ExpiryMessage, From: bob, To: ec.identity.ID, Expiry: &ahead}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := ec.SetExpiry(ExpiryRequest{User: bob, Expiry: "off"}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := ec.expiryFor(conversation); ttl != 0 {
+		t.Fatalf("timer still %s after we turned it off", ttl)
+	}
+}
+
+func TestNotificationLeavesOutDisappearing(t *testing.T) {
+	ec := newTestChat(t, "alice")
+	msg := &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.TextMessage,
+		From:      "bob",
+		To:        ec.identity.ID,
+		Content:   "burn after reading",
+		Timestamp: time.Now(),
+	}
+
+	n, found := ec.notification(msg)
+	if !found || n.Content != msg.Content || n.Disappearing {
+		t.Fatalf("got %+v for a lasting message", n)
+	}
+	msg.ExpiresAt = msg.Timestamp.Add(time.Hour)
+	n, found = ec.notification(msg)
+	if !found || n.Content != "" || !n.Disappearing {
+		t.Fatalf("got %+v for a disappearing message", n)
+	}
+}
@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/protocol"
+	"sort"
+	"time"
+)
+
+// maxRoomMembers caps the member list one userlist message may carry.
+const maxRoomMembers = 1000
+
+// Room membership is self-reported. A node sends a join to every peer when
+// it enters a room and a leave when it goes, and on connecting tells the new
+// peer every room it is in with a userlist. ec.rooms holds the members we
+// are directly connected to, which is who room messages are sent to.
+//
+// Members further away are only learned from the userlists peers send
+// whenever a room they are in changes: ec.heard keeps the latest list from
+// each member so everyone sees the same room, and a list is forgotten when
+// the member that sent it leaves.
+
+// Members lists everyone known to be in room, including us if we are.
+func (ec *EnhancedChat) Members(room string) []string {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return ec.membersLocked(room)
+}
+
+// membersLocked merges the direct members of room with the lists they sent
+// us. Callers hold ec.mu.
+func (ec *EnhancedChat) membersLocked(room string) []string {
+	seen := make(map[string]bool)
+	for userID := range ec.rooms[room] {
+		seen[userID] = true
+		for _, member := range ec.heard[room][userID] {
+			seen[member] = true
+		}
+	}
+
+	members := make([]string, 0, len(seen))
+	for userID := range seen {
+		if ec.allowedLocked(room, userID) {
+			members = append(members, userID)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// directMembersLocked lists the peers we are connected to in room, which is
+// what we report in our own userlist. Callers hold ec.mu.
+func (ec *EnhancedChat) directMembersLocked(room string) []string {
+	members := make([]string, 0, len(ec.rooms[room]))
+	for userID := range ec.rooms[room] {
+		members = append(members, userID)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// joinedRoomsLocked lists the rooms we are in. Callers hold ec.mu.
+func (ec *EnhancedChat) joinedRoomsLocked() []string {
+	var rooms []string
+	for room, members := range ec.rooms {
+		if members[ec.identity.ID] {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (ec *EnhancedChat) addMemberLocked(room, userID string) {
+	if ec.rooms[room] == nil {
+		ec.rooms[room] = make(map[string]bool)
+	}
+	ec.rooms[room][userID] = true
+}
+
+func (ec *EnhancedChat) removeMemberLocked(room, userID string) {
+	delete(ec.rooms[room], userID)
+	delete(ec.heard[room], userID)
+	if len(ec.rooms[room]) == 0 {
+		delete(ec.rooms, room)
+		delete(ec.heard, room)
+	}
+}
+
+// sendMembership tells every peer, or only to if set, that we joined or
+// left room.
+func (ec *EnhancedChat) sendMembership(msgType protocol.MessageType, room, to string) {
+	msg := &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      msgType,
+		From:      ec.identity.ID,
+		To:        to,
+		Room:      room,
+		Timestamp: time.Now(),
+	}
+	if err := ec.broadcastMessage(msg); err != nil {
+		fmt.Printf("Error sending %s for %s: %v\n", msgType, room, err)
+	}
+}
+
+// sendUserList sends our view of room to its members, or only to if set.
+func (ec *EnhancedChat) sendUserList(room, to string) {
+	ec.mu.RLock()
+	// who is in a private room is nobody else's business
+	if !ec.rooms[room][ec.identity.ID] || to != "" && !ec.allowedLocked(room, to) {
+		ec.mu.RUnlock()
+		return
+	}
+	members := ec.directMembersLocked(room)
+	actions := ec.actionsLocked(room)
+	ec.mu.RUnlock()
+
+	msg := &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.UserListMessage,
+		From:      ec.identity.ID,
+		To:        to,
+		Room:      room,
+		Timestamp: time.Now(),
+		Members:   members,
+		Actions:   actions,
+	}
+	if err := ec.broadcastMessage(msg); err != nil {
+		fmt.Printf("Error sending member list for %s: %v\n", room, err)
+	}
+}
+
+// handleMembership applies a join, leave or userlist from a peer.
+func (ec *EnhancedChat) handleMembership(msg *protocol.Message) error {
+	if msg.Room == "" || len(msg.Room) > maxRoomName {
+		return fmt.Errorf("invalid room name in %s", msg.Type)
+	}
+	if len(msg.Members) > maxRoomMembers {
+		return fmt.Errorf("member list for %s too long", msg.Room)
+	}
+	// a userlist brings the room's moderation log along, and a join into a
+	// private room the joiner's admission, which is passed on
+	added, err := ec.mergeActions(msg.Room, msg.Actions)
+	if err != nil {
+		return err
+	}
+	if msg.Type == protocol.JoinMessage && len(added) > 0 {
+		go ec.sendActions(msg.Room, added)
+	}
+
+	// our other devices share our ID, so their joins and leaves are not
+	// ours to follow
+	if msg.From == ec.identity.ID {
+		return nil
+	}
+
+	changed := true
+	ec.mu.Lock()
+	if !ec.allowedLocked(msg.Room, msg.From) {
+		ec.mu.Unlock()
+		return nil
+	}
+	switch msg.Type {
+	case protocol.JoinMessage:
+		ec.addMemberLocked(msg.Room, msg.From)
+	case protocol.LeaveMessage:
+		ec.removeMemberLocked(msg.Room, msg.From)
+	case protocol.UserListMessage:
+		// only members send their list, so the sender is one
+		changed = !ec.rooms[msg.Room][msg.From]
+		ec.addMemberLocked(msg.Room, msg.From)
+		var members []string
+		for _, member := range msg.Members {
+			if member != ec.identity.ID && member != msg.From {
+				members = append(members, member)
+			}
+		}
+		if ec.heard[msg.Room] == nil {
+			ec.heard[msg.Room] = make(map[string][]string)
+		}
+		ec.heard[msg.Room][msg.From] = members
+	}
+	joined := ec.rooms[msg.Room][ec.identity.ID]
+	ec.mu.Unlock()
+
+	// the rest of the room learns about the change from our new list. A
+	// userlist from a known member changes nothing we report, so it is not
+	// answered and lists don't bounce between peers.
+	if joined && changed {
+		go ec.sendUserList(msg.Room, "")
+	}
+	return nil
+}
@@ -0,0 +1,842 @@
+package chat
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+)
+
+const (
+	// maxRoomActions caps a room's moderation log, and maxActorActions the
+	// part of it one actor may fill
+	maxRoomActions  = 1000
+	maxActorActions = 100
+	maxReason       = 256
+	// actionFresh is how old an action may be and still kick someone out;
+	// older ones only matter for the state they leave behind
+	actionFresh = 2 * time.Minute
+)
+
+var errNotAllowed = errors.New("not allowed")
+
+// A room's roles, bans, mutes, topic and message expiry are not stored
+// anywhere as such. Every member keeps the room's log of signed actions and
+// replays it in order of time, dropping each action its actor wasn't
+// allowed to take at that point, so all peers holding the same log agree on
+// the same state.
+//
+// Whoever signs the earliest create action owns the room, whichever create
+// reaches a peer first. A room nobody created has no owner or admins: it
+// can't be moderated and anyone may set its topic or expiry. The default
+// room takes no actions at all, so nobody can claim it.
+//
+// Actors pick their own timestamps, so the order of the log can't be left
+// to them alone. Once we hold a room's create, other actions dated before
+// it are refused, and so are actions dated before the last change to their
+// actor's role: nobody can act as the admin they no longer are. Actions
+// other than creates that reach us after we hold the room count from when
+// they arrived if that is later, which is also what invite expiry and use
+// limits go by. Actions replay drops aren't kept, so an earlier create
+// takes everything that hung on the later one with it.
+
+// roomACL is a room's moderation log and the state replaying it gives.
+type roomACL struct {
+	actions  []protocol.RoomAction
+	seen     map[string]bool      // signatures in actions
+	applied  map[string]bool      // signatures of the actions replay allowed
+	received map[string]time.Time // when actions came in after we held the room
+	// pending holds password room admits we can't check without the key
+	pending []protocol.RoomAction
+
+	owner    string
+	admins   map[string]bool
+	bans     map[string]time.Time
+	mutes    map[string]time.Time
+	topic    string
+	ttl      time.Duration // disappearing message timer
+	mode     string
+	admitted map[string]bool
+	uses     map[string]int // admissions per invite nonce
+
+	created     time.Time            // when the accepted create was signed
+	roleChanged map[string]time.Time // when each user was last promoted, demoted or banned
+
+	// key is the password room key if we know it. It is never sent.
+	key []byte
+}
+
+func newRoomACL() *roomACL {
+	return &roomACL{seen: make(map[string]bool), received: make(map[string]time.Time)}
+}
+
+func (acl *roomACL) replay() {
+	sort.Slice(acl.actions, func(i, j int) bool {
+		a, b := &acl.actions[i], &acl.actions[j]
+		if at, bt := acl.at(a), acl.at(b); !at.Equal(bt) {
+			return at.Before(bt)
+		}
+		if a.Actor != b.Actor {
+			return a.Actor < b.Actor
+		}
+		return a.Signature < b.Signature
+	})
+
+	acl.owner = ""
+	acl.admins = make(map[string]bool)
+	acl.bans = make(map[string]time.Time)
+	acl.mutes = make(map[string]time.Time)
+	acl.topic = ""
+	acl.ttl = 0
+	acl.mode = ""
+	acl.admitted = make(map[string]bool)
+	acl.uses = make(map[string]int)
+	acl.created = time.Time{}
+	acl.roleChanged = make(map[string]time.Time)
+	acl.applied = make(map[string]bool)
+	for i := range acl.actions {
+		if acl.check(&acl.actions[i]) == nil {
+			acl.apply(&acl.actions[i])
+			acl.applied[acl.actions[i].Signature] = true
+		}
+	}
+}
+
+func (acl *roomACL) role(userID string) Role {
+	switch {
+	case userID == acl.owner:
+		return RoleOwner
+	case acl.admins[userID]:
+		return RoleAdmin
+	default:
+		return RoleMember
+	}
+}
+
+func (acl *roomACL) moderator(userID string) bool {
+	return acl.owner != "" && acl.role(userID) != RoleMember
+}
+
+// check reports why the actor of a may not take it in the current state.
+func (acl *roomACL) check(a *protocol.RoomAction) error {
+	if a.Room == defaultRoom {
+		return fmt.Errorf("%w: %s can't be moderated", errNotAllowed, a.Room)
+	}
+	switch a.Action {
+	case protocol.ActionCreate:
+		if acl.owner != "" {
+			return fmt.Errorf("%s already belongs to %s", a.Room, acl.owner)
+		}
+		switch RoomMode(a.Mode) {
+		case "", ModePublic, ModeInvite, ModePassword:
+		default:
+			return fmt.Errorf("unknown room mode %q", a.Mode)
+		}
+	case protocol.ActionAdmit:
+		return acl.checkAdmit(a)
+	case protocol.ActionTopic:
+		if acl.owner != "" && !acl.moderator(a.Actor) {
+			return fmt.Errorf("%w: only admins can set the topic of %s", errNotAllowed, a.Room)
+		}
+	case protocol.ActionExpiry:
+		if acl.owner != "" && !acl.moderator(a.Actor) {
+			return fmt.Errorf("%w: only admins can make messages in %s disappear", errNotAllowed, a.Room)
+		}
+		return checkExpiry(a.TTL)
+	case protocol.ActionPromote:
+		if a.Actor != acl.owner || acl.owner == "" {
+			return fmt.Errorf("%w: only the owner of %s can change roles", errNotAllowed, a.Room)
+		}
+		switch Role(a.Role) {
+		case RoleOwner, RoleAdmin, RoleMember:
+		default:
+			return fmt.Errorf("unknown role %q", a.Role)
+		}
+		if a.Target == "" || a.Target == a.Actor {
+			return fmt.Errorf("the owner's role can only change by handing ownership over")
+		}
+	case protocol.ActionKick, protocol.ActionBan, protocol.ActionUnban, protocol.ActionMute, protocol.ActionUnmute:
+		if !acl.moderator(a.Actor) {
+			return fmt.Errorf("%w: only admins can %s in %s", errNotAllowed, a.Action, a.Room)
+		}
+		if a.Target == "" || a.Target == acl.owner {
+			return fmt.Errorf("%w: the owner of %s can't be moderated", errNotAllowed, a.Room)
+		}
+		if acl.admins[a.Target] && a.Actor != acl.owner {
+			return fmt.Errorf("%w: only the owner can moderate admins", errNotAllowed)
+		}
+	default:
+		return fmt.Errorf("unknown room action %q", a.Action)
+	}
+	return nil
+}
+
+func (acl *roomACL) apply(a *protocol.RoomAction) {
+	switch a.Action {
+	case protocol.ActionCreate:
+		acl.owner = a.Actor
+		acl.mode = a.Mode
+		acl.created = a.Timestamp
+	case protocol.ActionAdmit:
+		acl.admit(a)
+	case protocol.ActionTopic:
+		acl.topic = a.Topic
+	case protocol.ActionExpiry:
+		acl.ttl = a.TTL
+	case protocol.ActionPromote:
+		acl.roleChanged[a.Target] = a.Timestamp
+		switch Role(a.Role) {
+		case RoleOwner:
+			acl.roleChanged[acl.owner] = a.Timestamp
+			acl.admins[acl.owner] = true
+			acl.owner = a.Target
+			delete(acl.admins, a.Target)
+		case RoleAdmin:
+			acl.admins[a.Target] = true
+			acl.admitted[a.Target] = true
+		case RoleMember:
+			delete(acl.admins, a.Target)
+		}
+	case protocol.ActionKick:
+		// a kick out of a private room takes a new invite to undo
+		delete(acl.admitted, a.Target)
+	case protocol.ActionBan:
+		acl.bans[a.Target] = a.Until
+		acl.roleChanged[a.Target] = a.Timestamp
+		delete(acl.admins, a.Target)
+		delete(acl.admitted, a.Target)
+	case protocol.ActionUnban:
+		delete(acl.bans, a.Target)
+	case protocol.ActionMute:
+		acl.mutes[a.Target] = a.Until
+	case protocol.ActionUnmute:
+		delete(acl.mutes, a.Target)
+	}
+}
+
+// admissible reports why a can't go in the log whatever its actor may do:
+// it is dated before the room's create or its actor's last role change, or
+// its actor has filled their share of the log. An earlier create is always
+// let in, for replay to put in place of the one we hold.
+func (acl *roomACL) admissible(a *protocol.RoomAction) error {
+	if a.Action != protocol.ActionCreate {
+		if !acl.created.IsZero() && a.Timestamp.Before(acl.created) {
+			return fmt.Errorf("%s action in %s is dated before the room was created", a.Action, a.Room)
+		}
+		if changed, exists := acl.roleChanged[a.Actor]; exists && a.Timestamp.Before(changed) {
+			return fmt.Errorf("%s action in %s is dated before its actor's role changed", a.Action, a.Room)
+		}
+	}
+	count := 0
+	for i := range acl.actions {
+		if acl.actions[i].Actor == a.Actor {
+			count++
+		}
+	}
+	if count >= maxActorActions {
+		return fmt.Errorf("%s has taken too many actions in %s", a.Actor, a.Room)
+	}
+	return nil
+}
+
+// add puts the admissible ones among actions, which are verified, in the
+// log and replays it. It returns the ones replay applied and whether the
+// log filled up. Actions are taken in timestamp order, so a log synced in
+// one go passes the checks against the state it builds up.
+func (acl *roomACL) add(actions []protocol.RoomAction, now time.Time) ([]protocol.RoomAction, bool) {
+	actions = append([]protocol.RoomAction(nil), actions...)
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].Timestamp.Before(actions[j].Timestamp)
+	})
+	// what comes in with the room's create is taken at its word
+	held := !acl.created.IsZero()
+
+	var added []protocol.RoomAction
+	for _, a := range actions {
+		if acl.seen[a.Signature] || acl.admissible(&a) != nil {
+			continue
+		}
+		if len(acl.actions) >= maxRoomActions {
+			return added, true
+		}
+		acl.seen[a.Signature] = true
+		// a create goes by its own date, or the earliest couldn't win
+		if held && a.Action != protocol.ActionCreate {
+			acl.received[a.Signature] = now
+		}
+		acl.actions = append(acl.actions, a)
+		acl.replay()
+		if acl.applied[a.Signature] {
+			added = append(added, a)
+		}
+		acl.prune()
+	}
+	return added, false
+}
+
+// prune drops the actions replay didn't apply. They change nothing, so the
+// state stays the same. Admits that need the room key we don't have wait
+// in pending.
+func (acl *roomACL) prune() {
+	kept := acl.actions[:0]
+	for _, a := range acl.actions {
+		if acl.applied[a.Signature] {
+			kept = append(kept, a)
+			continue
+		}
+		if acl.unverifiable(&a) {
+			acl.hold(a)
+		}
+		delete(acl.seen, a.Signature)
+		delete(acl.received, a.Signature)
+	}
+	acl.actions = kept
+}
+
+// hold keeps a in pending until the room key turns up.
+func (acl *roomACL) hold(a protocol.RoomAction) {
+	if len(acl.pending) >= maxRoomActions {
+		return
+	}
+	for _, p := range acl.pending {
+		if p.Signature == a.Signature {
+			return
+		}
+	}
+	acl.pending = append(acl.pending, a)
+}
+
+// at returns when a took place as far as we can tell: when it reached us,
+// unless it came with the room's log.
+func (acl *roomACL) at(a *protocol.RoomAction) time.Time {
+	if received, exists := acl.received[a.Signature]; exists && received.After(a.Timestamp) {
+		return received
+	}
+	return a.Timestamp
+}
+
+func active(until time.Time, exists bool) bool {
+	return exists && (until.IsZero() || time.Now().Before(until))
+}
+
+func (acl *roomACL) banned(userID string) bool {
+	until, exists := acl.bans[userID]
+	return active(until, exists)
+}
+
+func (acl *roomACL) muted(userID string) bool {
+	until, exists := acl.mutes[userID]
+	return active(until, exists)
+}
+
+func actionSignedBytes(a *protocol.RoomAction) ([]byte, error) {
+	unsigned := *a
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+func verifyAction(a *protocol.RoomAction) error {
+	signature, err := hex.DecodeString(a.Signature)
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("%s action in %s is not signed", a.Action, a.Room)
+	}
+	data, err := actionSignedBytes(a)
+	if err != nil {
+		return err
+	}
+	if err := identity.VerifyFrom(a.Actor, a.ActorKey, data, signature); err != nil {
+		return fmt.Errorf("bad signature on %s action in %s: %v", a.Action, a.Room, err)
+	}
+	return nil
+}
+
+// banned reports whether userID is banned from room. Callers hold ec.mu.
+func (ec *EnhancedChat) bannedLocked(room, userID string) bool {
+	acl, exists := ec.acls[room]
+	return exists && acl.banned(userID)
+}
+
+// silencedLocked reports whether messages from userID in room are dropped.
+// Callers hold ec.mu.
+func (ec *EnhancedChat) silencedLocked(room, userID string) bool {
+	acl, exists := ec.acls[room]
+	return exists && (!acl.allowed(userID) || acl.muted(userID))
+}
+
+// roleLocked returns userID's role in room. Callers hold ec.mu.
+func (ec *EnhancedChat) roleLocked(room, userID string) Role {
+	if acl, exists := ec.acls[room]; exists {
+		return acl.role(userID)
+	}
+	return RoleMember
+}
+
+// topicLocked returns room's topic. Callers hold ec.mu.
+func (ec *EnhancedChat) topicLocked(room string) string {
+	if acl, exists := ec.acls[room]; exists {
+		return acl.topic
+	}
+	return ""
+}
+
+// expiryLocked returns room's disappearing message timer. Callers hold
+// ec.mu.
+func (ec *EnhancedChat) expiryLocked(room string) time.Duration {
+	if acl, exists := ec.acls[room]; exists {
+		return acl.ttl
+	}
+	return 0
+}
+
+// actionsLocked copies room's moderation log. Callers hold ec.mu.
+func (ec *EnhancedChat) actionsLocked(room string) []protocol.RoomAction {
+	acl, exists := ec.acls[room]
+	if !exists {
+		return nil
+	}
+	return append([]protocol.RoomAction(nil), acl.actions...)
+}
+
+// signAction fills in us as the actor of a and signs it.
+func (ec *EnhancedChat) signAction(a protocol.RoomAction) (protocol.RoomAction, error) {
+	key, err := ec.identity.ExportPublicKey()
+	if err != nil {
+		return a, err
+	}
+	a.Actor = ec.identity.ID
+	a.ActorKey = key
+	a.Timestamp = time.Now()
+	data, err := actionSignedBytes(&a)
+	if err != nil {
+		return a, err
+	}
+	signature, err := ec.identity.Sign(data)
+	if err != nil {
+		return a, err
+	}
+	a.Signature = hex.EncodeToString(signature)
+	return a, nil
+}
+
+// moderate signs an action of ours in room, checks it is allowed, applies
+// it and sends it to the room.
+func (ec *EnhancedChat) moderate(a protocol.RoomAction) error {
+	a, err := ec.signAction(a)
+	if err != nil {
+		return err
+	}
+
+	ec.mu.RLock()
+	acl, exists := ec.acls[a.Room]
+	if !exists {
+		acl = newRoomACL()
+		acl.replay()
+	}
+	err = acl.admissible(&a)
+	if err == nil {
+		err = acl.check(&a)
+	}
+	ec.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if _, err := ec.mergeActions(a.Room, []protocol.RoomAction{a}); err != nil {
+		return err
+	}
+	ec.sendActions(a.Room, []protocol.RoomAction{a})
+	return nil
+}
+
+// sendActions sends actions to the members of room, and to whoever they
+// threw out, who are no longer members.
+func (ec *EnhancedChat) sendActions(room string, actions []protocol.RoomAction) {
+	recipients := []string{""}
+	for _, a := range actions {
+		if a.Action == protocol.ActionKick || a.Action == protocol.ActionBan {
+			recipients = append(recipients, a.Target)
+		}
+	}
+
+	for _, to := range recipients {
+		msg := &protocol.Message{
+			ID:        protocol.GenerateMessageID(),
+			Type:      protocol.ModerationMessage,
+			From:      ec.identity.ID,
+			To:        to,
+			Room:      room,
+			Timestamp: time.Now(),
+			Actions:   actions,
+		}
+		if err := ec.broadcastMessage(msg); err != nil {
+			fmt.Printf("Error sending moderation for %s: %v\n", room, err)
+		}
+	}
+}
+
+// mergeActions verifies actions for room, adds the ones we didn't have to
+// its log and carries out their effects. It returns the new ones. Actions
+// the log refuses, or that replay drops, are left out without an error:
+// they may be relayed by honest peers, and some become valid once the
+// actions they depend on arrive, so they aren't remembered as seen either.
+func (ec *EnhancedChat) mergeActions(room string, actions []protocol.RoomAction) ([]protocol.RoomAction, error) {
+	var fresh []protocol.RoomAction
+	for _, a := range actions {
+		if a.Room != room {
+			return nil, fmt.Errorf("action for %s sent in %s", a.Room, room)
+		}
+		if len(a.Topic) > maxTopic || len(a.Reason) > maxReason {
+			return nil, fmt.Errorf("oversized %s action in %s", a.Action, room)
+		}
+		if time.Until(a.Timestamp) > maxClockSkew {
+			return nil, fmt.Errorf("%s action in %s is from the future", a.Action, room)
+		}
+		ec.mu.RLock()
+		seen := ec.acls[room] != nil && ec.acls[room].seen[a.Signature]
+		ec.mu.RUnlock()
+		if seen {
+			continue
+		}
+		if err := verifyAction(&a); err != nil {
+			return nil, err
+		}
+		fresh = append(fresh, a)
+	}
+	if len(fresh) == 0 {
+		return nil, nil
+	}
+
+	ec.mu.Lock()
+	acl, exists := ec.acls[room]
+	if !exists {
+		acl = newRoomACL()
+		ec.acls[room] = acl
+	}
+	added, full := acl.add(fresh, time.Now())
+	if full {
+		ec.mu.Unlock()
+		return added, fmt.Errorf("moderation log of %s is full", room)
+	}
+
+	// members let in before we had the whole log may turn out not to be
+	for userID := range ec.rooms[room] {
+		if userID != ec.identity.ID && !acl.allowed(userID) {
+			ec.removeMemberLocked(room, userID)
+		}
+	}
+
+	// recent actions are news; old ones arrive when syncing a room's log
+	// and only matter for the state they leave behind
+	var news []protocol.RoomAction
+	for _, a := range added {
+		if acl.applied[a.Signature] && time.Since(a.Timestamp) < actionFresh {
+			news = append(news, a)
+		}
+	}
+
+	thrownOut := !acl.allowed(ec.identity.ID)
+	for _, a := range news {
+		if a.Action != protocol.ActionKick && a.Action != protocol.ActionBan {
+			continue
+		}
+		if a.Target == ec.identity.ID {
+			thrownOut = true
+		} else {
+			ec.removeMemberLocked(room, a.Target)
+		}
+	}
+	joined := ec.rooms[room][ec.identity.ID]
+	thrownOut = thrownOut && joined
+	if thrownOut {
+		ec.leaveLocked(room)
+	}
+	ec.mu.Unlock()
+
+	for _, a := range news {
+		ec.describeAction(&a)
+		// someone let in only told the members they knew of; the list
+		// tells them we are one too
+		if a.Action == protocol.ActionAdmit && a.Actor != ec.identity.ID && joined && !thrownOut {
+			go ec.sendUserList(room, a.Actor)
+		}
+	}
+	if thrownOut {
+		go ec.sendMembership(protocol.LeaveMessage, room, "")
+	}
+	return added, nil
+}
+
+// leaveLocked takes us out of room without asking, moving focus elsewhere.
+// Callers hold ec.mu.
+func (ec *EnhancedChat) leaveLocked(room string) {
+	ec.removeMemberLocked(room, ec.identity.ID)
+	if ec.currentRoom != room {
+		return
+	}
+	if joined := ec.joinedRoomsLocked(); len(joined) > 0 {
+		ec.currentRoom = joined[0]
+	} else {
+		ec.currentRoom = defaultRoom
+		ec.addMemberLocked(defaultRoom, ec.identity.ID)
+	}
+}
+
+func (ec *EnhancedChat) describeAction(a *protocol.RoomAction) {
+	until := ""
+	if !a.Until.IsZero() {
+		until = " until " + a.Until.Format("15:04:05")
+	}
+	reason := ""
+	if a.Reason != "" {
+		reason = ": " + a.Reason
+	}
+
+	actor, target := ec.displayName(a.Actor), ec.displayName(a.Target)
+	switch a.Action {
+	case protocol.ActionKick:
+		fmt.Printf("\r👢 %s kicked %s from %s%s\n> ", actor, target, a.Room, reason)
+	case protocol.ActionBan:
+		fmt.Printf("\r🚫 %s banned %s from %s%s%s\n> ", actor, target, a.Room, until, reason)
+	case protocol.ActionUnban:
+		fmt.Printf("\r✅ %s unbanned %s in %s\n> ", actor, target, a.Room)
+	case protocol.ActionMute:
+		fmt.Printf("\r🔇 %s muted %s in %s%s%s\n> ", actor, target, a.Room, until, reason)
+	case protocol.ActionUnmute:
+		fmt.Printf("\r🔊 %s unmuted %s in %s\n> ", actor, target, a.Room)
+	case protocol.ActionTopic:
+		fmt.Printf("\r📌 %s set the topic of %s: %s\n> ", actor, a.Room, a.Topic)
+	case protocol.ActionExpiry:
+		fmt.Printf("\r⏳ %s %s in %s\n> ", actor, describeExpiry(a.TTL), a.Room)
+	case protocol.ActionPromote:
+		fmt.Printf("\r⭐ %s made %s %s of %s\n> ", actor, target, a.Role, a.Room)
+	}
+}
+
+// claimRoom makes us the owner of a room nobody else seems to be in.
+func (ec *EnhancedChat) claimRoom(room string) {
+	if room == defaultRoom {
+		return
+	}
+	ec.mu.RLock()
+	_, moderated := ec.acls[room]
+	known := len(ec.rooms[room]) > 1 || ec.directory[room].Name != ""
+	ec.mu.RUnlock()
+	if moderated || known {
+		return
+	}
+
+	if err := ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionCreate}); err != nil {
+		fmt.Printf("Error creating room %s: %v\n", room, err)
+	}
+}
+
+// Kick removes target from room; they may join again.
+func (ec *EnhancedChat) Kick(room, target, reason string) error {
+	return ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionKick, Target: target, Reason: reason})
+}
+
+// Ban removes target from room and keeps them out for duration, or for good
+// if it is zero.
+func (ec *EnhancedChat) Ban(room, target string, duration time.Duration, reason string) error {
+	return ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionBan, Target: target, Reason: reason, Until: deadline(duration)})
+}
+
+func (ec *EnhancedChat) Unban(room, target string) error {
+	return ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionUnban, Target: target})
+}
+
+// Mute drops target's messages in room for duration, or for good if it is
+// zero.
+func (ec *EnhancedChat) Mute(room, target string, duration time.Duration, reason string) error {
+	return ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionMute, Target: target, Reason: reason, Until: deadline(duration)})
+}
+
+func (ec *EnhancedChat) Unmute(room, target string) error {
+	return ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionUnmute, Target: target})
+}
+
+// SetRole makes target an admin or member of room, or hands them ownership.
+func (ec *EnhancedChat) SetRole(room, target string, role Role) error {
+	return ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionPromote, Target: target, Role: string(role)})
+}
+
+// SetTopic sets the topic of room.
+func (ec *EnhancedChat) SetTopic(room, topic string) error {
+	if len(topic) > maxTopic {
+		return fmt.Errorf("topic longer than %d bytes", maxTopic)
+	}
+	if err := ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionTopic, Topic: topic}); err != nil {
+		return err
+	}
+	go ec.advertiseRooms()
+	return nil
+}
+
+func deadline(duration time.Duration) time.Time {
+	if duration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(duration)
+}
+
+// RoomModeration is a room's moderation state as shown to the user.
+type RoomModeration struct {
+	Room   string               `json:"room"`
+	Owner  string               `json:"owner,omitempty"`
+	Admins []string             `json:"admins"`
+	Banned map[string]time.Time `json:"banned"`
+	Muted  map[string]time.Time `json:"muted"`
+	Topic  string               `json:"topic,omitempty"`
+	Mode   string               `json:"mode,omitempty"`
+}
+
+// Moderation returns who owns and moderates room and who is banned or
+// muted in it. Zero times mean permanent.
+func (ec *EnhancedChat) Moderation(room string) RoomModeration {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	state := RoomModeration{
+		Room:   room,
+		Admins: []string{},
+		Banned: make(map[string]time.Time),
+		Muted:  make(map[string]time.Time),
+	}
+	acl, exists := ec.acls[room]
+	if !exists {
+		return state
+	}
+	state.Owner = acl.owner
+	state.Topic = acl.topic
+	state.Mode = acl.mode
+	for userID := range acl.admins {
+		state.Admins = append(state.Admins, userID)
+	}
+	sort.Strings(state.Admins)
+	for userID, until := range acl.bans {
+		if acl.banned(userID) {
+			state.Banned[userID] = until
+		}
+	}
+	for userID, until := range acl.mutes {
+		if acl.muted(userID) {
+			state.Muted[userID] = until
+		}
+	}
+	return state
+}
+
+// ModerationRequest is one moderation action as the APIs receive it.
+// Action is kick, ban, unban, mute, unmute, promote or topic; Duration is
+// like "30m" and empty means permanent.
+type ModerationRequest struct {
+	Room     string `json:"room"`
+	Action   string `json:"action"`
+	Target   string `json:"target,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+}
+
+// Moderate carries out req.
+func (ec *EnhancedChat) Moderate(req ModerationRequest) error {
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", req.Duration)
+		}
+		duration = d
+	}
+
+	switch req.Action {
+	case protocol.ActionKick:
+		return ec.Kick(req.Room, req.Target, req.Reason)
+	case protocol.ActionBan:
+		return ec.Ban(req.Room, req.Target, duration, req.Reason)
+	case protocol.ActionUnban:
+		return ec.Unban(req.Room, req.Target)
+	case protocol.ActionMute:
+		return ec.Mute(req.Room, req.Target, duration, req.Reason)
+	case protocol.ActionUnmute:
+		return ec.Unmute(req.Room, req.Target)
+	case protocol.ActionPromote:
+		return ec.SetRole(req.Room, req.Target, Role(req.Role))
+	case protocol.ActionTopic:
+		return ec.SetTopic(req.Room, req.Topic)
+	default:
+		return fmt.Errorf("unknown room action %q", req.Action)
+	}
+}
+
+// handleModerationCommand runs /kick, /ban, /unban, /mute, /unmute and /op
+// in the current room. /ban --peer and /unban --peer are the network's
+// /block and /unblock, which they used to be.
+func (ec *EnhancedChat) handleModerationCommand(command string, args []string) {
+	if len(args) > 0 && args[0] == "--peer" && (command == "ban" || command == "unban") {
+		alias := map[string]string{"ban": "block", "unban": "unblock"}[command]
+		ec.mu.RLock()
+		cmd, exists := ec.commands[alias]
+		ec.mu.RUnlock()
+		if !exists {
+			fmt.Println("Peers can't be blocked without a network")
+			return
+		}
+		cmd.handler(args[1:])
+		return
+	}
+	if len(args) == 0 {
+		fmt.Printf("Usage: /%s <user_id>\n", command)
+		return
+	}
+	room := ec.CurrentRoom()
+	target := ec.resolveUser(args[0])
+
+	// /ban and /mute take an optional duration before the reason
+	var duration time.Duration
+	rest := args[1:]
+	if len(rest) > 0 && (command == "ban" || command == "mute") {
+		if d, err := time.ParseDuration(rest[0]); err == nil {
+			duration = d
+			rest = rest[1:]
+		}
+	}
+	reason := strings.Join(rest, " ")
+
+	var err error
+	switch command {
+	case "kick":
+		err = ec.Kick(room, target, reason)
+	case "ban":
+		err = ec.Ban(room, target, duration, reason)
+	case "unban":
+		err = ec.Unban(room, target)
+	case "mute":
+		err = ec.Mute(room, target, duration, reason)
+	case "unmute":
+		err = ec.Unmute(room, target)
+	case "op":
+		role := RoleAdmin
+		if len(rest) > 0 {
+			role = Role(rest[0])
+		}
+		err = ec.SetRole(room, target, role)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
@@ -0,0 +1,234 @@
+package chat
+
+import (
+	"encoding/hex"
+	"p2p-chat-app/internal/protocol"
+	"testing"
+	"time"
+)
+
+// signedAt signs a as ec's user, dated at.
+func signedAt(t *testing.T, ec *EnhancedChat, a protocol.RoomAction, at time.Time) protocol.RoomAction {
+	t.Helper()
+	a, err := ec.signAction(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Timestamp = at
+	data, err := actionSignedBytes(&a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ec.identity.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Signature = hex.EncodeToString(signature)
+	return a
+}
+
+func TestMergeActionsSignatures(t *testing.T) {
+	bob := newTestChat(t, "bob")
+	mallory := newTestChat(t, "mallory")
+	create := protocol.RoomAction{Room: "golang", Action: protocol.ActionCreate}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		action func() protocol.RoomAction
+		ok     bool
+	}{
+		{"signed", func() protocol.RoomAction { return signedAt(t, bob, create, now) }, true},
+		{"unsigned", func() protocol.RoomAction {
+			a := signedAt(t, bob, create, now)
+			a.Signature = ""
+			return a
+		}, false},
+		{"tampered mode", func() protocol.RoomAction {
+			a := signedAt(t, bob, create, now)
+			a.Mode = string(ModeInvite)
+			return a
+		}, false},
+		{"signed by someone claiming bob", func() protocol.RoomAction {
+			a := signedAt(t, mallory, create, now)
+			a.Actor = bob.identity.ID
+			return a
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			_, err := alice.mergeActions("golang", []protocol.RoomAction{tt.action()})
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+			alice.mu.RLock()
+			owned := alice.acls["golang"] != nil && alice.acls["golang"].owner == bob.identity.ID
+			alice.mu.RUnlock()
+			if owned != tt.ok {
+				t.Fatalf("owned by bob = %v, want %v", owned, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMergeActionsOrder(t *testing.T) {
+	bob := newTestChat(t, "bob")
+	mallory := newTestChat(t, "mallory")
+	carol := newTestChat(t, "carol").identity.ID
+
+	start := time.Now().Add(-time.Hour)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	create := signedAt(t, bob, protocol.RoomAction{Room: "golang", Action: protocol.ActionCreate}, at(10))
+	promote := signedAt(t, bob, protocol.RoomAction{Room: "golang", Action: protocol.ActionPromote, Target: mallory.identity.ID, Role: string(RoleAdmin)}, at(20))
+	demote := signedAt(t, bob, protocol.RoomAction{Room: "golang", Action: protocol.ActionPromote, Target: mallory.identity.ID, Role: string(RoleMember)}, at(40))
+	ban := signedAt(t, mallory, protocol.RoomAction{Room: "golang", Action: protocol.ActionBan, Target: carol}, at(30))
+
+	tests := []struct {
+		name    string
+		batches [][]protocol.RoomAction
+		owner   string
+		banned  bool
+		logged  int
+	}{
+		{
+			name:    "ban by an admin, synced in one go",
+			batches: [][]protocol.RoomAction{{demote, ban, promote, create}},
+			owner:   bob.identity.ID,
+			banned:  true,
+			logged:  4,
+		},
+		{
+			name:    "ban dated before its actor was demoted",
+			batches: [][]protocol.RoomAction{{create, promote, demote}, {ban}},
+			owner:   bob.identity.ID,
+			logged:  3,
+		},
+		{
+			name:    "ban by a member is not kept",
+			batches: [][]protocol.RoomAction{{create}, {ban}},
+			owner:   bob.identity.ID,
+			logged:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			for _, batch := range tt.batches {
+				if _, err := alice.mergeActions("golang", batch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			alice.mu.RLock()
+			defer alice.mu.RUnlock()
+			acl := alice.acls["golang"]
+			if acl.owner != tt.owner {
+				t.Errorf("owner = %s, want %s", acl.owner, tt.owner)
+			}
+			if acl.banned(carol) != tt.banned {
+				t.Errorf("carol banned = %v, want %v", acl.banned(carol), tt.banned)
+			}
+			if len(acl.actions) != tt.logged {
+				t.Errorf("log holds %d actions, want %d", len(acl.actions), tt.logged)
+			}
+		})
+	}
+}
+
+func TestMergeActionsActorCap(t *testing.T) {
+	alice := newTestChat(t, "alice")
+	bob := newTestChat(t, "bob")
+
+	start := time.Now().Add(-time.Hour)
+	actions := []protocol.RoomAction{signedAt(t, bob, protocol.RoomAction{Room: "golang", Action: protocol.ActionCreate}, start)}
+	for i := 1; i <= maxActorActions; i++ {
+		topic := protocol.RoomAction{Room: "golang", Action: protocol.ActionTopic, Topic: "topic"}
+		actions = append(actions, signedAt(t, bob, topic, start.Add(time.Duration(i)*time.Second)))
+	}
+
+	added, err := alice.mergeActions("golang", actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != maxActorActions {
+		t.Fatalf("kept %d actions, want %d", len(added), maxActorActions)
+	}
+}
+
+func TestEarliestCreateWins(t *testing.T) {
+	bob := newTestChat(t, "bob")
+	mallory := newTestChat(t, "mallory")
+	carol := newTestChat(t, "carol").identity.ID
+
+	start := time.Now().Add(-time.Hour)
+	created := signedAt(t, bob, protocol.RoomAction{Room: "golang", Action: protocol.ActionCreate}, start)
+	later := signedAt(t, mallory, protocol.RoomAction{Room: "golang", Action: protocol.ActionCreate}, start.Add(time.Minute))
+	ban := signedAt(t, mallory, protocol.RoomAction{Room: "golang", Action: protocol.ActionBan, Target: carol}, start.Add(2*time.Minute))
+
+	tests := []struct {
+		name    string
+		batches [][]protocol.RoomAction
+	}{
+		{"earliest first", [][]protocol.RoomAction{{created}, {later, ban}}},
+		{"earliest last", [][]protocol.RoomAction{{later, ban}, {created}}},
+		{"one at a time, earliest last", [][]protocol.RoomAction{{later}, {ban}, {created}}},
+		{"all at once", [][]protocol.RoomAction{{ban, later, created}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			for _, batch := range tt.batches {
+				if _, err := alice.mergeActions("golang", batch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			alice.mu.RLock()
+			defer alice.mu.RUnlock()
+			acl := alice.acls["golang"]
+			if acl.owner != bob.identity.ID {
+				t.Errorf("owner = %s, want bob", acl.owner)
+			}
+			if acl.banned(carol) {
+				t.Error("the later owner's ban stands")
+			}
+			if len(acl.actions) != 1 {
+				t.Errorf("log holds %d actions, want only the earliest create", len(acl.actions))
+			}
+		})
+	}
+}
+
+func TestDefaultRoomUnmoderated(t *testing.T) {
+	mallory := newTestChat(t, "mallory")
+	bob := newTestChat(t, "bob").identity.ID
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		action protocol.RoomAction
+	}{
+		{"create", protocol.RoomAction{Room: defaultRoom, Action: protocol.ActionCreate, Mode: string(ModeInvite)}},
+		{"ban", protocol.RoomAction{Room: defaultRoom, Action: protocol.ActionBan, Target: bob}},
+		{"topic", protocol.RoomAction{Room: defaultRoom, Action: protocol.ActionTopic, Topic: "mine now"}},
+		{"expiry", protocol.RoomAction{Room: defaultRoom, Action: protocol.ActionExpiry, TTL: time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			create := signedAt(t, mallory, protocol.RoomAction{Room: defaultRoom, Action: protocol.ActionCreate}, now.Add(-time.Minute))
+			if _, err := alice.mergeActions(defaultRoom, []protocol.RoomAction{create, signedAt(t, mallory, tt.action, now)}); err != nil {
+				t.Fatal(err)
+			}
+
+			alice.mu.RLock()
+			defer alice.mu.RUnlock()
+			acl := alice.acls[defaultRoom]
+			if acl.owner != "" || acl.mode != "" || acl.topic != "" || acl.ttl != 0 || acl.banned(bob) {
+				t.Fatalf("mallory moderated %s: owner %q, mode %q, topic %q, expiry %s", defaultRoom, acl.owner, acl.mode, acl.topic, acl.ttl)
+			}
+			if len(acl.actions) != 0 {
+				t.Fatalf("log holds %d actions", len(acl.actions))
+			}
+		})
+	}
+}
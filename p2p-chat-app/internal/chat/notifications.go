@@ -0,0 +1,269 @@
+package chat
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/notify"
+	"p2p-chat-app/internal/protocol"
+	"strings"
+	"time"
+)
+
+// Messages name users with @username, @nickname or @userID. The sender
+// resolves those names against its contacts into msg.Mentions so clients
+// can show who is meant; receivers also match the text against their own
+// username, since the sender may not know them by name. Mentions are left
+// out of messages sealed with a room key and rebuilt once opened.
+
+// NotificationSettings are the notification settings as the APIs show
+// them.
+type NotificationSettings struct {
+	Keywords []string             `json:"keywords"`
+	Muted    map[string]time.Time `json:"muted"`
+	Sinks    []string             `json:"sinks"`
+}
+
+// NotifyRequest changes the notification settings as the APIs receive it.
+// Action is keyword or unkeyword with Keyword set, or mute or unmute with
+// Room set; Duration limits a mute, which is permanent without it.
+type NotifyRequest struct {
+	Action   string `json:"action"`
+	Keyword  string `json:"keyword,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Notifier is the dispatcher notifications go through, for adding sinks.
+func (ec *EnhancedChat) Notifier() *notify.Dispatcher {
+	return ec.notifier
+}
+
+func (ec *EnhancedChat) NotificationSettings() NotificationSettings {
+	settings := ec.notifier.Settings()
+	return NotificationSettings{
+		Keywords: settings.Keywords,
+		Muted:    settings.Muted,
+		Sinks:    ec.notifier.Sinks(),
+	}
+}
+
+// ConfigureNotifications carries out req.
+func (ec *EnhancedChat) ConfigureNotifications(req NotifyRequest) error {
+	switch req.Action {
+	case "keyword":
+		return ec.notifier.AddKeyword(req.Keyword)
+	case "unkeyword":
+		if !ec.notifier.RemoveKeyword(req.Keyword) {
+			return fmt.Errorf("%q is not a keyword", req.Keyword)
+		}
+		return nil
+	case "mute":
+		if req.Room == "" {
+			return fmt.Errorf("room required")
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid duration %q", req.Duration)
+			}
+			duration = d
+		}
+		ec.notifier.Mute(req.Room, duration)
+		return nil
+	case "unmute":
+		ec.notifier.Unmute(req.Room)
+		return nil
+	default:
+		return fmt.Errorf("unknown notify action %q", req.Action)
+	}
+}
+
+// resolveMentions turns the @names in content into user IDs. Names nobody
+// we know goes by are skipped.
+func (ec *EnhancedChat) resolveMentions(content string) []string {
+	names := protocol.ParseMentions(content)
+	if len(names) == 0 {
+		return nil
+	}
+
+	known := ec.contacts.List()
+	seen := make(map[string]bool)
+	var mentions []string
+	add := func(userID string) {
+		if !seen[userID] {
+			seen[userID] = true
+			mentions = append(mentions, userID)
+		}
+	}
+	for _, name := range names {
+		if name == ec.identity.ID || strings.EqualFold(name, ec.identity.Username) {
+			add(ec.identity.ID)
+			continue
+		}
+		if userID, found := ec.contacts.Resolve(name); found {
+			add(userID)
+			continue
+		}
+		// usernames aren't unique, so everyone going by name is meant
+		for _, contact := range known {
+			if strings.EqualFold(contact.Username, name) {
+				add(contact.UserID)
+			}
+		}
+	}
+	return mentions
+}
+
+// mentionsMe reports whether msg names us.
+func (ec *EnhancedChat) mentionsMe(msg *protocol.Message) bool {
+	for _, userID := range msg.Mentions {
+		if userID == ec.identity.ID {
+			return true
+		}
+	}
+	for _, name := range protocol.ParseMentions(msg.Content) {
+		if name == ec.identity.ID || strings.EqualFold(name, ec.identity.Username) {
+			return true
+		}
+	}
+	return false
+}
+
+// notification returns what msg is worth telling the user about, if
+// anything.
+func (ec *EnhancedChat) notification(msg *protocol.Message) (*notify.Notification, bool) {
+	if msg.From == ec.identity.ID || (msg.Type != protocol.TextMessage && msg.Type != protocol.FileMessage) {
+		return nil, false
+	}
+
+	n := &notify.Notification{
+		MessageID: msg.ID,
+		From:      msg.From,
+		FromName:  ec.displayName(msg.From),
+		Room:      msg.Room,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+	}
+	if !msg.ExpiresAt.IsZero() {
+		n.Content = ""
+		n.Disappearing = true
+	}
+	switch {
+	case msg.To == ec.identity.ID:
+		n.Kind = notify.KindDirect
+	case msg.Room == "":
+		return nil, false
+	case ec.mentionsMe(msg):
+		n.Kind = notify.KindMention
+	default:
+		keyword, found := ec.notifier.Keyword(msg.Content)
+		if !found {
+			return nil, false
+		}
+		n.Kind = notify.KindKeyword
+		n.Keyword = keyword
+	}
+	return n, true
+}
+
+// highlighted reports whether msg mentions us or one of our keywords.
+func (ec *EnhancedChat) highlighted(msg *protocol.Message) bool {
+	n, found := ec.notification(msg)
+	return found && n.Kind != notify.KindDirect
+}
+
+func (ec *EnhancedChat) notifyMessage(msg *protocol.Message) {
+	if n, found := ec.notification(msg); found {
+		ec.notifier.Notify(n)
+	}
+}
+
+// handleNotifyCommand runs /notify [on|off] [room] [duration],
+// /highlight [keyword] and /unhighlight <keyword>.
+func (ec *EnhancedChat) handleNotifyCommand(command string, args []string) {
+	switch command {
+	case "notify":
+		if len(args) == 0 {
+			ec.showNotificationSettings()
+			return
+		}
+		req := NotifyRequest{Room: ec.CurrentRoom()}
+		switch args[0] {
+		case "off":
+			req.Action = "mute"
+		case "on":
+			req.Action = "unmute"
+		default:
+			fmt.Println("Usage: /notify [on|off] [room] [duration]")
+			return
+		}
+		for _, arg := range args[1:] {
+			if _, err := time.ParseDuration(arg); err == nil {
+				req.Duration = arg
+			} else {
+				req.Room = arg
+			}
+		}
+		if err := ec.ConfigureNotifications(req); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		switch {
+		case req.Action == "unmute":
+			fmt.Printf("🔔 Notifications for %s are on\n", req.Room)
+		case req.Duration != "":
+			fmt.Printf("🔕 Muted %s for %s\n", req.Room, req.Duration)
+		default:
+			fmt.Printf("🔕 Muted %s until /notify on %s\n", req.Room, req.Room)
+		}
+
+	case "highlight":
+		if len(args) == 0 {
+			keywords := ec.notifier.Settings().Keywords
+			if len(keywords) == 0 {
+				fmt.Println("No highlight keywords, add one with /highlight <keyword>")
+				return
+			}
+			fmt.Printf("🔆 Highlighting: %s\n", strings.Join(keywords, ", "))
+			return
+		}
+		keyword := strings.Join(args, " ")
+		if err := ec.ConfigureNotifications(NotifyRequest{Action: "keyword", Keyword: keyword}); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("🔆 Highlighting %q\n", keyword)
+
+	case "unhighlight":
+		if len(args) == 0 {
+			fmt.Println("Usage: /unhighlight <keyword>")
+			return
+		}
+		keyword := strings.Join(args, " ")
+		if err := ec.ConfigureNotifications(NotifyRequest{Action: "unkeyword", Keyword: keyword}); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("No longer highlighting %q\n", keyword)
+	}
+}
+
+func (ec *EnhancedChat) showNotificationSettings() {
+	settings := ec.NotificationSettings()
+
+	sinks := "none"
+	if len(settings.Sinks) > 0 {
+		sinks = strings.Join(settings.Sinks, ", ")
+	}
+	fmt.Printf("🔔 Notifying via %s for private messages, mentions of @%s and keywords\n", sinks, ec.identity.Username)
+	if len(settings.Keywords) > 0 {
+		fmt.Printf("  keywords: %s\n", strings.Join(settings.Keywords, ", "))
+	}
+	for room, until := range settings.Muted {
+		if until.IsZero() {
+			fmt.Printf("  🔕 %s muted\n", room)
+		} else {
+			fmt.Printf("  🔕 %s muted until %s\n", room, until.Format("2006-01-02 15:04"))
+		}
+	}
+}
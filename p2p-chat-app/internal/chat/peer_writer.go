@@ -0,0 +1,244 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueuePolicy decides what happens when a peer's send queue is full.
+type QueuePolicy int
+
+const (
+	// DropOldest discards the oldest queued frame to make room.
+	DropOldest QueuePolicy = iota
+	// Disconnect treats a full queue as a dead peer.
+	Disconnect
+	// BlockWithTimeout waits up to SendConfig.BlockTimeout for room.
+	BlockWithTimeout
+)
+
+var errQueueFull = errors.New("send queue full")
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case Disconnect:
+		return "disconnect"
+	case BlockWithTimeout:
+		return "block"
+	default:
+		return "drop-oldest"
+	}
+}
+
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch s {
+	case "drop-oldest", "drop":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	case "block":
+		return BlockWithTimeout, nil
+	}
+	return DropOldest, fmt.Errorf("unknown queue policy %q (want drop-oldest, disconnect or block)", s)
+}
+
+// SendConfig tunes the per-peer writers.
+type SendConfig struct {
+	QueueSize    int
+	WriteTimeout time.Duration
+	Policy       QueuePolicy
+	BlockTimeout time.Duration
+}
+
+func DefaultSendConfig() SendConfig {
+	return SendConfig{
+		QueueSize:    256,
+		WriteTimeout: 10 * time.Second,
+		Policy:       DropOldest,
+		BlockTimeout: 2 * time.Second,
+	}
+}
+
+// PeerQueueStats reports one peer writer's queue for metrics.
+type PeerQueueStats struct {
+	UserID   string `json:"user_id"`
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Sent     uint64 `json:"sent"`
+	Dropped  uint64 `json:"dropped"`
+	Policy   string `json:"policy"`
+}
+
+// peerWriter owns all writes to one peer so a slow peer only ever stalls
+// its own queue, never the chat lock.
+type peerWriter struct {
+	userID  string
+	conn    net.Conn
+	config  SendConfig
+	queue   chan string
+	done    chan struct{}
+	once    sync.Once
+	onFail  func(w *peerWriter, err error)
+	sent    uint64
+	dropped uint64
+	// pushMu serialises DropOldest's evict-and-retry
+	pushMu sync.Mutex
+}
+
+func newPeerWriter(userID string, conn net.Conn, config SendConfig, onFail func(*peerWriter, error)) *peerWriter {
+	w := &peerWriter{
+		userID: userID,
+		conn:   conn,
+		config: config,
+		queue:  make(chan string, config.QueueSize),
+		done:   make(chan struct{}),
+		onFail: onFail,
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues one line for the peer according to the queue policy.
+func (w *peerWriter) enqueue(line string) error {
+	// a stopped writer may still have room in its queue
+	select {
+	case <-w.done:
+		return fmt.Errorf("peer %s is gone", w.userID)
+	default:
+	}
+	select {
+	case w.queue <- line:
+		return nil
+	default:
+	}
+
+	switch w.config.Policy {
+	case Disconnect:
+		atomic.AddUint64(&w.dropped, 1)
+		w.fail(errQueueFull)
+		return errQueueFull
+
+	case BlockWithTimeout:
+		timer := time.NewTimer(w.config.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case w.queue <- line:
+			return nil
+		case <-w.done:
+			return fmt.Errorf("peer %s is gone", w.userID)
+		case <-timer.C:
+			atomic.AddUint64(&w.dropped, 1)
+			return errQueueFull
+		}
+
+	default:
+		w.pushMu.Lock()
+		defer w.pushMu.Unlock()
+		for {
+			select {
+			case w.queue <- line:
+				return nil
+			default:
+			}
+			select {
+			case <-w.queue:
+				atomic.AddUint64(&w.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+func (w *peerWriter) run() {
+	for {
+		select {
+		case line := <-w.queue:
+			w.conn.SetWriteDeadline(time.Now().Add(w.config.WriteTimeout))
+			if _, err := fmt.Fprintln(w.conn, line); err != nil {
+				w.fail(err)
+				return
+			}
+			atomic.AddUint64(&w.sent, 1)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *peerWriter) fail(err error) {
+	w.stop()
+	if w.onFail != nil {
+		go w.onFail(w, err)
+	}
+}
+
+func (w *peerWriter) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *peerWriter) stats() PeerQueueStats {
+	return PeerQueueStats{
+		UserID:   w.userID,
+		Depth:    len(w.queue),
+		Capacity: cap(w.queue),
+		Sent:     atomic.LoadUint64(&w.sent),
+		Dropped:  atomic.LoadUint64(&w.dropped),
+		Policy:   w.config.Policy.String(),
+	}
+}
+
+// SetSendConfig applies to peers added afterwards.
+func (ec *EnhancedChat) SetSendConfig(config SendConfig) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.sendConfig = config
+}
+
+// SetDisconnectHandler is called when a peer's writer gives up on it, so
+// the network layer can tear down the connection.
+func (ec *EnhancedChat) SetDisconnectHandler(handler func(userID string)) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.disconnect = handler
+}
+
+// QueueStats exports the depth of every peer's send queue.
+func (ec *EnhancedChat) QueueStats() []PeerQueueStats {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	stats := make([]PeerQueueStats, 0, len(ec.peers))
+	for _, w := range ec.peers {
+		stats = append(stats, w.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].UserID < stats[j].UserID
+	})
+	return stats
+}
+
+func (ec *EnhancedChat) peerWriteFailed(w *peerWriter, err error) {
+	ec.mu.RLock()
+	current := ec.peers[w.userID] == w
+	handler := ec.disconnect
+	ec.mu.RUnlock()
+
+	// a reconnect may already have replaced this writer
+	if !current {
+		return
+	}
+
+	fmt.Printf("⚠️  Dropping %s: %v\n", w.userID, err)
+	if handler != nil {
+		handler(w.userID)
+	} else {
+		ec.RemovePeer(w.userID)
+	}
+}
@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseQueuePolicy(t *testing.T) {
+	tests := []struct {
+		in     string
+		policy QueuePolicy
+		ok     bool
+	}{
+		{"drop-oldest", DropOldest, true},
+		{"drop", DropOldest, true},
+		{"disconnect", Disconnect, true},
+		{"block", BlockWithTimeout, true},
+		{"", DropOldest, false},
+		{"wait", DropOldest, false},
+	}
+	for _, tt := range tests {
+		policy, err := ParseQueuePolicy(tt.in)
+		if policy != tt.policy || tt.ok != (err == nil) {
+			t.Errorf("ParseQueuePolicy(%q) = %v, %v", tt.in, policy, err)
+		}
+		if tt.ok && policy.String() != tt.in && tt.in != "drop" {
+			t.Errorf("%v prints as %q", policy, policy.String())
+		}
+	}
+}
+
+// stalledWriter returns a writer to a peer that reads nothing until read
+// is called, which reads up to the line last and returns what it read.
+func stalledWriter(t *testing.T, config SendConfig, onFail func(*peerWriter, error)) (*peerWriter, func(last string) []string) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	w := newPeerWriter("bob", conn, config, onFail)
+	t.Cleanup(w.stop)
+	read := func(last string) []string {
+		var lines []string
+		scanner := bufio.NewScanner(peer)
+		for scanner.Scan() {
+			if lines = append(lines, scanner.Text()); scanner.Text() == last {
+				break
+			}
+		}
+		return lines
+	}
+	return w, read
+}
+
+func TestPeerWriterFull(t *testing.T) {
+	const size = 2
+	tests := []struct {
+		policy QueuePolicy
+		// check looks at the writer after more lines than fit were queued
+		check func(t *testing.T, w *peerWriter, errs []error, failed chan error, read func(last string) []string)
+	}{
+		{DropOldest, func(t *testing.T, w *peerWriter, errs []error, failed chan error, read func(last string) []string) {
+			for _, err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if atomic.LoadUint64(&w.dropped) == 0 {
+				t.Fatal("nothing dropped")
+			}
+			// the first line may have been on its way before the queue filled
+			lines := read("line 9")
+			if len(lines) > size+1 || lines[len(lines)-2] != "line 8" {
+				t.Fatalf("read %q, want the newest lines", lines)
+			}
+		}},
+		{Disconnect, func(t *testing.T, w *peerWriter, errs []error, failed chan error, read func(last string) []string) {
+			if errs[len(errs)-1] == nil {
+				t.Fatal("a full queue was not an error")
+			}
+			select {
+			case err := <-failed:
+				if err != errQueueFull {
+					t.Fatalf("failed with %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the peer was not given up on")
+			}
+			if err := w.enqueue("after"); err == nil {
+				t.Fatal("queued to a peer given up on")
+			}
+		}},
+		{BlockWithTimeout, func(t *testing.T, w *peerWriter, errs []error, failed chan error, read func(last string) []string) {
+			if errs[len(errs)-1] != errQueueFull {
+				t.Fatalf("got %v after waiting", errs[len(errs)-1])
+			}
+			select {
+			case err := <-failed:
+				t.Fatalf("gave up on the peer: %v", err)
+			default:
+			}
+			// waiting works once the peer reads again
+			go read("after")
+			if err := w.enqueue("after"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			failed := make(chan error, 1)
+			config := SendConfig{QueueSize: size, WriteTimeout: time.Minute, Policy: tt.policy, BlockTimeout: 20 * time.Millisecond}
+			w, read := stalledWriter(t, config, func(w *peerWriter, err error) { failed <- err })
+
+			var errs []error
+			for i := 0; i < 10; i++ {
+				err := w.enqueue(fmt.Sprint("line ", i))
+				errs = append(errs, err)
+				if err != nil && tt.policy == Disconnect {
+					break
+				}
+			}
+			tt.check(t, w, errs, failed, read)
+		})
+	}
+}
+
+func TestRemovePeerStopsWriter(t *testing.T) {
+	ec := newTestChat(t, "alice")
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	ec.AddPeer("bob", conn)
+
+	ec.mu.RLock()
+	w := ec.peers["bob"]
+	ec.mu.RUnlock()
+	ec.RemovePeer("bob")
+
+	select {
+	case <-w.done:
+	case <-time.After(time.Second):
+		t.Fatal("writer still running")
+	}
+	if err := w.enqueue("hello"); err == nil {
+		t.Fatal("queued to a removed peer")
+	}
+}
@@ -0,0 +1,500 @@
+package chat
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultIdleTimeout is how long without activity turns us away
+	DefaultIdleTimeout = 5 * time.Minute
+	// presenceRefresh is how often we re-sign our presence to keep it fresh
+	presenceRefresh = 5 * time.Minute
+	// presenceTTL is how long a presence counts without being refreshed
+	presenceTTL       = 15 * time.Minute
+	idleCheckInterval = 15 * time.Second
+	maxStatus         = 128
+	// maxPresence caps how many presences one message carries
+	maxPresence = 200
+	// maxKnownPresence caps how many presences we keep
+	maxKnownPresence = 1000
+)
+
+// Presence is gossiped like room advertisements, but pushed as it changes:
+// every node passes a presence newer than the one it knew on to all its
+// peers, and a new peer gets every fresh presence we know. Presences are
+// signed, so nobody can set someone else's. We refresh ours every few
+// minutes; users not heard from within presenceTTL count as offline.
+//
+// Only the presence of users we share something with is kept and passed
+// on: peers we are connected to, members of our rooms and users we have a
+// private conversation with. Anyone can sign presences with fresh keys, so
+// nobody else's are worth the memory.
+//
+// Activity is typing or sending in the terminal, web UI or API. Without any
+// for the idle timeout, online turns into away until the next activity.
+// Away and busy chosen by the user stay as they are.
+
+// PeerStatus is a user's presence as the APIs show it.
+type PeerStatus struct {
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	Status     string    `json:"status,omitempty"`
+	Idle       bool      `json:"idle,omitempty"`
+	Connected  bool      `json:"connected"`
+	LastActive time.Time `json:"last_active,omitempty"`
+}
+
+// PresenceRequest sets our state and status text as the APIs receive it.
+type PresenceRequest struct {
+	State  string `json:"state"`
+	Status string `json:"status,omitempty"`
+}
+
+// SetPresenceHandler is called with every presence that changes, ours
+// included, so the network layer can keep its peer list current.
+func (ec *EnhancedChat) SetPresenceHandler(handler func(p protocol.Presence)) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.onPresence = handler
+}
+
+// SetIdleTimeout sets how long without activity turns us away; 0 never
+// does.
+func (ec *EnhancedChat) SetIdleTimeout(timeout time.Duration) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.idleAfter = timeout
+}
+
+// SetPresence sets our state, online, away or busy, and status text and
+// tells the network.
+func (ec *EnhancedChat) SetPresence(state, status string) error {
+	switch state {
+	case protocol.PresenceOnline, protocol.PresenceAway, protocol.PresenceBusy:
+	default:
+		return fmt.Errorf("state must be online, away or busy, not %q", state)
+	}
+	if len(status) > maxStatus {
+		return fmt.Errorf("status longer than %d bytes", maxStatus)
+	}
+	ec.mu.Lock()
+	ec.lastActive = time.Now()
+	ec.mu.Unlock()
+	return ec.announcePresence(state, status, false)
+}
+
+// Touch records activity by the user, bringing us back if we went idle.
+func (ec *EnhancedChat) Touch() {
+	ec.mu.Lock()
+	ec.lastActive = time.Now()
+	own := ec.presence[ec.identity.ID]
+	ec.mu.Unlock()
+
+	if own.Idle {
+		if err := ec.announcePresence(protocol.PresenceOnline, own.Status, false); err != nil {
+			fmt.Printf("Error announcing presence: %v\n", err)
+		}
+	}
+}
+
+// OwnPresence is our presence as the APIs show it.
+func (ec *EnhancedChat) OwnPresence() PeerStatus {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return ec.peerStatusLocked(ec.identity.ID)
+}
+
+// announcePresence signs our new presence, keeps it and sends it to every
+// peer.
+func (ec *EnhancedChat) announcePresence(state, status string, idle bool) error {
+	key, err := ec.identity.ExportPublicKey()
+	if err != nil {
+		return err
+	}
+	ec.mu.RLock()
+	p := protocol.Presence{
+		UserID:     ec.identity.ID,
+		UserKey:    key,
+		State:      state,
+		Status:     status,
+		Idle:       idle,
+		LastActive: ec.lastActive,
+		UpdatedAt:  time.Now(),
+	}
+	ec.mu.RUnlock()
+
+	data, err := presenceSignedBytes(&p)
+	if err != nil {
+		return err
+	}
+	signature, err := ec.identity.Sign(data)
+	if err != nil {
+		return err
+	}
+	p.Signature = hex.EncodeToString(signature)
+
+	ec.mu.Lock()
+	if known, exists := ec.presence[p.UserID]; exists && known.UpdatedAt.After(p.UpdatedAt) {
+		ec.mu.Unlock()
+		return nil
+	}
+	ec.presence[p.UserID] = p
+	handler := ec.onPresence
+	ec.mu.Unlock()
+
+	if handler != nil {
+		handler(p)
+	}
+	ec.sendPresence([]protocol.Presence{p}, "")
+	return nil
+}
+
+// sendPresence sends presences to every peer, or only to if set.
+func (ec *EnhancedChat) sendPresence(presences []protocol.Presence, to string) {
+	if len(presences) == 0 {
+		return
+	}
+	msg := &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.PresenceMessage,
+		From:      ec.identity.ID,
+		To:        to,
+		Timestamp: time.Now(),
+		Presence:  presences,
+	}
+	if err := ec.broadcastMessage(msg); err != nil {
+		fmt.Printf("Error sending presence: %v\n", err)
+	}
+}
+
+// presenceSnapshot returns every fresh presence we know, newest first.
+func (ec *EnhancedChat) presenceSnapshot() []protocol.Presence {
+	ec.mu.RLock()
+	now := time.Now()
+	var presences []protocol.Presence
+	for _, p := range ec.presence {
+		if now.Sub(p.UpdatedAt) < presenceTTL {
+			presences = append(presences, p)
+		}
+	}
+	ec.mu.RUnlock()
+
+	sort.Slice(presences, func(i, j int) bool {
+		return presences[i].UpdatedAt.After(presences[j].UpdatedAt)
+	})
+	if len(presences) > maxPresence {
+		presences = presences[:maxPresence]
+	}
+	return presences
+}
+
+func (ec *EnhancedChat) presenceLoop() {
+	if err := ec.announcePresence(protocol.PresenceOnline, "", false); err != nil {
+		fmt.Printf("Error announcing presence: %v\n", err)
+	}
+
+	idle := time.NewTicker(idleCheckInterval)
+	defer idle.Stop()
+	refresh := time.NewTicker(presenceRefresh)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-idle.C:
+			ec.checkIdle()
+		case <-refresh.C:
+			ec.mu.RLock()
+			own := ec.presence[ec.identity.ID]
+			ec.mu.RUnlock()
+			if err := ec.announcePresence(own.State, own.Status, own.Idle); err != nil {
+				fmt.Printf("Error announcing presence: %v\n", err)
+			}
+		case <-ec.quit:
+			return
+		}
+	}
+}
+
+// checkIdle turns us away once we have been inactive for the idle timeout.
+func (ec *EnhancedChat) checkIdle() {
+	ec.mu.RLock()
+	own := ec.presence[ec.identity.ID]
+	idle := ec.idleAfter > 0 && time.Since(ec.lastActive) > ec.idleAfter
+	ec.mu.RUnlock()
+
+	if idle && own.State == protocol.PresenceOnline {
+		if err := ec.announcePresence(protocol.PresenceAway, own.Status, true); err != nil {
+			fmt.Printf("Error announcing presence: %v\n", err)
+		}
+	}
+}
+
+func presenceSignedBytes(p *protocol.Presence) ([]byte, error) {
+	unsigned := *p
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+func verifyPresence(p *protocol.Presence) error {
+	signature, err := hex.DecodeString(p.Signature)
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("presence of %s is not signed", p.UserID)
+	}
+	data, err := presenceSignedBytes(p)
+	if err != nil {
+		return err
+	}
+	if err := identity.VerifyFrom(p.UserID, p.UserKey, data, signature); err != nil {
+		return fmt.Errorf("bad signature on presence of %s: %v", p.UserID, err)
+	}
+	return nil
+}
+
+// mergePresence takes in the presences a peer sent and returns those that
+// were news to us.
+func (ec *EnhancedChat) mergePresence(presences []protocol.Presence) ([]protocol.Presence, error) {
+	if len(presences) > maxPresence {
+		return nil, fmt.Errorf("presence message too long")
+	}
+
+	now := time.Now()
+	var added []protocol.Presence
+	var firstErr error
+	for _, p := range presences {
+		// we know our own presence best, even if another device shares it
+		if p.UserID == ec.identity.ID {
+			continue
+		}
+		age := now.Sub(p.UpdatedAt)
+		if age > presenceTTL || age < -maxClockSkew {
+			continue
+		}
+
+		ec.mu.RLock()
+		known, exists := ec.presence[p.UserID]
+		shared := ec.sharesWithLocked(p.UserID)
+		ec.mu.RUnlock()
+		if !shared || exists && !p.UpdatedAt.After(known.UpdatedAt) {
+			continue
+		}
+
+		err := verifyPresence(&p)
+		if err == nil && (!validState(p.State) || len(p.Status) > maxStatus) {
+			err = fmt.Errorf("invalid presence for %s", p.UserID)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		ec.mu.Lock()
+		known, exists = ec.presence[p.UserID]
+		if !exists && len(ec.presence) >= maxKnownPresence {
+			ec.mu.Unlock()
+			continue
+		}
+		if !exists || p.UpdatedAt.After(known.UpdatedAt) {
+			ec.presence[p.UserID] = p
+			added = append(added, p)
+		}
+		ec.mu.Unlock()
+	}
+
+	ec.mu.Lock()
+	for userID, p := range ec.presence {
+		if userID != ec.identity.ID && (now.Sub(p.UpdatedAt) > presenceTTL || !ec.sharesWithLocked(userID)) {
+			delete(ec.presence, userID)
+		}
+	}
+	handler := ec.onPresence
+	ec.mu.Unlock()
+
+	if handler != nil {
+		for _, p := range added {
+			handler(p)
+		}
+	}
+	return added, firstErr
+}
+
+// sharesWithLocked reports whether userID is connected to us, in one of
+// our rooms or in a private conversation with us.
+func (ec *EnhancedChat) sharesWithLocked(userID string) bool {
+	if _, connected := ec.peers[userID]; connected {
+		return true
+	}
+	for room, members := range ec.rooms {
+		if !members[ec.identity.ID] {
+			continue
+		}
+		if members[userID] {
+			return true
+		}
+		for _, heard := range ec.heard[room] {
+			for _, member := range heard {
+				if member == userID {
+					return true
+				}
+			}
+		}
+	}
+	_, talked := ec.storage.Latest(storage.PrivateKey(ec.identity.ID, userID))
+	return talked
+}
+
+func validState(state string) bool {
+	switch state {
+	case protocol.PresenceOnline, protocol.PresenceAway, protocol.PresenceBusy, protocol.PresenceOffline:
+		return true
+	default:
+		return false
+	}
+}
+
+// PresenceOf returns userID's presence. Users not heard from lately are
+// offline, and peers too old to announce theirs are online while connected.
+func (ec *EnhancedChat) PresenceOf(userID string) protocol.Presence {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return ec.presenceLocked(userID)
+}
+
+// presenceLocked is PresenceOf for callers holding ec.mu.
+func (ec *EnhancedChat) presenceLocked(userID string) protocol.Presence {
+	p, exists := ec.presence[userID]
+	_, connected := ec.peers[userID]
+	switch {
+	case !exists && connected:
+		return protocol.Presence{UserID: userID, State: protocol.PresenceOnline}
+	case !exists:
+		return protocol.Presence{UserID: userID, State: protocol.PresenceOffline}
+	case userID != ec.identity.ID && time.Since(p.UpdatedAt) > presenceTTL:
+		p.State = protocol.PresenceOffline
+	}
+	return p
+}
+
+func (ec *EnhancedChat) peerStatusLocked(userID string) PeerStatus {
+	p := ec.presenceLocked(userID)
+	_, connected := ec.peers[userID]
+	return PeerStatus{
+		UserID:     userID,
+		Name:       ec.displayName(userID),
+		State:      p.State,
+		Status:     p.Status,
+		Idle:       p.Idle,
+		Connected:  connected,
+		LastActive: p.LastActive,
+	}
+}
+
+// Presences lists the presence of everyone we are connected to or have
+// heard from lately, by name.
+func (ec *EnhancedChat) Presences() []PeerStatus {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	list := []PeerStatus{}
+	add := func(userID string) {
+		if userID != ec.identity.ID && !seen[userID] {
+			seen[userID] = true
+			list = append(list, ec.peerStatusLocked(userID))
+		}
+	}
+	for userID := range ec.peers {
+		add(userID)
+	}
+	for userID, p := range ec.presence {
+		if time.Since(p.UpdatedAt) < presenceTTL {
+			add(userID)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+	return list
+}
+
+// DescribePresence formats userID's presence for the terminal, e.g.
+// "🌙 away: lunch, active 12m ago".
+func (ec *EnhancedChat) DescribePresence(userID string) string {
+	return formatPresence(ec.PresenceOf(userID))
+}
+
+func formatPresence(p protocol.Presence) string {
+	var s string
+	switch p.State {
+	case protocol.PresenceOnline:
+		s = "🟢 online"
+	case protocol.PresenceAway:
+		s = "🌙 away"
+		if p.Idle {
+			s += " (idle)"
+		}
+	case protocol.PresenceBusy:
+		s = "⛔ busy"
+	default:
+		s = "⚫ offline"
+	}
+	if p.Status != "" {
+		s += ": " + p.Status
+	}
+	if p.State != protocol.PresenceOnline && !p.LastActive.IsZero() {
+		s += ", active " + ago(p.LastActive)
+	}
+	return s
+}
+
+// ago formats how long ago t was, coarsely.
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return t.Format("2006-01-02")
+	}
+}
+
+// handleStatusCommand runs /status [online|away|busy] [text]. Text alone
+// keeps the state; a state alone clears the text.
+func (ec *EnhancedChat) handleStatusCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Printf("You are %s\n", ec.DescribePresence(ec.identity.ID))
+		fmt.Println("Usage: /status [online|away|busy] [text]")
+		return
+	}
+
+	own := ec.PresenceOf(ec.identity.ID)
+	state := own.State
+	if own.Idle {
+		state = protocol.PresenceOnline
+	}
+	text := args
+	switch args[0] {
+	case protocol.PresenceOnline, protocol.PresenceAway, protocol.PresenceBusy:
+		state = args[0]
+		text = args[1:]
+	}
+	if err := ec.SetPresence(state, strings.Join(text, " ")); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("You are %s\n", ec.DescribePresence(ec.identity.ID))
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"encoding/hex"
+	"fmt"
+	"p2p-chat-app/internal/protocol"
+	"testing"
+	"time"
+)
+
+// signedPresence signs a presence for ec's user, updated at.
+func signedPresence(t *testing.T, ec *EnhancedChat, state string, at time.Time) protocol.Presence {
+	t.Helper()
+	key, err := ec.identity.ExportPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := protocol.Presence{UserID: ec.identity.ID, UserKey: key, State: state, UpdatedAt: at}
+	data, err := presenceSignedBytes(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ec.identity.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Signature = hex.EncodeToString(signature)
+	return p
+}
+
+func TestMergePresence(t *testing.T) {
+	bob := newTestChat(t, "bob")
+	mallory := newTestChat(t, "mallory")
+	stranger := newTestChat(t, "stranger")
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		presence func() protocol.Presence
+		ok       bool
+		kept     bool
+	}{
+		{"signed", func() protocol.Presence { return signedPresence(t, bob, protocol.PresenceAway, now) }, true, true},
+		{"unsigned", func() protocol.Presence {
+			p := signedPresence(t, bob, protocol.PresenceAway, now)
+			p.Signature = ""
+			return p
+		}, false, false},
+		{"tampered status", func() protocol.Presence {
+			p := signedPresence(t, bob, protocol.PresenceAway, now)
+			p.Status = "gone fishing"
+			return p
+		}, false, false},
+		{"signed by someone claiming bob", func() protocol.Presence {
+			p := signedPresence(t, mallory, protocol.PresenceAway, now)
+			p.UserID = bob.identity.ID
+			return p
+		}, false, false},
+		{"unknown state", func() protocol.Presence { return signedPresence(t, bob, "asleep", now) }, false, false},
+		{"expired", func() protocol.Presence {
+			return signedPresence(t, bob, protocol.PresenceAway, now.Add(-presenceTTL-time.Minute))
+		}, true, false},
+		{"from the future", func() protocol.Presence {
+			return signedPresence(t, bob, protocol.PresenceAway, now.Add(maxClockSkew+time.Minute))
+		}, true, false},
+		{"nobody we share a room with", func() protocol.Presence { return signedPresence(t, stranger, protocol.PresenceAway, now) }, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			alice.mu.Lock()
+			alice.addMemberLocked(defaultRoom, bob.identity.ID)
+			alice.mu.Unlock()
+
+			p := tt.presence()
+			added, err := alice.mergePresence([]protocol.Presence{p})
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+			if kept := len(added) == 1; kept != tt.kept {
+				t.Fatalf("kept = %v, want %v", kept, tt.kept)
+			}
+			if away := alice.PresenceOf(p.UserID).State == protocol.PresenceAway; away != tt.kept {
+				t.Fatalf("shown away = %v, want %v", away, tt.kept)
+			}
+		})
+	}
+}
+
+func TestMergePresenceCap(t *testing.T) {
+	alice := newTestChat(t, "alice")
+	bob := newTestChat(t, "bob")
+	alice.mu.Lock()
+	alice.addMemberLocked(defaultRoom, bob.identity.ID)
+	for i := 0; len(alice.presence) < maxKnownPresence; i++ {
+		userID := fmt.Sprint("user", i)
+		alice.addMemberLocked(defaultRoom, userID)
+		alice.presence[userID] = protocol.Presence{UserID: userID, State: protocol.PresenceOnline, UpdatedAt: time.Now()}
+	}
+	alice.mu.Unlock()
+
+	added, err := alice.mergePresence([]protocol.Presence{signedPresence(t, bob, protocol.PresenceAway, time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 {
+		t.Fatal("kept a presence past the cap")
+	}
+}
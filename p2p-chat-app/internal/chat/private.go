@@ -0,0 +1,599 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"p2p-chat-app/internal/encryption"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RoomMode string
+
+const (
+	ModePublic   RoomMode = "public"
+	ModeInvite   RoomMode = "invite"
+	ModePassword RoomMode = "password"
+)
+
+const (
+	// roomKeyIterations slows down guessing a room password
+	roomKeyIterations = 100000
+	defaultInviteTTL  = 24 * time.Hour
+)
+
+// errNoRoomKey is why we can't check an admit to a password room whose
+// password we don't know.
+var errNoRoomKey = errors.New("room key unknown")
+
+// Rooms other than public ones only take members who are admitted: the
+// joiner signs an admit action carrying an invite token, or for password
+// rooms a proof that they know the room key derived from the password.
+// Admissions go in the room's moderation log like everything else, so every
+// member checks them the same way, invite use limits included.
+//
+// Members of a password room also encrypt what they say in it with the room
+// key, so only those who know the password can read it. Peers that don't
+// know the key keep the admits they can't check until they learn it.
+
+// deriveRoomKey stretches password into the key of room with PBKDF2.
+func deriveRoomKey(room, password string) []byte {
+	return pbkdf2SHA256([]byte(password), []byte("p2pchat room "+room), roomKeyIterations)
+}
+
+// pbkdf2SHA256 is PBKDF2 with HMAC-SHA256 giving a 32 byte key.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	// one block is all a 32 byte key needs
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// admitProof proves to the members of a password room that userID knows
+// its key.
+func admitProof(key []byte, userID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("admit " + userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func inviteSignedBytes(invite *protocol.RoomInvite) ([]byte, error) {
+	unsigned := *invite
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+// EncodeInvite turns an invite into the token users pass around.
+func EncodeInvite(invite *protocol.RoomInvite) (string, error) {
+	data, err := json.Marshal(invite)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeInvite parses and verifies an invite token. Whether its inviter may
+// invite to the room is up to the room's log.
+func DecodeInvite(token string) (*protocol.RoomInvite, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("not an invite token")
+	}
+	var invite protocol.RoomInvite
+	if err := json.Unmarshal(data, &invite); err != nil {
+		return nil, fmt.Errorf("not an invite token")
+	}
+
+	signature, err := hex.DecodeString(invite.Signature)
+	if err != nil || len(signature) == 0 {
+		return nil, fmt.Errorf("invite is not signed")
+	}
+	signed, err := inviteSignedBytes(&invite)
+	if err != nil {
+		return nil, err
+	}
+	if err := identity.VerifyFrom(invite.Inviter, invite.InviterKey, signed, signature); err != nil {
+		return nil, fmt.Errorf("bad signature on invite: %v", err)
+	}
+	return &invite, nil
+}
+
+// CompactInvite drops the inviter's key from token to keep invite links
+// short. The link pins that key and the connection it makes delivers it.
+func CompactInvite(token string) (string, error) {
+	invite, err := DecodeInvite(token)
+	if err != nil {
+		return "", err
+	}
+	invite.InviterKey = ""
+	return EncodeInvite(invite)
+}
+
+// ExpandInvite puts the inviter's key back into a compacted token and
+// verifies the result.
+func ExpandInvite(token, inviterKey string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("not an invite token")
+	}
+	var invite protocol.RoomInvite
+	if err := json.Unmarshal(data, &invite); err != nil {
+		return "", fmt.Errorf("not an invite token")
+	}
+	if invite.InviterKey == "" {
+		invite.InviterKey = inviterKey
+	}
+	expanded, err := EncodeInvite(&invite)
+	if err != nil {
+		return "", err
+	}
+	if _, err := DecodeInvite(expanded); err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// checkAdmit reports why a may not admit its actor to the room.
+func (acl *roomACL) checkAdmit(a *protocol.RoomAction) error {
+	switch RoomMode(acl.mode) {
+	case ModeInvite:
+		invite, err := DecodeInvite(a.Token)
+		if err != nil {
+			return err
+		}
+		switch {
+		case invite.Room != a.Room:
+			return fmt.Errorf("invite is for %s", invite.Room)
+		case !acl.moderator(invite.Inviter):
+			return fmt.Errorf("%w: %s can't invite to %s", errNotAllowed, invite.Inviter, a.Room)
+		case invite.Invitee != "" && invite.Invitee != a.Actor:
+			return fmt.Errorf("invite is for %s", invite.Invitee)
+		case acl.at(a).After(invite.Expires):
+			return fmt.Errorf("invite expired at %s", invite.Expires.Format(time.RFC3339))
+		case invite.MaxUses > 0 && acl.uses[invite.Nonce] >= invite.MaxUses:
+			return fmt.Errorf("invite has been used up")
+		}
+	case ModePassword:
+		// only members know the key; the rest keep the admit until they do
+		if acl.key == nil {
+			return errNoRoomKey
+		}
+		if !hmac.Equal([]byte(a.Proof), []byte(admitProof(acl.key, a.Actor))) {
+			return fmt.Errorf("wrong password for %s", a.Room)
+		}
+	}
+	return nil
+}
+
+// unverifiable reports whether a is an admit to a password room whose key
+// we don't know.
+func (acl *roomACL) unverifiable(a *protocol.RoomAction) bool {
+	return a.Action == protocol.ActionAdmit && RoomMode(acl.mode) == ModePassword && acl.key == nil
+}
+
+// checkKey reports whether key is the wrong one for the room, as far as
+// the admits in its log can tell.
+func (acl *roomACL) checkKey(room string, key []byte) error {
+	if acl.key != nil {
+		if !hmac.Equal(acl.key, key) {
+			return fmt.Errorf("wrong password for %s", room)
+		}
+		return nil
+	}
+	checked := false
+	for _, actions := range [][]protocol.RoomAction{acl.actions, acl.pending} {
+		for _, a := range actions {
+			if a.Action != protocol.ActionAdmit || a.Proof == "" {
+				continue
+			}
+			if hmac.Equal([]byte(a.Proof), []byte(admitProof(key, a.Actor))) {
+				return nil
+			}
+			checked = true
+		}
+	}
+	if checked {
+		return fmt.Errorf("wrong password for %s", room)
+	}
+	return nil
+}
+
+func (acl *roomACL) admit(a *protocol.RoomAction) {
+	acl.admitted[a.Actor] = true
+	if a.Token == "" {
+		return
+	}
+	if invite, err := DecodeInvite(a.Token); err == nil {
+		acl.uses[invite.Nonce]++
+	}
+}
+
+// allowed reports whether userID may be in the room.
+func (acl *roomACL) allowed(userID string) bool {
+	if acl.banned(userID) {
+		return false
+	}
+	return RoomMode(acl.mode) == ModePublic || acl.mode == "" ||
+		acl.admitted[userID] || acl.role(userID) != RoleMember
+}
+
+// allowedLocked reports whether userID may be in room. Callers hold ec.mu.
+func (ec *EnhancedChat) allowedLocked(room, userID string) bool {
+	acl, exists := ec.acls[room]
+	return !exists || acl.allowed(userID)
+}
+
+// publicLocked reports whether room may be listed in the directory. A room
+// we joined with a credential is taken to be private even before we have
+// its log. Callers hold ec.mu.
+func (ec *EnhancedChat) publicLocked(room string) bool {
+	acl, exists := ec.acls[room]
+	if !exists {
+		return true
+	}
+	return (acl.mode == "" || RoomMode(acl.mode) == ModePublic) && acl.key == nil && len(acl.admitted) == 0
+}
+
+// roomKeyLocked returns the key of a password room we know the password
+// of. Callers hold ec.mu.
+func (ec *EnhancedChat) roomKeyLocked(room string) []byte {
+	if acl, exists := ec.acls[room]; exists {
+		return acl.key
+	}
+	return nil
+}
+
+// setRoomKey remembers the key of room, or forgets it if nil, and checks
+// the log against it, taking in the admits that waited for it.
+func (ec *EnhancedChat) setRoomKey(room string, key []byte) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	acl, exists := ec.acls[room]
+	if !exists {
+		acl = newRoomACL()
+		ec.acls[room] = acl
+	}
+	acl.key = key
+	acl.replay()
+	acl.prune()
+	if key != nil {
+		pending := acl.pending
+		acl.pending = nil
+		acl.add(pending, time.Now())
+	}
+}
+
+// CreateRoom creates room in mode and joins it as its owner. Password rooms
+// need a password; the others ignore it.
+func (ec *EnhancedChat) CreateRoom(room string, mode RoomMode, password string) error {
+	if room == "" || len(room) > maxRoomName {
+		return fmt.Errorf("room names are 1 to %d bytes", maxRoomName)
+	}
+	switch mode {
+	case ModePublic, ModeInvite:
+	case ModePassword:
+		if password == "" {
+			return fmt.Errorf("password rooms need a password")
+		}
+	default:
+		return fmt.Errorf("unknown room mode %q", mode)
+	}
+
+	ec.mu.RLock()
+	_, moderated := ec.acls[room]
+	known := len(ec.rooms[room]) > 0 || ec.directory[room].Name != "" || room == defaultRoom
+	ec.mu.RUnlock()
+	if moderated || known {
+		return fmt.Errorf("room %s already exists", room)
+	}
+
+	if mode == ModePassword {
+		ec.setRoomKey(room, deriveRoomKey(room, password))
+	}
+	if err := ec.moderate(protocol.RoomAction{Room: room, Action: protocol.ActionCreate, Mode: string(mode)}); err != nil {
+		return err
+	}
+	return ec.Subscribe(room)
+}
+
+// Invite issues a token letting invitee, or anyone if it is empty, into
+// room. It expires after ttl, the default if zero, and works maxUses times,
+// any number if zero. A named invitee is sent the token directly.
+func (ec *EnhancedChat) Invite(room, invitee string, ttl time.Duration, maxUses int) (string, error) {
+	ec.mu.RLock()
+	acl, exists := ec.acls[room]
+	canInvite := exists && acl.moderator(ec.identity.ID)
+	mode := RoomMode("")
+	if exists {
+		mode = RoomMode(acl.mode)
+	}
+	ec.mu.RUnlock()
+	if mode != ModeInvite {
+		return "", fmt.Errorf("%s is not invite-only", room)
+	}
+	if !canInvite {
+		return "", fmt.Errorf("%w: only admins can invite to %s", errNotAllowed, room)
+	}
+	if ttl <= 0 {
+		ttl = defaultInviteTTL
+	}
+
+	key, err := ec.identity.ExportPublicKey()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	invite := &protocol.RoomInvite{
+		Room:       room,
+		Inviter:    ec.identity.ID,
+		InviterKey: key,
+		Invitee:    invitee,
+		Expires:    time.Now().Add(ttl),
+		MaxUses:    maxUses,
+		Nonce:      hex.EncodeToString(nonce),
+	}
+	signed, err := inviteSignedBytes(invite)
+	if err != nil {
+		return "", err
+	}
+	signature, err := ec.identity.Sign(signed)
+	if err != nil {
+		return "", err
+	}
+	invite.Signature = hex.EncodeToString(signature)
+	token, err := EncodeInvite(invite)
+	if err != nil {
+		return "", err
+	}
+
+	if invitee != "" {
+		text := fmt.Sprintf("🎟️ You are invited to %s: /join %s %s", room, room, token)
+		if err := ec.sendText(text, "", invitee); err != nil {
+			fmt.Printf("Error sending invite to %s: %v\n", invitee, err)
+		}
+	}
+	return token, nil
+}
+
+// SubscribeWith joins a room that isn't public, with an invite token or the
+// room password as credential.
+func (ec *EnhancedChat) SubscribeWith(room, credential string) error {
+	if credential == "" {
+		return ec.Subscribe(room)
+	}
+
+	admit := protocol.RoomAction{Room: room, Action: protocol.ActionAdmit}
+	inviter := ""
+	var key []byte
+	if invite, err := DecodeInvite(credential); err == nil {
+		if invite.Room != room {
+			return fmt.Errorf("invite is for %s", invite.Room)
+		}
+		admit.Token = credential
+		inviter = invite.Inviter
+	} else {
+		key = deriveRoomKey(room, credential)
+		ec.mu.RLock()
+		acl, exists := ec.acls[room]
+		if exists {
+			err = acl.checkKey(room, key)
+		}
+		ec.mu.RUnlock()
+		if exists && err != nil {
+			return err
+		}
+		admit.Proof = admitProof(key, ec.identity.ID)
+	}
+
+	signed, err := ec.signAction(admit)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		// our own admit needs the key to check out
+		ec.mu.RLock()
+		previous := ec.roomKeyLocked(room)
+		ec.mu.RUnlock()
+		ec.setRoomKey(room, key)
+		defer func() {
+			if err != nil {
+				ec.setRoomKey(room, previous)
+			}
+		}()
+	}
+	if _, err = ec.mergeActions(room, []protocol.RoomAction{signed}); err != nil {
+		return err
+	}
+
+	ec.mu.Lock()
+	if !ec.allowedLocked(room, ec.identity.ID) {
+		ec.mu.Unlock()
+		err = fmt.Errorf("not admitted to %s", room)
+		return err
+	}
+	joined := ec.rooms[room][ec.identity.ID]
+	ec.addMemberLocked(room, ec.identity.ID)
+	ec.mu.Unlock()
+
+	if !joined {
+		go ec.sendAdmission(room, inviter, signed)
+	}
+	return nil
+}
+
+// sendAdmission sends our join to room with the admit that lets us in, so
+// members can check it. The room is private, so the join only goes to the
+// members we know of and whoever invited us, who pass the admit on.
+func (ec *EnhancedChat) sendAdmission(room, inviter string, admit protocol.RoomAction) {
+	recipients := []string{""}
+	ec.mu.RLock()
+	known := len(ec.rooms[room]) > 1
+	if inviter != "" && inviter != ec.identity.ID && !ec.rooms[room][inviter] {
+		recipients = append(recipients, inviter)
+		if _, connected := ec.peers[inviter]; connected {
+			known = true
+		}
+	}
+	ec.mu.RUnlock()
+	if !known {
+		fmt.Printf("No members of %s are connected to hear of your admission yet\n", room)
+	}
+
+	for _, to := range recipients {
+		msg := &protocol.Message{
+			ID:        protocol.GenerateMessageID(),
+			Type:      protocol.JoinMessage,
+			From:      ec.identity.ID,
+			To:        to,
+			Room:      room,
+			Timestamp: time.Now(),
+			Actions:   []protocol.RoomAction{admit},
+		}
+		if err := ec.broadcastMessage(msg); err != nil {
+			fmt.Printf("Error sending join for %s: %v\n", room, err)
+		}
+	}
+}
+
+// JoinRoomWith joins room with a credential as SubscribeWith does and gives
+// it focus.
+func (ec *EnhancedChat) JoinRoomWith(roomName, credential string) {
+	if err := ec.SubscribeWith(roomName, credential); err != nil {
+		fmt.Printf("Error joining room: %v\n", err)
+		return
+	}
+	ec.SwitchRoom(roomName)
+
+	fmt.Printf("📋 Joined room: %s\n", roomName)
+
+	ec.displayRecentMessages(roomName)
+}
+
+// sealContent encrypts msg's content with its room's key if the room has
+// a password.
+func (ec *EnhancedChat) sealContent(msg *protocol.Message) error {
+	ec.mu.RLock()
+	key := ec.roomKeyLocked(msg.Room)
+	ec.mu.RUnlock()
+	if msg.Room == "" || key == nil {
+		return nil
+	}
+
+	sealed, err := encryption.Encrypt([]byte(msg.Content), key)
+	if err != nil {
+		return err
+	}
+	msg.Content = sealed
+	msg.Encrypted = true
+	// who is mentioned would give away what was said
+	msg.Mentions = nil
+	return nil
+}
+
+// openContent decrypts content sealed with a room key.
+func (ec *EnhancedChat) openContent(msg *protocol.Message) error {
+	if !msg.Encrypted || msg.Room == "" {
+		return nil
+	}
+	ec.mu.RLock()
+	key := ec.roomKeyLocked(msg.Room)
+	ec.mu.RUnlock()
+	if key == nil {
+		return fmt.Errorf("no key for %s", msg.Room)
+	}
+
+	content, err := encryption.Decrypt(msg.Content, key)
+	if err != nil {
+		return err
+	}
+	msg.Content = string(content)
+	msg.Encrypted = false
+	return nil
+}
+
+// handleCreateCommand runs /create <room> [--private|--password <pw>].
+func (ec *EnhancedChat) handleCreateCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: /create <room_name> [--private|--password <password>]")
+		return
+	}
+
+	mode, password := ModePublic, ""
+	if len(args) > 1 {
+		switch args[1] {
+		case "--private":
+			mode = ModeInvite
+		case "--password":
+			mode = ModePassword
+			password = strings.Join(args[2:], " ")
+		default:
+			fmt.Println("Usage: /create <room_name> [--private|--password <password>]")
+			return
+		}
+	}
+
+	if err := ec.CreateRoom(args[0], mode, password); err != nil {
+		fmt.Printf("Error creating room: %v\n", err)
+		return
+	}
+	ec.SwitchRoom(args[0])
+	fmt.Printf("🏠 Created %s room %s\n", mode, args[0])
+}
+
+// handleInviteCommand runs /invite <user|*> [duration] [uses] for the
+// current room.
+func (ec *EnhancedChat) handleInviteCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: /invite <user_id|*> [duration] [uses]")
+		return
+	}
+
+	invitee := ec.resolveUser(args[0])
+	if invitee == "*" {
+		invitee = ""
+	}
+	var ttl time.Duration
+	maxUses := 1
+	if invitee == "" {
+		maxUses = 0
+	}
+	for _, arg := range args[1:] {
+		if d, err := time.ParseDuration(arg); err == nil {
+			ttl = d
+		} else if n, err := strconv.Atoi(arg); err == nil {
+			maxUses = n
+		}
+	}
+
+	room := ec.CurrentRoom()
+	token, err := ec.Invite(room, invitee, ttl, maxUses)
+	if err != nil {
+		fmt.Printf("Error creating invite: %v\n", err)
+		return
+	}
+	fmt.Printf("🎟️ Invite to %s: /join %s %s\n", room, room, token)
+}
@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"encoding/hex"
+	"p2p-chat-app/internal/protocol"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations))
+		if got != tt.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+
+	if got := hex.EncodeToString(deriveRoomKey("secret", "hunter2")); got != "a576fc97a0c485479317555ecfd2a4be5a1829173765680b2ae56da4ec730c2e" {
+		t.Errorf("room key = %s", got)
+	}
+}
+
+// passwordRoom has bob create a password room that carol joined, and
+// returns its log.
+func passwordRoom(t *testing.T) ([]protocol.RoomAction, string) {
+	t.Helper()
+	bob := newTestChat(t, "bob")
+	carol := newTestChat(t, "carol")
+	if err := bob.CreateRoom("secret", ModePassword, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := carol.SubscribeWith("secret", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	bob.mu.RLock()
+	log := bob.actionsLocked("secret")
+	bob.mu.RUnlock()
+	carol.mu.RLock()
+	log = append(log, carol.actionsLocked("secret")...)
+	carol.mu.RUnlock()
+	return log, carol.identity.ID
+}
+
+func TestSubscribeWithPassword(t *testing.T) {
+	log, _ := passwordRoom(t)
+
+	tests := []struct {
+		name     string
+		password string
+		ok       bool
+	}{
+		{"right password", "hunter2", true},
+		{"wrong password", "hunter3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			if _, err := alice.mergeActions("secret", log); err != nil {
+				t.Fatal(err)
+			}
+			err := alice.SubscribeWith("secret", tt.password)
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+
+			alice.mu.RLock()
+			defer alice.mu.RUnlock()
+			if hasKey := alice.roomKeyLocked("secret") != nil; hasKey != tt.ok {
+				t.Errorf("key kept = %v, want %v", hasKey, tt.ok)
+			}
+			if joined := alice.rooms["secret"][alice.identity.ID]; joined != tt.ok {
+				t.Errorf("joined = %v, want %v", joined, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPendingAdmits(t *testing.T) {
+	log, carol := passwordRoom(t)
+	alice := newTestChat(t, "alice")
+	if _, err := alice.mergeActions("secret", log); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.mu.RLock()
+	acl := alice.acls["secret"]
+	admitted, pending := acl.allowed(carol), len(acl.pending)
+	alice.mu.RUnlock()
+	if admitted || pending != 1 {
+		t.Fatalf("without the key carol admitted = %v with %d pending", admitted, pending)
+	}
+
+	if err := alice.SubscribeWith("secret", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	alice.mu.RLock()
+	admitted, pending = acl.allowed(carol), len(acl.pending)
+	alice.mu.RUnlock()
+	if !admitted || pending != 0 {
+		t.Fatalf("with the key carol admitted = %v with %d pending", admitted, pending)
+	}
+}
+
+func TestInviteReceiptTime(t *testing.T) {
+	bob := newTestChat(t, "bob")
+	carol := newTestChat(t, "carol")
+	mallory := newTestChat(t, "mallory")
+	if err := bob.CreateRoom("club", ModeInvite, ""); err != nil {
+		t.Fatal(err)
+	}
+	bob.mu.RLock()
+	create := bob.actionsLocked("club")
+	bob.mu.RUnlock()
+
+	issued := time.Now()
+	expiring, err := bob.Invite("club", "", time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	once, err := bob.Invite("club", "", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	admit := func(ec *EnhancedChat, token string, at time.Time) protocol.RoomAction {
+		return signedAt(t, ec, protocol.RoomAction{Room: "club", Action: protocol.ActionAdmit, Token: token}, at)
+	}
+	tests := []struct {
+		name    string
+		batches [][]protocol.RoomAction
+		carol   bool
+		mallory bool
+	}{
+		{
+			name:    "backdated to before expiry",
+			batches: [][]protocol.RoomAction{create, {admit(mallory, expiring, issued)}},
+		},
+		{
+			name:    "synced with the room's log",
+			batches: [][]protocol.RoomAction{append(create, admit(mallory, expiring, issued))},
+			mallory: true,
+		},
+		{
+			name:    "backdated ahead of the last use",
+			batches: [][]protocol.RoomAction{create, {admit(carol, once, time.Now())}, {admit(mallory, once, issued)}},
+			carol:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			for _, batch := range tt.batches {
+				if _, err := alice.mergeActions("club", batch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			alice.mu.RLock()
+			defer alice.mu.RUnlock()
+			acl := alice.acls["club"]
+			if got := acl.allowed(carol.identity.ID); got != tt.carol {
+				t.Errorf("carol admitted = %v, want %v", got, tt.carol)
+			}
+			if got := acl.allowed(mallory.identity.ID); got != tt.mallory {
+				t.Errorf("mallory admitted = %v, want %v", got, tt.mallory)
+			}
+		})
+	}
+}
@@ -0,0 +1,437 @@
+package chat
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxEmoji caps a reaction in bytes; some emoji take several code points
+	maxEmoji = 32
+	// maxReactions caps how many different emoji one user puts on a message
+	maxReactions = 20
+)
+
+// A reaction is sent to the conversation of the message it is on, like a
+// message would be, and signed by the user who reacted. Peers apply it to
+// their stored copy of the message, which keeps who reacted with what and
+// when each reaction last changed; a reaction to a message they don't have
+// is dropped, and so is one no newer than the last change, so relaying an
+// old one doesn't undo what came after. Reacting twice with the same emoji
+// takes the reaction back.
+
+// ReactRequest toggles our Emoji on the message MessageID as the APIs
+// receive it.
+type ReactRequest struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionCount is how many users reacted to a message with Emoji.
+type ReactionCount struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+	Mine  bool     `json:"mine"`
+}
+
+const (
+	zeroWidthJoiner = 0x200D
+	variationEmoji  = 0xFE0F
+	keycap          = 0x20E3
+	blackFlag       = 0x1F3F4
+	cancelTag       = 0xE007F
+)
+
+// pictographs are the code point ranges emoji are drawn from, regional
+// indicators aside.
+var pictographs = []struct{ lo, hi rune }{
+	{0x00A9, 0x00A9}, {0x00AE, 0x00AE}, {0x203C, 0x203C}, {0x2049, 0x2049},
+	{0x2122, 0x2122}, {0x2139, 0x2139}, {0x2194, 0x2199}, {0x21A9, 0x21AA},
+	{0x231A, 0x231B}, {0x2328, 0x2328}, {0x23CF, 0x23CF}, {0x23E9, 0x23F3},
+	{0x23F8, 0x23FA}, {0x24C2, 0x24C2}, {0x25AA, 0x25AB}, {0x25B6, 0x25B6},
+	{0x25C0, 0x25C0}, {0x25FB, 0x25FE}, {0x2600, 0x27BF}, {0x2934, 0x2935},
+	{0x2B05, 0x2B07}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55},
+	{0x3030, 0x3030}, {0x303D, 0x303D}, {0x3297, 0x3297}, {0x3299, 0x3299},
+	{0x1F000, 0x1F1E5}, {0x1F200, 0x1FAFF},
+}
+
+func isPictograph(r rune) bool {
+	for _, p := range pictographs {
+		if r >= p.lo && r <= p.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isSkinTone(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+func isTag(r rune) bool {
+	return r >= 0xE0020 && r <= 0xE007E
+}
+
+// validEmoji reports whether emoji is a single emoji: a pictograph with
+// its variation selector and skin tone, a flag, a keycap, or a sequence of
+// those joined by zero width joiners.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmoji {
+		return false
+	}
+	runes := []rune(emoji)
+	for i := 0; ; i++ {
+		n := emojiElement(runes[i:])
+		if n == 0 {
+			return false
+		}
+		if i += n; i == len(runes) {
+			return true
+		}
+		if runes[i] != zeroWidthJoiner {
+			return false
+		}
+	}
+}
+
+// emojiElement returns how many runes the emoji r starts with takes, or 0
+// if r doesn't start with one.
+func emojiElement(r []rune) int {
+	switch {
+	case len(r) == 0:
+		return 0
+	case isRegionalIndicator(r[0]):
+		if len(r) > 1 && isRegionalIndicator(r[1]) {
+			return 2
+		}
+		return 0
+	case r[0] >= '0' && r[0] <= '9' || r[0] == '#' || r[0] == '*':
+		n := 1
+		if n < len(r) && r[n] == variationEmoji {
+			n++
+		}
+		if n < len(r) && r[n] == keycap {
+			return n + 1
+		}
+		return 0
+	case !isPictograph(r[0]):
+		return 0
+	}
+
+	n := 1
+	if n < len(r) && r[n] == variationEmoji {
+		n++
+	}
+	if n < len(r) && isSkinTone(r[n]) {
+		n++
+	}
+	// a black flag followed by tags is the flag of a region, like England
+	if r[0] == blackFlag {
+		end := n
+		for end < len(r) && isTag(r[end]) {
+			end++
+		}
+		if end > n && end < len(r) && r[end] == cancelTag {
+			n = end + 1
+		}
+	}
+	return n
+}
+
+// reactionsBy counts the different emoji userID put on msg, including
+// those taken back, which are remembered so they can't be replayed.
+func reactionsBy(msg *protocol.Message, userID string) int {
+	emoji := make(map[string]bool)
+	for e, users := range msg.Reactions {
+		for _, user := range users {
+			if user == userID {
+				emoji[e] = true
+			}
+		}
+	}
+	for reaction := range msg.ReactedAt {
+		if e := strings.TrimPrefix(reaction, protocol.ReactionKey(userID, "")); e != reaction {
+			emoji[e] = true
+		}
+	}
+	return len(emoji)
+}
+
+// reactedWith reports whether userID ever reacted to msg with emoji.
+func reactedWith(msg *protocol.Message, userID, emoji string) bool {
+	_, exists := msg.ReactedAt[protocol.ReactionKey(userID, emoji)]
+	return exists
+}
+
+// React adds our emoji to the message in req, or takes it back if we had
+// reacted with it, and tells the message's conversation. It reports
+// whether the reaction is now there.
+func (ec *EnhancedChat) React(req ReactRequest) (bool, error) {
+	if !validEmoji(req.Emoji) {
+		return false, fmt.Errorf("invalid emoji %q", req.Emoji)
+	}
+	key, msg, found := ec.storage.FindMessage(req.MessageID)
+	if !found {
+		return false, fmt.Errorf("no message %s", req.MessageID)
+	}
+
+	wire := &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.ReactionMessage,
+		From:      ec.identity.ID,
+		Timestamp: time.Now(),
+	}
+	if msg.Room != "" {
+		ec.mu.RLock()
+		joined := ec.rooms[msg.Room][ec.identity.ID]
+		silenced := ec.silencedLocked(msg.Room, ec.identity.ID)
+		ec.mu.RUnlock()
+		if !joined || silenced {
+			return false, fmt.Errorf("you can't post in %s", msg.Room)
+		}
+		wire.Room = msg.Room
+	} else if wire.To = ec.otherParty(key); wire.To == "" {
+		return false, fmt.Errorf("can't react to message %s", req.MessageID)
+	}
+
+	removed := false
+	for _, userID := range msg.Reactions[req.Emoji] {
+		if userID == ec.identity.ID {
+			removed = true
+		}
+	}
+	if !removed && !reactedWith(msg, ec.identity.ID, req.Emoji) && reactionsBy(msg, ec.identity.ID) >= maxReactions {
+		return false, fmt.Errorf("you already used %d different emoji on that message", maxReactions)
+	}
+	r, err := ec.signReaction(protocol.Reaction{
+		MessageID: msg.ID,
+		Emoji:     req.Emoji,
+		Removed:   removed,
+	})
+	if err != nil {
+		return false, err
+	}
+	if _, err := ec.storage.React(key, msg.ID, ec.identity.ID, r.Emoji, r.Removed, r.Timestamp); err != nil {
+		return false, err
+	}
+	ec.Touch()
+
+	wire.Reaction = &r
+	return !removed, ec.broadcastMessage(wire)
+}
+
+func reactionSignedBytes(r *protocol.Reaction) ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+// signReaction fills in us as the user reacting in r and signs it.
+func (ec *EnhancedChat) signReaction(r protocol.Reaction) (protocol.Reaction, error) {
+	key, err := ec.identity.ExportPublicKey()
+	if err != nil {
+		return r, err
+	}
+	r.Reactor = ec.identity.ID
+	r.ReactorKey = key
+	r.Timestamp = time.Now()
+	data, err := reactionSignedBytes(&r)
+	if err != nil {
+		return r, err
+	}
+	signature, err := ec.identity.Sign(data)
+	if err != nil {
+		return r, err
+	}
+	r.Signature = hex.EncodeToString(signature)
+	return r, nil
+}
+
+func verifyReaction(r *protocol.Reaction) error {
+	signature, err := hex.DecodeString(r.Signature)
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("reaction by %s is not signed", r.Reactor)
+	}
+	data, err := reactionSignedBytes(r)
+	if err != nil {
+		return err
+	}
+	if err := identity.VerifyFrom(r.Reactor, r.ReactorKey, data, signature); err != nil {
+		return fmt.Errorf("bad signature on reaction by %s: %v", r.Reactor, err)
+	}
+	return nil
+}
+
+// handleReaction applies a reaction from a peer to our copy of the message.
+func (ec *EnhancedChat) handleReaction(msg *protocol.Message) error {
+	r := msg.Reaction
+	if r == nil || r.Reactor != msg.From {
+		return fmt.Errorf("reaction from %s is not theirs", msg.From)
+	}
+	if !validEmoji(r.Emoji) {
+		return fmt.Errorf("invalid emoji in reaction from %s", msg.From)
+	}
+	if time.Until(r.Timestamp) > maxClockSkew {
+		return fmt.Errorf("reaction from %s is in the future", msg.From)
+	}
+	if err := verifyReaction(r); err != nil {
+		return err
+	}
+
+	key, ours := ec.peerConversation(msg)
+	if !ours {
+		return nil
+	}
+	if target, found := ec.storage.Message(key, r.MessageID); found && !reactedWith(target, r.Reactor, r.Emoji) && reactionsBy(target, r.Reactor) >= maxReactions {
+		return fmt.Errorf("%s used more than %d different emoji on %s", msg.From, maxReactions, r.MessageID)
+	}
+	changed, err := ec.storage.React(key, r.MessageID, r.Reactor, r.Emoji, r.Removed, r.Timestamp)
+	if err != nil || !changed {
+		// most likely a message from before we joined
+		return nil
+	}
+
+	ec.mu.RLock()
+	focused := msg.Room == "" || msg.Room == ec.currentRoom
+	ec.mu.RUnlock()
+	if focused {
+		select {
+		case ec.incoming <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+// Reactions counts the reactions on the message id, most popular first.
+func (ec *EnhancedChat) Reactions(id string) ([]ReactionCount, error) {
+	_, msg, found := ec.storage.FindMessage(id)
+	if !found {
+		return nil, fmt.Errorf("no message %s", id)
+	}
+	return ec.reactionCounts(msg), nil
+}
+
+func (ec *EnhancedChat) reactionCounts(msg *protocol.Message) []ReactionCount {
+	counts := []ReactionCount{}
+	for emoji, users := range msg.Reactions {
+		c := ReactionCount{Emoji: emoji, Count: len(users), Users: users}
+		for _, userID := range users {
+			if userID == ec.identity.ID {
+				c.Mine = true
+			}
+		}
+		counts = append(counts, c)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Emoji < counts[j].Emoji
+	})
+	return counts
+}
+
+// reactionSummary formats the reactions on msg for the terminal, e.g.
+// " [👍 2 ❤️ 1]", or "" if there are none.
+func (ec *EnhancedChat) reactionSummary(msg *protocol.Message) string {
+	counts := ec.reactionCounts(msg)
+	if len(counts) == 0 {
+		return ""
+	}
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		parts[i] = fmt.Sprintf("%s %d", c.Emoji, c.Count)
+	}
+	return " [" + strings.Join(parts, " ") + "]"
+}
+
+func (ec *EnhancedChat) displayReaction(msg *protocol.Message) {
+	r := msg.Reaction
+	key, _ := ec.peerConversation(msg)
+	target, found := ec.storage.Message(key, r.MessageID)
+	if !found {
+		return
+	}
+	preview := []rune(target.Content)
+	if len(preview) > 30 {
+		preview = append(preview[:30], '…')
+	}
+	verb := "reacted " + r.Emoji + " to"
+	if r.Removed {
+		verb = "took back " + r.Emoji + " on"
+	}
+	fmt.Printf("\r%s %s %s %q%s\n> ", r.Emoji, ec.displayName(r.Reactor), verb, string(preview), ec.reactionSummary(target))
+}
+
+// resolveMessageID turns what was typed in /react into a message ID: a
+// full ID, or the end of one in the current room as long as only one
+// message matches.
+func (ec *EnhancedChat) resolveMessageID(typed string) (string, error) {
+	if _, _, found := ec.storage.FindMessage(typed); found {
+		return typed, nil
+	}
+	messages, err := ec.storage.GetMessages(storage.RoomKey(ec.CurrentRoom()), 0)
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, msg := range messages {
+		if strings.HasSuffix(msg.ID, typed) {
+			matches = append(matches, msg.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no message %s in %s", typed, ec.CurrentRoom())
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%s matches %d messages, give more of the ID", typed, len(matches))
+	}
+}
+
+// handleReactCommand runs /react <msgid> <emoji>, or lists the recent
+// messages of the current room with their IDs.
+func (ec *EnhancedChat) handleReactCommand(args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: /react <message_id> <emoji>")
+		messages, err := ec.storage.GetMessages(storage.RoomKey(ec.CurrentRoom()), 5)
+		if err != nil || len(messages) == 0 {
+			return
+		}
+		fmt.Println("Recent messages:")
+		for _, msg := range messages {
+			fmt.Printf("  %s %s: %s%s\n", msg.ID, ec.displayName(msg.From), msg.Content, ec.reactionSummary(msg))
+		}
+		return
+	}
+
+	id, err := ec.resolveMessageID(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	added, err := ec.React(ReactRequest{MessageID: id, Emoji: args[1]})
+	if err != nil {
+		fmt.Printf("Error reacting: %v\n", err)
+		return
+	}
+	if added {
+		fmt.Printf("%s Reacted to %s\n", args[1], id)
+	} else {
+		fmt.Printf("Took back %s on %s\n", args[1], id)
+	}
+}
@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"encoding/hex"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		valid bool
+	}{
+		{"👍", true},
+		{"❤️", true},
+		{"👍🏽", true},
+		{"🇳🇱", true},
+		{"1️⃣", true},
+		{"#⃣", true},
+		{"👩‍💻", true},
+		{"👨‍👩‍👧‍👦", true},
+		{"🏳️‍🌈", true},
+		{"🏴\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F", true},
+		{"", false},
+		{"lol", false},
+		{"a", false},
+		{"1", false},
+		{"🇳", false},
+		{"👍👍", false},
+		{"👍 ", false},
+		{"👩‍", false},
+		{"‍👩", false},
+		{"👍\n", false},
+		{"👨‍👩‍👧‍👦‍👨‍👩‍👧‍👦", false},
+	}
+	for _, tt := range tests {
+		if got := validEmoji(tt.emoji); got != tt.valid {
+			t.Errorf("validEmoji(%q) = %v, want %v", tt.emoji, got, tt.valid)
+		}
+	}
+}
+
+// signedReaction signs r as ec's user, dated at.
+func signedReaction(t *testing.T, ec *EnhancedChat, r protocol.Reaction, at time.Time) protocol.Reaction {
+	t.Helper()
+	r, err := ec.signReaction(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Timestamp = at
+	data, err := reactionSignedBytes(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ec.identity.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Signature = hex.EncodeToString(signature)
+	return r
+}
+
+// reactionTarget stores a message in the default room for ec to react to.
+func reactionTarget(t *testing.T, ec *EnhancedChat) *protocol.Message {
+	t.Helper()
+	msg := &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.TextMessage,
+		From:      "carol",
+		Room:      defaultRoom,
+		Content:   "hello",
+		Timestamp: time.Now(),
+	}
+	if err := ec.storage.StoreMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func reactionMessage(from string, r protocol.Reaction) *protocol.Message {
+	return &protocol.Message{Type: protocol.ReactionMessage, From: from, Room: defaultRoom, Reaction: &r}
+}
+
+func TestHandleReaction(t *testing.T) {
+	bob := newTestChat(t, "bob")
+	mallory := newTestChat(t, "mallory")
+	now := time.Now()
+
+	// each case gets a thumbs up on the message to sign
+	tests := []struct {
+		name     string
+		reaction func(r protocol.Reaction) protocol.Reaction
+		ok       bool
+	}{
+		{"signed", func(r protocol.Reaction) protocol.Reaction { return signedReaction(t, bob, r, now) }, true},
+		{"unsigned", func(r protocol.Reaction) protocol.Reaction {
+			r = signedReaction(t, bob, r, now)
+			r.Signature = ""
+			return r
+		}, false},
+		{"tampered emoji", func(r protocol.Reaction) protocol.Reaction {
+			r = signedReaction(t, bob, r, now)
+			r.Emoji = "👎"
+			return r
+		}, false},
+		{"signed by someone claiming bob", func(r protocol.Reaction) protocol.Reaction {
+			r = signedReaction(t, mallory, r, now)
+			r.Reactor = bob.identity.ID
+			return r
+		}, false},
+		{"not an emoji", func(r protocol.Reaction) protocol.Reaction {
+			r.Emoji = "lol"
+			return signedReaction(t, bob, r, now)
+		}, false},
+		{"from the future", func(r protocol.Reaction) protocol.Reaction {
+			return signedReaction(t, bob, r, now.Add(maxClockSkew+time.Minute))
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			target := reactionTarget(t, alice)
+			r := tt.reaction(protocol.Reaction{MessageID: target.ID, Emoji: "👍"})
+			err := alice.handleReaction(reactionMessage(bob.identity.ID, r))
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+			stored, _ := alice.storage.Message(storage.RoomKey(defaultRoom), target.ID)
+			if reacted := reactionsBy(stored, bob.identity.ID) == 1; reacted != tt.ok {
+				t.Fatalf("reaction kept = %v, want %v", reacted, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReactionCap(t *testing.T) {
+	alice := newTestChat(t, "alice")
+	bob := newTestChat(t, "bob")
+	target := reactionTarget(t, alice)
+
+	for i := 0; i <= maxReactions; i++ {
+		r := signedReaction(t, bob, protocol.Reaction{MessageID: target.ID, Emoji: string(rune(0x1F600 + i))}, time.Now())
+		err := alice.handleReaction(reactionMessage(bob.identity.ID, r))
+		if full := i == maxReactions; full != (err != nil) {
+			t.Fatalf("reaction %d: got error %v", i+1, err)
+		}
+	}
+	stored, _ := alice.storage.Message(storage.RoomKey(defaultRoom), target.ID)
+	if got := reactionsBy(stored, bob.identity.ID); got != maxReactions {
+		t.Fatalf("bob has %d reactions, want %d", got, maxReactions)
+	}
+
+	// taking one back is still allowed
+	taken := signedReaction(t, bob, protocol.Reaction{MessageID: target.ID, Emoji: string(rune(0x1F600)), Removed: true}, time.Now())
+	if err := alice.handleReaction(reactionMessage(bob.identity.ID, taken)); err != nil {
+		t.Fatal(err)
+	}
+
+	// as is our own cap
+	for i := 0; i < maxReactions; i++ {
+		if _, err := alice.React(ReactRequest{MessageID: target.ID, Emoji: string(rune(0x1F600 + i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := alice.React(ReactRequest{MessageID: target.ID, Emoji: "👍"}); err == nil {
+		t.Fatal("reacted past the cap")
+	}
+}
+
+// reactionStep is a thumbs up from bob arriving: when it was made and
+// whether it takes the thumbs up back.
+type reactionStep struct {
+	at      time.Time
+	removed bool
+}
+
+func TestReactionReplay(t *testing.T) {
+	bob := newTestChat(t, "bob")
+	start := time.Now().Add(-time.Minute)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	tests := []struct {
+		name    string
+		steps   []reactionStep
+		reacted bool
+	}{
+		{"added", []reactionStep{{at(1), false}}, true},
+		{"taken back", []reactionStep{{at(1), false}, {at(2), true}}, false},
+		{"add replayed after taking back", []reactionStep{{at(1), false}, {at(2), true}, {at(1), false}}, false},
+		{"older add arriving late", []reactionStep{{at(2), true}, {at(1), false}}, false},
+		{"added again", []reactionStep{{at(1), false}, {at(2), true}, {at(3), false}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			target := reactionTarget(t, alice)
+			signed := make(map[time.Time]protocol.Reaction)
+			for _, step := range tt.steps {
+				// a replay is the very reaction seen before
+				r, seen := signed[step.at]
+				if !seen {
+					r = signedReaction(t, bob, protocol.Reaction{MessageID: target.ID, Emoji: "👍", Removed: step.removed}, step.at)
+					signed[step.at] = r
+				}
+				if err := alice.handleReaction(reactionMessage(bob.identity.ID, r)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stored, _ := alice.storage.Message(storage.RoomKey(defaultRoom), target.ID)
+			reacted := len(stored.Reactions["👍"]) == 1
+			if reacted != tt.reacted {
+				t.Fatalf("thumbs up = %v, want %v", reacted, tt.reacted)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package chat
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A read marker records the newest message we have read in a room or
+// private conversation; what others sent after it is unread. Markers live
+// in storage, so unread and mention counts survive restarts. A room is
+// read while it has focus, a private conversation once its messages were
+// shown or we answered.
+//
+// Markers only move forward. Each move is sent to our other devices, which
+// are peers connected under our own user ID and merge it the same way. With
+// read receipts on, the other side of a private conversation is told how
+// far we have read it, and we keep the receipts it sends us.
+//
+// A busy room moves our marker with every message, so moves are saved and
+// sent in batches: when focus changes, when a conversation is marked read
+// by hand, every readFlushInterval, and on Stop.
+
+// readFlushInterval is the longest a moved marker waits to be saved and
+// sent.
+const readFlushInterval = 5 * time.Second
+
+// unsentRead is a marker flushReads still has to send.
+type unsentRead struct {
+	marker protocol.ReadMarker
+	// receiptTo is who gets a read receipt for it, if anyone
+	receiptTo string
+}
+
+// Conversation is a room we are in or a private conversation, with what is
+// unread in it.
+type Conversation struct {
+	Key      string    `json:"key"`
+	Room     string    `json:"room,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Name     string    `json:"name"`
+	Unread   int       `json:"unread"`
+	Mentions int       `json:"mentions"`
+	ReadUpTo time.Time `json:"read_up_to,omitempty"`
+	// SeenUpTo is how far the other side of a private conversation has
+	// read it, from their read receipts
+	SeenUpTo time.Time `json:"seen_up_to,omitempty"`
+	// Expiry is its disappearing message timer, like "1h", if it has one
+	Expiry string `json:"expiry,omitempty"`
+}
+
+// ReadRequest marks a room, or a private conversation with User, read as
+// the APIs receive it.
+type ReadRequest struct {
+	Room string `json:"room,omitempty"`
+	User string `json:"user,omitempty"`
+}
+
+// SetReadReceipts turns telling others how far we read our private
+// conversations with them on or off.
+func (ec *EnhancedChat) SetReadReceipts(enabled bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.receipts = enabled
+}
+
+// MarkRead marks everything in the conversation req names read.
+func (ec *EnhancedChat) MarkRead(req ReadRequest) error {
+	switch {
+	case req.Room != "":
+		ec.markRead(storage.RoomKey(req.Room))
+	case req.User != "":
+		ec.markRead(storage.PrivateKey(ec.identity.ID, ec.resolveUser(req.User)))
+	default:
+		return fmt.Errorf("room or user required")
+	}
+	ec.flushReads()
+	return nil
+}
+
+// markRead moves our marker in key to its newest message.
+func (ec *EnhancedChat) markRead(key string) {
+	if latest, exists := ec.storage.Latest(key); exists {
+		ec.markReadUpTo(key, latest)
+	}
+}
+
+// markReadUpTo moves our marker in key to msg if that is further on.
+func (ec *EnhancedChat) markReadUpTo(key string, msg *protocol.Message) {
+	marker := protocol.ReadMarker{
+		Conversation: key,
+		Reader:       ec.identity.ID,
+		MessageID:    msg.ID,
+		ReadUpTo:     msg.Timestamp,
+		ReadAt:       time.Now(),
+	}
+	if !ec.storage.MarkRead(marker) {
+		return
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	unsent, exists := ec.unsentReads[key]
+	if !exists || marker.ReadUpTo.After(unsent.marker.ReadUpTo) {
+		unsent.marker = marker
+	}
+	if to := ec.otherParty(key); ec.receipts && to != "" && msg.From != ec.identity.ID {
+		unsent.receiptTo = to
+	}
+	ec.unsentReads[key] = unsent
+}
+
+// flushReads saves the read markers and sends the moves not sent yet.
+func (ec *EnhancedChat) flushReads() {
+	if err := ec.storage.SaveMarkers(); err != nil {
+		fmt.Printf("Error saving read markers: %v\n", err)
+	}
+
+	ec.mu.Lock()
+	unsent := ec.unsentReads
+	ec.unsentReads = make(map[string]unsentRead)
+	ec.mu.Unlock()
+	for _, u := range unsent {
+		ec.sendReadMarker(u.marker, ec.identity.ID)
+		if u.receiptTo != "" {
+			ec.sendReadMarker(u.marker, u.receiptTo)
+		}
+	}
+}
+
+func (ec *EnhancedChat) readLoop() {
+	ticker := time.NewTicker(readFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ec.flushReads()
+		case <-ec.quit:
+			return
+		}
+	}
+}
+
+func (ec *EnhancedChat) sendReadMarker(marker protocol.ReadMarker, to string) {
+	msg := &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.ReadMessage,
+		From:      ec.identity.ID,
+		To:        to,
+		Timestamp: time.Now(),
+		Read:      &marker,
+	}
+	if err := ec.broadcastMessage(msg); err != nil {
+		fmt.Printf("Error sending read marker: %v\n", err)
+	}
+}
+
+// handleReadMarker merges a marker from one of our devices, or a read
+// receipt for our private conversation with its sender.
+func (ec *EnhancedChat) handleReadMarker(msg *protocol.Message) error {
+	marker := msg.Read
+	if marker == nil || marker.Reader != msg.From {
+		return fmt.Errorf("read marker from %s is not theirs", msg.From)
+	}
+	if msg.From != ec.identity.ID && marker.Conversation != storage.PrivateKey(ec.identity.ID, msg.From) {
+		return fmt.Errorf("read receipt from %s for %s", msg.From, marker.Conversation)
+	}
+	// a marker from the future would hide every message still to come
+	if time.Until(marker.ReadUpTo) > maxClockSkew {
+		return fmt.Errorf("read marker from %s is in the future", msg.From)
+	}
+	ec.storage.MarkRead(*marker)
+	return nil
+}
+
+// otherParty returns who we talk to in the private conversation key, or
+// "" if key is not one of ours.
+func (ec *EnhancedChat) otherParty(key string) string {
+	users := strings.Split(strings.TrimPrefix(key, "private:"), ":")
+	if !strings.HasPrefix(key, "private:") || len(users) != 2 {
+		return ""
+	}
+	switch ec.identity.ID {
+	case users[0]:
+		return users[1]
+	case users[1]:
+		return users[0]
+	default:
+		return ""
+	}
+}
+
+// peerConversation returns the conversation a message from a peer belongs
+// to, and whether it is one of ours that the sender may speak in.
+func (ec *EnhancedChat) peerConversation(msg *protocol.Message) (string, bool) {
+	if msg.To != "" {
+		return storage.PrivateKey(ec.identity.ID, msg.From), msg.To == ec.identity.ID
+	}
+	if msg.Room == "" {
+		return "", false
+	}
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	ours := ec.rooms[msg.Room][ec.identity.ID] && !ec.silencedLocked(msg.Room, msg.From)
+	return storage.RoomKey(msg.Room), ours
+}
+
+// unreadCounts counts the unread messages in key and those among them
+// that mention us.
+func (ec *EnhancedChat) unreadCounts(key string) (unread, mentions int) {
+	for _, msg := range ec.storage.Unread(key, ec.identity.ID) {
+		if msg.Type != protocol.TextMessage && msg.Type != protocol.FileMessage {
+			continue
+		}
+		unread++
+		if ec.mentionsMe(msg) {
+			mentions++
+		}
+	}
+	return unread, mentions
+}
+
+func (ec *EnhancedChat) unreadCount(room string) int {
+	unread, _ := ec.unreadCounts(storage.RoomKey(room))
+	return unread
+}
+
+// readIfFocused marks msg read if it arrived in the room with focus, where
+// it is shown straight away.
+func (ec *EnhancedChat) readIfFocused(msg *protocol.Message) {
+	if msg.Room == "" || (msg.Type != protocol.TextMessage && msg.Type != protocol.FileMessage) {
+		return
+	}
+	ec.mu.RLock()
+	focused := msg.Room == ec.currentRoom
+	ec.mu.RUnlock()
+	if focused {
+		ec.markReadUpTo(storage.RoomKey(msg.Room), msg)
+	}
+}
+
+// Conversations lists the rooms we are in, then our private
+// conversations, with their unread and mention counts.
+func (ec *EnhancedChat) Conversations() []Conversation {
+	ec.mu.RLock()
+	rooms := ec.joinedRoomsLocked()
+	ec.mu.RUnlock()
+
+	list := make([]Conversation, 0, len(rooms))
+	for _, room := range rooms {
+		c := ec.conversation(storage.RoomKey(room))
+		c.Room = room
+		c.Name = room
+		list = append(list, c)
+	}
+
+	var private []Conversation
+	for _, key := range ec.storage.GetAllRooms() {
+		userID := ec.otherParty(key)
+		if userID == "" {
+			continue
+		}
+		c := ec.conversation(key)
+		c.User = userID
+		c.Name = ec.displayName(userID)
+		if seen, exists := ec.storage.ReadMarker(key, userID); exists {
+			c.SeenUpTo = seen.ReadUpTo
+		}
+		private = append(private, c)
+	}
+	sort.Slice(private, func(i, j int) bool {
+		return strings.ToLower(private[i].Name) < strings.ToLower(private[j].Name)
+	})
+	return append(list, private...)
+}
+
+func (ec *EnhancedChat) conversation(key string) Conversation {
+	c := Conversation{Key: key}
+	c.Unread, c.Mentions = ec.unreadCounts(key)
+	if ttl := ec.expiryFor(key); ttl > 0 {
+		c.Expiry = formatExpiry(ttl)
+	}
+	if marker, exists := ec.storage.ReadMarker(key, ec.identity.ID); exists {
+		c.ReadUpTo = marker.ReadUpTo
+	}
+	return c
+}
+
+// handleReadCommand runs /unread and /read [room|user].
+func (ec *EnhancedChat) handleReadCommand(command string, args []string) {
+	switch command {
+	case "unread":
+		found := false
+		for _, c := range ec.Conversations() {
+			if c.Unread == 0 {
+				continue
+			}
+			found = true
+			where := "#" + c.Name
+			if c.User != "" {
+				where = "🔒 " + c.Name
+			}
+			if c.Mentions > 0 {
+				fmt.Printf("  %s: %d unread, %d mentioning you\n", where, c.Unread, c.Mentions)
+			} else {
+				fmt.Printf("  %s: %d unread\n", where, c.Unread)
+			}
+		}
+		if !found {
+			fmt.Println("📭 Nothing unread")
+		}
+
+	case "read":
+		req := ReadRequest{Room: ec.CurrentRoom()}
+		if len(args) > 0 {
+			ec.mu.RLock()
+			joined := ec.rooms[args[0]][ec.identity.ID]
+			ec.mu.RUnlock()
+			if joined {
+				req.Room = args[0]
+			} else {
+				req = ReadRequest{User: args[0]}
+			}
+		}
+		if err := ec.MarkRead(req); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if req.Room != "" {
+			fmt.Printf("✔️  Marked %s read\n", req.Room)
+		} else {
+			fmt.Printf("✔️  Marked your conversation with %s read\n", ec.displayName(ec.resolveUser(req.User)))
+		}
+	}
+}
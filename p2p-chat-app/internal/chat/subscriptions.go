@@ -0,0 +1,130 @@
+package chat
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"sort"
+)
+
+// RoomSubscription is a room we are in as shown to the user.
+type RoomSubscription struct {
+	Name     string `json:"name"`
+	Members  int    `json:"members"`
+	Unread   int    `json:"unread"`
+	Mentions int    `json:"mentions"`
+	Focused  bool   `json:"focused"`
+}
+
+// Subscribe joins room without moving focus to it. Joining a room nobody
+// else is in makes us its owner.
+func (ec *EnhancedChat) Subscribe(room string) error {
+	if room == "" || len(room) > maxRoomName {
+		return fmt.Errorf("room names are 1 to %d bytes", maxRoomName)
+	}
+
+	ec.mu.Lock()
+	if ec.bannedLocked(room, ec.identity.ID) {
+		ec.mu.Unlock()
+		return fmt.Errorf("you are banned from %s", room)
+	}
+	if !ec.allowedLocked(room, ec.identity.ID) {
+		ec.mu.Unlock()
+		return fmt.Errorf("%s is private, join it with an invite token or its password", room)
+	}
+	joined := ec.rooms[room][ec.identity.ID]
+	ec.addMemberLocked(room, ec.identity.ID)
+	ec.mu.Unlock()
+
+	if joined {
+		return nil
+	}
+	ec.claimRoom(room)
+	go func() {
+		ec.sendMembership(protocol.JoinMessage, room, "")
+		ec.advertiseRooms()
+	}()
+	return nil
+}
+
+// LeaveRoom leaves room. If it had focus, focus moves to another room we
+// are in; the last room can't be left.
+func (ec *EnhancedChat) LeaveRoom(room string) error {
+	ec.mu.Lock()
+	if !ec.rooms[room][ec.identity.ID] {
+		ec.mu.Unlock()
+		return fmt.Errorf("not in room %s", room)
+	}
+	if len(ec.joinedRoomsLocked()) == 1 {
+		ec.mu.Unlock()
+		return fmt.Errorf("%s is the only room you are in", room)
+	}
+	ec.removeMemberLocked(room, ec.identity.ID)
+	if ec.currentRoom == room {
+		ec.currentRoom = ec.joinedRoomsLocked()[0]
+	}
+	ec.mu.Unlock()
+
+	go func() {
+		ec.sendMembership(protocol.LeaveMessage, room, "")
+		ec.advertiseRooms()
+	}()
+	return nil
+}
+
+// SwitchRoom moves focus to room, which we must be in, and marks it read.
+func (ec *EnhancedChat) SwitchRoom(room string) error {
+	ec.mu.Lock()
+	if !ec.rooms[room][ec.identity.ID] {
+		ec.mu.Unlock()
+		return fmt.Errorf("not in room %s, /join it first", room)
+	}
+	ec.currentRoom = room
+	ec.mu.Unlock()
+
+	ec.markRead(storage.RoomKey(room))
+	ec.flushReads()
+	return nil
+}
+
+// CurrentRoom returns the room that has focus.
+func (ec *EnhancedChat) CurrentRoom() string {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return ec.currentRoom
+}
+
+// Subscriptions lists the rooms we are in with their unread and mention
+// counts.
+func (ec *EnhancedChat) Subscriptions() []RoomSubscription {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	rooms := ec.joinedRoomsLocked()
+	subs := make([]RoomSubscription, 0, len(rooms))
+	for _, room := range rooms {
+		unread, mentions := ec.unreadCounts(storage.RoomKey(room))
+		subs = append(subs, RoomSubscription{
+			Name:     room,
+			Members:  len(ec.membersLocked(room)),
+			Unread:   unread,
+			Mentions: mentions,
+			Focused:  room == ec.currentRoom,
+		})
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Name < subs[j].Name
+	})
+	return subs
+}
+
+// SendRoomMessage sends content to room, which need not have focus.
+func (ec *EnhancedChat) SendRoomMessage(room, content string) error {
+	ec.mu.RLock()
+	joined := ec.rooms[room][ec.identity.ID]
+	ec.mu.RUnlock()
+	if !joined {
+		return fmt.Errorf("not in room %s", room)
+	}
+	return ec.sendText(content, room, "")
+}
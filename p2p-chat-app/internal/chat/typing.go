@@ -0,0 +1,292 @@
+package chat
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// typingThrottle is the least time between two typing starts we send
+	// for one conversation while the user keeps typing
+	typingThrottle = 3 * time.Second
+	// typingTimeout is how long someone counts as typing without a new start
+	typingTimeout  = 2 * typingThrottle
+	typingInterval = time.Second
+	// typingBuffer events may queue per subscriber before new ones are dropped
+	typingBuffer = 64
+)
+
+// Clients report keystrokes with SetTyping as often as they like; a start
+// goes out at most every typingThrottle per conversation and a stop when
+// they say the user stopped. Receivers drop a typer who neither sent a new
+// start nor a message within typingTimeout, so a lost stop only lingers
+// briefly. Typing in a room goes to its members, in a private conversation
+// only to the other side.
+//
+// The terminal reads whole lines, so it cannot tell when someone types;
+// its typing mode only shows who is typing.
+
+// TypingRequest says we started or stopped typing in a room, or a private
+// conversation with User, as the APIs receive it.
+type TypingRequest struct {
+	Room   string `json:"room,omitempty"`
+	User   string `json:"user,omitempty"`
+	Typing bool   `json:"typing"`
+}
+
+// TypingEvent reports that From started or stopped typing in Room, or in
+// our private conversation with them when Room is empty.
+type TypingEvent struct {
+	Room   string `json:"room,omitempty"`
+	From   string `json:"from"`
+	Name   string `json:"name"`
+	Typing bool   `json:"typing"`
+}
+
+// SetTypingDisplay turns showing who is typing in the terminal on or off.
+func (ec *EnhancedChat) SetTypingDisplay(enabled bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.showTyping = enabled
+}
+
+// SetTyping tells the room or user in req that we started or stopped
+// typing, throttled as described above.
+func (ec *EnhancedChat) SetTyping(req TypingRequest) error {
+	msg := &protocol.Message{
+		ID:        protocol.GenerateMessageID(),
+		Type:      protocol.TypingMessage,
+		From:      ec.identity.ID,
+		Timestamp: time.Now(),
+		Typing:    protocol.TypingStop,
+	}
+	var key string
+	switch {
+	case req.Room != "":
+		ec.mu.RLock()
+		joined := ec.rooms[req.Room][ec.identity.ID]
+		silenced := ec.silencedLocked(req.Room, ec.identity.ID)
+		ec.mu.RUnlock()
+		if !joined || silenced {
+			return fmt.Errorf("you can't post in %s", req.Room)
+		}
+		msg.Room = req.Room
+		key = storage.RoomKey(req.Room)
+	case req.User != "":
+		msg.To = ec.resolveUser(req.User)
+		key = storage.PrivateKey(ec.identity.ID, msg.To)
+	default:
+		return fmt.Errorf("room or user required")
+	}
+
+	ec.mu.Lock()
+	last, typing := ec.typingSent[key]
+	if req.Typing {
+		if typing && time.Since(last) < typingThrottle {
+			ec.mu.Unlock()
+			return nil
+		}
+		ec.typingSent[key] = time.Now()
+		msg.Typing = protocol.TypingStart
+	} else {
+		if !typing {
+			ec.mu.Unlock()
+			return nil
+		}
+		delete(ec.typingSent, key)
+	}
+	ec.mu.Unlock()
+
+	if req.Typing {
+		ec.Touch()
+	}
+	return ec.broadcastMessage(msg)
+}
+
+// doneTyping forgets that we were typing in key once we sent what we typed;
+// the message ends the indicator on the other side.
+func (ec *EnhancedChat) doneTyping(key string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	delete(ec.typingSent, key)
+}
+
+// handleTyping applies a typing start or stop from a peer.
+func (ec *EnhancedChat) handleTyping(msg *protocol.Message) error {
+	if msg.Typing != protocol.TypingStart && msg.Typing != protocol.TypingStop {
+		return fmt.Errorf("invalid typing state %q", msg.Typing)
+	}
+	key, ours := ec.peerConversation(msg)
+	if !ours {
+		return nil
+	}
+	if msg.Typing == protocol.TypingStop {
+		ec.stopTyper(key, msg.From)
+		return nil
+	}
+
+	ec.mu.Lock()
+	if ec.typers[key] == nil {
+		ec.typers[key] = make(map[string]time.Time)
+	}
+	_, known := ec.typers[key][msg.From]
+	ec.typers[key][msg.From] = time.Now().Add(typingTimeout)
+	show := !known && ec.showTyping && (msg.Room == "" || msg.Room == ec.currentRoom)
+	ec.mu.Unlock()
+
+	if known {
+		return nil
+	}
+	ec.emitTyping(key, msg.From, true)
+	if show {
+		select {
+		case ec.incoming <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+// stopTyper ends userID typing in key.
+func (ec *EnhancedChat) stopTyper(key, userID string) {
+	ec.mu.Lock()
+	_, typing := ec.typers[key][userID]
+	if typing {
+		delete(ec.typers[key], userID)
+		if len(ec.typers[key]) == 0 {
+			delete(ec.typers, key)
+		}
+	}
+	ec.mu.Unlock()
+
+	if typing {
+		ec.emitTyping(key, userID, false)
+	}
+}
+
+func (ec *EnhancedChat) typingLoop() {
+	ticker := time.NewTicker(typingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			ec.expireTypers(now)
+		case <-ec.quit:
+			return
+		}
+	}
+}
+
+// expireTypers drops typers whose last start is older than typingTimeout
+// at now.
+func (ec *EnhancedChat) expireTypers(now time.Time) {
+	var expired [][2]string
+	ec.mu.RLock()
+	for key, typers := range ec.typers {
+		for userID, until := range typers {
+			if now.After(until) {
+				expired = append(expired, [2]string{key, userID})
+			}
+		}
+	}
+	ec.mu.RUnlock()
+	for _, typer := range expired {
+		ec.stopTyper(typer[0], typer[1])
+	}
+}
+
+func (ec *EnhancedChat) typingEvent(key, userID string, typing bool) TypingEvent {
+	event := TypingEvent{From: userID, Name: ec.displayName(userID), Typing: typing}
+	if ec.otherParty(key) == "" {
+		event.Room = strings.TrimPrefix(key, "room:")
+	}
+	return event
+}
+
+// emitTyping sends an event to every typing subscriber.
+func (ec *EnhancedChat) emitTyping(key, userID string, typing bool) {
+	event := ec.typingEvent(key, userID, typing)
+
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	for ch := range ec.typingSubs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// SubscribeTyping returns a channel of typing events and a function that
+// ends the subscription. A subscriber that falls behind misses events, so
+// it should ask Typers again if that matters.
+func (ec *EnhancedChat) SubscribeTyping() (<-chan TypingEvent, func()) {
+	ch := make(chan TypingEvent, typingBuffer)
+
+	ec.mu.Lock()
+	ec.typingSubs[ch] = true
+	ec.mu.Unlock()
+
+	cancel := func() {
+		ec.mu.Lock()
+		defer ec.mu.Unlock()
+		if ec.typingSubs[ch] {
+			delete(ec.typingSubs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// Typers lists who is typing in the room, or private conversation with the
+// user, that req names.
+func (ec *EnhancedChat) Typers(req TypingRequest) []TypingEvent {
+	key := storage.RoomKey(req.Room)
+	if req.Room == "" {
+		key = storage.PrivateKey(ec.identity.ID, ec.resolveUser(req.User))
+	}
+
+	ec.mu.RLock()
+	var userIDs []string
+	for userID := range ec.typers[key] {
+		userIDs = append(userIDs, userID)
+	}
+	ec.mu.RUnlock()
+
+	sort.Strings(userIDs)
+	typers := []TypingEvent{}
+	for _, userID := range userIDs {
+		typers = append(typers, ec.typingEvent(key, userID, true))
+	}
+	return typers
+}
+
+// handleTypingCommand runs /typing [on|off].
+func (ec *EnhancedChat) handleTypingCommand(args []string) {
+	if len(args) == 0 {
+		ec.mu.RLock()
+		enabled := ec.showTyping
+		ec.mu.RUnlock()
+		if enabled {
+			fmt.Println("✏️  Showing who is typing, /typing off to stop")
+		} else {
+			fmt.Println("Not showing who is typing, /typing on to start")
+		}
+		return
+	}
+	switch args[0] {
+	case "on":
+		ec.SetTypingDisplay(true)
+		fmt.Println("✏️  Showing who is typing")
+	case "off":
+		ec.SetTypingDisplay(false)
+		fmt.Println("No longer showing who is typing")
+	default:
+		fmt.Println("Usage: /typing [on|off]")
+	}
+}
@@ -0,0 +1,227 @@
+package chat
+
+import (
+	"bufio"
+	"net"
+	"p2p-chat-app/internal/encryption"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/storage"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// typingPeer connects userID to ec and returns a function that reads what
+// ec sends them, up to a private message saying last, and returns the
+// typing states among it.
+func typingPeer(t *testing.T, ec *EnhancedChat, userID string) func(last string) []string {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	ec.AddPeer(userID, conn)
+
+	return func(last string) []string {
+		t.Helper()
+		end := &protocol.Message{
+			ID:        protocol.GenerateMessageID(),
+			Type:      protocol.TextMessage,
+			From:      ec.identity.ID,
+			To:        userID,
+			Content:   last,
+			Timestamp: time.Now(),
+		}
+		if err := ec.broadcastMessage(end); err != nil {
+			t.Fatal(err)
+		}
+
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		states := []string{}
+		scanner := bufio.NewScanner(peer)
+		for scanner.Scan() {
+			data, err := encryption.Decrypt(scanner.Text(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := protocol.DeserializeMessage(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case msg.Type == protocol.TypingMessage:
+				states = append(states, msg.Typing)
+			case msg.ID == end.ID:
+				return states
+			}
+		}
+		t.Fatalf("no %q from %s: %v", last, ec.identity.ID, scanner.Err())
+		return nil
+	}
+}
+
+func TestSetTypingThrottle(t *testing.T) {
+	start, stop := protocol.TypingStart, protocol.TypingStop
+
+	// steps are "start" and "stop" calls to SetTyping, "wait" for
+	// typingThrottle to pass and "send" for sending what we typed
+	tests := []struct {
+		name  string
+		steps []string
+		want  []string
+	}{
+		{"start", []string{"start"}, []string{start}},
+		{"keeps typing", []string{"start", "start", "start"}, []string{start}},
+		{"keeps typing past the throttle", []string{"start", "start", "wait", "start", "start"}, []string{start, start}},
+		{"stops", []string{"start", "stop"}, []string{start, stop}},
+		{"stops twice", []string{"start", "stop", "stop"}, []string{start, stop}},
+		{"stops without starting", []string{"stop"}, []string{}},
+		{"starts again", []string{"start", "stop", "start"}, []string{start, stop, start}},
+		{"sends what it typed", []string{"start", "send", "stop"}, []string{start}},
+		{"types the next message", []string{"start", "send", "start"}, []string{start, start}},
+	}
+	for _, tt := range tests {
+		for _, room := range []bool{false, true} {
+			name := tt.name + " in private"
+			if room {
+				name = tt.name + " in a room"
+			}
+			t.Run(name, func(t *testing.T) {
+				alice := newTestChat(t, "alice")
+				read := typingPeer(t, alice, "bob")
+				req := TypingRequest{User: "bob"}
+				conversation := storage.PrivateKey(alice.identity.ID, "bob")
+				if room {
+					alice.mu.Lock()
+					alice.addMemberLocked(defaultRoom, "bob")
+					alice.mu.Unlock()
+					req = TypingRequest{Room: defaultRoom}
+					conversation = storage.RoomKey(defaultRoom)
+				}
+
+				for _, step := range tt.steps {
+					switch step {
+					case "start", "stop":
+						req.Typing = step == "start"
+						if err := alice.SetTyping(req); err != nil {
+							t.Fatal(err)
+						}
+					case "wait":
+						alice.mu.Lock()
+						alice.typingSent[conversation] = alice.typingSent[conversation].Add(-typingThrottle)
+						alice.mu.Unlock()
+					case "send":
+						alice.doneTyping(conversation)
+					}
+				}
+				if got := read("end"); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("sent %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestSetTypingOutsideRoom(t *testing.T) {
+	alice := newTestChat(t, "alice")
+	read := typingPeer(t, alice, "bob")
+	alice.mu.Lock()
+	alice.addMemberLocked("golang", "bob")
+	alice.mu.Unlock()
+
+	if err := alice.SetTyping(TypingRequest{Room: "golang", Typing: true}); err == nil {
+		t.Error("typing in a room we are not in")
+	}
+	if err := alice.SetTyping(TypingRequest{Typing: true}); err == nil {
+		t.Error("typing nowhere")
+	}
+	if got := read("end"); len(got) != 0 {
+		t.Errorf("sent %q", got)
+	}
+}
+
+func TestTypingTimeout(t *testing.T) {
+	// steps are "start" and "stop" from bob, bob sending a "message", bob's
+	// last start aging by typingThrottle, and checking for typers just
+	// "before" and "after" typingTimeout
+	tests := []struct {
+		name   string
+		steps  []string
+		typing bool
+		events []bool
+	}{
+		{"starts", []string{"start"}, true, []bool{true}},
+		{"keeps typing", []string{"start", "start"}, true, []bool{true}},
+		{"stops", []string{"start", "stop"}, false, []bool{true, false}},
+		{"stops without starting", []string{"stop"}, false, []bool{}},
+		{"sends a message", []string{"start", "message"}, false, []bool{true, false}},
+		{"still typing", []string{"start", "before"}, true, []bool{true}},
+		{"times out", []string{"start", "after"}, false, []bool{true, false}},
+		{"times out once", []string{"start", "after", "after", "stop"}, false, []bool{true, false}},
+		{"a new start holds off the timeout", []string{"start", "age", "start", "before"}, true, []bool{true}},
+		{"an old start times out", []string{"start", "age", "before"}, false, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestChat(t, "alice")
+			events, cancel := alice.SubscribeTyping()
+			defer cancel()
+			conversation := storage.PrivateKey(alice.identity.ID, "bob")
+			from := func(typ protocol.MessageType, typing string) *protocol.Message {
+				return &protocol.Message{
+					ID:        protocol.GenerateMessageID(),
+					Type:      typ,
+					From:      "bob",
+					To:        alice.identity.ID,
+					Content:   "hi",
+					Timestamp: time.Now(),
+					Typing:    typing,
+				}
+			}
+
+			for _, step := range tt.steps {
+				var err error
+				switch step {
+				case "start":
+					err = alice.handleTyping(from(protocol.TypingMessage, protocol.TypingStart))
+				case "stop":
+					err = alice.handleTyping(from(protocol.TypingMessage, protocol.TypingStop))
+				case "message":
+					var data []byte
+					if data, err = protocol.SerializeMessage(from(protocol.TextMessage, "")); err != nil {
+						break
+					}
+					var frame string
+					if frame, err = encryption.Encrypt(data, key); err != nil {
+						break
+					}
+					err = alice.ProcessIncomingMessage("bob", frame)
+				case "age":
+					alice.mu.Lock()
+					alice.typers[conversation]["bob"] = alice.typers[conversation]["bob"].Add(-typingThrottle)
+					alice.mu.Unlock()
+				case "before":
+					alice.expireTypers(time.Now().Add(typingTimeout - time.Second))
+				case "after":
+					alice.expireTypers(time.Now().Add(typingTimeout + time.Second))
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", step, err)
+				}
+			}
+
+			if typing := len(alice.Typers(TypingRequest{User: "bob"})) == 1; typing != tt.typing {
+				t.Errorf("bob typing = %v, want %v", typing, tt.typing)
+			}
+			got := []bool{}
+			for len(events) > 0 {
+				event := <-events
+				if event.From != "bob" || event.Room != "" {
+					t.Errorf("event %+v", event)
+				}
+				got = append(got, event.Typing)
+			}
+			if !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("events %v, want %v", got, tt.events)
+			}
+		})
+	}
+}
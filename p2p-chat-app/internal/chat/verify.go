@@ -0,0 +1,154 @@
+package chat
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/identity"
+	"strings"
+	"time"
+)
+
+// Two users verify each other by comparing safety numbers over a channel
+// they trust, in person or on a call. The number is derived from both keys,
+// so a man in the middle shows each side a different one.
+
+// Verification is the verification state of a contact as shown to the
+// user. NewSafetyNumber is set when the contact showed up with another key.
+type Verification struct {
+	UserID          string    `json:"user_id"`
+	Name            string    `json:"name"`
+	SafetyNumber    string    `json:"safety_number,omitempty"`
+	Verified        bool      `json:"verified"`
+	VerifiedAt      time.Time `json:"verified_at,omitempty"`
+	KeyChanged      bool      `json:"key_changed"`
+	NewSafetyNumber string    `json:"new_safety_number,omitempty"`
+}
+
+// VerifyRequest changes a contact's verification as the APIs receive it.
+// Action is confirm, reset, accept (the new key) or reject (the new key).
+type VerifyRequest struct {
+	User   string `json:"user"`
+	Action string `json:"action"`
+}
+
+// Verification returns the safety numbers of a contact, by ID or nickname.
+func (ec *EnhancedChat) Verification(user string) (Verification, error) {
+	userID := ec.resolveUser(user)
+	contact, exists := ec.contacts.Get(userID)
+	if !exists {
+		return Verification{}, fmt.Errorf("%s is not a contact", user)
+	}
+	ownKey, err := ec.identity.ExportPublicKey()
+	if err != nil {
+		return Verification{}, err
+	}
+
+	v := Verification{
+		UserID:     userID,
+		Name:       contact.Name(),
+		Verified:   contact.Verified,
+		VerifiedAt: contact.VerifiedAt,
+		KeyChanged: contact.NewKey != "",
+	}
+	if contact.PublicKey != "" {
+		if v.SafetyNumber, err = identity.SafetyNumber(ec.identity.ID, ownKey, userID, contact.PublicKey); err != nil {
+			return Verification{}, err
+		}
+	}
+	if contact.NewKey != "" {
+		if v.NewSafetyNumber, err = identity.SafetyNumber(ec.identity.ID, ownKey, userID, contact.NewKey); err != nil {
+			return Verification{}, err
+		}
+	}
+	return v, nil
+}
+
+// Verify carries out req.
+func (ec *EnhancedChat) Verify(req VerifyRequest) error {
+	userID := ec.resolveUser(req.User)
+	switch req.Action {
+	case "confirm":
+		return ec.contacts.SetVerified(userID, true)
+	case "reset":
+		return ec.contacts.SetVerified(userID, false)
+	case "accept":
+		return ec.contacts.AcceptNewKey(userID)
+	case "reject":
+		return ec.contacts.RejectNewKey(userID)
+	default:
+		return fmt.Errorf("unknown verify action %q", req.Action)
+	}
+}
+
+// formatSafetyNumber lays the twelve groups out in three rows.
+func formatSafetyNumber(number string) string {
+	groups := strings.Fields(number)
+	var rows []string
+	for i := 0; i < len(groups); i += 4 {
+		end := i + 4
+		if end > len(groups) {
+			end = len(groups)
+		}
+		rows = append(rows, "    "+strings.Join(groups[i:end], " "))
+	}
+	return strings.Join(rows, "\n")
+}
+
+// handleVerifyCommand runs /verify <user> [--confirm|--reset|--accept-new|--reject-new].
+func (ec *EnhancedChat) handleVerifyCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: /verify <user> [--confirm|--reset|--accept-new|--reject-new]")
+		return
+	}
+
+	if len(args) > 1 {
+		actions := map[string]string{
+			"--confirm":    "confirm",
+			"--reset":      "reset",
+			"--accept-new": "accept",
+			"--reject-new": "reject",
+		}
+		action, known := actions[args[1]]
+		if !known {
+			fmt.Println("Usage: /verify <user> [--confirm|--reset|--accept-new|--reject-new]")
+			return
+		}
+		if err := ec.Verify(VerifyRequest{User: args[0], Action: action}); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		name := ec.displayName(ec.resolveUser(args[0]))
+		switch action {
+		case "confirm":
+			fmt.Printf("✅ %s is verified\n", name)
+		case "reset":
+			fmt.Printf("%s is no longer verified\n", name)
+		case "accept":
+			fmt.Printf("🔑 Accepted the new key of %s, verify them again with /verify %s\n", name, args[0])
+		case "reject":
+			fmt.Printf("🚫 Rejected the new key of %s\n", name)
+		}
+		return
+	}
+
+	v, err := ec.Verification(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if v.SafetyNumber == "" {
+		fmt.Printf("No key of %s yet, connect to them first\n", v.Name)
+		return
+	}
+
+	fmt.Printf("🔐 Safety number with %s (%s):\n%s\n", v.Name, v.UserID, formatSafetyNumber(v.SafetyNumber))
+	if v.Verified {
+		fmt.Printf("✅ Verified on %s\n", v.VerifiedAt.Format("2006-01-02 15:04"))
+	} else {
+		fmt.Println("Compare it with the number they see, in person or over a channel you trust.")
+		fmt.Printf("If both match, /verify %s --confirm\n", args[0])
+	}
+	if v.KeyChanged {
+		fmt.Printf("⚠️  %s showed up with a different key, which gives this safety number:\n%s\n", v.Name, formatSafetyNumber(v.NewSafetyNumber))
+		fmt.Printf("Only if they confirm that one, /verify %s --accept-new; otherwise /verify %s --reject-new\n", args[0], args[0])
+	}
+}
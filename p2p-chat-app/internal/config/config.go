@@ -0,0 +1,274 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"p2p-chat-app/internal/transport"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every address and port a node uses. Defaults match the
+// classic single-node setup; flags override P2PCHAT_* environment
+// variables, which override the defaults.
+type Config struct {
+	// ListenAddr is where peers connect to us, on any transport
+	// (":9000", "[::]:9000", "unix:///tmp/chat.sock", ...)
+	ListenAddr string
+	// AdvertisePort is announced in discovery when peers must connect on a
+	// different port than we listen on (e.g. behind port forwarding)
+	AdvertisePort int
+
+	DiscoveryPort int
+	DiscoveryBind string
+	DiscoveryIPv6 bool
+	// Discovery lists the discovery backends: broadcast, multicast, mdns
+	Discovery string
+
+	WebAddr string
+	APIAddr string
+
+	// Bootstrap lists peers to dial at startup, comma separated
+	Bootstrap string
+
+	Rendezvous       string
+	RendezvousListen string
+	Proxy            string
+	OnionAddress     string
+	SendPolicy       string
+
+	// Notify lists the notification sinks: bell, desktop, webhook
+	Notify        string
+	NotifyWebhook string
+	// ReadReceipts tells the other side of private conversations how far
+	// we have read them
+	ReadReceipts bool
+	// IdleTimeout is how long without activity turns us away, 0 for never
+	IdleTimeout time.Duration
+	// ShowTyping shows who is typing in the terminal
+	ShowTyping bool
+}
+
+func Default() *Config {
+	return &Config{
+		ListenAddr:    ":9000",
+		DiscoveryPort: 9001,
+		DiscoveryIPv6: true,
+		Discovery:     "broadcast,multicast,mdns",
+		WebAddr:       ":8080",
+		APIAddr:       ":8081",
+		Notify:        "bell",
+		ReadReceipts:  true,
+		IdleTimeout:   5 * time.Minute,
+	}
+}
+
+// Load builds the configuration from the environment and command line.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	fs := flag.NewFlagSet("p2pchat", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "chat listen address (host:port or tcp:// unix:// mem:// ws:// address)")
+	fs.IntVar(&c.AdvertisePort, "advertise-port", c.AdvertisePort, "chat port announced to peers (default: the listen port)")
+	fs.IntVar(&c.DiscoveryPort, "discovery-port", c.DiscoveryPort, "udp port for peer discovery")
+	fs.StringVar(&c.DiscoveryBind, "discovery-bind", c.DiscoveryBind, "ipv4 or ipv6 address to bind discovery to (default: all)")
+	fs.BoolVar(&c.DiscoveryIPv6, "discovery-ipv6", c.DiscoveryIPv6, "also discover over ipv6 link-local multicast")
+	fs.StringVar(&c.Discovery, "discovery", c.Discovery, "comma separated discovery backends: broadcast, multicast, mdns")
+	fs.StringVar(&c.Bootstrap, "bootstrap", c.Bootstrap, "comma separated peers to dial at startup to find the rest of the network")
+	fs.StringVar(&c.WebAddr, "web", c.WebAddr, "web ui listen address")
+	fs.StringVar(&c.APIAddr, "api", c.APIAddr, "mobile api listen address")
+	fs.StringVar(&c.Rendezvous, "rendezvous", c.Rendezvous, "rendezvous server for hole punching and relay")
+	fs.StringVar(&c.RendezvousListen, "rendezvous-listen", c.RendezvousListen, "act as a rendezvous server on this address")
+	fs.StringVar(&c.Proxy, "proxy", c.Proxy, "socks5 proxy for outbound dials, e.g. socks5://127.0.0.1:9050")
+	fs.StringVar(&c.OnionAddress, "onion", c.OnionAddress, "onion address to advertise instead of our ip")
+	fs.StringVar(&c.SendPolicy, "send-policy", c.SendPolicy, "full send queue policy: drop-oldest, disconnect or block")
+	fs.StringVar(&c.Notify, "notify", c.Notify, "comma separated notification sinks: bell, desktop, webhook")
+	fs.BoolVar(&c.ReadReceipts, "read-receipts", c.ReadReceipts, "send read receipts in private conversations")
+	fs.DurationVar(&c.IdleTimeout, "idle", c.IdleTimeout, "inactivity after which we show as away (0 never)")
+	fs.BoolVar(&c.ShowTyping, "typing", c.ShowTyping, "show who is typing in the terminal")
+	fs.StringVar(&c.NotifyWebhook, "notify-webhook", c.NotifyWebhook, "url notifications are posted to as json (implies the webhook sink)")
+}
+
+func (c *Config) applyEnv() error {
+	stringVars := map[string]*string{
+		"P2PCHAT_LISTEN":            &c.ListenAddr,
+		"P2PCHAT_DISCOVERY_BIND":    &c.DiscoveryBind,
+		"P2PCHAT_DISCOVERY":         &c.Discovery,
+		"P2PCHAT_BOOTSTRAP":         &c.Bootstrap,
+		"P2PCHAT_WEB":               &c.WebAddr,
+		"P2PCHAT_API":               &c.APIAddr,
+		"P2PCHAT_RENDEZVOUS":        &c.Rendezvous,
+		"P2PCHAT_RENDEZVOUS_LISTEN": &c.RendezvousListen,
+		"P2PCHAT_PROXY":             &c.Proxy,
+		"P2PCHAT_ONION_ADDRESS":     &c.OnionAddress,
+		"P2PCHAT_SEND_POLICY":       &c.SendPolicy,
+		"P2PCHAT_NOTIFY":            &c.Notify,
+		"P2PCHAT_NOTIFY_WEBHOOK":    &c.NotifyWebhook,
+	}
+	for name, field := range stringVars {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	intVars := map[string]*int{
+		"P2PCHAT_ADVERTISE_PORT": &c.AdvertisePort,
+		"P2PCHAT_DISCOVERY_PORT": &c.DiscoveryPort,
+	}
+	for name, field := range intVars {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*field = n
+		}
+	}
+
+	if v := os.Getenv("P2PCHAT_DISCOVERY_IPV6"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("P2PCHAT_DISCOVERY_IPV6: %v", err)
+		}
+		c.DiscoveryIPv6 = enabled
+	}
+	if v := os.Getenv("P2PCHAT_READ_RECEIPTS"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("P2PCHAT_READ_RECEIPTS: %v", err)
+		}
+		c.ReadReceipts = enabled
+	}
+	if v := os.Getenv("P2PCHAT_TYPING"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("P2PCHAT_TYPING: %v", err)
+		}
+		c.ShowTyping = enabled
+	}
+	if v := os.Getenv("P2PCHAT_IDLE"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("P2PCHAT_IDLE: %v", err)
+		}
+		c.IdleTimeout = timeout
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.DiscoveryPort < 1 || c.DiscoveryPort > 65535 {
+		return fmt.Errorf("invalid discovery port %d", c.DiscoveryPort)
+	}
+	if c.AdvertisePort < 0 || c.AdvertisePort > 65535 {
+		return fmt.Errorf("invalid advertise port %d", c.AdvertisePort)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("invalid idle timeout %s", c.IdleTimeout)
+	}
+	for name, addr := range map[string]string{"web": c.WebAddr, "api": c.APIAddr} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid %s address %q: %v", name, addr, err)
+		}
+	}
+	if c.DiscoveryBind != "" && net.ParseIP(c.DiscoveryBind) == nil {
+		return fmt.Errorf("invalid discovery bind address %q", c.DiscoveryBind)
+	}
+	if strings.TrimSpace(strings.Replace(c.Discovery, ",", "", -1)) == "" {
+		return fmt.Errorf("no discovery backend selected")
+	}
+	for _, sink := range c.NotifySinks() {
+		switch sink {
+		case "bell", "desktop":
+		case "webhook":
+			if c.NotifyWebhook == "" {
+				return fmt.Errorf("the webhook notification sink needs -notify-webhook")
+			}
+		default:
+			return fmt.Errorf("unknown notification sink %q", sink)
+		}
+	}
+	return nil
+}
+
+// DiscoveryBackends splits Discovery into backend names.
+func (c *Config) DiscoveryBackends() []string {
+	return strings.Split(c.Discovery, ",")
+}
+
+// NotifySinks splits Notify into sink names, adding the webhook when a
+// webhook url is set.
+func (c *Config) NotifySinks() []string {
+	var sinks []string
+	webhook := false
+	for _, name := range strings.Split(c.Notify, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			sinks = append(sinks, name)
+			webhook = webhook || name == "webhook"
+		}
+	}
+	if c.NotifyWebhook != "" && !webhook {
+		sinks = append(sinks, "webhook")
+	}
+	return sinks
+}
+
+// BootstrapPeers splits Bootstrap into addresses.
+func (c *Config) BootstrapPeers() []string {
+	var peers []string
+	for _, addr := range strings.Split(c.Bootstrap, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+// ChatPort is the tcp port peers should dial, or 0 when we listen on a
+// transport without one.
+func (c *Config) ChatPort() int {
+	if c.AdvertisePort != 0 {
+		return c.AdvertisePort
+	}
+	scheme, addr := transport.Parse(c.ListenAddr)
+	if scheme != "tcp" {
+		return 0
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// LocalURL turns a listen address like ":8080" into something a browser on
+// this host can open.
+func LocalURL(scheme, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return scheme + "://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		// change turns the defaults into the configuration we want
+		change  func(c *Config)
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			change: func(c *Config) {},
+		},
+		{
+			name: "flags",
+			args: []string{"-listen", "[::]:9100", "-discovery-port", "9101", "-discovery-bind", "fe80::1", "-web", "[::1]:8180", "-idle", "0", "-typing"},
+			change: func(c *Config) {
+				c.ListenAddr = "[::]:9100"
+				c.DiscoveryPort = 9101
+				c.DiscoveryBind = "fe80::1"
+				c.WebAddr = "[::1]:8180"
+				c.IdleTimeout = 0
+				c.ShowTyping = true
+			},
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				"P2PCHAT_LISTEN":         "unix:///tmp/chat.sock",
+				"P2PCHAT_ADVERTISE_PORT": "19000",
+				"P2PCHAT_DISCOVERY_BIND": "192.168.1.10",
+				"P2PCHAT_DISCOVERY_IPV6": "false",
+				"P2PCHAT_API":            "127.0.0.1:8181",
+				"P2PCHAT_READ_RECEIPTS":  "0",
+				"P2PCHAT_IDLE":           "90s",
+			},
+			change: func(c *Config) {
+				c.ListenAddr = "unix:///tmp/chat.sock"
+				c.AdvertisePort = 19000
+				c.DiscoveryBind = "192.168.1.10"
+				c.DiscoveryIPv6 = false
+				c.APIAddr = "127.0.0.1:8181"
+				c.ReadReceipts = false
+				c.IdleTimeout = 90 * time.Second
+			},
+		},
+		{
+			name: "flags override the environment",
+			env:  map[string]string{"P2PCHAT_DISCOVERY_PORT": "7001", "P2PCHAT_WEB": ":7080"},
+			args: []string{"-discovery-port", "7002"},
+			change: func(c *Config) {
+				c.DiscoveryPort = 7002
+				c.WebAddr = ":7080"
+			},
+		},
+		{
+			name:    "bad port in the environment",
+			env:     map[string]string{"P2PCHAT_DISCOVERY_PORT": "ninety"},
+			wantErr: "P2PCHAT_DISCOVERY_PORT",
+		},
+		{
+			name:    "bad boolean in the environment",
+			env:     map[string]string{"P2PCHAT_DISCOVERY_IPV6": "maybe"},
+			wantErr: "P2PCHAT_DISCOVERY_IPV6",
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"-colour"},
+			wantErr: "colour",
+		},
+		{
+			name:    "discovery port out of range",
+			args:    []string{"-discovery-port", "70000"},
+			wantErr: "invalid discovery port",
+		},
+		{
+			name:    "negative advertise port",
+			args:    []string{"-advertise-port", "-1"},
+			wantErr: "invalid advertise port",
+		},
+		{
+			name:    "negative idle timeout",
+			args:    []string{"-idle", "-1m"},
+			wantErr: "invalid idle timeout",
+		},
+		{
+			name:    "web address without a port",
+			args:    []string{"-web", "localhost"},
+			wantErr: "invalid web address",
+		},
+		{
+			name:    "unbracketed ipv6 api address",
+			args:    []string{"-api", "::1:8081"},
+			wantErr: "invalid api address",
+		},
+		{
+			name:    "discovery bind to a host name",
+			args:    []string{"-discovery-bind", "eth0"},
+			wantErr: "invalid discovery bind address",
+		},
+		{
+			name:    "discovery bind with a port",
+			args:    []string{"-discovery-bind", "[fe80::1]:9001"},
+			wantErr: "invalid discovery bind address",
+		},
+		{
+			name:    "no discovery backend",
+			args:    []string{"-discovery", " , "},
+			wantErr: "no discovery backend",
+		},
+		{
+			name:    "unknown notification sink",
+			args:    []string{"-notify", "bell,pager"},
+			wantErr: `unknown notification sink "pager"`,
+		},
+		{
+			name:    "webhook sink without a url",
+			args:    []string{"-notify", "webhook"},
+			wantErr: "needs -notify-webhook",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := Load(tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			want := Default()
+			tt.change(want)
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("Load() = %+v, want %+v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestChatPort(t *testing.T) {
+	tests := []struct {
+		listen    string
+		advertise int
+		want      int
+	}{
+		{":9000", 0, 9000},
+		{"0.0.0.0:9100", 0, 9100},
+		{"[::]:9200", 0, 9200},
+		{"tcp://[fe80::1%eth0]:9300", 0, 9300},
+		{"[::]:9000", 19000, 19000},
+		{"unix:///tmp/chat.sock", 0, 0},
+		{"unix:///tmp/chat.sock", 19000, 19000},
+		{"mem://alice", 0, 0},
+		{"no port", 0, 0},
+	}
+	for _, tt := range tests {
+		c := &Config{ListenAddr: tt.listen, AdvertisePort: tt.advertise}
+		if got := c.ChatPort(); got != tt.want {
+			t.Errorf("ChatPort() listening on %q advertising %d = %d, want %d", tt.listen, tt.advertise, got, tt.want)
+		}
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{":8080", "http://localhost:8080"},
+		{"0.0.0.0:8080", "http://localhost:8080"},
+		{"[::]:8080", "http://localhost:8080"},
+		{"127.0.0.1:8080", "http://127.0.0.1:8080"},
+		{"[::1]:8080", "http://[::1]:8080"},
+		{"[fe80::1]:8080", "http://[fe80::1]:8080"},
+		{"chat.local", "http://chat.local"},
+	}
+	for _, tt := range tests {
+		if got := LocalURL("http", tt.addr); got != tt.want {
+			t.Errorf("LocalURL(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestLists(t *testing.T) {
+	tests := []struct {
+		name      string
+		c         Config
+		sinks     []string
+		bootstrap []string
+	}{
+		{"empty", Config{}, nil, nil},
+		{
+			"spaces and empty entries",
+			Config{Notify: " bell, ,desktop ", Bootstrap: "10.0.0.1:9000, ,[::1]:9000,"},
+			[]string{"bell", "desktop"},
+			[]string{"10.0.0.1:9000", "[::1]:9000"},
+		},
+		{
+			"webhook url adds the sink",
+			Config{Notify: "bell", NotifyWebhook: "https://example.com/hook"},
+			[]string{"bell", "webhook"},
+			nil,
+		},
+		{
+			"webhook listed once",
+			Config{Notify: "webhook,bell", NotifyWebhook: "https://example.com/hook"},
+			[]string{"webhook", "bell"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.NotifySinks(); !reflect.DeepEqual(got, tt.sinks) {
+				t.Errorf("NotifySinks() = %q, want %q", got, tt.sinks)
+			}
+			if got := tt.c.BootstrapPeers(); !reflect.DeepEqual(got, tt.bootstrap) {
+				t.Errorf("BootstrapPeers() = %q, want %q", got, tt.bootstrap)
+			}
+		})
+	}
+}
@@ -0,0 +1,609 @@
+// Package contacts is the address book: what we call the users we know,
+// where we last reached them and the key each one first showed us. Keys are
+// trusted on first use and pinned, so a known user showing up with another
+// key is refused instead of silently accepted.
+//
+// Users only become contacts when we add them, connect through their
+// invite link or exchange private messages with them. Anyone else who
+// connects is checked against the book but not written into it.
+package contacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAddresses caps how many addresses are remembered per contact
+	maxAddresses = 8
+	maxNickname  = 64
+	maxNotes     = 1024
+	// maxContacts caps the book, and the keys of strangers held in memory
+	maxContacts = 1000
+)
+
+// ErrFull is returned for a contact that doesn't fit in the book.
+var ErrFull = fmt.Errorf("contact book is full (%d contacts)", maxContacts)
+
+type Contact struct {
+	UserID   string `json:"user_id"`
+	Nickname string `json:"nickname,omitempty"`
+	// Username is what the user calls themselves
+	Username    string    `json:"username,omitempty"`
+	PublicKey   string    `json:"public_key,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Addresses   []string  `json:"addresses,omitempty"`
+	Notes       string    `json:"notes,omitempty"`
+	FirstSeen   time.Time `json:"first_seen,omitempty"`
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+	// Verified is set once the user compared safety numbers with them
+	Verified   bool      `json:"verified,omitempty"`
+	VerifiedAt time.Time `json:"verified_at,omitempty"`
+	// NewKey is a key other than the pinned one the user showed up with.
+	// They stay blocked until it is accepted.
+	NewKey         string    `json:"new_key,omitempty"`
+	NewFingerprint string    `json:"new_fingerprint,omitempty"`
+	KeyChangedAt   time.Time `json:"key_changed_at,omitempty"`
+}
+
+// Name is how the contact is shown: nickname, else username, else ID.
+func (c *Contact) Name() string {
+	switch {
+	case c.Nickname != "":
+		return c.Nickname
+	case c.Username != "":
+		return c.Username
+	default:
+		return c.UserID
+	}
+}
+
+// KeyChangedError is returned for a contact presenting a key other than
+// the pinned one. WasVerified tells whether that cost them their verified
+// state.
+type KeyChangedError struct {
+	UserID      string
+	Name        string
+	Pinned      string
+	Received    string
+	WasVerified bool
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("key of %s changed: pinned %s, got %s", e.UserID, e.Pinned, e.Received)
+}
+
+type Book struct {
+	contacts map[string]*Contact
+	// expected holds fingerprints from invite links being connected
+	expected map[string]string
+	// strangers holds the users who connected without being contacts, in
+	// case we come to exchange private messages
+	strangers map[string]protocol.User
+	path      string
+	mu        sync.Mutex
+}
+
+func NewBook() *Book {
+	return &Book{
+		contacts:  make(map[string]*Contact),
+		expected:  make(map[string]string),
+		strangers: make(map[string]protocol.User),
+	}
+}
+
+// Load reads the contacts from path and persists future changes there. A
+// missing file is not an error.
+func (b *Book) Load(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var contacts []*Contact
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return err
+	}
+	for _, contact := range contacts {
+		b.contacts[contact.UserID] = contact
+	}
+	return nil
+}
+
+// pin is an entry of pins.json, where keys pinned through invite links were
+// kept before the contacts book took them over.
+type pin struct {
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	Fingerprint string    `json:"fingerprint"`
+	PinnedAt    time.Time `json:"pinned_at"`
+}
+
+// MigratePins moves the keys pinned in the pins.json at path into the book
+// and renames the file so it is only done once. Contacts that have a key
+// already keep it. It returns how many pins were taken over; a missing file
+// is not an error.
+func (b *Book) MigratePins(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var pins []pin
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return 0, fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	b.mu.Lock()
+	migrated := 0
+	for _, p := range pins {
+		if p.UserID == "" || p.Fingerprint == "" {
+			continue
+		}
+		contact, exists := b.contacts[p.UserID]
+		if exists && contact.Fingerprint != "" {
+			continue
+		}
+		if !exists {
+			if len(b.contacts) >= maxContacts {
+				break
+			}
+			contact = &Contact{UserID: p.UserID, Username: p.Username, FirstSeen: p.PinnedAt}
+			b.contacts[p.UserID] = contact
+		}
+		contact.Fingerprint = p.Fingerprint
+		migrated++
+	}
+	if migrated > 0 {
+		b.saveLocked()
+	}
+	b.mu.Unlock()
+
+	return migrated, os.Rename(path, path+".migrated")
+}
+
+// Get returns a copy of the contact for userID.
+func (b *Book) Get(userID string) (Contact, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	contact, exists := b.contacts[userID]
+	if !exists {
+		return Contact{}, false
+	}
+	return copyContact(contact), true
+}
+
+// List returns every contact sorted by name.
+func (b *Book) List() []Contact {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := make([]Contact, 0, len(b.contacts))
+	for _, contact := range b.contacts {
+		list = append(list, copyContact(contact))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name()) < strings.ToLower(list[j].Name())
+	})
+	return list
+}
+
+// Name returns how userID is shown, which is the ID itself for strangers.
+func (b *Book) Name(userID string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if contact, exists := b.contacts[userID]; exists {
+		return contact.Name()
+	}
+	return userID
+}
+
+// Resolve finds the user ID for an ID or nickname.
+func (b *Book) Resolve(name string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.contacts[name]; exists {
+		return name, true
+	}
+	for userID, contact := range b.contacts {
+		if contact.Nickname != "" && strings.EqualFold(contact.Nickname, name) {
+			return userID, true
+		}
+	}
+	return "", false
+}
+
+// Add saves c, merging it into what we know about its user. A fingerprint
+// must agree with the pinned one.
+func (b *Book) Add(c Contact) (Contact, error) {
+	if c.UserID == "" {
+		return Contact{}, fmt.Errorf("contacts need a user id")
+	}
+	if err := checkNickname(c.Nickname); err != nil {
+		return Contact{}, err
+	}
+	if len(c.Notes) > maxNotes {
+		return Contact{}, fmt.Errorf("notes are at most %d bytes", maxNotes)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.nicknameFreeLocked(c.UserID, c.Nickname); err != nil {
+		return Contact{}, err
+	}
+	contact, exists := b.contacts[c.UserID]
+	if !exists {
+		if len(b.contacts) >= maxContacts {
+			return Contact{}, ErrFull
+		}
+		contact = &Contact{UserID: c.UserID}
+		b.contacts[c.UserID] = contact
+	}
+	if c.Fingerprint != "" {
+		if contact.Fingerprint != "" && contact.Fingerprint != c.Fingerprint {
+			return Contact{}, &KeyChangedError{UserID: c.UserID, Name: contact.Name(), Pinned: contact.Fingerprint, Received: c.Fingerprint}
+		}
+		contact.Fingerprint = c.Fingerprint
+	}
+	if c.Nickname != "" {
+		contact.Nickname = c.Nickname
+	}
+	if c.Notes != "" {
+		contact.Notes = c.Notes
+	}
+	if c.Username != "" && contact.Username == "" {
+		contact.Username = c.Username
+	}
+	for _, addr := range c.Addresses {
+		contact.addAddress(addr)
+	}
+
+	b.saveLocked()
+	return copyContact(contact), nil
+}
+
+// Rename sets the nickname of a contact; an empty one clears it.
+func (b *Book) Rename(userID, nickname string) error {
+	if err := checkNickname(nickname); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	contact, exists := b.contacts[userID]
+	if !exists {
+		return fmt.Errorf("%s is not a contact", userID)
+	}
+	if err := b.nicknameFreeLocked(userID, nickname); err != nil {
+		return err
+	}
+	contact.Nickname = nickname
+	b.saveLocked()
+	return nil
+}
+
+// SetNotes replaces the notes on a contact.
+func (b *Book) SetNotes(userID, notes string) error {
+	if len(notes) > maxNotes {
+		return fmt.Errorf("notes are at most %d bytes", maxNotes)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	contact, exists := b.contacts[userID]
+	if !exists {
+		return fmt.Errorf("%s is not a contact", userID)
+	}
+	contact.Notes = notes
+	b.saveLocked()
+	return nil
+}
+
+// Remove forgets a contact, pinned key included: the next key it shows is
+// trusted again.
+func (b *Book) Remove(userID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.contacts[userID]; !exists {
+		return false
+	}
+	delete(b.contacts, userID)
+	b.saveLocked()
+	return true
+}
+
+// SetVerified marks a contact as verified or not. Only a pinned key can be
+// verified.
+func (b *Book) SetVerified(userID string, verified bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	contact, exists := b.contacts[userID]
+	if !exists {
+		return fmt.Errorf("%s is not a contact", userID)
+	}
+	if verified && contact.PublicKey == "" {
+		return fmt.Errorf("no key of %s to verify yet, connect to them first", contact.Name())
+	}
+	if verified && contact.NewKey != "" {
+		return fmt.Errorf("the key of %s changed, accept or reject the new key first", contact.Name())
+	}
+	contact.Verified = verified
+	contact.VerifiedAt = time.Time{}
+	if verified {
+		contact.VerifiedAt = time.Now()
+	}
+	b.saveLocked()
+	return nil
+}
+
+// AcceptNewKey pins the key a contact last showed up with in place of the
+// old one. The contact is no longer verified.
+func (b *Book) AcceptNewKey(userID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	contact, exists := b.contacts[userID]
+	if !exists {
+		return fmt.Errorf("%s is not a contact", userID)
+	}
+	if contact.NewKey == "" {
+		return fmt.Errorf("the key of %s has not changed", contact.Name())
+	}
+	contact.PublicKey = contact.NewKey
+	contact.Fingerprint = contact.NewFingerprint
+	contact.NewKey = ""
+	contact.NewFingerprint = ""
+	contact.KeyChangedAt = time.Time{}
+	contact.Verified = false
+	contact.VerifiedAt = time.Time{}
+	b.saveLocked()
+	return nil
+}
+
+// RejectNewKey forgets the key a contact last showed up with, keeping the
+// pinned one.
+func (b *Book) RejectNewKey(userID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	contact, exists := b.contacts[userID]
+	if !exists {
+		return fmt.Errorf("%s is not a contact", userID)
+	}
+	if contact.NewKey == "" {
+		return fmt.Errorf("the key of %s has not changed", contact.Name())
+	}
+	contact.NewKey = ""
+	contact.NewFingerprint = ""
+	contact.KeyChangedAt = time.Time{}
+	b.saveLocked()
+	return nil
+}
+
+// Expect makes the next key userID shows have fingerprint, unless a
+// different one is pinned already.
+func (b *Book) Expect(userID, fingerprint string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if contact, exists := b.contacts[userID]; exists && contact.Fingerprint != "" {
+		if contact.Fingerprint != fingerprint {
+			return fmt.Errorf("link key for %s does not match their pinned key", contact.Name())
+		}
+		return nil
+	}
+	b.expected[userID] = fingerprint
+	return nil
+}
+
+// Forget drops what Expect set up.
+func (b *Book) Forget(userID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.expected, userID)
+}
+
+// Check accepts the key user presented in a handshake if it is the one
+// pinned for them and records having seen them. A user we expect through an
+// invite link is added with their key; other strangers are only remembered
+// in memory, for Pin.
+func (b *Book) Check(user protocol.User) error {
+	fingerprint, err := identity.Fingerprint(user.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key from %s: %v", user.ID, err)
+	}
+	if !identity.MatchesPublicKey(user.ID, user.PublicKey) {
+		return fmt.Errorf("public key of %s does not match its id", user.ID)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	contact, exists := b.contacts[user.ID]
+	if exists && contact.Fingerprint != "" && contact.Fingerprint != fingerprint {
+		changed := &KeyChangedError{
+			UserID:      user.ID,
+			Name:        contact.Name(),
+			Pinned:      contact.Fingerprint,
+			Received:    fingerprint,
+			WasVerified: contact.Verified,
+		}
+		if contact.NewFingerprint != fingerprint {
+			contact.NewKey = user.PublicKey
+			contact.NewFingerprint = fingerprint
+			contact.KeyChangedAt = time.Now()
+		}
+		contact.Verified = false
+		contact.VerifiedAt = time.Time{}
+		b.saveLocked()
+		return changed
+	}
+	expected, expecting := b.expected[user.ID]
+	if expecting && expected != fingerprint {
+		return fmt.Errorf("key of %s does not match the invite link", user.ID)
+	}
+
+	if !exists && !expecting {
+		if len(b.strangers) >= maxContacts {
+			for userID := range b.strangers {
+				delete(b.strangers, userID)
+				break
+			}
+		}
+		b.strangers[user.ID] = user
+		return nil
+	}
+	delete(b.expected, user.ID)
+	return b.pinLocked(user, fingerprint)
+}
+
+// Pin makes userID a contact with the key they connected with, if they
+// aren't one already. It is for users we exchange private messages with.
+func (b *Book) Pin(userID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.contacts[userID]; exists {
+		return nil
+	}
+	user, seen := b.strangers[userID]
+	if !seen {
+		return nil
+	}
+	fingerprint, err := identity.Fingerprint(user.PublicKey)
+	if err != nil {
+		return err
+	}
+	return b.pinLocked(user, fingerprint)
+}
+
+// pinLocked adds or refreshes the contact for user, who showed the key
+// with fingerprint. The book is only saved when something other than the
+// time they were last seen changed. Callers hold b.mu.
+func (b *Book) pinLocked(user protocol.User, fingerprint string) error {
+	now := time.Now()
+	contact, exists := b.contacts[user.ID]
+	if !exists {
+		if len(b.contacts) >= maxContacts {
+			return ErrFull
+		}
+		contact = &Contact{UserID: user.ID, FirstSeen: now}
+		b.contacts[user.ID] = contact
+	}
+	delete(b.strangers, user.ID)
+
+	changed := !exists
+	if contact.Fingerprint == "" {
+		fmt.Printf("📌 Pinned key of %s (%s)\n", user.Username, user.ID)
+	}
+	if contact.FirstSeen.IsZero() {
+		contact.FirstSeen = now
+	}
+	if contact.Fingerprint != fingerprint || contact.PublicKey != user.PublicKey || contact.Username != user.Username {
+		contact.Fingerprint = fingerprint
+		contact.PublicKey = user.PublicKey
+		contact.Username = user.Username
+		changed = true
+	}
+	contact.LastSeen = now
+	if user.Address != "" && (len(contact.Addresses) == 0 || contact.Addresses[0] != user.Address) {
+		contact.addAddress(user.Address)
+		changed = true
+	}
+
+	if changed {
+		b.saveLocked()
+	}
+	return nil
+}
+
+func (c *Contact) addAddress(addr string) {
+	if addr == "" {
+		return
+	}
+	for i, known := range c.Addresses {
+		if known == addr {
+			// most recent first
+			copy(c.Addresses[1:i+1], c.Addresses[:i])
+			c.Addresses[0] = addr
+			return
+		}
+	}
+	c.Addresses = append([]string{addr}, c.Addresses...)
+	if len(c.Addresses) > maxAddresses {
+		c.Addresses = c.Addresses[:maxAddresses]
+	}
+}
+
+func checkNickname(nickname string) error {
+	if len(nickname) > maxNickname {
+		return fmt.Errorf("nicknames are at most %d bytes", maxNickname)
+	}
+	if strings.ContainsAny(nickname, " \t\n") {
+		return fmt.Errorf("nicknames can't contain spaces")
+	}
+	return nil
+}
+
+// nicknameFreeLocked makes sure nobody but userID goes by nickname, so
+// nicknames can stand in for IDs in commands. Callers hold b.mu.
+func (b *Book) nicknameFreeLocked(userID, nickname string) error {
+	if nickname == "" {
+		return nil
+	}
+	for id, contact := range b.contacts {
+		if id != userID && strings.EqualFold(contact.Nickname, nickname) {
+			return fmt.Errorf("%s is already the nickname of %s", nickname, id)
+		}
+	}
+	return nil
+}
+
+func copyContact(c *Contact) Contact {
+	contact := *c
+	contact.Addresses = append([]string(nil), c.Addresses...)
+	return contact
+}
+
+func (b *Book) saveLocked() {
+	if b.path == "" {
+		return
+	}
+
+	var contacts []*Contact
+	for _, contact := range b.contacts {
+		contacts = append(contacts, contact)
+	}
+	data, err := json.MarshalIndent(contacts, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(b.path, data, 0600)
+	}
+	if err != nil {
+		fmt.Printf("Error saving contacts: %v\n", err)
+	}
+}
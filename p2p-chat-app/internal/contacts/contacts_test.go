@@ -0,0 +1,204 @@
+package contacts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigratePins(t *testing.T) {
+	tests := []struct {
+		name     string
+		pins     string
+		existing *Contact
+		migrated int
+		want     string // fingerprint of alice afterwards
+	}{
+		{
+			name:     "new contact",
+			pins:     `[{"user_id":"alice","username":"Alice","fingerprint":"aa11","pinned_at":"2026-01-02T03:04:05Z"}]`,
+			migrated: 1,
+			want:     "aa11",
+		},
+		{
+			name:     "contact without a key",
+			pins:     `[{"user_id":"alice","fingerprint":"aa11"}]`,
+			existing: &Contact{UserID: "alice", Nickname: "al"},
+			migrated: 1,
+			want:     "aa11",
+		},
+		{
+			name:     "contact keeps its key",
+			pins:     `[{"user_id":"alice","fingerprint":"aa11"}]`,
+			existing: &Contact{UserID: "alice", Fingerprint: "bb22"},
+			want:     "bb22",
+		},
+		{
+			name: "pin without a fingerprint",
+			pins: `[{"user_id":"alice"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pinsPath := filepath.Join(dir, "pins.json")
+			if err := ioutil.WriteFile(pinsPath, []byte(tt.pins), 0600); err != nil {
+				t.Fatal(err)
+			}
+			book := NewBook()
+			if err := book.Load(filepath.Join(dir, "contacts.json")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing != nil {
+				book.contacts[tt.existing.UserID] = tt.existing
+			}
+
+			migrated, err := book.MigratePins(pinsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if migrated != tt.migrated {
+				t.Fatalf("migrated %d pins, want %d", migrated, tt.migrated)
+			}
+			alice, _ := book.Get("alice")
+			if alice.Fingerprint != tt.want {
+				t.Fatalf("fingerprint %q, want %q", alice.Fingerprint, tt.want)
+			}
+			if _, err := os.Stat(pinsPath); !os.IsNotExist(err) {
+				t.Fatal("pins.json left in place")
+			}
+
+			// what was migrated is saved
+			reloaded := NewBook()
+			if err := reloaded.Load(filepath.Join(dir, "contacts.json")); err != nil {
+				t.Fatal(err)
+			}
+			if alice, _ := reloaded.Get("alice"); tt.migrated > 0 && alice.Fingerprint != tt.want {
+				t.Fatalf("saved fingerprint %q, want %q", alice.Fingerprint, tt.want)
+			}
+		})
+	}
+
+	if migrated, err := NewBook().MigratePins(filepath.Join(t.TempDir(), "pins.json")); migrated != 0 || err != nil {
+		t.Fatalf("missing file: %d, %v", migrated, err)
+	}
+}
+
+func testUser(t *testing.T, name string) protocol.User {
+	t.Helper()
+	id, err := identity.NewIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := id.ExportPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protocol.User{ID: id.ID, Username: name, PublicKey: key, Address: "10.0.0.1:9000"}
+}
+
+func TestCheck(t *testing.T) {
+	alice := testUser(t, "alice")
+	mallory := testUser(t, "mallory")
+	aliceFingerprint, _ := identity.Fingerprint(alice.PublicKey)
+
+	tests := []struct {
+		name string
+		// setup prepares the book before alice connects
+		setup func(b *Book)
+		// key is what alice presents, her own if empty
+		key       string
+		ok        bool
+		contact   bool
+		keyChange bool
+	}{
+		{"stranger", func(b *Book) {}, "", true, false, false},
+		{"expected through a link", func(b *Book) { b.Expect(alice.ID, aliceFingerprint) }, "", true, true, false},
+		{"link for another key", func(b *Book) { b.Expect(alice.ID, "ffff") }, "", false, false, false},
+		{"contact added by id", func(b *Book) { b.Add(Contact{UserID: alice.ID}) }, "", true, true, false},
+		{"contact with another key", func(b *Book) {
+			b.contacts[alice.ID] = &Contact{UserID: alice.ID, Fingerprint: "ffff"}
+		}, "", false, true, true},
+		{"someone else's key", func(b *Book) {}, mallory.PublicKey, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book := NewBook()
+			if err := book.Load(filepath.Join(t.TempDir(), "contacts.json")); err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(book)
+
+			user := alice
+			if tt.key != "" {
+				user.PublicKey = tt.key
+			}
+			err := book.Check(user)
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+			_, isKeyChange := err.(*KeyChangedError)
+			if isKeyChange != tt.keyChange {
+				t.Fatalf("got %v, key change %v", err, tt.keyChange)
+			}
+			contact, exists := book.Get(alice.ID)
+			if exists != tt.contact {
+				t.Fatalf("contact = %v, want %v", exists, tt.contact)
+			}
+			if tt.ok && exists && contact.PublicKey != alice.PublicKey {
+				t.Fatal("key not filled in")
+			}
+		})
+	}
+}
+
+func TestPin(t *testing.T) {
+	book := NewBook()
+	alice := testUser(t, "alice")
+
+	if err := book.Pin(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := book.Get(alice.ID); exists {
+		t.Fatal("pinned a user who never connected")
+	}
+
+	if err := book.Check(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.Pin(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	contact, exists := book.Get(alice.ID)
+	if !exists || contact.PublicKey != alice.PublicKey || contact.Addresses[0] != alice.Address {
+		t.Fatalf("pinned %+v", contact)
+	}
+}
+
+func TestBookCap(t *testing.T) {
+	book := NewBook()
+	for i := 0; i < maxContacts; i++ {
+		if _, err := book.Add(Contact{UserID: fmt.Sprint("user", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := book.Add(Contact{UserID: "one too many"}); err != ErrFull {
+		t.Fatalf("got %v, want ErrFull", err)
+	}
+	// known contacts can still be changed
+	if _, err := book.Add(Contact{UserID: "user0", Notes: "still here"}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := testUser(t, "alice")
+	if err := book.Check(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.Pin(alice.ID); err != ErrFull {
+		t.Fatalf("got %v, want ErrFull", err)
+	}
+}
@@ -0,0 +1,324 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"p2p-chat-app/internal/transport"
+	"strconv"
+)
+
+const (
+	BackendBroadcast = "broadcast"
+	BackendMulticast = "multicast"
+	BackendMDNS      = "mdns"
+)
+
+// DefaultBackends is used when SetBackends was never called.
+var DefaultBackends = []string{BackendBroadcast, BackendMulticast, BackendMDNS}
+
+// discoveryGroupV4 and discoveryGroupV6 carry multicast announcements ("pc"
+// and "p2pc" in the last octets).
+const (
+	discoveryGroupV4 = "239.255.112.99"
+	discoveryGroupV6 = "ff02::7032:7063"
+)
+
+// Backend carries signed announcements over one kind of network. Backends
+// never trust what they receive; everything goes to the Sink, which verifies
+// it and merges it into the one peer table behind GetPeers.
+type Backend interface {
+	Name() string
+	Start(sink Sink) error
+	// Announce sends our signed announcement to everyone listening.
+	Announce(data []byte)
+	Stop()
+}
+
+// Sink is the side of the DiscoveryService that backends talk to.
+type Sink interface {
+	// Deliver hands over a received announcement and returns the response
+	// to send back to its sender, or nil.
+	Deliver(data []byte, from *net.UDPAddr) []byte
+	// Announcement returns a freshly signed message of msgType.
+	Announcement(msgType string) ([]byte, error)
+}
+
+// scope limits discovery to the interface owning the configured bind
+// address, or allows every interface when there is none.
+type scope struct {
+	ifaces []net.Interface
+	subnet *net.IPNet
+}
+
+func newScope(bindAddr string) (*scope, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var bindIP net.IP
+	if bindAddr != "" {
+		bindIP = net.ParseIP(bindAddr)
+	}
+
+	s := &scope{}
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if bindIP == nil {
+			s.ifaces = append(s.ifaces, iface)
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(bindIP) {
+				s.ifaces = append(s.ifaces, iface)
+				s.subnet = ipNet
+			}
+		}
+	}
+
+	if bindIP != nil && s.subnet == nil {
+		return nil, fmt.Errorf("no interface has address %s", bindAddr)
+	}
+	return s, nil
+}
+
+// allows reports whether a packet from addr is inside the scope.
+func (s *scope) allows(addr *net.UDPAddr) bool {
+	if s.subnet == nil {
+		return true
+	}
+	return s.subnet.Contains(addr.IP) || addr.IP.IsLinkLocalUnicast()
+}
+
+// broadcastAddr is where IPv4 broadcasts go: the directed broadcast of the
+// bound subnet, or the limited broadcast address.
+func (s *scope) broadcastAddr() net.IP {
+	if s.subnet == nil || s.subnet.IP.To4() == nil {
+		return net.IPv4bcast
+	}
+	ip := s.subnet.IP.To4()
+	mask := s.subnet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	bcast := make(net.IP, net.IPv4len)
+	for i := range bcast {
+		bcast[i] = ip[i] | ^mask[i]
+	}
+	return bcast
+}
+
+// serve reads packets from conn until it is closed.
+func serve(conn *net.UDPConn, bufSize int, s *scope, handle func(data []byte, from *net.UDPAddr)) {
+	buffer := make([]byte, bufSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || !s.allows(from) {
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		handle(packet, from)
+	}
+}
+
+// replyTo answers announcements straight back to their sender.
+func replyTo(conn *net.UDPConn, sink Sink) func(data []byte, from *net.UDPAddr) {
+	return func(data []byte, from *net.UDPAddr) {
+		if response := sink.Deliver(data, from); response != nil {
+			conn.WriteToUDP(response, from)
+		}
+	}
+}
+
+// broadcastBackend is the original discovery: IPv4 broadcasts on the
+// discovery port. It rarely crosses interfaces and is filtered on many
+// networks, but needs nothing from the network.
+type broadcastBackend struct {
+	port  int
+	scope *scope
+	conn  *net.UDPConn
+}
+
+func (b *broadcastBackend) Name() string {
+	return BackendBroadcast
+}
+
+func (b *broadcastBackend) Start(sink Sink) error {
+	// the multicast backend and other nodes on this host share the port
+	lc := net.ListenConfig{Control: transport.ReuseControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(b.port))
+	if err != nil {
+		return err
+	}
+	b.conn = pc.(*net.UDPConn)
+
+	go serve(b.conn, 4096, b.scope, replyTo(b.conn, sink))
+	return nil
+}
+
+func (b *broadcastBackend) Announce(data []byte) {
+	b.conn.WriteToUDP(data, &net.UDPAddr{IP: b.scope.broadcastAddr(), Port: b.port})
+}
+
+func (b *broadcastBackend) Stop() {
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+// multicastGroup joins a group on every interface in scope, keeping one
+// socket per interface so that sends leave through each of them.
+type multicastGroup struct {
+	addr  *net.UDPAddr
+	conns []*net.UDPConn
+	zones []string
+}
+
+func joinGroup(group string, port int, s *scope) (*multicastGroup, error) {
+	ip := net.ParseIP(group)
+	network := "udp6"
+	if ip.To4() != nil {
+		network = "udp4"
+	}
+
+	g := &multicastGroup{addr: &net.UDPAddr{IP: ip, Port: port}}
+	var lastErr error
+	for i := range s.ifaces {
+		iface := s.ifaces[i]
+		if iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		conn, err := net.ListenMulticastUDP(network, &iface, g.addr)
+		if err != nil {
+			// most often an interface without an address of this family
+			lastErr = err
+			continue
+		}
+		g.conns = append(g.conns, conn)
+		g.zones = append(g.zones, iface.Name)
+	}
+
+	if len(g.conns) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no multicast capable interface")
+		}
+		return nil, fmt.Errorf("join %s: %v", group, lastErr)
+	}
+	return g, nil
+}
+
+func (g *multicastGroup) serve(bufSize int, s *scope, handler func(conn *net.UDPConn) func(data []byte, from *net.UDPAddr)) {
+	for _, conn := range g.conns {
+		go serve(conn, bufSize, s, handler(conn))
+	}
+}
+
+func (g *multicastGroup) send(data []byte) {
+	for i := range g.conns {
+		g.sendOn(i, data)
+	}
+}
+
+// sendOn sends through the socket of the i-th joined interface only.
+func (g *multicastGroup) sendOn(i int, data []byte) {
+	addr := *g.addr
+	if addr.IP.To4() == nil {
+		addr.Zone = g.zones[i]
+	}
+	g.conns[i].WriteToUDP(data, &addr)
+}
+
+func (g *multicastGroup) close() {
+	for _, conn := range g.conns {
+		conn.Close()
+	}
+}
+
+// joinGroups joins the IPv4 group and, when enabled, the IPv6 one. Failing
+// IPv6 is not fatal since plenty of hosts run without it.
+func joinGroups(v4, v6 string, port int, ipv6 bool, s *scope) ([]*multicastGroup, error) {
+	var groups []*multicastGroup
+	g4, err := joinGroup(v4, port, s)
+	if err == nil {
+		groups = append(groups, g4)
+	}
+	if ipv6 {
+		g6, err6 := joinGroup(v6, port, s)
+		if err6 != nil {
+			fmt.Printf("IPv6 discovery unavailable: %v\n", err6)
+		} else {
+			groups = append(groups, g6)
+		}
+	}
+
+	if len(groups) == 0 {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// multicastBackend announces to the discovery groups on every interface.
+type multicastBackend struct {
+	port   int
+	ipv6   bool
+	scope  *scope
+	groups []*multicastGroup
+}
+
+func (m *multicastBackend) Name() string {
+	return BackendMulticast
+}
+
+func (m *multicastBackend) Start(sink Sink) error {
+	groups, err := joinGroups(discoveryGroupV4, discoveryGroupV6, m.port, m.ipv6, m.scope)
+	if err != nil {
+		return err
+	}
+	m.groups = groups
+
+	for _, g := range m.groups {
+		g.serve(4096, m.scope, func(conn *net.UDPConn) func([]byte, *net.UDPAddr) {
+			return replyTo(conn, sink)
+		})
+	}
+	return nil
+}
+
+func (m *multicastBackend) Announce(data []byte) {
+	for _, g := range m.groups {
+		g.send(data)
+	}
+}
+
+func (m *multicastBackend) Stop() {
+	for _, g := range m.groups {
+		g.close()
+	}
+}
+
+// newBackend builds a backend by its config name.
+func newBackend(name string, port int, ipv6 bool, s *scope) (Backend, error) {
+	switch name {
+	case BackendBroadcast:
+		return &broadcastBackend{port: port, scope: s}, nil
+	case BackendMulticast:
+		return &multicastBackend{port: port, ipv6: ipv6, scope: s}, nil
+	case BackendMDNS:
+		return newMDNSBackend(ipv6, s), nil
+	}
+	return nil, fmt.Errorf("unknown discovery backend %q (want %s, %s or %s)", name, BackendBroadcast, BackendMulticast, BackendMDNS)
+}
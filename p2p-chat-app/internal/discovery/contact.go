@@ -0,0 +1,160 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// contactTTL is how long a contact record stays usable while it is
+	// passed from peer to peer
+	contactTTL = 10 * time.Minute
+	// maxContacts caps how many records one peer exchange carries
+	maxContacts = 64
+	// maxKnownContacts caps the records we keep; once full, a new peer's
+	// record pushes out the oldest
+	maxKnownContacts = 1024
+)
+
+// Contact records are DiscoveryMessages of type "contact": a peer's own
+// signed statement of the addresses it can be reached at. Peers relay them
+// unchanged, so whoever passes one on cannot alter where it points.
+
+// SetContactAddresses sets the addresses put in our own contact record.
+func (ds *DiscoveryService) SetContactAddresses(addrs []string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.addresses = addrs
+}
+
+// Contacts returns the records to share with peers: a freshly signed one of
+// our own, if we are reachable, and the latest record of every peer we
+// know, newest first.
+func (ds *DiscoveryService) Contacts() []*DiscoveryMessage {
+	var records []*DiscoveryMessage
+	own, err := ds.contactRecord()
+	if err != nil {
+		fmt.Printf("Contact record error: %v\n", err)
+	} else if own != nil {
+		records = append(records, own)
+	}
+
+	ds.mu.RLock()
+	var relayed []*DiscoveryMessage
+	for _, record := range ds.contacts {
+		if time.Since(record.Timestamp) < contactTTL {
+			relayed = append(relayed, record)
+		}
+	}
+	ds.mu.RUnlock()
+
+	sort.Slice(relayed, func(i, j int) bool {
+		return relayed[i].Timestamp.After(relayed[j].Timestamp)
+	})
+	records = append(records, relayed...)
+	if len(records) > maxContacts {
+		records = records[:maxContacts]
+	}
+	return records
+}
+
+func (ds *DiscoveryService) contactRecord() (*DiscoveryMessage, error) {
+	ds.mu.Lock()
+	if len(ds.addresses) == 0 {
+		ds.mu.Unlock()
+		return nil, nil
+	}
+	ds.sequence++
+	record := &DiscoveryMessage{
+		Type:      "contact",
+		User:      ds.localUser,
+		Port:      ds.chatPort,
+		Addresses: ds.addresses,
+		Sequence:  ds.sequence,
+		Timestamp: time.Now(),
+	}
+	ds.mu.Unlock()
+
+	if err := record.sign(ds.identity); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// AddContacts merges contact records learned from bootstrap peers or peer
+// exchange into the peer table. It returns how many were new and how many
+// were forged.
+func (ds *DiscoveryService) AddContacts(records []*DiscoveryMessage) (added, forged int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.pruneContacts(time.Now())
+	for _, record := range records {
+		if record.Type != "contact" || len(record.Addresses) == 0 || record.User.ID == ds.localUser.ID {
+			continue
+		}
+
+		age := time.Since(record.Timestamp)
+		if age > contactTTL || age < -maxClockSkew {
+			ds.countDrop(errStale)
+			continue
+		}
+		// several peers relay the same records, so older ones are expected
+		if known, exists := ds.contacts[record.User.ID]; exists && record.Sequence <= known.Sequence {
+			continue
+		}
+		if err := record.verify(); err != nil {
+			ds.countDrop(err)
+			forged++
+			continue
+		}
+		if !ds.keepContact(record) {
+			continue
+		}
+
+		peer := &PeerInfo{}
+		if known, exists := ds.peers[record.User.ID]; exists {
+			*peer = *known
+		} else {
+			added++
+		}
+		peer.User = record.User
+		peer.Addresses = record.Addresses
+		peer.LastSeen = time.Now()
+		peer.Online = true
+		ds.updatePeer(peer)
+	}
+	return added, forged
+}
+
+// keepContact stores record as the latest of its peer, pushing out the
+// oldest record if maxKnownContacts are kept already. It reports false,
+// keeping nothing, when record is the oldest. Callers hold ds.mu.
+func (ds *DiscoveryService) keepContact(record *DiscoveryMessage) bool {
+	if _, exists := ds.contacts[record.User.ID]; !exists && len(ds.contacts) >= maxKnownContacts {
+		var oldest *DiscoveryMessage
+		for _, known := range ds.contacts {
+			if oldest == nil || known.Timestamp.Before(oldest.Timestamp) {
+				oldest = known
+			}
+		}
+		if !record.Timestamp.After(oldest.Timestamp) {
+			return false
+		}
+		delete(ds.contacts, oldest.User.ID)
+	}
+	ds.contacts[record.User.ID] = record
+	return true
+}
+
+// pruneContacts forgets records older than contactTTL. AddContacts turns
+// such records away as stale, so forgetting them lets no replay back in.
+// Callers hold ds.mu.
+func (ds *DiscoveryService) pruneContacts(now time.Time) {
+	for userID, record := range ds.contacts {
+		if now.Sub(record.Timestamp) >= contactTTL {
+			delete(ds.contacts, userID)
+		}
+	}
+}
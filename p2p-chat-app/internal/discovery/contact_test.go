@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"testing"
+	"time"
+)
+
+func signedContact(t *testing.T, id *identity.Identity, user protocol.User, seq uint64, at time.Time) *DiscoveryMessage {
+	t.Helper()
+	msg := &DiscoveryMessage{Type: "contact", User: user, Addresses: []string{"10.0.0.2:9000"}, Sequence: seq, Timestamp: at}
+	if err := msg.sign(id); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestAddContactsCapAndExpiry(t *testing.T) {
+	alice, aliceUser := testAnnouncer(t, "alice")
+	bob, bobUser := testAnnouncer(t, "bob")
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		// known records of other peers are kept already, one dated oldest
+		// and the others dated rest
+		known  int
+		oldest time.Time
+		rest   time.Time
+		// bobKnown keeps bob's record with sequence 1 among them
+		bobKnown bool
+		record   *DiscoveryMessage
+		kept     bool
+		// gone is whether the oldest known record was forgotten
+		gone bool
+	}{
+		{"first", 0, time.Time{}, time.Time{}, false, signedContact(t, bob, bobUser, 2, now), true, false},
+		{"expired records are pruned", 3, now.Add(-contactTTL), now, false, signedContact(t, bob, bobUser, 2, now), true, true},
+		{"a full table pushes out the oldest", maxKnownContacts, now.Add(-time.Minute), now.Add(-time.Second), false,
+			signedContact(t, bob, bobUser, 2, now), true, true},
+		{"a full table of newer records keeps them", maxKnownContacts, now.Add(-time.Minute), now, false,
+			signedContact(t, bob, bobUser, 2, now.Add(-2*time.Minute)), false, false},
+		{"a full table updates a known peer", maxKnownContacts, now.Add(-time.Minute), now, true,
+			signedContact(t, bob, bobUser, 2, now.Add(-2*time.Minute)), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDiscoveryService(0, alice, aliceUser)
+			for i := 0; i < tt.known; i++ {
+				userID := fmt.Sprint("peer-", i)
+				at := tt.rest
+				if i == 0 {
+					at = tt.oldest
+				}
+				if i == tt.known-1 && tt.bobKnown {
+					userID = bobUser.ID
+				}
+				ds.contacts[userID] = &DiscoveryMessage{Type: "contact", User: protocol.User{ID: userID}, Sequence: 1, Timestamp: at}
+			}
+
+			ds.AddContacts([]*DiscoveryMessage{tt.record})
+			if kept := ds.contacts[bobUser.ID] == tt.record; kept != tt.kept {
+				t.Errorf("bob's record kept = %v, want %v", kept, tt.kept)
+			}
+			if _, known := ds.peers[bobUser.ID]; known != tt.kept {
+				t.Errorf("bob known = %v, want %v", known, tt.kept)
+			}
+			if tt.known > 0 {
+				if _, exists := ds.contacts["peer-0"]; exists == tt.gone {
+					t.Errorf("oldest record forgotten = %v, want %v", !exists, tt.gone)
+				}
+			}
+			if len(ds.contacts) > maxKnownContacts {
+				t.Errorf("%d records kept", len(ds.contacts))
+			}
+		})
+	}
+}
@@ -4,107 +4,209 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"p2p-chat-app/internal/identity"
 	"p2p-chat-app/internal/protocol"
+	"strings"
 	"sync"
 	"time"
 )
 
 type PeerInfo struct {
 	Address   string    `json:"address"`
+	// Port is the chat port the peer announced, 0 if it did not say
+	Port      int       `json:"port,omitempty"`
+	// Addresses come from the peer's signed contact record
+	Addresses []string  `json:"addresses,omitempty"`
 	User      protocol.User `json:"user"`
 	LastSeen  time.Time `json:"last_seen"`
 	Online    bool      `json:"online"`
 }
 
 type DiscoveryService struct {
+	// drops comes first to keep its counters 64-bit aligned for atomics
+	drops     DropStats
 	port      int
+	bindAddr  string
+	ipv6      bool
+	chatPort  int
+	// names selects the backends built by Start
+	names     []string
+	backends  []Backend
 	peers     map[string]*PeerInfo
 	mu        sync.RWMutex
 	localUser protocol.User
-	conn      *net.UDPConn
+	identity  *identity.Identity
+	// sequence numbers our announcements; sequences holds the last one
+	// accepted from each peer, pruned by prunedAt
+	sequence  uint64
+	sequences map[string]lastSequence
+	prunedAt  time.Time
+	// addresses go in our contact record; contacts holds the latest
+	// record of every peer, up to maxKnownContacts
+	addresses []string
+	contacts  map[string]*DiscoveryMessage
+	// listeners receive peer events
+	listeners map[chan Event]bool
 	running   bool
 }
 
 type DiscoveryMessage struct {
 	Type      string        `json:"type"` 
 	User      protocol.User `json:"user"`
+	Port      int           `json:"port,omitempty"`
+	Addresses []string      `json:"addresses,omitempty"`
+	Sequence  uint64        `json:"seq"`
 	Timestamp time.Time     `json:"timestamp"`
+	Signature string        `json:"signature"`
 }
 
-func NewDiscoveryService(port int, localUser protocol.User) *DiscoveryService {
+func NewDiscoveryService(port int, userIdentity *identity.Identity, localUser protocol.User) *DiscoveryService {
 	return &DiscoveryService{
 		port:      port,
 		peers:     make(map[string]*PeerInfo),
 		localUser: localUser,
+		identity:  userIdentity,
+		// start from the clock so sequence numbers keep rising across restarts
+		sequence:  uint64(time.Now().UnixNano()),
+		sequences: make(map[string]lastSequence),
+		contacts:  make(map[string]*DiscoveryMessage),
+		listeners: make(map[chan Event]bool),
+		names:     DefaultBackends,
 	}
 }
 
+// SetBackends picks the discovery backends by name. Must be called before
+// Start.
+func (ds *DiscoveryService) SetBackends(names []string) error {
+	var selected []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, err := newBackend(name, 0, false, &scope{}); err != nil {
+			return err
+		}
+		selected = append(selected, name)
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("no discovery backend selected")
+	}
+	ds.names = selected
+	return nil
+}
+
+// SetBindAddr restricts discovery to the interface with this address. Must
+// be called before Start.
+func (ds *DiscoveryService) SetBindAddr(addr string) {
+	ds.bindAddr = addr
+}
+
+// EnableIPv6 lets the multicast and mDNS backends use IPv6 link-local
+// multicast as well. Must be called before Start.
+func (ds *DiscoveryService) EnableIPv6(enabled bool) {
+	ds.ipv6 = enabled
+}
+
+// SetChatPort sets the port announced for peers to connect to us on.
+func (ds *DiscoveryService) SetChatPort(port int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.chatPort = port
+}
+
+// SetPresence sets the presence state and status text we announce.
+func (ds *DiscoveryService) SetPresence(state, status string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.localUser.Presence = state
+	ds.localUser.Status = status
+	ds.localUser.Online = state != protocol.PresenceOffline
+}
+
 func (ds *DiscoveryService) Start() error {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", ds.port))
+	scope, err := newScope(ds.bindAddr)
 	if err != nil {
 		return err
 	}
 
-	ds.conn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return err
+	// a backend failing is not fatal as long as another one works
+	var lastErr error
+	for _, name := range ds.names {
+		backend, err := newBackend(name, ds.port, ds.ipv6, scope)
+		if err == nil {
+			err = backend.Start(ds)
+		}
+		if err != nil {
+			fmt.Printf("Discovery backend %s unavailable: %v\n", name, err)
+			lastErr = err
+			continue
+		}
+		ds.backends = append(ds.backends, backend)
+	}
+	if len(ds.backends) == 0 {
+		return lastErr
 	}
 
 	ds.running = true
-	go ds.listenLoop()
 	go ds.announceLoop()
+	go ds.expiryLoop()
 
 	return nil
 }
 
 func (ds *DiscoveryService) Stop() {
 	ds.running = false
-	if ds.conn != nil {
-		ds.conn.Close()
+	for _, backend := range ds.backends {
+		backend.Stop()
+	}
+}
+
+// Backends names the backends that started.
+func (ds *DiscoveryService) Backends() []string {
+	var names []string
+	for _, backend := range ds.backends {
+		names = append(names, backend.Name())
 	}
+	return names
 }
 
+// GetPeers returns copies of every peer currently discovered; peers not
+// heard from within peerTTL have already been expired.
 func (ds *DiscoveryService) GetPeers() []*PeerInfo {
 	ds.mu.RLock()
 	defer ds.mu.RUnlock()
 
 	var peers []*PeerInfo
 	for _, peer := range ds.peers {
-		if time.Since(peer.LastSeen) < 5*time.Minute {
-			peer.Online = true
-			peers = append(peers, peer)
-		}
+		info := *peer
+		peers = append(peers, &info)
 	}
 	return peers
 }
 
-func (ds *DiscoveryService) listenLoop() {
-	buffer := make([]byte, 1024)
-
-	for ds.running {
-		ds.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, addr, err := ds.conn.ReadFromUDP(buffer)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
-			if ds.running {
-				fmt.Printf("Discovery listen error: %v\n", err)
-			}
-			continue
-		}
+// Deliver implements Sink: it verifies an announcement received by any
+// backend, merges it into the peer table and returns our response when the
+// sender asked for one.
+func (ds *DiscoveryService) Deliver(data []byte, from *net.UDPAddr) []byte {
+	var msg DiscoveryMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil
+	}
 
-		var msg DiscoveryMessage
-		if err := json.Unmarshal(buffer[:n], &msg); err != nil {
-			continue
-		}
+	if msg.User.ID == ds.localUser.ID || (msg.Type != "announce" && msg.Type != "response") {
+		return nil
+	}
 
-		if msg.User.ID == ds.localUser.ID {
-			continue
-		}
+	if !ds.handleDiscoveryMessage(&msg, from) || msg.Type != "announce" {
+		return nil
+	}
 
-		ds.handleDiscoveryMessage(&msg, addr)
+	response, err := ds.Announcement("response")
+	if err != nil {
+		return nil
 	}
+	return response
 }
 
 func (ds *DiscoveryService) announceLoop() {
@@ -122,61 +224,65 @@ func (ds *DiscoveryService) announceLoop() {
 }
 
 func (ds *DiscoveryService) announce() {
-	msg := DiscoveryMessage{
-		Type:      "announce",
-		User:      ds.localUser,
-		Timestamp: time.Now(),
-	}
-
-	data, err := json.Marshal(msg)
+	data, err := ds.Announcement("announce")
 	if err != nil {
+		fmt.Printf("Discovery announce error: %v\n", err)
 		return
 	}
 
-	broadcastAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("255.255.255.255:%d", ds.port))
-	if err != nil {
-		return
+	for _, backend := range ds.backends {
+		backend.Announce(data)
+	}
+}
+
+// Announcement implements Sink: it builds and signs our next announcement
+// or response.
+func (ds *DiscoveryService) Announcement(msgType string) ([]byte, error) {
+	ds.mu.Lock()
+	ds.sequence++
+	msg := &DiscoveryMessage{
+		Type:      msgType,
+		User:      ds.localUser,
+		Port:      ds.chatPort,
+		Sequence:  ds.sequence,
+		Timestamp: time.Now(),
 	}
+	ds.mu.Unlock()
 
-	if ds.conn != nil {
-		ds.conn.WriteTo(data, broadcastAddr)
+	if err := msg.sign(ds.identity); err != nil {
+		return nil, err
 	}
+	return json.Marshal(msg)
 }
 
-func (ds *DiscoveryService) handleDiscoveryMessage(msg *DiscoveryMessage, addr *net.UDPAddr) {
+// handleDiscoveryMessage reports whether msg was accepted.
+func (ds *DiscoveryService) handleDiscoveryMessage(msg *DiscoveryMessage, addr *net.UDPAddr) bool {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
+	if err := ds.checkAnnouncement(msg); err != nil {
+		ds.countDrop(err)
+		return false
+	}
+
+	// keep the zone so link-local IPv6 peers stay dialable
 	peerAddr := addr.IP.String()
+	if addr.Zone != "" {
+		peerAddr += "%" + addr.Zone
+	}
 	peer := &PeerInfo{
 		Address:  peerAddr,
+		Port:     msg.Port,
 		User:     msg.User,
 		LastSeen: time.Now(),
 		Online:   true,
 	}
-
-	ds.peers[msg.User.ID] = peer
-
-	if msg.Type == "announce" {
-		go ds.sendResponse(addr)
+	if known, exists := ds.peers[msg.User.ID]; exists {
+		peer.Addresses = known.Addresses
 	}
-}
 
-func (ds *DiscoveryService) sendResponse(addr *net.UDPAddr) {
-	msg := DiscoveryMessage{
-		Type:      "response",
-		User:      ds.localUser,
-		Timestamp: time.Now(),
-	}
-
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return
-	}
-
-	if ds.conn != nil {
-		ds.conn.WriteTo(data, addr)
-	}
+	ds.updatePeer(peer)
+	return true
 }
 
 func (ds *DiscoveryService) FindPeer(userID string) *PeerInfo {
@@ -188,9 +294,6 @@ func (ds *DiscoveryService) FindPeer(userID string) *PeerInfo {
 		return nil
 	}
 
-	if time.Since(peer.LastSeen) > 5*time.Minute {
-		peer.Online = false
-	}
-
-	return peer
+	info := *peer
+	return &info
 }
@@ -0,0 +1,120 @@
+package discovery
+
+import "time"
+
+const (
+	// peerTTL is how long a peer stays discovered without being heard from
+	peerTTL        = 5 * time.Minute
+	expiryInterval = 15 * time.Second
+	// eventBuffer events may queue per subscriber before new ones are dropped
+	eventBuffer = 64
+)
+
+type EventType int
+
+const (
+	PeerAppeared EventType = iota
+	PeerUpdated
+	PeerLost
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PeerAppeared:
+		return "peer_appeared"
+	case PeerUpdated:
+		return "peer_updated"
+	default:
+		return "peer_lost"
+	}
+}
+
+// Event reports a change in the peer table. Peer is a copy taken when the
+// event happened.
+type Event struct {
+	Type EventType
+	Peer PeerInfo
+}
+
+// Subscribe returns a channel of peer events and a function that ends the
+// subscription. A subscriber that falls behind misses events rather than
+// stalling discovery, so it should GetPeers again if that matters.
+func (ds *DiscoveryService) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+
+	ds.mu.Lock()
+	ds.listeners[ch] = true
+	ds.mu.Unlock()
+
+	cancel := func() {
+		ds.mu.Lock()
+		defer ds.mu.Unlock()
+		if ds.listeners[ch] {
+			delete(ds.listeners, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// emit sends an event to every subscriber. Callers hold ds.mu.
+func (ds *DiscoveryService) emit(eventType EventType, peer *PeerInfo) {
+	event := Event{Type: eventType, Peer: *peer}
+	for ch := range ds.listeners {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// updatePeer stores peer and emits appeared or updated when something other
+// than LastSeen changed. Callers hold ds.mu.
+func (ds *DiscoveryService) updatePeer(peer *PeerInfo) {
+	known, exists := ds.peers[peer.User.ID]
+	ds.peers[peer.User.ID] = peer
+
+	switch {
+	case !exists:
+		ds.emit(PeerAppeared, peer)
+	case known.Address != peer.Address || known.Port != peer.Port ||
+		known.User != peer.User || !sameAddresses(known.Addresses, peer.Addresses):
+		ds.emit(PeerUpdated, peer)
+	}
+}
+
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// expiryLoop drops peers that have not been heard from within peerTTL.
+func (ds *DiscoveryService) expiryLoop() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for ds.running {
+		<-ticker.C
+		ds.expirePeers()
+	}
+}
+
+func (ds *DiscoveryService) expirePeers() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for userID, peer := range ds.peers {
+		if time.Since(peer.LastSeen) > peerTTL {
+			delete(ds.peers, userID)
+			peer.Online = false
+			ds.emit(PeerLost, peer)
+		}
+	}
+}
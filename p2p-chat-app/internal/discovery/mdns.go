@@ -0,0 +1,468 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mDNS/DNS-SD: every node answers PTR queries for _p2pchat._tcp.local with
+// an instance named after its user ID, and queries for that instance or its
+// host name <id>.local. The SRV record carries the chat port and the A and
+// AAAA records the addresses of the interface the answer leaves through,
+// so standard browsers can resolve and connect; the TXT record carries the
+// signed announcement in m0=, m1=, ... chunks, which is all our own browser
+// looks at. The service type is listed under _services._dns-sd._udp.local.
+const (
+	mdnsGroupV4 = "224.0.0.251"
+	mdnsGroupV6 = "ff02::fb"
+	mdnsPort    = 5353
+
+	mdnsService  = "_p2pchat._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsTTL      = 120
+
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+	// cacheFlush marks records we are the only owner of
+	cacheFlush = 0x8000
+
+	dnsFlagResponse = 0x8400
+	txtChunkSize    = 240
+	// mdnsQueryDedup swallows copies of a query arriving on several sockets
+	mdnsQueryDedup = time.Second
+)
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	data  []byte
+}
+
+type dnsPacket struct {
+	flags     uint16
+	questions []dnsQuestion
+	// records holds the answers; parsed packets hold their authority and
+	// additional records there too
+	records []dnsRecord
+	// additional is only used when writing
+	additional []dnsRecord
+}
+
+var errBadPacket = errors.New("malformed dns packet")
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func (p *dnsPacket) marshal() []byte {
+	b := make([]byte, 0, 512)
+	b = appendUint16(b, 0) // id, always zero in mDNS
+	b = appendUint16(b, p.flags)
+	b = appendUint16(b, uint16(len(p.questions)))
+	b = appendUint16(b, uint16(len(p.records)))
+	b = appendUint16(b, 0)
+	b = appendUint16(b, uint16(len(p.additional)))
+
+	for _, q := range p.questions {
+		b = appendName(b, q.name)
+		b = appendUint16(b, q.qtype)
+		b = appendUint16(b, dnsClassIN)
+	}
+	for _, r := range p.records {
+		b = appendRecord(b, r)
+	}
+	for _, r := range p.additional {
+		b = appendRecord(b, r)
+	}
+	return b
+}
+
+func appendRecord(b []byte, r dnsRecord) []byte {
+	b = appendName(b, r.name)
+	b = appendUint16(b, r.rtype)
+	b = appendUint16(b, r.class)
+	b = append(b, byte(r.ttl>>24), byte(r.ttl>>16), byte(r.ttl>>8), byte(r.ttl))
+	b = appendUint16(b, uint16(len(r.data)))
+	return append(b, r.data...)
+}
+
+// readName reads a possibly compressed name starting at off and returns it
+// with the offset just past it.
+func readName(data []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(data) {
+			return "", 0, errBadPacket
+		}
+		length := int(data[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(data) || jumps > 16 {
+				return "", 0, errBadPacket
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(data[off:]) & 0x3fff)
+			jumps++
+
+		default:
+			if off+1+length > len(data) {
+				return "", 0, errBadPacket
+			}
+			labels = append(labels, string(data[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+func parseDNS(data []byte) (*dnsPacket, error) {
+	if len(data) < 12 {
+		return nil, errBadPacket
+	}
+	p := &dnsPacket{flags: binary.BigEndian.Uint16(data[2:])}
+	questions := int(binary.BigEndian.Uint16(data[4:]))
+	records := int(binary.BigEndian.Uint16(data[6:])) +
+		int(binary.BigEndian.Uint16(data[8:])) +
+		int(binary.BigEndian.Uint16(data[10:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readName(data, off)
+		if err != nil || next+4 > len(data) {
+			return nil, errBadPacket
+		}
+		p.questions = append(p.questions, dnsQuestion{
+			name:  name,
+			qtype: binary.BigEndian.Uint16(data[next:]),
+		})
+		off = next + 4
+	}
+
+	for i := 0; i < records; i++ {
+		name, next, err := readName(data, off)
+		if err != nil || next+10 > len(data) {
+			return nil, errBadPacket
+		}
+		length := int(binary.BigEndian.Uint16(data[next+8:]))
+		if next+10+length > len(data) {
+			return nil, errBadPacket
+		}
+		p.records = append(p.records, dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(data[next:]),
+			class: binary.BigEndian.Uint16(data[next+2:]),
+			ttl:   binary.BigEndian.Uint32(data[next+4:]),
+			data:  data[next+10 : next+10+length],
+		})
+		off = next + 10 + length
+	}
+	return p, nil
+}
+
+// announcementRecords describes us as a DNS-SD instance carrying the signed
+// announcement data, and returns the instance and host names it uses.
+func announcementRecords(data []byte) (records []dnsRecord, instance, host string, err error) {
+	var msg DiscoveryMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, "", "", err
+	}
+	instance = msg.User.ID + "." + mdnsService
+	host = msg.User.ID + ".local."
+
+	srv := appendUint16(nil, 0) // priority
+	srv = appendUint16(srv, 0)  // weight
+	srv = appendUint16(srv, uint16(msg.Port))
+	srv = appendName(srv, host)
+
+	txt := []byte{3, 'v', '=', '1'}
+	for i := 0; i*txtChunkSize < len(data); i++ {
+		end := (i + 1) * txtChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		entry := "m" + strconv.Itoa(i) + "=" + string(data[i*txtChunkSize:end])
+		txt = append(txt, byte(len(entry)))
+		txt = append(txt, entry...)
+	}
+
+	return []dnsRecord{
+		{name: mdnsService, rtype: dnsTypePTR, class: dnsClassIN, ttl: mdnsTTL, data: appendName(nil, instance)},
+		{name: instance, rtype: dnsTypeSRV, class: dnsClassIN | cacheFlush, ttl: mdnsTTL, data: srv},
+		{name: instance, rtype: dnsTypeTXT, class: dnsClassIN | cacheFlush, ttl: mdnsTTL, data: txt},
+	}, instance, host, nil
+}
+
+// addressRecords gives host the addresses in addrs as A and AAAA records.
+func addressRecords(host string, addrs []net.Addr) []dnsRecord {
+	var records []dnsRecord
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			records = append(records, dnsRecord{name: host, rtype: dnsTypeA, class: dnsClassIN | cacheFlush, ttl: mdnsTTL, data: ip4})
+		} else {
+			records = append(records, dnsRecord{name: host, rtype: dnsTypeAAAA, class: dnsClassIN | cacheFlush, ttl: mdnsTTL, data: ipNet.IP.To16()})
+		}
+	}
+	return records
+}
+
+// interfaceAddrs lists the addresses of the named interface.
+func interfaceAddrs(name string) []net.Addr {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, _ := iface.Addrs()
+	return addrs
+}
+
+// asked reports whether a query wants our records, by the service type or
+// our instance or host name, and whether it enumerates service types.
+func asked(questions []dnsQuestion, instance, host string) (ours, enumeration bool) {
+	for _, q := range questions {
+		switch {
+		case strings.EqualFold(q.name, mdnsService):
+			ours = ours || q.qtype == dnsTypePTR || q.qtype == dnsTypeANY
+		case instance != "" && strings.EqualFold(q.name, instance):
+			ours = ours || q.qtype == dnsTypeSRV || q.qtype == dnsTypeTXT || q.qtype == dnsTypeANY
+		case host != "" && strings.EqualFold(q.name, host):
+			ours = ours || q.qtype == dnsTypeA || q.qtype == dnsTypeAAAA || q.qtype == dnsTypeANY
+		case strings.EqualFold(q.name, mdnsServices):
+			enumeration = enumeration || q.qtype == dnsTypePTR || q.qtype == dnsTypeANY
+		}
+	}
+	return ours, enumeration
+}
+
+// announcementFromTXT reassembles the signed announcement from a TXT
+// record's m0=, m1=, ... entries.
+func announcementFromTXT(txt []byte) []byte {
+	chunks := make(map[int]string)
+	for off := 0; off < len(txt); {
+		length := int(txt[off])
+		if off+1+length > len(txt) {
+			return nil
+		}
+		entry := string(txt[off+1 : off+1+length])
+		off += 1 + length
+
+		key := strings.SplitN(entry, "=", 2)
+		if len(key) != 2 || !strings.HasPrefix(key[0], "m") {
+			continue
+		}
+		index, err := strconv.Atoi(key[0][1:])
+		if err != nil {
+			continue
+		}
+		chunks[index] = key[1]
+	}
+
+	indexes := make([]int, 0, len(chunks))
+	for index := range chunks {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var data []byte
+	for i, index := range indexes {
+		if i != index {
+			return nil
+		}
+		data = append(data, chunks[index]...)
+	}
+	return data
+}
+
+// mdnsBackend is both responder and browser for _p2pchat._tcp.
+type mdnsBackend struct {
+	ipv6    bool
+	scope   *scope
+	groups  []*multicastGroup
+	sink    Sink
+	queries map[string]time.Time
+	// instance and host are our names, known from the first announcement
+	instance string
+	host     string
+	mu       sync.Mutex
+}
+
+func newMDNSBackend(ipv6 bool, s *scope) *mdnsBackend {
+	return &mdnsBackend{
+		ipv6:    ipv6,
+		scope:   s,
+		queries: make(map[string]time.Time),
+	}
+}
+
+func (m *mdnsBackend) Name() string {
+	return BackendMDNS
+}
+
+func (m *mdnsBackend) Start(sink Sink) error {
+	groups, err := joinGroups(mdnsGroupV4, mdnsGroupV6, mdnsPort, m.ipv6, m.scope)
+	if err != nil {
+		return err
+	}
+	m.groups = groups
+	m.sink = sink
+
+	for _, g := range m.groups {
+		g.serve(9000, m.scope, func(*net.UDPConn) func([]byte, *net.UDPAddr) {
+			return m.handlePacket
+		})
+	}
+	return nil
+}
+
+// Announce sends an unsolicited response so others learn about us, and a
+// query so that they answer with their own records.
+func (m *mdnsBackend) Announce(data []byte) {
+	m.publish(data)
+	query := (&dnsPacket{questions: []dnsQuestion{{name: mdnsService, qtype: dnsTypePTR}}}).marshal()
+	for _, g := range m.groups {
+		g.send(query)
+	}
+}
+
+// publish sends our records through every joined interface, each time with
+// the addresses of that interface for our host name.
+func (m *mdnsBackend) publish(data []byte) {
+	records, instance, host, err := announcementRecords(data)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	m.instance, m.host = instance, host
+	m.mu.Unlock()
+
+	for _, g := range m.groups {
+		for i := range g.conns {
+			packet := &dnsPacket{
+				flags:      dnsFlagResponse,
+				records:    records,
+				additional: addressRecords(host, interfaceAddrs(g.zones[i])),
+			}
+			g.sendOn(i, packet.marshal())
+		}
+	}
+}
+
+func (m *mdnsBackend) Stop() {
+	for _, g := range m.groups {
+		g.close()
+	}
+}
+
+func (m *mdnsBackend) handlePacket(data []byte, from *net.UDPAddr) {
+	packet, err := parseDNS(data)
+	if err != nil {
+		return
+	}
+
+	if packet.flags&0x8000 == 0 {
+		m.handleQuery(packet, data, from)
+		return
+	}
+
+	for _, record := range packet.records {
+		if record.rtype != dnsTypeTXT || !strings.HasSuffix(strings.ToLower(record.name), mdnsService) {
+			continue
+		}
+		if announcement := announcementFromTXT(record.data); announcement != nil {
+			m.sink.Deliver(announcement, from)
+		}
+	}
+}
+
+func (m *mdnsBackend) handleQuery(packet *dnsPacket, data []byte, from *net.UDPAddr) {
+	m.mu.Lock()
+	instance, host := m.instance, m.host
+	m.mu.Unlock()
+
+	ours, enumeration := asked(packet.questions, instance, host)
+	if !(ours || enumeration) || m.seenQuery(from, data) {
+		return
+	}
+
+	if enumeration {
+		services := &dnsPacket{flags: dnsFlagResponse, records: []dnsRecord{
+			{name: mdnsServices, rtype: dnsTypePTR, class: dnsClassIN, ttl: mdnsTTL, data: appendName(nil, mdnsService)},
+		}}
+		for _, g := range m.groups {
+			g.send(services.marshal())
+		}
+	}
+	if !ours {
+		return
+	}
+
+	response, err := m.sink.Announcement("response")
+	if err != nil {
+		fmt.Printf("mDNS response error: %v\n", err)
+		return
+	}
+	m.publish(response)
+}
+
+// seenQuery reports whether the same query from the same host was already
+// answered, since it arrives once per joined interface.
+func (m *mdnsBackend) seenQuery(from *net.UDPAddr, data []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, at := range m.queries {
+		if now.Sub(at) > mdnsQueryDedup {
+			delete(m.queries, key)
+		}
+	}
+
+	key := from.IP.String() + "|" + string(data)
+	if _, seen := m.queries[key]; seen {
+		return true
+	}
+	m.queries[key] = now
+	return false
+}
@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMDNSRecords(t *testing.T) {
+	alice, aliceUser := testAnnouncer(t, "alice")
+	msg := signedAnnouncement(t, alice, aliceUser, 1, time.Now())
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, instance, host, err := announcementRecords(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("192.168.1.20"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+	}
+	packet := &dnsPacket{flags: dnsFlagResponse, records: records, additional: addressRecords(host, addrs)}
+	parsed, err := parseDNS(packet.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byType := make(map[uint16]dnsRecord)
+	for _, r := range parsed.records {
+		byType[r.rtype] = r
+	}
+	tests := []struct {
+		name  string
+		rtype uint16
+		owner string
+		check func(r dnsRecord) bool
+	}{
+		{"PTR names the instance", dnsTypePTR, mdnsService, func(r dnsRecord) bool {
+			name, _, err := readName(r.data, 0)
+			return err == nil && name == instance
+		}},
+		{"SRV points at the host and chat port", dnsTypeSRV, instance, func(r dnsRecord) bool {
+			name, _, err := readName(r.data, 6)
+			return err == nil && name == host && binary.BigEndian.Uint16(r.data[4:]) == 9000
+		}},
+		{"TXT carries the announcement", dnsTypeTXT, instance, func(r dnsRecord) bool {
+			return bytes.Equal(announcementFromTXT(r.data), data)
+		}},
+		{"A resolves the host", dnsTypeA, host, func(r dnsRecord) bool {
+			return net.IP(r.data).Equal(net.ParseIP("192.168.1.20"))
+		}},
+		{"AAAA resolves the host", dnsTypeAAAA, host, func(r dnsRecord) bool {
+			return net.IP(r.data).Equal(net.ParseIP("fe80::1"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, exists := byType[tt.rtype]
+			if !exists {
+				t.Fatal("record missing")
+			}
+			if r.name != tt.owner {
+				t.Fatalf("owner %q, want %q", r.name, tt.owner)
+			}
+			if !tt.check(r) {
+				t.Fatalf("unexpected data % x", r.data)
+			}
+		})
+	}
+}
+
+func TestMDNSAsked(t *testing.T) {
+	instance := "0123456789abcdef." + mdnsService
+	host := "0123456789abcdef.local."
+	tests := []struct {
+		name        string
+		question    dnsQuestion
+		ours        bool
+		enumeration bool
+	}{
+		{"browse", dnsQuestion{mdnsService, dnsTypePTR}, true, false},
+		{"resolve instance", dnsQuestion{instance, dnsTypeSRV}, true, false},
+		{"instance TXT", dnsQuestion{instance, dnsTypeTXT}, true, false},
+		{"host address", dnsQuestion{host, dnsTypeA}, true, false},
+		{"host IPv6 address", dnsQuestion{"0123456789ABCDEF.local.", dnsTypeAAAA}, true, false},
+		{"service types", dnsQuestion{mdnsServices, dnsTypePTR}, false, true},
+		{"someone else's host", dnsQuestion{"printer.local.", dnsTypeA}, false, false},
+		{"other service", dnsQuestion{"_http._tcp.local.", dnsTypePTR}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ours, enumeration := asked([]dnsQuestion{tt.question}, instance, host)
+			if ours != tt.ours || enumeration != tt.enumeration {
+				t.Fatalf("got ours %v, enumeration %v", ours, enumeration)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package discovery
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"p2p-chat-app/internal/identity"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxClockSkew is how far an announcement's timestamp may be from our
+	// clock before it is treated as stale.
+	maxClockSkew = 2 * time.Minute
+	// sequenceTTL is how long the last sequence number of a peer is kept.
+	// An announcement dated up to maxClockSkew ahead stays fresh for
+	// another maxClockSkew, and anything older than it is stale, so after
+	// this long a replay is caught by its timestamp alone.
+	sequenceTTL = 2*maxClockSkew + time.Minute
+)
+
+// lastSequence is the latest sequence number accepted from a peer.
+type lastSequence struct {
+	seq uint64
+	at  time.Time
+}
+
+var (
+	errForged   = errors.New("forged announcement")
+	errStale    = errors.New("stale announcement")
+	errReplayed = errors.New("replayed announcement")
+	// errDuplicate is the latest announcement arriving again over another
+	// backend or interface; it is dropped without being counted
+	errDuplicate = errors.New("duplicate announcement")
+)
+
+// DropStats counts announcements rejected since the service started.
+type DropStats struct {
+	Forged   uint64 `json:"forged"`
+	Stale    uint64 `json:"stale"`
+	Replayed uint64 `json:"replayed"`
+}
+
+// signedBytes is what the signature covers: the message without its
+// signature.
+func (msg *DiscoveryMessage) signedBytes() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+func (msg *DiscoveryMessage) sign(id *identity.Identity) error {
+	data, err := msg.signedBytes()
+	if err != nil {
+		return err
+	}
+	signature, err := id.Sign(data)
+	if err != nil {
+		return err
+	}
+	msg.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+// verify checks that the message was signed by the key its user ID was
+// derived from, so nobody can announce on another user's behalf.
+func (msg *DiscoveryMessage) verify() error {
+	if !identity.MatchesPublicKey(msg.User.ID, msg.User.PublicKey) {
+		return errForged
+	}
+	pubKey, err := identity.ImportPublicKey(msg.User.PublicKey)
+	if err != nil {
+		return errForged
+	}
+	signature, err := hex.DecodeString(msg.Signature)
+	if err != nil || len(signature) == 0 {
+		return errForged
+	}
+	data, err := msg.signedBytes()
+	if err != nil {
+		return errForged
+	}
+	hash := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hash[:], signature); err != nil {
+		return errForged
+	}
+	return nil
+}
+
+// checkAnnouncement validates msg and records its sequence number. Callers
+// hold ds.mu.
+func (ds *DiscoveryService) checkAnnouncement(msg *DiscoveryMessage) error {
+	skew := time.Since(msg.Timestamp)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return errStale
+	}
+	if err := msg.verify(); err != nil {
+		return err
+	}
+	now := time.Now()
+	ds.pruneSequences(now)
+	if last, seen := ds.sequences[msg.User.ID]; seen && now.Sub(last.at) < sequenceTTL {
+		if msg.Sequence == last.seq {
+			return errDuplicate
+		}
+		if msg.Sequence < last.seq {
+			return errReplayed
+		}
+	}
+	ds.sequences[msg.User.ID] = lastSequence{seq: msg.Sequence, at: now}
+	return nil
+}
+
+// pruneSequences forgets peers not heard from within sequenceTTL, at most
+// once per sequenceTTL. Callers hold ds.mu.
+func (ds *DiscoveryService) pruneSequences(now time.Time) {
+	if now.Sub(ds.prunedAt) < sequenceTTL {
+		return
+	}
+	ds.prunedAt = now
+	for userID, last := range ds.sequences {
+		if now.Sub(last.at) >= sequenceTTL {
+			delete(ds.sequences, userID)
+		}
+	}
+}
+
+func (ds *DiscoveryService) countDrop(err error) {
+	switch err {
+	case errForged:
+		atomic.AddUint64(&ds.drops.Forged, 1)
+	case errStale:
+		atomic.AddUint64(&ds.drops.Stale, 1)
+	case errReplayed:
+		atomic.AddUint64(&ds.drops.Replayed, 1)
+	}
+}
+
+// DropStats reports how many forged, stale and replayed announcements were
+// dropped.
+func (ds *DiscoveryService) DropStats() DropStats {
+	return DropStats{
+		Forged:   atomic.LoadUint64(&ds.drops.Forged),
+		Stale:    atomic.LoadUint64(&ds.drops.Stale),
+		Replayed: atomic.LoadUint64(&ds.drops.Replayed),
+	}
+}
@@ -0,0 +1,88 @@
+package discovery
+
+import (
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"testing"
+	"time"
+)
+
+func testAnnouncer(t *testing.T, name string) (*identity.Identity, protocol.User) {
+	t.Helper()
+	id, err := identity.NewIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := id.ExportPublicKey()
+	return id, protocol.User{ID: id.ID, Username: name, PublicKey: key}
+}
+
+func signedAnnouncement(t *testing.T, id *identity.Identity, user protocol.User, seq uint64, at time.Time) *DiscoveryMessage {
+	t.Helper()
+	msg := &DiscoveryMessage{Type: "announce", User: user, Port: 9000, Sequence: seq, Timestamp: at}
+	if err := msg.sign(id); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestCheckAnnouncement(t *testing.T) {
+	alice, aliceUser := testAnnouncer(t, "alice")
+	mallory, _ := testAnnouncer(t, "mallory")
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		// accepted is the sequence already accepted from alice, if any
+		accepted uint64
+		msg      func() *DiscoveryMessage
+		want     error
+	}{
+		{"first", 0, func() *DiscoveryMessage { return signedAnnouncement(t, alice, aliceUser, 10, now) }, nil},
+		{"newer", 10, func() *DiscoveryMessage { return signedAnnouncement(t, alice, aliceUser, 11, now) }, nil},
+		{"duplicate", 10, func() *DiscoveryMessage { return signedAnnouncement(t, alice, aliceUser, 10, now) }, errDuplicate},
+		{"replayed", 10, func() *DiscoveryMessage { return signedAnnouncement(t, alice, aliceUser, 9, now) }, errReplayed},
+		{"too old", 0, func() *DiscoveryMessage {
+			return signedAnnouncement(t, alice, aliceUser, 10, now.Add(-2*maxClockSkew))
+		}, errStale},
+		{"too far ahead", 0, func() *DiscoveryMessage {
+			return signedAnnouncement(t, alice, aliceUser, 10, now.Add(2*maxClockSkew))
+		}, errStale},
+		{"signed by someone else", 0, func() *DiscoveryMessage { return signedAnnouncement(t, mallory, aliceUser, 10, now) }, errForged},
+		{"tampered", 0, func() *DiscoveryMessage {
+			msg := signedAnnouncement(t, alice, aliceUser, 10, now)
+			msg.Port = 6666
+			return msg
+		}, errForged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDiscoveryService(0, alice, aliceUser)
+			if tt.accepted != 0 {
+				ds.sequences[aliceUser.ID] = lastSequence{seq: tt.accepted, at: now}
+			}
+			if err := ds.checkAnnouncement(tt.msg()); err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSequencesExpire(t *testing.T) {
+	alice, aliceUser := testAnnouncer(t, "alice")
+	_, bobUser := testAnnouncer(t, "bob")
+	ds := NewDiscoveryService(0, alice, aliceUser)
+
+	long := time.Now().Add(-sequenceTTL)
+	ds.sequences[aliceUser.ID] = lastSequence{seq: 10, at: long}
+	ds.sequences[bobUser.ID] = lastSequence{seq: 10, at: long}
+
+	// a restarted peer whose clock went back is accepted once its last
+	// sequence has expired
+	if err := ds.checkAnnouncement(signedAnnouncement(t, alice, aliceUser, 5, time.Now())); err != nil {
+		t.Fatalf("got %v after the sequence expired", err)
+	}
+	if _, kept := ds.sequences[bobUser.ID]; kept {
+		t.Fatal("bob's expired sequence was not pruned")
+	}
+}
@@ -5,12 +5,19 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"strings"
 )
 
+// safetyIterations is how many times safety number hashes are iterated,
+// as in Signal.
+const safetyIterations = 5200
+
 // Identity represents a user's cryptographic identity
 type Identity struct {
 	Username   string
@@ -123,3 +130,119 @@ func ImportPrivateKey(pemStr string) (*rsa.PrivateKey, error) {
 
 	return x509.ParsePKCS1PrivateKey(block.Bytes)
 }
+
+// MatchesPublicKey reports whether userID was derived from the PEM encoded
+// public key. NewIdentity hashes the DER key while identities reloaded from
+// identity.txt hash the PEM text, so both forms are accepted.
+func MatchesPublicKey(userID, publicKeyPEM string) bool {
+	pubKey, err := ImportPublicKey(publicKeyPEM)
+	if err != nil {
+		return false
+	}
+
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(pubKeyBytes)
+	if hex.EncodeToString(hash[:])[:16] == userID {
+		return true
+	}
+
+	legacy := sha256.Sum256([]byte(publicKeyPEM))
+	return hex.EncodeToString(legacy[:])[:16] == userID
+}
+
+// VerifyFrom checks that signature over message was made by userID with the
+// PEM encoded key its ID was derived from.
+func VerifyFrom(userID, publicKeyPEM string, message, signature []byte) error {
+	if !MatchesPublicKey(userID, publicKeyPEM) {
+		return errors.New("public key does not belong to user")
+	}
+	pubKey, err := ImportPublicKey(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(message)
+	return rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hash[:], signature)
+}
+
+// Fingerprint returns the hex SHA-256 of the DER form of a PEM encoded
+// public key, the value users compare and pin.
+func Fingerprint(publicKeyPEM string) (string, error) {
+	pubKey, err := ImportPublicKey(publicKeyPEM)
+	if err != nil {
+		return "", err
+	}
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(pubKeyBytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Fingerprint returns the fingerprint of our own public key.
+func (i *Identity) Fingerprint() (string, error) {
+	pubKey, err := i.ExportPublicKey()
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(pubKey)
+}
+
+// SafetyNumber returns the 60 digit number two users compare out of band to
+// make sure they have each other's real keys. Both sides compute the same
+// number: each half comes from one user's ID and key, lower half first.
+func SafetyNumber(userID, publicKeyPEM, otherID, otherKeyPEM string) (string, error) {
+	own, err := safetyDigits(userID, publicKeyPEM)
+	if err != nil {
+		return "", err
+	}
+	other, err := safetyDigits(otherID, otherKeyPEM)
+	if err != nil {
+		return "", err
+	}
+	if other < own {
+		own, other = other, own
+	}
+
+	digits := own + other
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+// safetyDigits turns one user's ID and key into 30 digits.
+func safetyDigits(userID, publicKeyPEM string) (string, error) {
+	pubKey, err := ImportPublicKey(publicKeyPEM)
+	if err != nil {
+		return "", err
+	}
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha512.New()
+	hash.Write([]byte{0, 0}) // version
+	hash.Write(pubKeyBytes)
+	hash.Write([]byte(userID))
+	digest := hash.Sum(nil)
+	for i := 0; i < safetyIterations; i++ {
+		hash.Reset()
+		hash.Write(digest)
+		hash.Write(pubKeyBytes)
+		digest = hash.Sum(digest[:0])
+	}
+
+	var digits strings.Builder
+	for i := 0; i < 30; i += 5 {
+		chunk := uint64(digest[i])<<32 | uint64(digest[i+1])<<24 | uint64(digest[i+2])<<16 |
+			uint64(digest[i+3])<<8 | uint64(digest[i+4])
+		fmt.Fprintf(&digits, "%05d", chunk%100000)
+	}
+	return digits.String(), nil
+}
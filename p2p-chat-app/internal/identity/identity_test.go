@@ -0,0 +1,78 @@
+package identity
+
+import "testing"
+
+// Test keys and the numbers they give, worked out apart from this package
+// by hashing each key's DER form with its ID as SafetyNumber describes.
+const (
+	aliceID  = "e0729ff62d031a12"
+	aliceKey = `-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQCzMxgGQYaJ6y6l3FmklhmxCimp
+s6JgdZT303LNiaHpjsbZI5K61e2YDQvp4s3dVG4xDFxNhN02Kb9hIPwy7BRCsfvL
+lCuS7W2JvTXCb9V69WQDSwLhPMgpXIKbS2/hF1oQkv2zHqiXvxBhpQFXwnAblpRt
+t9Lz1OcKczw/rQyJ9wIDAQAB
+-----END PUBLIC KEY-----
+`
+	bobID  = "c8cdeddb90f389ba"
+	bobKey = `-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQCvebsB2hIm32rVO6Q8YEiY2mFH
+SFJbIyteK9wQg4yKe1n5xl5J/+6WOzghqs9kpad3xWZSwtXTw4YYMBFHnPG04tmm
+h6GgL/15ly3S9O/X0Vk19QEcA1Wj/Flp+C02ex3b3XDn2KxZAEuA7A95e0XIWzwJ
+axMPLeKp6t0vuIAsfQIDAQAB
+-----END PUBLIC KEY-----
+`
+	malloryID  = "d1fc880b2733bab1"
+	malloryKey = `-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQCtJFfPhg3KNtQHILBzIQkzOJEw
+WMuLZeUFYUqfpX7zwvyc7oXDTn6fPKfJD0jjNgx0gdz/z3vVhUIc6Od8L8yvloVT
+Ki5gDQlrPRxdb1V1RdovpC7qqSOSs/ABHOr98tGcWZ3H0z07eKn8dK2H8ad/IAxV
+zfv1QQ8W18Rhk2MjbwIDAQAB
+-----END PUBLIC KEY-----
+`
+)
+
+func TestSafetyNumber(t *testing.T) {
+	type user struct{ id, key string }
+	alice := user{aliceID, aliceKey}
+	bob := user{bobID, bobKey}
+	mallory := user{malloryID, malloryKey}
+
+	tests := []struct {
+		name string
+		a, b user
+		want string
+	}{
+		{"alice and bob", alice, bob, "29425 49894 11981 61382 59299 43241 37590 75835 86381 90096 44786 10190"},
+		{"alice and mallory", alice, mallory, "29425 49894 11981 61382 59299 43241 35142 51695 03282 49959 32511 29137"},
+		{"mallory and bob", mallory, bob, "35142 51695 03282 49959 32511 29137 37590 75835 86381 90096 44786 10190"},
+		{"mallory's key under alice's ID", user{aliceID, malloryKey}, bob, "37590 75835 86381 90096 44786 10190 66221 03124 53417 88048 58076 35870"},
+	}
+	seen := make(map[string]string)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SafetyNumber(tt.a.id, tt.a.key, tt.b.id, tt.b.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+			back, err := SafetyNumber(tt.b.id, tt.b.key, tt.a.id, tt.a.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if back != got {
+				t.Fatalf("the other side gets %s", back)
+			}
+		})
+		// a different key on either side gives a different number
+		if other, exists := seen[tt.want]; exists {
+			t.Errorf("%s and %s share a safety number", tt.name, other)
+		}
+		seen[tt.want] = tt.name
+	}
+
+	if _, err := SafetyNumber(aliceID, "not a key", bobID, bobKey); err == nil {
+		t.Error("got a safety number for a broken key")
+	}
+}
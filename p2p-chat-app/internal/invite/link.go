@@ -0,0 +1,86 @@
+// Package invite builds and parses p2pchat:// links, which carry everything
+// needed to reach a user and check their key:
+//
+//	p2pchat://<user id>?fp=<key fingerprint>&addr=<host:port>&addr=...&room=<room>&token=<invite token>
+//
+// Room and token are optional and ask the recipient to join that room.
+package invite
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const Scheme = "p2pchat"
+
+// Link is a parsed invite link.
+type Link struct {
+	UserID      string   `json:"user_id"`
+	Username    string   `json:"username,omitempty"`
+	Fingerprint string   `json:"fingerprint"`
+	Addresses   []string `json:"addresses"`
+	Room        string   `json:"room,omitempty"`
+	Token       string   `json:"token,omitempty"`
+}
+
+// IsLink reports whether s looks like an invite link rather than an
+// address.
+func IsLink(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), Scheme+"://")
+}
+
+// String encodes the link.
+func (l *Link) String() string {
+	query := url.Values{}
+	query.Set("fp", l.Fingerprint)
+	for _, addr := range l.Addresses {
+		query.Add("addr", addr)
+	}
+	if l.Username != "" {
+		query.Set("name", l.Username)
+	}
+	if l.Room != "" {
+		query.Set("room", l.Room)
+	}
+	if l.Token != "" {
+		query.Set("token", l.Token)
+	}
+	u := url.URL{Scheme: Scheme, Host: l.UserID, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// Parse decodes and checks an invite link.
+func Parse(s string) (*Link, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite link: %v", err)
+	}
+	if !strings.EqualFold(u.Scheme, Scheme) {
+		return nil, fmt.Errorf("invite links start with %s://", Scheme)
+	}
+
+	query := u.Query()
+	link := &Link{
+		UserID:      u.Host,
+		Username:    query.Get("name"),
+		Fingerprint: strings.ToLower(query.Get("fp")),
+		Addresses:   query["addr"],
+		Room:        query.Get("room"),
+		Token:       query.Get("token"),
+	}
+	if link.UserID == "" {
+		return nil, fmt.Errorf("invite link has no user id")
+	}
+	if fp, err := hex.DecodeString(link.Fingerprint); err != nil || len(fp) != 32 {
+		return nil, fmt.Errorf("invite link has no valid key fingerprint")
+	}
+	if len(link.Addresses) == 0 {
+		return nil, fmt.Errorf("invite link has no addresses")
+	}
+	if link.Token != "" && link.Room == "" {
+		return nil, fmt.Errorf("invite link has a token but no room")
+	}
+	return link, nil
+}
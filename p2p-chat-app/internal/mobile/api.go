@@ -2,10 +2,12 @@ package mobile
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"p2p-chat-app/internal/chat"
+	"p2p-chat-app/internal/config"
+	"p2p-chat-app/internal/invite"
 	"p2p-chat-app/internal/network"
+	"p2p-chat-app/internal/qrcode"
 	"strconv"
 	"time"
 )
@@ -13,7 +15,9 @@ import (
 type MobileAPI struct {
 	chat    *chat.EnhancedChat
 	network *network.EnhancedP2PNetwork
-	port    string
+	addr    string
+	app     AppConfig
+	push    *pushQueue // nil with push notifications off
 }
 
 type APIResponse struct {
@@ -28,31 +32,71 @@ type MessageRequest struct {
 	Room    string `json:"room,omitempty"`
 }
 
+// ConnectRequest names a peer address or a p2pchat:// invite link.
 type ConnectRequest struct {
 	Address string `json:"address"`
 }
 
-func NewMobileAPI(port string, chat *chat.EnhancedChat, network *network.EnhancedP2PNetwork) *MobileAPI {
-	return &MobileAPI{
+func NewMobileAPI(addr string, chat *chat.EnhancedChat, network *network.EnhancedP2PNetwork) *MobileAPI {
+	api := &MobileAPI{
 		chat:    chat,
 		network: network,
-		port:    port,
+		addr:    addr,
+		app: AppConfig{
+			APIBaseURL:      config.LocalURL("http", addr) + "/api",
+			WebSocketURL:    "ws://localhost:8080/ws",
+			DiscoveryPort:   9001,
+			ChatPort:        9000,
+			EnablePushNotif: true,
+			Theme:           "dark",
+		},
 	}
+	if api.app.EnablePushNotif {
+		api.push = newPushQueue()
+		chat.Notifier().AddSink(api.push)
+	}
+	return api
+}
+
+// ConfigureApp tells mobile clients where the web socket, chat listener and
+// discovery actually are.
+func (api *MobileAPI) ConfigureApp(webAddr string, chatPort, discoveryPort int) {
+	api.app.WebSocketURL = config.LocalURL("ws", webAddr) + "/ws"
+	api.app.ChatPort = chatPort
+	api.app.DiscoveryPort = discoveryPort
 }
 
 func (api *MobileAPI) Start() error {
-	http.HandleFunc("/api/messages", api.handleMessages)
-	http.HandleFunc("/api/send", api.handleSend)
-	http.HandleFunc("/api/rooms", api.handleRooms)
-	http.HandleFunc("/api/join", api.handleJoin)
-	http.HandleFunc("/api/peers", api.handlePeers)
-	http.HandleFunc("/api/connect", api.handleConnect)
-	http.HandleFunc("/api/discover", api.handleDiscover)
-	http.HandleFunc("/api/status", api.handleStatus)
-	http.HandleFunc("/api/search", api.handleSearch)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/messages", api.handleMessages)
+	mux.HandleFunc("/api/send", api.handleSend)
+	mux.HandleFunc("/api/rooms", api.handleRooms)
+	mux.HandleFunc("/api/read", api.handleRead)
+	mux.HandleFunc("/api/rooms/directory", api.handleRoomDirectory)
+	mux.HandleFunc("/api/rooms/subscriptions", api.handleSubscriptions)
+	mux.HandleFunc("/api/rooms/focus", api.handleFocus)
+	mux.HandleFunc("/api/rooms/moderation", api.handleModeration)
+	mux.HandleFunc("/api/rooms/create", api.handleCreateRoom)
+	mux.HandleFunc("/api/rooms/invite", api.handleInvite)
+	mux.HandleFunc("/api/join", api.handleJoin)
+	mux.HandleFunc("/api/invite/link", api.handleInviteLink)
+	mux.HandleFunc("/api/invite/qr.png", api.handleInviteQR)
+	mux.HandleFunc("/api/contacts", api.handleContacts)
+	mux.HandleFunc("/api/contacts/verify", api.handleVerify)
+	mux.HandleFunc("/api/notifications", api.handleNotifications)
+	mux.HandleFunc("/api/notifications/settings", api.handleNotificationSettings)
+	mux.HandleFunc("/api/peers", api.handlePeers)
+	mux.HandleFunc("/api/presence", api.handlePresence)
+	mux.HandleFunc("/api/typing", api.handleTyping)
+	mux.HandleFunc("/api/reactions", api.handleReactions)
+	mux.HandleFunc("/api/disappearing", api.handleDisappearing)
+	mux.HandleFunc("/api/connect", api.handleConnect)
+	mux.HandleFunc("/api/discover", api.handleDiscover)
+	mux.HandleFunc("/api/status", api.handleStatus)
+	mux.HandleFunc("/api/search", api.handleSearch)
 
 	// cors middleware
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
@@ -64,7 +108,7 @@ func (api *MobileAPI) Start() error {
 		http.NotFound(w, r)
 	})
 
-	return http.ListenAndServe(":"+api.port, nil)
+	return http.ListenAndServe(api.addr, mux)
 }
 
 func (api *MobileAPI) handleMessages(w http.ResponseWriter, r *http.Request) {
@@ -107,7 +151,12 @@ func (api *MobileAPI) handleSend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	err := api.chat.SendMessage(req.Content, req.To)
+	var err error
+	if req.To == "" && req.Room != "" {
+		err = api.chat.SendRoomMessage(req.Room, req.Content)
+	} else {
+		err = api.chat.SendMessage(req.Content, req.To)
+	}
 	if err != nil {
 		api.sendError(w, err.Error())
 		return
@@ -116,13 +165,123 @@ func (api *MobileAPI) handleSend(w http.ResponseWriter, r *http.Request) {
 	api.sendSuccess(w, map[string]string{"status": "sent"})
 }
 
+// handleRooms lists the rooms we are in and our private conversations with
+// their unread and mention counts.
 func (api *MobileAPI) handleRooms(w http.ResponseWriter, r *http.Request) {
 	api.setCORSHeaders(w)
 	
-	rooms := api.chat.GetRooms()
+	api.sendSuccess(w, api.chat.Conversations())
+}
+
+// handleRead marks a room or private conversation read on POST {"room": ...}
+// or {"user": ...}, which our other devices and, with read receipts on,
+// the other user hear of.
+func (api *MobileAPI) handleRead(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	if r.Method != "POST" {
+		api.sendError(w, "method not allowed")
+		return
+	}
+	
+	var req chat.ReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.sendError(w, "invalid json")
+		return
+	}
+	if err := api.chat.MarkRead(req); err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	api.sendSuccess(w, api.chat.Conversations())
+}
+
+// handleRoomDirectory lists the public rooms advertised on the network;
+// join one with /api/join.
+func (api *MobileAPI) handleRoomDirectory(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	rooms := api.chat.RoomDirectory()
 	api.sendSuccess(w, rooms)
 }
 
+// handleSubscriptions lists the rooms we are in on GET, joins one without
+// moving focus on POST {"room": ...} and leaves one on DELETE ?room=...
+func (api *MobileAPI) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	switch r.Method {
+	case "GET":
+		api.sendSuccess(w, api.chat.Subscriptions())
+	case "POST":
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if req["room"] == "" {
+			api.sendError(w, "room name required")
+			return
+		}
+		if err := api.chat.SubscribeWith(req["room"], credential(req)); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+		api.sendSuccess(w, api.chat.Subscriptions())
+	case "DELETE":
+		if err := api.chat.LeaveRoom(r.URL.Query().Get("room")); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+		api.sendSuccess(w, api.chat.Subscriptions())
+	default:
+		api.sendError(w, "method not allowed")
+	}
+}
+
+// handleFocus returns the focused room on GET and moves focus on POST
+// {"room": ...}, which marks that room read.
+func (api *MobileAPI) handleFocus(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	if r.Method == "POST" {
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if err := api.chat.SwitchRoom(req["room"]); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+	}
+	api.sendSuccess(w, map[string]string{"room": api.chat.CurrentRoom()})
+}
+
+// handleModeration returns a room's owner, admins, bans and mutes on GET
+// ?room=... and takes a ModerationRequest on POST.
+func (api *MobileAPI) handleModeration(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	room := r.URL.Query().Get("room")
+	if r.Method == "POST" {
+		var req chat.ModerationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if err := api.chat.Moderate(req); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+		room = req.Room
+	}
+	if room == "" {
+		room = api.chat.CurrentRoom()
+	}
+	api.sendSuccess(w, api.chat.Moderation(room))
+}
+
 func (api *MobileAPI) handleJoin(w http.ResponseWriter, r *http.Request) {
 	api.setCORSHeaders(w)
 	
@@ -143,10 +302,371 @@ func (api *MobileAPI) handleJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	api.chat.JoinRoom(room)
+	if err := api.chat.SubscribeWith(room, credential(req)); err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	api.chat.SwitchRoom(room)
 	api.sendSuccess(w, map[string]string{"room": room})
 }
 
+// credential picks the invite token or password from a join request.
+func credential(req map[string]string) string {
+	if req["token"] != "" {
+		return req["token"]
+	}
+	return req["password"]
+}
+
+// handleCreateRoom takes POST {"room": ..., "mode": "public"|"invite"|
+// "password", "password": ...} and joins the new room.
+func (api *MobileAPI) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	if r.Method != "POST" {
+		api.sendError(w, "method not allowed")
+		return
+	}
+	
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.sendError(w, "invalid json")
+		return
+	}
+	mode := chat.RoomMode(req["mode"])
+	if mode == "" {
+		mode = chat.ModePublic
+	}
+	if err := api.chat.CreateRoom(req["room"], mode, req["password"]); err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	api.sendSuccess(w, map[string]string{"room": req["room"], "mode": string(mode)})
+}
+
+// handleInvite takes POST {"room": ..., "invitee": ..., "duration": "24h",
+// "uses": "1"} and returns the invite token. Without an invitee anyone
+// holding the token can join.
+func (api *MobileAPI) handleInvite(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	if r.Method != "POST" {
+		api.sendError(w, "method not allowed")
+		return
+	}
+	
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.sendError(w, "invalid json")
+		return
+	}
+	var ttl time.Duration
+	if req["duration"] != "" {
+		d, err := time.ParseDuration(req["duration"])
+		if err != nil {
+			api.sendError(w, "invalid duration")
+			return
+		}
+		ttl = d
+	}
+	uses, _ := strconv.Atoi(req["uses"])
+	
+	token, err := api.chat.Invite(req["room"], req["invitee"], ttl, uses)
+	if err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	api.sendSuccess(w, map[string]string{"room": req["room"], "token": token})
+}
+
+// handleInviteLink returns our invite link, asking to join ?room= if given.
+func (api *MobileAPI) handleInviteLink(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	link, err := api.network.InviteLink(r.URL.Query().Get("room"))
+	if err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	api.sendSuccess(w, map[string]interface{}{"uri": link.String(), "link": link})
+}
+
+// handleInviteQR returns a PNG QR code of the invite link in ?uri=, or of
+// a fresh one.
+func (api *MobileAPI) handleInviteQR(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		link, err := api.network.InviteLink(r.URL.Query().Get("room"))
+		if err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+		uri = link.String()
+	} else if _, err := invite.Parse(uri); err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	
+	code, err := qrcode.Encode([]byte(uri))
+	if err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	image, err := code.PNG(8)
+	if err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(image)
+}
+
+// handleContacts lists contacts on GET, adds one on POST {"user": ...,
+// "nickname": ..., "notes": ...} where user may be an invite link, updates
+// one on PUT and removes ?user= on DELETE.
+func (api *MobileAPI) handleContacts(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		var req chat.ContactRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if req.User == "" {
+			api.sendError(w, "user required")
+			return
+		}
+		var err error
+		if r.Method == "POST" {
+			_, err = api.chat.AddContact(req.User, req.Nickname, req.Notes)
+		} else {
+			err = api.chat.UpdateContact(req)
+		}
+		if err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+	case "DELETE":
+		if !api.chat.RemoveContact(r.URL.Query().Get("user")) {
+			api.sendError(w, "not a contact")
+			return
+		}
+	default:
+		api.sendError(w, "method not allowed")
+		return
+	}
+	api.sendSuccess(w, api.chat.Contacts().List())
+}
+
+// handleVerify returns the safety numbers of ?user= on GET and changes
+// their verification on POST {"user": ..., "action": "confirm"}; the other
+// actions are reset, accept and reject, the last two for a changed key.
+func (api *MobileAPI) handleVerify(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	user := r.URL.Query().Get("user")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req chat.VerifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if err := api.chat.Verify(req); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+		user = req.User
+	default:
+		api.sendError(w, "method not allowed")
+		return
+	}
+	
+	verification, err := api.chat.Verification(user)
+	if err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	api.sendSuccess(w, verification)
+}
+
+// handleNotifications returns the notifications after ?since=<seq>. With
+// ?wait=30s it holds the request until one arrives, so the app can
+// long-poll it for push notifications.
+func (api *MobileAPI) handleNotifications(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	if api.push == nil {
+		api.sendError(w, "push notifications are disabled")
+		return
+	}
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			api.sendError(w, "invalid wait")
+			return
+		}
+		wait = d
+	}
+	
+	api.sendSuccess(w, api.push.since(since, wait))
+}
+
+// handleNotificationSettings returns the keywords, muted rooms and sinks
+// on GET and changes them on POST {"action": "keyword", "keyword": ...};
+// the other actions are unkeyword, mute and unmute, the last two with
+// "room" and mute with an optional "duration".
+func (api *MobileAPI) handleNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req chat.NotifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if err := api.chat.ConfigureNotifications(req); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+	default:
+		api.sendError(w, "method not allowed")
+		return
+	}
+	api.sendSuccess(w, api.chat.NotificationSettings())
+}
+
+// handlePresence returns our presence on GET and sets it on POST
+// {"state": "online"|"away"|"busy", "status": ...}.
+func (api *MobileAPI) handlePresence(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req chat.PresenceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if err := api.chat.SetPresence(req.State, req.Status); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+	default:
+		api.sendError(w, "method not allowed")
+		return
+	}
+	api.sendSuccess(w, api.chat.OwnPresence())
+}
+
+// handleTyping lists who is typing on GET ?room= or ?user=, and reports
+// our own typing on POST {"room": ..., "typing": true} or with "user"
+// instead of "room". Apps may POST on every keystroke; starts are
+// throttled before they reach peers.
+func (api *MobileAPI) handleTyping(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	switch r.Method {
+	case "GET":
+		req := chat.TypingRequest{Room: r.URL.Query().Get("room"), User: r.URL.Query().Get("user")}
+		if req.Room == "" && req.User == "" {
+			api.sendError(w, "room or user required")
+			return
+		}
+		api.sendSuccess(w, api.chat.Typers(req))
+	case "POST":
+		var req chat.TypingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if err := api.chat.SetTyping(req); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+		api.sendSuccess(w, map[string]bool{"typing": req.Typing})
+	default:
+		api.sendError(w, "method not allowed")
+	}
+}
+
+// handleReactions counts the reactions on a message on GET ?message=<id>,
+// and toggles ours on POST {"message_id": ..., "emoji": ...}, answering
+// with the new counts.
+func (api *MobileAPI) handleReactions(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	id := r.URL.Query().Get("message")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req chat.ReactRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if _, err := api.chat.React(req); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+		id = req.MessageID
+	default:
+		api.sendError(w, "method not allowed")
+		return
+	}
+	
+	counts, err := api.chat.Reactions(id)
+	if err != nil {
+		api.sendError(w, err.Error())
+		return
+	}
+	api.sendSuccess(w, counts)
+}
+
+// handleDisappearing returns the disappearing message timer of a
+// conversation on GET ?room= or ?user=, and sets it on POST
+// {"room": ..., "expiry": "1h"} or with "user" instead of "room"; "off"
+// turns it off.
+func (api *MobileAPI) handleDisappearing(w http.ResponseWriter, r *http.Request) {
+	api.setCORSHeaders(w)
+	
+	var req chat.ExpiryRequest
+	switch r.Method {
+	case "GET":
+		req = chat.ExpiryRequest{Room: r.URL.Query().Get("room"), User: r.URL.Query().Get("user")}
+		if req.Room == "" && req.User == "" {
+			api.sendError(w, "room or user required")
+			return
+		}
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.sendError(w, "invalid json")
+			return
+		}
+		if err := api.chat.SetExpiry(req); err != nil {
+			api.sendError(w, err.Error())
+			return
+		}
+	default:
+		api.sendError(w, "method not allowed")
+		return
+	}
+	api.sendSuccess(w, api.chat.Expiry(req))
+}
+
+// handlePeers lists connected and discovered peers, and the presence of
+// everyone we know it of.
 func (api *MobileAPI) handlePeers(w http.ResponseWriter, r *http.Request) {
 	api.setCORSHeaders(w)
 	
@@ -156,6 +676,7 @@ func (api *MobileAPI) handlePeers(w http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{
 		"connected":  connected,
 		"discovered": discovered,
+		"presence":   api.chat.Presences(),
 	}
 	
 	api.sendSuccess(w, result)
@@ -198,6 +719,8 @@ func (api *MobileAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
 		"timestamp":        time.Now(),
 		"connected_peers":  len(api.network.GetConnectedPeers()),
 		"discovered_peers": len(api.network.GetDiscoveredPeers()),
+		"send_queues":      api.chat.QueueStats(),
+		"discovery_drops":  api.network.Discovery().DropStats(),
 	}
 	
 	api.sendSuccess(w, status)
@@ -262,12 +785,6 @@ type AppConfig struct {
 }
 
 func (api *MobileAPI) GetAppConfig() *AppConfig {
-	return &AppConfig{
-		APIBaseURL:      fmt.Sprintf("http://localhost:%s/api", api.port),
-		WebSocketURL:    fmt.Sprintf("ws://localhost:8080/ws"),
-		DiscoveryPort:   9001,
-		ChatPort:        9000,
-		EnablePushNotif: true,
-		Theme:           "dark",
-	}
+	app := api.app
+	return &app
 }
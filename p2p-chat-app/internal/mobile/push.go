@@ -0,0 +1,79 @@
+package mobile
+
+import (
+	"p2p-chat-app/internal/notify"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPushed is how many notifications wait for the app to fetch them
+	maxPushed   = 100
+	maxPushWait = time.Minute
+)
+
+// PushedNotification is a notification numbered so the app can ask for
+// the ones after the last it saw.
+type PushedNotification struct {
+	Seq uint64 `json:"seq"`
+	*notify.Notification
+}
+
+// pushQueue is the notification sink behind AppConfig.EnablePushNotif. The
+// app long-polls /api/notifications and shows what it gets as push
+// notifications.
+type pushQueue struct {
+	items   []PushedNotification
+	next    uint64
+	changed chan struct{} // closed when a notification arrives
+	mu      sync.Mutex
+}
+
+func newPushQueue() *pushQueue {
+	return &pushQueue{next: 1, changed: make(chan struct{})}
+}
+
+func (q *pushQueue) Name() string { return "push" }
+
+func (q *pushQueue) Notify(n *notify.Notification) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, PushedNotification{Seq: q.next, Notification: n})
+	q.next++
+	if len(q.items) > maxPushed {
+		q.items = q.items[len(q.items)-maxPushed:]
+	}
+	close(q.changed)
+	q.changed = make(chan struct{})
+	return nil
+}
+
+// since returns the notifications after seq, waiting up to wait for one
+// if there are none yet.
+func (q *pushQueue) since(seq uint64, wait time.Duration) []PushedNotification {
+	if wait > maxPushWait {
+		wait = maxPushWait
+	}
+	deadline := time.After(wait)
+	for {
+		q.mu.Lock()
+		pending := []PushedNotification{}
+		for _, item := range q.items {
+			if item.Seq > seq {
+				pending = append(pending, item)
+			}
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		if len(pending) > 0 || wait <= 0 {
+			return pending
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return pending
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Priority decides which stream's frames go out first when several streams
+// have data queued on the same connection.
+type Priority uint8
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+)
+
+type frameType uint8
+
+const (
+	frameOpen frameType = iota + 1
+	frameData
+	frameWindow
+	frameClose
+)
+
+const (
+	headerSize = 10
+	// maxDataFrame bounds how long a low priority stream can hold the wire
+	// before a queued chat frame gets its turn.
+	maxDataFrame  = 16 * 1024
+	maxFrameSize  = 64 * 1024
+	initialWindow = 256 * 1024
+	queueDepth    = 64
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+	errTimeout       = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "mux: i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+type frame struct {
+	typ      frameType
+	priority Priority
+	streamID uint32
+	payload  []byte
+}
+
+// Session multiplexes logical streams over a single peer connection. Every
+// frame carries a 10-byte header: type, priority, stream ID and payload
+// length.
+type Session struct {
+	conn    net.Conn
+	reader  io.Reader
+	streams map[uint32]*Stream
+	nextID  uint32
+	parity  uint32 // nextID%2, which the remote side must not open
+	mu      sync.Mutex
+
+	queues   [PriorityLow + 1]chan *frame
+	accepted chan *Stream
+	done     chan struct{}
+	closeErr error
+	once     sync.Once
+}
+
+// NewSession starts multiplexing over conn. Reads go through r so that any
+// bytes already buffered during the handshake are not lost. The dialing side
+// passes initiator=true; it allocates odd stream IDs, the other side even.
+func NewSession(conn net.Conn, r io.Reader, initiator bool) *Session {
+	s := &Session{
+		conn:     conn,
+		reader:   r,
+		streams:  make(map[uint32]*Stream),
+		accepted: make(chan *Stream, queueDepth),
+		done:     make(chan struct{}),
+	}
+	if initiator {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	s.parity = s.nextID % 2
+	for i := range s.queues {
+		s.queues[i] = make(chan *frame, queueDepth)
+	}
+
+	go s.readLoop()
+	go s.writeLoop()
+	return s
+}
+
+// Open creates a stream of the given kind; the remote side receives it from
+// Accept with the same kind.
+func (s *Session) Open(kind string, priority Priority) (*Stream, error) {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id, kind, priority)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.enqueue(&frame{typ: frameOpen, priority: priority, streamID: id, payload: []byte(kind)}, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept returns the next stream opened by the remote side.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accepted:
+		return stream, nil
+	case <-s.done:
+		return nil, s.err()
+	}
+}
+
+// Done is closed when the session has shut down.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) Close() error {
+	s.shutdown(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) shutdown(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closeErr = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.remoteClose()
+		}
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeErr
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// enqueue hands f to the writer. cancel, when non-nil, aborts the wait
+// (used for write deadlines).
+func (s *Session) enqueue(f *frame, cancel <-chan time.Time) error {
+	select {
+	case s.queues[f.priority] <- f:
+		return nil
+	case <-s.done:
+		return s.err()
+	case <-cancel:
+		return errTimeout
+	}
+}
+
+func (s *Session) writeLoop() {
+	header := make([]byte, headerSize)
+	for {
+		f := s.nextFrame()
+		if f == nil {
+			return
+		}
+
+		header[0] = byte(f.typ)
+		header[1] = byte(f.priority)
+		binary.BigEndian.PutUint32(header[2:6], f.streamID)
+		binary.BigEndian.PutUint32(header[6:10], uint32(len(f.payload)))
+
+		if _, err := s.conn.Write(append(header, f.payload...)); err != nil {
+			s.shutdown(err)
+			return
+		}
+	}
+}
+
+// nextFrame takes from the highest priority queue that has anything ready.
+func (s *Session) nextFrame() *frame {
+	for {
+		for _, queue := range s.queues {
+			select {
+			case f := <-queue:
+				return f
+			default:
+			}
+		}
+
+		select {
+		case f := <-s.queues[PriorityHigh]:
+			return f
+		case f := <-s.queues[PriorityNormal]:
+			return f
+		case f := <-s.queues[PriorityLow]:
+			return f
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+func (s *Session) readLoop() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			s.shutdown(err)
+			return
+		}
+
+		f := &frame{
+			typ:      frameType(header[0]),
+			priority: Priority(header[1]),
+			streamID: binary.BigEndian.Uint32(header[2:6]),
+		}
+		length := binary.BigEndian.Uint32(header[6:10])
+		if length > maxFrameSize || f.priority > PriorityLow {
+			s.shutdown(fmt.Errorf("mux: malformed frame header"))
+			return
+		}
+
+		f.payload = make([]byte, length)
+		if _, err := io.ReadFull(s.reader, f.payload); err != nil {
+			s.shutdown(err)
+			return
+		}
+
+		if err := s.handleFrame(f); err != nil {
+			s.shutdown(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(f *frame) error {
+	s.mu.Lock()
+	stream, exists := s.streams[f.streamID]
+	s.mu.Unlock()
+
+	switch f.typ {
+	case frameOpen:
+		if exists {
+			return fmt.Errorf("mux: stream %d opened twice", f.streamID)
+		}
+		// IDs of our parity are ours to hand out; taking one could hijack
+		// a stream we are about to open
+		if f.streamID == 0 || f.streamID%2 == s.parity {
+			return fmt.Errorf("mux: remote opened stream %d with our parity", f.streamID)
+		}
+		stream = newStream(s, f.streamID, string(f.payload), f.priority)
+		s.mu.Lock()
+		s.streams[f.streamID] = stream
+		s.mu.Unlock()
+
+		select {
+		case s.accepted <- stream:
+		default:
+			// nobody is accepting; refuse rather than stall every stream
+			stream.Close()
+		}
+
+	case frameData:
+		if !exists {
+			return nil
+		}
+		return stream.receive(f.payload)
+
+	case frameWindow:
+		if !exists || len(f.payload) != 4 {
+			return nil
+		}
+		stream.grant(binary.BigEndian.Uint32(f.payload))
+
+	case frameClose:
+		if exists {
+			stream.remoteClose()
+		}
+
+	default:
+		return fmt.Errorf("mux: unknown frame type %d", f.typ)
+	}
+	return nil
+}
+
+// Stream is one logical, flow-controlled byte stream within a Session. It
+// implements net.Conn so it can stand in wherever a peer connection is used.
+type Stream struct {
+	session  *Session
+	id       uint32
+	kind     string
+	priority Priority
+
+	mu           sync.Mutex
+	buf          []byte
+	consumed     uint32
+	sendWindow   uint32
+	localClosed  bool
+	remoteClosed bool
+
+	readable      chan struct{}
+	writable      chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(s *Session, id uint32, kind string, priority Priority) *Stream {
+	return &Stream{
+		session:    s,
+		id:         id,
+		kind:       kind,
+		priority:   priority,
+		sendWindow: initialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// Kind is the stream type the opener asked for, used to pick a handler.
+func (st *Stream) Kind() string {
+	return st.kind
+}
+
+func (st *Stream) Priority() Priority {
+	return st.priority
+}
+
+func (st *Stream) Session() *Session {
+	return st.session
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			st.consumed += uint32(n)
+
+			var update uint32
+			if st.consumed >= initialWindow/2 && !st.remoteClosed {
+				update = st.consumed
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, update)
+				st.session.enqueue(&frame{typ: frameWindow, priority: PriorityHigh, streamID: st.id, payload: payload}, nil)
+			}
+			return n, nil
+		}
+		if st.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		if st.localClosed || st.remoteClosed {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		chunk := len(p) - written
+		if chunk > maxDataFrame {
+			chunk = maxDataFrame
+		}
+		if uint32(chunk) > st.sendWindow {
+			chunk = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(chunk)
+		deadline := st.writeDeadline
+		st.mu.Unlock()
+
+		payload := make([]byte, chunk)
+		copy(payload, p[written:written+chunk])
+		if err := st.session.enqueue(&frame{typ: frameData, priority: st.priority, streamID: st.id, payload: payload}, deadlineChan(deadline)); err != nil {
+			return written, err
+		}
+		written += chunk
+	}
+	return written, nil
+}
+
+// Close half-closes the stream: the remote side reads EOF once it has
+// drained what was sent. The stream is forgotten once both sides closed.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	both := st.remoteClosed
+	st.mu.Unlock()
+
+	notify(st.writable)
+	if both {
+		st.session.removeStream(st.id)
+	}
+	return st.session.enqueue(&frame{typ: frameClose, priority: st.priority, streamID: st.id}, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
+
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(st.buf)+len(data)) > initialWindow {
+		return fmt.Errorf("mux: stream %d overran its receive window", st.id)
+	}
+	st.buf = append(st.buf, data...)
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	both := st.localClosed
+	st.mu.Unlock()
+
+	notify(st.readable)
+	notify(st.writable)
+	if both {
+		st.session.removeStream(st.id)
+	}
+}
+
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return errTimeout
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-deadlineChan(deadline):
+		return errTimeout
+	case <-st.session.done:
+		// the caller re-checks the stream, which shutdown has closed
+		return nil
+	}
+}
+
+func deadlineChan(deadline time.Time) <-chan time.Time {
+	if deadline.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(deadline))
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
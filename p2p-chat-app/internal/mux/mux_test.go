@@ -0,0 +1,157 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func sessionPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	dialer := NewSession(a, a, true)
+	listener := NewSession(b, b, false)
+	t.Cleanup(func() {
+		dialer.Close()
+		listener.Close()
+	})
+	return dialer, listener
+}
+
+func acceptWithin(t *testing.T, s *Session) *Stream {
+	t.Helper()
+	accepted := make(chan *Stream, 1)
+	go func() {
+		stream, err := s.Accept()
+		if err == nil {
+			accepted <- stream
+		}
+	}()
+	select {
+	case stream := <-accepted:
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream accepted")
+		return nil
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"one frame", 100},
+		{"several frames", 3 * maxDataFrame},
+		// more than the window, so the writer waits for window updates
+		{"beyond the window", 4 * initialWindow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer, listener := sessionPair(t)
+			out, err := dialer.Open("file", PriorityLow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in := acceptWithin(t, listener)
+			if in.Kind() != "file" {
+				t.Fatalf("kind %q, want file", in.Kind())
+			}
+
+			data := bytes.Repeat([]byte("0123456789abcdef"), tt.size/16+1)[:tt.size]
+			go func() {
+				out.Write(data)
+				out.Close()
+			}()
+			got, err := io.ReadAll(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes, want the %d written", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestOpensFromBothSides(t *testing.T) {
+	dialer, listener := sessionPair(t)
+	for _, s := range []*Session{dialer, listener} {
+		other := listener
+		if s == listener {
+			other = dialer
+		}
+		if _, err := s.Open("chat", PriorityHigh); err != nil {
+			t.Fatal(err)
+		}
+		acceptWithin(t, other)
+	}
+}
+
+// rawOpen writes an open frame for id the way a misbehaving peer would.
+func rawOpen(conn net.Conn, id uint32) {
+	header := make([]byte, headerSize)
+	header[0] = byte(frameOpen)
+	header[1] = byte(PriorityNormal)
+	binary.BigEndian.PutUint32(header[2:6], id)
+	binary.BigEndian.PutUint32(header[6:10], 4)
+	conn.Write(append(header, []byte("chat")...))
+}
+
+func TestRemoteOpenParity(t *testing.T) {
+	tests := []struct {
+		name      string
+		initiator bool
+		id        uint32
+		accepted  bool
+	}{
+		{"dialer takes even", true, 2, true},
+		{"dialer refuses odd", true, 1, false},
+		{"listener takes odd", false, 3, true},
+		{"listener refuses even", false, 4, false},
+		{"zero is nobody's", false, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			s := NewSession(local, local, tt.initiator)
+			defer s.Close()
+			// drain whatever the session writes back
+			go io.Copy(io.Discard, remote)
+			go rawOpen(remote, tt.id)
+
+			select {
+			case <-s.Done():
+				if tt.accepted {
+					t.Fatalf("session closed: %v", s.err())
+				}
+			case <-time.After(time.Second):
+				if !tt.accepted {
+					t.Fatal("session kept a stream opened with its own parity")
+				}
+				acceptWithin(t, s)
+			}
+			remote.Close()
+		})
+	}
+}
+
+func TestSessionCloseEndsStreams(t *testing.T) {
+	dialer, listener := sessionPair(t)
+	out, err := dialer.Open("chat", PriorityHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := acceptWithin(t, listener)
+
+	dialer.Close()
+	if _, err := out.Write([]byte("x")); err == nil {
+		t.Fatal("write on a closed session succeeded")
+	}
+	if _, err := io.ReadAll(in); err != nil {
+		t.Fatalf("reading after the remote closed: %v", err)
+	}
+}
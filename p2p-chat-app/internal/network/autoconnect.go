@@ -0,0 +1,71 @@
+package network
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/discovery"
+	"time"
+)
+
+// autoConnectRetry is how often discovered peers we are not connected to
+// are tried again.
+const autoConnectRetry = 1 * time.Minute
+
+// AutoConnect connects to every discovered peer and keeps connecting to
+// peers as discovery finds them, until the network stops.
+func (n *EnhancedP2PNetwork) AutoConnect() {
+	events, cancel := n.discovery.Subscribe()
+	defer cancel()
+
+	ticker := time.NewTicker(autoConnectRetry)
+	defer ticker.Stop()
+
+	dialing := make(map[string]bool)
+	done := make(chan string, 1)
+	// stopped lets dials finishing after we return exit
+	stopped := make(chan struct{})
+	defer close(stopped)
+	dial := func(peer *discovery.PeerInfo) {
+		if dialing[peer.User.ID] || n.isConnected(peer.User.ID) {
+			return
+		}
+		if _, banned := n.reputation.IsBanned(peer.User.ID, ""); banned {
+			return
+		}
+
+		dialing[peer.User.ID] = true
+		go func() {
+			if err := n.ConnectToPeer(peer); err != nil {
+				fmt.Printf("auto-connect to %s failed: %v\n", peer.User.Username, err)
+			} else {
+				fmt.Printf("🔗 auto-connected to %s\n", peer.User.Username)
+			}
+			select {
+			case done <- peer.User.ID:
+			case <-stopped:
+			}
+		}()
+	}
+
+	for _, peer := range n.discovery.GetPeers() {
+		dial(peer)
+	}
+
+	for n.isRunning() {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type != discovery.PeerLost {
+				peer := event.Peer
+				dial(&peer)
+			}
+		case userID := <-done:
+			delete(dialing, userID)
+		case <-ticker.C:
+			for _, peer := range n.discovery.GetPeers() {
+				dial(peer)
+			}
+		}
+	}
+}
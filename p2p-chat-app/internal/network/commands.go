@@ -0,0 +1,86 @@
+package network
+
+import (
+	"fmt"
+	"p2p-chat-app/internal/qrcode"
+	"strings"
+	"time"
+)
+
+// registerCommands adds the terminal commands that need the network layer.
+func (n *EnhancedP2PNetwork) registerCommands() {
+	n.chat.RegisterCommand("peers", "/peers [--scores]", "List peers, or their reputation", func(args []string) {
+		if len(args) > 0 && args[0] == "--scores" {
+			n.ListPeerScores()
+			return
+		}
+		n.ListPeers()
+	})
+
+	// /ban and /unban act on the current room, so peers are blocked instead
+	n.chat.RegisterCommand("block", "/block <user> [dur]", "Refuse a peer's connections (e.g. 30m, 24h; permanent if omitted)", func(args []string) {
+		if len(args) == 0 {
+			fmt.Println("Usage: /block <user_id> [duration] [reason]")
+			return
+		}
+
+		var duration time.Duration
+		reasonArgs := args[1:]
+		if len(args) > 1 {
+			if d, err := time.ParseDuration(args[1]); err == nil {
+				duration = d
+				reasonArgs = args[2:]
+			}
+		}
+		reason := strings.Join(reasonArgs, " ")
+		if reason == "" {
+			reason = "banned by admin"
+		}
+
+		ban := n.BanPeer(args[0], duration, reason)
+		fmt.Printf("🚫 Blocked %s (%s)\n", args[0], describeBan(ban))
+	})
+
+	n.chat.RegisterCommand("unblock", "/unblock <user>", "Lift a block", func(args []string) {
+		if len(args) == 0 {
+			fmt.Println("Usage: /unblock <user_id>")
+			return
+		}
+		if n.UnbanPeer(args[0]) {
+			fmt.Printf("✅ Unblocked %s\n", args[0])
+		} else {
+			fmt.Printf("%s is not blocked\n", args[0])
+		}
+	})
+
+	n.chat.RegisterCommand("connect", "/connect <addr|link>", "Connect to a peer by address or p2pchat:// invite link", func(args []string) {
+		if len(args) == 0 {
+			fmt.Println("Usage: /connect <host:port|p2pchat://...>")
+			return
+		}
+		if err := n.Connect(args[0]); err != nil {
+			fmt.Printf("Error connecting: %v\n", err)
+		}
+	})
+
+	n.chat.RegisterCommand("link", "/link [room]", "Show your invite link and its QR code, optionally inviting to a room", func(args []string) {
+		room := ""
+		if len(args) > 0 {
+			room = args[0]
+		}
+		link, err := n.InviteLink(room)
+		if err != nil {
+			fmt.Printf("Error creating invite link: %v\n", err)
+			return
+		}
+
+		uri := link.String()
+		fmt.Printf("🔗 Your invite link:\n%s\n", uri)
+		code, err := qrcode.Encode([]byte(uri))
+		if err != nil {
+			fmt.Printf("Error drawing QR code: %v\n", err)
+			return
+		}
+		fmt.Print(code.Terminal())
+	})
+}
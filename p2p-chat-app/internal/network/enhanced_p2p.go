@@ -2,37 +2,92 @@ package network
 
 import (
 	"bufio"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
 	"p2p-chat-app/internal/blockchain"
 	"p2p-chat-app/internal/chat"
+	"p2p-chat-app/internal/contacts"
 	"p2p-chat-app/internal/discovery"
 	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/invite"
+	"p2p-chat-app/internal/mux"
 	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/transport"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type EnhancedP2PNetwork struct {
-	identity    *identity.Identity
-	peers       map[string]*EnhancedPeer
-	mu          sync.RWMutex
-	chat        *chat.EnhancedChat
-	discovery   *discovery.DiscoveryService
-	blockchain  *blockchain.Blockchain
-	listener    net.Listener
-	running     bool
+	identity *identity.Identity
+	peers    map[string]*EnhancedPeer
+	mu       sync.RWMutex
+	// registerMu keeps adding and removing peers in the same order in
+	// peers and in the chat
+	registerMu sync.Mutex
+	chat       *chat.EnhancedChat
+	discovery  *discovery.DiscoveryService
+	blockchain *blockchain.Blockchain
+	listener   net.Listener
+	rendezvous *rendezvousClient
+	handlers   map[string]StreamHandler
+	reputation *Reputation
+	contacts   *contacts.Book
+	// advertised goes out as User.Address in our handshake
+	advertised string
+	// advertPort overrides the listen port announced in discovery
+	advertPort int
+	bootstrap  []string
+	running    bool // between Start and Stop; guarded by mu like the rest
 }
 
 type EnhancedPeer struct {
 	Conn     net.Conn
+	Session  *mux.Session
 	User     protocol.User
-	LastSeen time.Time
 	Verified bool
+
+	// initiator is true when we dialed the connection
+	initiator bool
+	// fingerprint is of the key the peer proved in the handshake
+	fingerprint string
+
+	// chat is our outbound chat stream; the peer's own arrives via Accept
+	chat *mux.Stream
+
+	// lastSeen is written by every stream handler of the peer
+	lastSeen time.Time
+	seenMu   sync.Mutex
+}
+
+// LastSeen is when the peer last sent us anything.
+func (p *EnhancedPeer) LastSeen() time.Time {
+	p.seenMu.Lock()
+	defer p.seenMu.Unlock()
+	return p.lastSeen
 }
 
-func NewEnhancedP2PNetwork(userIdentity *identity.Identity) *EnhancedP2PNetwork {
+func (p *EnhancedPeer) touch() {
+	p.seenMu.Lock()
+	p.lastSeen = time.Now()
+	p.seenMu.Unlock()
+}
+
+// defaultChatPort is assumed for discovered peers that predate announcing
+// their chat port.
+const defaultChatPort = 9000
+
+const (
+	// handshakeTimeout bounds the handshake and key proof of a new peer
+	handshakeTimeout = 15 * time.Second
+	// maxHandshakeLine bounds one handshake line, which carries a key
+	maxHandshakeLine = 16 * 1024
+)
+
+func NewEnhancedP2PNetwork(userIdentity *identity.Identity, discoveryPort int) *EnhancedP2PNetwork {
 	pubKey, _ := userIdentity.ExportPublicKey()
 	user := protocol.User{
 		ID:        userIdentity.ID,
@@ -41,90 +96,269 @@ func NewEnhancedP2PNetwork(userIdentity *identity.Identity) *EnhancedP2PNetwork
 		Online:    true,
 	}
 
-	discovery := discovery.NewDiscoveryService(9001, user)
+	discovery := discovery.NewDiscoveryService(discoveryPort, userIdentity, user)
 
-	return &EnhancedP2PNetwork{
-		identity:  userIdentity,
-		peers:     make(map[string]*EnhancedPeer),
-		discovery: discovery,
+	n := &EnhancedP2PNetwork{
+		identity:   userIdentity,
+		peers:      make(map[string]*EnhancedPeer),
+		discovery:  discovery,
+		handlers:   make(map[string]StreamHandler),
+		reputation: NewReputation(),
+		contacts:   contacts.NewBook(),
 	}
+	n.HandleStream(StreamChat, n.handleChatStream)
+	n.HandleStream(StreamPing, n.handlePingStream)
+	n.HandleStream(StreamPEX, n.handlePEXStream)
+
+	return n
 }
 
 func (n *EnhancedP2PNetwork) SetChat(chat *chat.EnhancedChat) {
 	n.chat = chat
+	n.chat.SetDisconnectHandler(n.DisconnectPeer)
+	n.chat.SetPresenceHandler(n.updatePresence)
+	n.chat.SetContacts(n.contacts)
+	n.registerCommands()
+}
+
+// DisconnectPeer closes the connection to userID; the usual cleanup runs
+// once its session ends.
+func (n *EnhancedP2PNetwork) DisconnectPeer(userID string) {
+	n.mu.RLock()
+	peer, connected := n.peers[userID]
+	n.mu.RUnlock()
+
+	if connected {
+		peer.Session.Close()
+	}
+}
+
+// updatePresence keeps the users of connected peers, and the user we
+// announce in discovery, in step with their presence.
+func (n *EnhancedP2PNetwork) updatePresence(p protocol.Presence) {
+	if p.UserID == n.identity.ID {
+		n.discovery.SetPresence(p.State, p.Status)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if peer, exists := n.peers[p.UserID]; exists {
+		peer.User.Online = p.State != protocol.PresenceOffline
+		peer.User.Presence = p.State
+		peer.User.Status = p.Status
+	}
 }
 
 func (n *EnhancedP2PNetwork) SetBlockchain(bc *blockchain.Blockchain) {
 	n.blockchain = bc
 }
 
-func (n *EnhancedP2PNetwork) Start() error {
-	n.running = true
-	
-	if err := n.discovery.Start(); err != nil {
-		return fmt.Errorf("failed to start discovery: %v", err)
+// Discovery exposes the discovery service for configuration before Start.
+func (n *EnhancedP2PNetwork) Discovery() *discovery.DiscoveryService {
+	return n.discovery
+}
+
+// LoadContacts restores the contacts and keeps them saved at path. Keys
+// pinned in a pins.json next to it by older versions are moved in.
+func (n *EnhancedP2PNetwork) LoadContacts(path string) error {
+	if err := n.contacts.Load(path); err != nil {
+		return err
+	}
+	migrated, err := n.contacts.MigratePins(filepath.Join(filepath.Dir(path), "pins.json"))
+	if migrated > 0 {
+		fmt.Printf("📌 Moved %d pinned keys into your contacts\n", migrated)
 	}
+	return err
+}
+
+// SetAdvertisePort announces port in discovery instead of the port we
+// listen on, for setups with port forwarding in between.
+func (n *EnhancedP2PNetwork) SetAdvertisePort(port int) {
+	n.mu.Lock()
+	n.advertPort = port
+	n.mu.Unlock()
+
+	if port != 0 {
+		n.discovery.SetChatPort(port)
+	}
+}
+
+func (n *EnhancedP2PNetwork) Start() error {
+	n.setRunning(true)
+
+	// LAN discovery and peer exchange both hand out our addresses, which
+	// is what dialing through a proxy is meant to hide
+	if transport.ProxyEnabled() {
+		fmt.Println("🧅 Proxy configured, discovery and peer exchange disabled")
+	} else {
+		if err := n.discovery.Start(); err != nil {
+			return fmt.Errorf("failed to start discovery: %v", err)
+		}
+
+		fmt.Println("🔍 Discovery service started")
 
-	fmt.Println("🔍 Discovery service started")
+		go n.pexLoop()
+	}
+	n.mu.RLock()
+	if len(n.bootstrap) > 0 {
+		go n.bootstrapLoop(n.bootstrap)
+	}
+	n.mu.RUnlock()
 	return nil
 }
 
 func (n *EnhancedP2PNetwork) Stop() {
-	n.running = false
-	
+	n.setRunning(false)
+
 	if n.discovery != nil {
 		n.discovery.Stop()
 	}
-	
+
 	if n.listener != nil {
 		n.listener.Close()
 	}
-	
+
 	n.mu.Lock()
+	if n.rendezvous != nil {
+		n.rendezvous.close()
+	}
 	for _, peer := range n.peers {
-		peer.Conn.Close()
+		peer.Session.Close()
 	}
 	n.mu.Unlock()
 }
 
+func (n *EnhancedP2PNetwork) setRunning(running bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.running = running
+}
+
+// isRunning reports whether the network is started, for the loops that
+// stop with it.
+func (n *EnhancedP2PNetwork) isRunning() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.running
+}
+
+// Listen accepts peers on addr, which may name any registered transport
+// (tcp://, unix://, mem://, ws://); a bare host:port means tcp.
 func (n *EnhancedP2PNetwork) Listen(addr string) error {
 	var err error
-	n.listener, err = net.Listen("tcp", addr)
+	n.listener, err = transport.Listen(addr)
 	if err != nil {
 		return err
 	}
 
 	fmt.Printf("🎧 Listening for connections on %s\n", addr)
 
+	n.mu.RLock()
+	advertisePort := n.advertPort
+	n.mu.RUnlock()
+	if tcpAddr, ok := n.listener.Addr().(*net.TCPAddr); ok && advertisePort == 0 {
+		n.discovery.SetChatPort(tcpAddr.Port)
+	}
+	n.discovery.SetContactAddresses(n.contactAddresses())
+
 	go func() {
-		for n.running {
+		for n.isRunning() {
 			conn, err := n.listener.Accept()
 			if err != nil {
-				if n.running {
+				if n.isRunning() {
 					fmt.Printf("Accept error: %v\n", err)
 				}
 				continue
 			}
 
-			go n.handleConnection(conn)
+			go n.handleConnection(conn, false)
 		}
 	}()
 
 	return nil
 }
 
+// Connect dials addr over its transport and, when a tcp dial fails and a
+// rendezvous server is configured, retries with a hole punch and finally
+// through its relay. addr may also be a p2pchat:// invite link.
 func (n *EnhancedP2PNetwork) Connect(addr string) error {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return err
+	if invite.IsLink(addr) {
+		return n.ConnectLink(addr)
+	}
+	_, err := n.connect(addr)
+	return err
+}
+
+func (n *EnhancedP2PNetwork) connect(addr string) (*EnhancedPeer, error) {
+	conn, err := transport.Dial(addr, directDialTimeout)
+	if err == nil {
+		return n.handleConnection(conn, true)
+	}
+
+	n.mu.RLock()
+	rendezvous := n.rendezvous
+	n.mu.RUnlock()
+	scheme, target := transport.Parse(addr)
+	if rendezvous == nil || scheme != "tcp" || transport.ProxyEnabled() {
+		return nil, err
+	}
+	addr = target
+
+	fmt.Printf("Direct connection to %s failed (%v), trying hole punch\n", addr, err)
+	conn, punchErr := rendezvous.punch(addr)
+	if punchErr == nil {
+		return n.handleConnection(conn, true)
 	}
 
-	return n.handleConnection(conn)
+	fmt.Printf("Hole punch to %s failed (%v), falling back to relay\n", addr, punchErr)
+	conn, relayErr := rendezvous.relay(addr)
+	if relayErr != nil {
+		return nil, fmt.Errorf("direct: %v; punch: %v; relay: %v", err, punchErr, relayErr)
+	}
+	return n.handleConnection(conn, true)
 }
 
+// ConnectToPeer tries the peer's advertised address, then where discovery
+// saw it, then the addresses from its contact record.
 func (n *EnhancedP2PNetwork) ConnectToPeer(peerInfo *discovery.PeerInfo) error {
-	addr := fmt.Sprintf("%s:9000", peerInfo.Address) 
-	return n.Connect(addr)
+	var addrs []string
+	if peerInfo.User.Address != "" {
+		addrs = append(addrs, peerInfo.User.Address)
+	}
+	if peerInfo.Address != "" {
+		port := peerInfo.Port
+		if port == 0 {
+			port = defaultChatPort
+		}
+		addrs = append(addrs, net.JoinHostPort(peerInfo.Address, strconv.Itoa(port)))
+	}
+	addrs = append(addrs, peerInfo.Addresses...)
+
+	err := fmt.Errorf("no address known for %s", peerInfo.User.ID)
+	for _, addr := range addrs {
+		if err = n.Connect(addr); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// SetOnionAddress publishes addr (<v3 onion>.onion:port) instead of our IP
+// in handshakes. Tor must map that onion service to our listen address, and
+// outbound dials should go through Tor with transport.SetProxy.
+func (n *EnhancedP2PNetwork) SetOnionAddress(addr string) error {
+	if err := transport.ValidOnionAddress(addr); err != nil {
+		return err
+	}
+	if !transport.ProxyEnabled() {
+		fmt.Println("⚠️  Onion address set but no socks5 proxy configured, outbound dials will reveal your IP")
+	}
+
+	n.mu.Lock()
+	n.advertised = addr
+	n.mu.Unlock()
+	return nil
 }
 
 func (n *EnhancedP2PNetwork) GetDiscoveredPeers() []*discovery.PeerInfo {
@@ -138,10 +372,14 @@ func (n *EnhancedP2PNetwork) ListPeers() {
 	fmt.Println("🔗 Connected peers:")
 	for userID, peer := range n.peers {
 		status := "✅"
-		if time.Since(peer.LastSeen) > 5*time.Minute {
+		if time.Since(peer.LastSeen()) > 5*time.Minute {
 			status = "⚠️"
 		}
-		fmt.Printf("  %s %s (%s)\n", status, peer.User.Username, userID)
+		presence := peer.User.Presence
+		if n.chat != nil {
+			presence = n.chat.DescribePresence(userID)
+		}
+		fmt.Printf("  %s %s (%s) - %s\n", status, n.contacts.Name(userID), userID, presence)
 	}
 
 	discovered := n.discovery.GetPeers()
@@ -149,116 +387,260 @@ func (n *EnhancedP2PNetwork) ListPeers() {
 		fmt.Println("📡 Discovered peers:")
 		for _, peer := range discovered {
 			if _, connected := n.peers[peer.User.ID]; !connected {
-				fmt.Printf("  🔍 %s (%s) - %s\n", peer.User.Username, peer.User.ID, peer.Address)
+				presence := ""
+				if peer.User.Presence != "" {
+					presence = " [" + peer.User.Presence + "]"
+				}
+				fmt.Printf("  🔍 %s (%s) - %s%s\n", peer.User.Username, peer.User.ID, peer.Address, presence)
 			}
 		}
 	}
 }
 
-func (n *EnhancedP2PNetwork) handleConnection(conn net.Conn) error {
-	peer, err := n.performHandshake(conn)
+// handleConnection performs the handshake and then multiplexes conn.
+// initiator is true on the side that dialed.
+func (n *EnhancedP2PNetwork) handleConnection(conn net.Conn, initiator bool) (*EnhancedPeer, error) {
+	peer, reader, err := n.performHandshake(conn)
 	if err != nil {
 		conn.Close()
-		return err
+		return nil, err
+	}
+
+	if ban, banned := n.reputation.IsBanned(peer.User.ID, peer.fingerprint); banned {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s is banned: %s", peer.User.ID, ban.Reason)
 	}
 
+	// our other devices prove our own key and are no contact of ours
+	if peer.User.ID != n.identity.ID {
+		if err := n.contacts.Check(peer.User); err != nil {
+			conn.Close()
+			warnKey(peer.User, err)
+			return nil, err
+		}
+	}
+
+	peer.Session = mux.NewSession(conn, reader, initiator)
+	peer.chat, err = peer.Session.Open(StreamChat, streamPriority(StreamChat))
+	if err != nil {
+		peer.Session.Close()
+		return nil, err
+	}
+
+	peer.initiator = initiator
+
+	n.registerMu.Lock()
 	n.mu.Lock()
+	existing := n.peers[peer.User.ID]
+	if existing != nil && !n.replaces(peer, existing) {
+		n.mu.Unlock()
+		n.registerMu.Unlock()
+		peer.Session.Close()
+		return existing, nil
+	}
 	n.peers[peer.User.ID] = peer
 	n.mu.Unlock()
 
 	if n.chat != nil {
-		n.chat.AddPeer(peer.User.ID, conn)
+		n.chat.AddPeer(peer.User.ID, peer.chat)
+	}
+	n.registerMu.Unlock()
+	if existing != nil {
+		existing.Session.Close()
 	}
 
 	fmt.Printf("🤝 Connected to %s (%s)\n", peer.User.Username, peer.User.ID)
 
-	go n.handlePeerMessages(peer)
+	go n.handlePeerStreams(peer)
+	go n.keepAlive(peer)
+	if !transport.ProxyEnabled() {
+		go n.sendPEX(peer, n.discovery.Contacts())
+	}
 
-	return nil
+	return peer, nil
 }
 
-func (n *EnhancedP2PNetwork) performHandshake(conn net.Conn) (*EnhancedPeer, error) {
+// replaces decides whether a new connection to a peer takes the place of
+// the existing one. When both sides dial each other at once, each keeps the
+// connection dialed by the lower user ID, so they end up keeping the same
+// one. A connection from the same dialer as the existing one replaces it,
+// as the old one is most likely dead.
+func (n *EnhancedP2PNetwork) replaces(peer, existing *EnhancedPeer) bool {
+	select {
+	case <-existing.Session.Done():
+		return true
+	default:
+	}
+	if peer.initiator == existing.initiator {
+		return true
+	}
+	weDialed := n.identity.ID < peer.User.ID
+	return peer.initiator == weDialed
+}
+
+// performHandshake exchanges HandshakeData lines. The returned reader may
+// already hold the first multiplexed frames and must be used for the session.
+func (n *EnhancedP2PNetwork) performHandshake(conn net.Conn) (*EnhancedPeer, *bufio.Reader, error) {
 	pubKey, _ := n.identity.ExportPublicKey()
+	n.mu.RLock()
+	advertised := n.advertised
+	n.mu.RUnlock()
 	ourUser := protocol.User{
 		ID:        n.identity.ID,
 		Username:  n.identity.Username,
 		PublicKey: pubKey,
+		Address:   advertised,
 		Online:    true,
 	}
+	if n.chat != nil {
+		presence := n.chat.PresenceOf(n.identity.ID)
+		ourUser.Presence = presence.State
+		ourUser.Status = presence.Status
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
 
 	handshake := protocol.HandshakeData{
 		User:      ourUser,
 		Version:   "1.0",
 		Timestamp: time.Now(),
+		Nonce:     newSessionID() + newSessionID(),
+	}
+	if err := writeHandshakeLine(conn, handshake); err != nil {
+		return nil, nil, err
 	}
 
-	data, err := json.Marshal(handshake)
-	if err != nil {
-		return nil, err
+	reader := bufio.NewReader(conn)
+	var theirHandshake protocol.HandshakeData
+	if err := readHandshakeLine(reader, &theirHandshake); err != nil {
+		return nil, nil, err
+	}
+	if len(theirHandshake.Nonce) < 16 {
+		return nil, nil, fmt.Errorf("handshake from %s carries no challenge", theirHandshake.User.ID)
 	}
 
-	if _, err := conn.Write(append(data, '\n')); err != nil {
-		return nil, err
+	// each side signs the nonce the other chose, so a proof is only good
+	// for this connection
+	signature, err := n.identity.Sign(handshakeProof(n.identity.ID, theirHandshake.Nonce, handshake.Nonce))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeHandshakeLine(conn, protocol.HandshakeProof{Signature: hex.EncodeToString(signature)}); err != nil {
+		return nil, nil, err
 	}
 
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
+	var proof protocol.HandshakeProof
+	if err := readHandshakeLine(reader, &proof); err != nil {
+		return nil, nil, err
+	}
+	theirSignature, err := hex.DecodeString(proof.Signature)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("malformed handshake proof from %s", theirHandshake.User.ID)
+	}
+	user := theirHandshake.User
+	if err := identity.VerifyFrom(user.ID, user.PublicKey, handshakeProof(user.ID, handshake.Nonce, theirHandshake.Nonce), theirSignature); err != nil {
+		return nil, nil, fmt.Errorf("%s did not prove its key: %v", user.ID, err)
+	}
+	fingerprint, err := identity.Fingerprint(user.PublicKey)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	var theirHandshake protocol.HandshakeData
-	if err := json.Unmarshal([]byte(response), &theirHandshake); err != nil {
-		return nil, err
+	peer := &EnhancedPeer{
+		Conn:        conn,
+		User:        user,
+		Verified:    true,
+		fingerprint: fingerprint,
+		lastSeen:    time.Now(),
 	}
 
+	return peer, reader, nil
+}
 
+// handshakeProof is what signerID signs to answer the verifier's nonce.
+func handshakeProof(signerID, verifierNonce, signerNonce string) []byte {
+	return []byte("p2pchat-handshake:" + signerID + ":" + verifierNonce + ":" + signerNonce)
+}
 
-	peer := &EnhancedPeer{
-		Conn:     conn,
-		User:     theirHandshake.User,
-		LastSeen: time.Now(),
-		Verified: true, 
+func writeHandshakeLine(conn net.Conn, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
 
-	return peer, nil
+func readHandshakeLine(reader *bufio.Reader, v interface{}) error {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxHandshakeLine {
+			return fmt.Errorf("handshake longer than %d bytes", maxHandshakeLine)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(line, v)
+	}
 }
 
-func (n *EnhancedP2PNetwork) handlePeerMessages(peer *EnhancedPeer) {
-	reader := bufio.NewReader(peer.Conn)
-	
-	for n.running {
-		peer.Conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-		message, err := reader.ReadString('\n')
+// handlePeerStreams hands every stream the peer opens to the handler
+// registered for its kind, until the session ends.
+func (n *EnhancedP2PNetwork) handlePeerStreams(peer *EnhancedPeer) {
+	for n.isRunning() {
+		stream, err := peer.Session.Accept()
 		if err != nil {
 			break
 		}
 
-		peer.LastSeen = time.Now()
+		n.mu.RLock()
+		handler, exists := n.handlers[stream.Kind()]
+		n.mu.RUnlock()
 
-		if n.chat != nil {
-			n.chat.ProcessIncomingMessage(message)
+		if !exists {
+			stream.Close()
+			continue
 		}
+		go handler(peer, stream)
 	}
 
+	// a peer replaced by a newer connection is no longer ours to remove
+	n.registerMu.Lock()
 	n.mu.Lock()
-	delete(n.peers, peer.User.ID)
+	current := n.peers[peer.User.ID] == peer
+	if current {
+		delete(n.peers, peer.User.ID)
+	}
 	n.mu.Unlock()
 
-	if n.chat != nil {
+	if current && n.chat != nil {
 		n.chat.RemovePeer(peer.User.ID)
 	}
+	n.registerMu.Unlock()
 
-	peer.Conn.Close()
+	peer.Session.Close()
 	fmt.Printf("🔌 Disconnected from %s\n", peer.User.Username)
 }
 
+// Broadcast writes message to every connected peer. Writes happen outside
+// the lock so one slow peer does not hold up the others' connects and
+// disconnects.
 func (n *EnhancedP2PNetwork) Broadcast(message []byte) {
 	n.mu.RLock()
-	defer n.mu.RUnlock()
-
+	peers := make([]*EnhancedPeer, 0, len(n.peers))
 	for _, peer := range n.peers {
-		_, err := peer.Conn.Write(append(message, '\n'))
+		peers = append(peers, peer)
+	}
+	n.mu.RUnlock()
+
+	for _, peer := range peers {
+		_, err := peer.chat.Write(append(message, '\n'))
 		if err != nil {
 			fmt.Printf("Error sending to %s: %v\n", peer.User.Username, err)
 		}
@@ -267,14 +649,13 @@ func (n *EnhancedP2PNetwork) Broadcast(message []byte) {
 
 func (n *EnhancedP2PNetwork) SendToPeer(userID string, message []byte) error {
 	n.mu.RLock()
-	defer n.mu.RUnlock()
-
 	peer, exists := n.peers[userID]
+	n.mu.RUnlock()
 	if !exists {
 		return fmt.Errorf("peer %s not connected", userID)
 	}
 
-	_, err := peer.Conn.Write(append(message, '\n'))
+	_, err := peer.chat.Write(append(message, '\n'))
 	return err
 }
 
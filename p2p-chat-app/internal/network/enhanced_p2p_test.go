@@ -0,0 +1,183 @@
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/protocol"
+	"p2p-chat-app/internal/transport"
+	"testing"
+	"time"
+)
+
+// TestConnectOverMem connects peers through the in-process transport.
+func TestConnectOverMem(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen string
+		dial   string
+		ok     bool
+	}{
+		{"listening", "mem://alice-listening", "mem://alice-listening", true},
+		{"nobody there", "mem://alice-elsewhere", "mem://alice-missing", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestNetwork(t, "alice")
+			bob := newTestNetwork(t, "bob")
+			if err := alice.Listen(tt.listen); err != nil {
+				t.Fatal(err)
+			}
+
+			err := bob.Connect(tt.dial)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("connected to an address nobody listens on")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, 5*time.Second, "both sides to connect", func() bool {
+				return alice.isConnected(bob.identity.ID) && bob.isConnected(alice.identity.ID)
+			})
+		})
+	}
+}
+
+func TestProxyDisablesDiscovery(t *testing.T) {
+	if err := transport.SetProxy("socks5://127.0.0.1:9050"); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.SetProxy("")
+
+	n := newTestNetwork(t, "alice")
+	if err := n.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if backends := n.discovery.Backends(); len(backends) != 0 {
+		t.Fatalf("discovery started %v behind a proxy", backends)
+	}
+}
+
+// TestHandshakeNeedsKeyProof runs alice's handshake against a peer that
+// claims to be bob, which only the holder of bob's key gets through.
+func TestHandshakeNeedsKeyProof(t *testing.T) {
+	alice := newTestNetwork(t, "alice")
+	bob, err := identity.NewIdentity("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := identity.NewIdentity("mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, _ := bob.ExportPublicKey()
+
+	tests := []struct {
+		name   string
+		signer *identity.Identity
+		// proof builds what the peer signs from alice's nonce and its own
+		proof func(aliceNonce, ownNonce string) []byte
+		ok    bool
+	}{
+		{"bob", bob, func(a, o string) []byte { return handshakeProof(bob.ID, a, o) }, true},
+		{"mallory with bob's key", mallory, func(a, o string) []byte { return handshakeProof(bob.ID, a, o) }, false},
+		{"replayed nonce", bob, func(a, o string) []byte { return handshakeProof(bob.ID, "0123456789abcdef", o) }, false},
+		{"proof for another user", bob, func(a, o string) []byte { return handshakeProof(alice.identity.ID, a, o) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			go claimBob(remote, bob, bobKey, tt.signer, tt.proof)
+
+			peer, _, err := alice.performHandshake(local)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("handshake accepted without proof of bob's key")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if peer.User.ID != bob.ID || !peer.Verified {
+				t.Fatalf("got %s, verified %v", peer.User.ID, peer.Verified)
+			}
+		})
+	}
+}
+
+// claimBob speaks the handshake as bob, signing its proof with signer.
+func claimBob(conn net.Conn, bob *identity.Identity, bobKey string, signer *identity.Identity, proof func(aliceNonce, ownNonce string) []byte) {
+	reader := bufio.NewReader(conn)
+	var theirs protocol.HandshakeData
+	if err := readHandshakeLine(reader, &theirs); err != nil {
+		return
+	}
+	ownNonce := "fedcba9876543210fedcba9876543210"
+	writeHandshakeLine(conn, protocol.HandshakeData{
+		User:      protocol.User{ID: bob.ID, Username: "bob", PublicKey: bobKey},
+		Version:   "1.0",
+		Timestamp: time.Now(),
+		Nonce:     ownNonce,
+	})
+	var ignored protocol.HandshakeProof
+	if err := readHandshakeLine(reader, &ignored); err != nil {
+		return
+	}
+	signature, _ := signer.Sign(proof(theirs.Nonce, ownNonce))
+	writeHandshakeLine(conn, protocol.HandshakeProof{Signature: hex.EncodeToString(signature)})
+}
+
+// TestSimultaneousDials has two peers dial each other at once. Both must
+// keep the same single connection.
+func TestSimultaneousDials(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		alice := newTestNetwork(t, "alice")
+		bob := newTestNetwork(t, "bob")
+		aliceAddr := "mem://alice-simultaneous-" + alice.identity.ID
+		bobAddr := "mem://bob-simultaneous-" + bob.identity.ID
+		if err := alice.Listen(aliceAddr); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.Listen(bobAddr); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make(chan error, 2)
+		go func() { errs <- alice.Connect(bobAddr) }()
+		go func() { errs <- bob.Connect(aliceAddr) }()
+		for j := 0; j < 2; j++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		waitFor(t, 5*time.Second, "one shared connection", func() bool {
+			alice.mu.RLock()
+			toBob := alice.peers[bob.identity.ID]
+			alice.mu.RUnlock()
+			bob.mu.RLock()
+			toAlice := bob.peers[alice.identity.ID]
+			bob.mu.RUnlock()
+			// the same connection is dialed by exactly one of them
+			return toBob != nil && toAlice != nil && toBob.initiator != toAlice.initiator
+		})
+		alice.mu.RLock()
+		kept := alice.peers[bob.identity.ID]
+		alice.mu.RUnlock()
+		if wantDialer := alice.identity.ID < bob.identity.ID; kept.initiator != wantDialer {
+			t.Fatal("kept the connection dialed by the higher ID")
+		}
+		select {
+		case <-kept.Session.Done():
+			t.Fatal("the kept connection was closed")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
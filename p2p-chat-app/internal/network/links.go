@@ -0,0 +1,125 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"p2p-chat-app/internal/chat"
+	"p2p-chat-app/internal/contacts"
+	"p2p-chat-app/internal/invite"
+	"p2p-chat-app/internal/protocol"
+)
+
+// InviteLink returns a link others can connect to us with. Given a room it
+// asks them to join it too; for invite-only rooms it carries a fresh
+// invite anyone holding the link can use, less the inviter's key.
+func (n *EnhancedP2PNetwork) InviteLink(room string) (*invite.Link, error) {
+	if n.listener == nil {
+		return nil, fmt.Errorf("not listening for connections")
+	}
+	addrs := n.contactAddresses()
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address others can reach us at")
+	}
+	fingerprint, err := n.identity.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	link := &invite.Link{
+		UserID:      n.identity.ID,
+		Username:    n.identity.Username,
+		Fingerprint: fingerprint,
+		Addresses:   addrs,
+		Room:        room,
+	}
+	if room != "" && n.chat != nil && n.chat.Moderation(room).Mode == string(chat.ModeInvite) {
+		token, err := n.chat.Invite(room, "", 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if link.Token, err = chat.CompactInvite(token); err != nil {
+			return nil, err
+		}
+	}
+	return link, nil
+}
+
+// ConnectLink connects to the user an invite link points to, trying its
+// addresses in turn. The user's key must match the link's fingerprint and
+// the key pinned in our contacts, where it goes on first contact. A room in the link is joined afterwards.
+func (n *EnhancedP2PNetwork) ConnectLink(uri string) error {
+	link, err := invite.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if link.UserID == n.identity.ID {
+		return fmt.Errorf("that is your own link")
+	}
+	if err := n.contacts.Expect(link.UserID, link.Fingerprint); err != nil {
+		return err
+	}
+	defer n.contacts.Forget(link.UserID)
+
+	n.mu.RLock()
+	peer, connected := n.peers[link.UserID]
+	n.mu.RUnlock()
+
+	if connected {
+		// connected before the link, so check its key against it now
+		if err := n.contacts.Check(peer.User); err != nil {
+			warnKey(peer.User, err)
+			return err
+		}
+	} else {
+		err = fmt.Errorf("no address in link")
+		for _, addr := range link.Addresses {
+			var p *EnhancedPeer
+			if p, err = n.connect(addr); err != nil {
+				continue
+			}
+			if p.User.ID != link.UserID {
+				p.Session.Close()
+				err = fmt.Errorf("%s is %s, not %s", addr, p.User.ID, link.UserID)
+				continue
+			}
+			peer = p
+			break
+		}
+		if peer == nil {
+			return err
+		}
+	}
+
+	if link.Room == "" || n.chat == nil {
+		return nil
+	}
+	token := link.Token
+	if token != "" {
+		// links leave out the inviter's key, which the peer just showed us
+		if token, err = chat.ExpandInvite(token, peer.User.PublicKey); err != nil {
+			return fmt.Errorf("invalid room invite in link: %v", err)
+		}
+	}
+	n.chat.JoinRoomWith(link.Room, token)
+	return nil
+}
+
+// warnKey tells the user why a peer's key was refused, loudly when a
+// contact's key changed since that may be someone impersonating them.
+func warnKey(user protocol.User, err error) {
+	var changed *contacts.KeyChangedError
+	if !errors.As(err, &changed) {
+		fmt.Printf("⚠️  Refused %s: %v\n", user.Username, err)
+		return
+	}
+
+	fmt.Println("⚠️ ⚠️ ⚠️  WARNING: KEY CHANGED ⚠️ ⚠️ ⚠️")
+	fmt.Printf("%s (%s) connected with a different key than before.\n", changed.Name, changed.UserID)
+	fmt.Printf("  pinned:   %s\n", changed.Pinned)
+	fmt.Printf("  received: %s\n", changed.Received)
+	fmt.Println("Someone may be impersonating them, so they stay blocked until you decide.")
+	if changed.WasVerified {
+		fmt.Println("They are no longer verified.")
+	}
+	fmt.Printf("Compare safety numbers with /verify %s, then --accept-new or --reject-new.\n", changed.UserID)
+}
@@ -0,0 +1,783 @@
+package network
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"p2p-chat-app/internal/identity"
+	"p2p-chat-app/internal/transport"
+	"sync"
+	"time"
+)
+
+const (
+	directDialTimeout  = 5 * time.Second
+	punchTimeout       = 8 * time.Second
+	punchAttemptWindow = 500 * time.Millisecond
+	rendezvousTimeout  = 10 * time.Second
+	relayPairTimeout   = 30 * time.Second
+	// reregisterMax caps the wait between attempts to register again after
+	// losing the rendezvous server
+	reregisterMax = time.Minute
+	// maxRendezvousLine bounds every line read from a rendezvous connection
+	maxRendezvousLine = 4096
+	// maxRelaySessions caps the relays one peer may have waiting to be
+	// spliced
+	maxRelaySessions = 8
+)
+
+// rendezvousMessage is the line-delimited JSON spoken between peers and a
+// rendezvous server.
+//
+//	register   peer -> server   announce ID, public key and chat listen address
+//	challenge  server -> peer   a fresh Nonce to sign
+//	prove      peer -> server   Signature over the nonce with the key of ID
+//	registered server -> peer   echo the public endpoint the server observed
+//	punch      peer -> server   ask to be introduced to Target
+//	peer       server -> peer   the other side's observed endpoint, start punching
+//	relay      peer -> server   punching failed, splice us through the server
+//	relay      server -> peer   the Session both sides splice, to the requester and Target
+//	splice     peer -> server   first line on a fresh relay connection, with ID and key
+//	                            proven by the same challenge as register
+//	spliced    server -> peer   last line on a relay connection before the other side's bytes
+//	error      server -> peer   request could not be served
+type rendezvousMessage struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	Session   string `json:"session,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RendezvousServer introduces NATed peers to each other by exchanging the
+// public endpoints it observes, and relays traffic for pairs whose NATs
+// cannot be punched.
+type RendezvousServer struct {
+	listener net.Listener
+	clients  map[string]*rendezvousRegistration
+	sessions map[string]*relaySession
+	relays   map[string]*relayHalf
+	mu       sync.Mutex
+	running  bool
+}
+
+// relaySession is a relay a registered peer asked for; only it and its
+// target may splice it.
+type relaySession struct {
+	from string
+	to   string
+}
+
+// relayHalf is the first peer of a relay session, waiting for the second.
+type relayHalf struct {
+	id     string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type rendezvousRegistration struct {
+	id       string
+	address  string
+	endpoint string
+	conn     net.Conn
+	writeMu  sync.Mutex
+}
+
+func NewRendezvousServer() *RendezvousServer {
+	return &RendezvousServer{
+		clients:  make(map[string]*rendezvousRegistration),
+		sessions: make(map[string]*relaySession),
+		relays:   make(map[string]*relayHalf),
+	}
+}
+
+func (rs *RendezvousServer) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	rs.listener = listener
+	rs.running = true
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				rs.mu.Lock()
+				running := rs.running
+				rs.mu.Unlock()
+				if !running {
+					return
+				}
+				fmt.Printf("Rendezvous accept error: %v\n", err)
+				continue
+			}
+			go rs.handleConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (rs *RendezvousServer) Close() {
+	rs.mu.Lock()
+	rs.running = false
+	rs.mu.Unlock()
+	if rs.listener != nil {
+		rs.listener.Close()
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, client := range rs.clients {
+		client.conn.Close()
+	}
+	for _, half := range rs.relays {
+		half.conn.Close()
+	}
+}
+
+func (rs *RendezvousServer) handleConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(rendezvousTimeout))
+	first, err := readRendezvousMessage(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch first.Type {
+	case "register":
+		rs.serveClient(conn, reader, first)
+	case "splice":
+		// nobody may hold the server's resources for a relay before
+		// proving who they are
+		if err := rs.challenge(conn, reader, first); err != nil {
+			writeRendezvousMessage(conn, &rendezvousMessage{Type: "error", Error: "splice refused: " + err.Error()})
+			conn.Close()
+			return
+		}
+		rs.splice(conn, reader, first.ID, first.Session)
+	default:
+		conn.Close()
+	}
+}
+
+// registrationProof is what a peer signs to show the server it holds the
+// key behind the ID it registers or splices a relay as.
+func registrationProof(id, nonce string) []byte {
+	return []byte("p2pchat-rendezvous-register:" + id + ":" + nonce)
+}
+
+// challenge makes the peer registering as reg.ID sign a fresh nonce with
+// the key the ID was derived from, so nobody can take over someone else's
+// registration and the traffic relayed to them.
+func (rs *RendezvousServer) challenge(conn net.Conn, reader *bufio.Reader, reg *rendezvousMessage) error {
+	if !identity.MatchesPublicKey(reg.ID, reg.Key) {
+		return fmt.Errorf("key does not belong to %s", reg.ID)
+	}
+	nonce := newSessionID() + newSessionID()
+	if err := writeRendezvousMessage(conn, &rendezvousMessage{Type: "challenge", Nonce: nonce}); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(rendezvousTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	proof, err := readRendezvousMessage(reader)
+	if err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(proof.Signature)
+	if proof.Type != "prove" || err != nil {
+		return fmt.Errorf("expected a signed challenge")
+	}
+	return identity.VerifyFrom(reg.ID, reg.Key, registrationProof(reg.ID, nonce), signature)
+}
+
+func (rs *RendezvousServer) serveClient(conn net.Conn, reader *bufio.Reader, reg *rendezvousMessage) {
+	if err := rs.challenge(conn, reader, reg); err != nil {
+		writeRendezvousMessage(conn, &rendezvousMessage{Type: "error", Error: "registration refused: " + err.Error()})
+		conn.Close()
+		return
+	}
+
+	client := &rendezvousRegistration{
+		id:       reg.ID,
+		address:  reg.Address,
+		endpoint: conn.RemoteAddr().String(),
+		conn:     conn,
+	}
+
+	rs.mu.Lock()
+	if old, exists := rs.clients[client.id]; exists {
+		old.conn.Close()
+	}
+	rs.clients[client.id] = client
+	rs.mu.Unlock()
+
+	client.send(&rendezvousMessage{Type: "registered", Endpoint: client.endpoint})
+
+	for {
+		msg, err := readRendezvousMessage(reader)
+		if err != nil {
+			break
+		}
+
+		switch msg.Type {
+		case "punch", "relay":
+			target := rs.lookup(msg.Target)
+			if target == nil || target == client {
+				client.send(&rendezvousMessage{Type: "error", Session: msg.Session, Error: "unknown target " + msg.Target})
+				continue
+			}
+			if msg.Type == "punch" {
+				client.send(&rendezvousMessage{Type: "peer", ID: target.id, Endpoint: target.endpoint, Session: msg.Session})
+				target.send(&rendezvousMessage{Type: "peer", ID: client.id, Endpoint: client.endpoint, Session: msg.Session})
+			} else if err := rs.openSession(msg.Session, client.id, target.id); err != nil {
+				client.send(&rendezvousMessage{Type: "error", Session: msg.Session, Error: err.Error()})
+			} else {
+				client.send(&rendezvousMessage{Type: "relay", ID: target.id, Session: msg.Session})
+				target.send(&rendezvousMessage{Type: "relay", ID: client.id, Session: msg.Session})
+			}
+		}
+	}
+
+	rs.mu.Lock()
+	if rs.clients[client.id] == client {
+		delete(rs.clients, client.id)
+	}
+	rs.mu.Unlock()
+	conn.Close()
+}
+
+// lookup resolves a Connect target, which may be a user ID, the address a
+// peer listens on, or the public host combined with its listen port.
+func (rs *RendezvousServer) lookup(target string) *rendezvousRegistration {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if client, exists := rs.clients[target]; exists {
+		return client
+	}
+
+	for _, client := range rs.clients {
+		if client.address == target || client.endpoint == target {
+			return client
+		}
+		host, _, err := net.SplitHostPort(client.endpoint)
+		if err != nil {
+			continue
+		}
+		_, port, err := net.SplitHostPort(client.address)
+		if err != nil {
+			continue
+		}
+		if net.JoinHostPort(host, port) == target {
+			return client
+		}
+	}
+	return nil
+}
+
+// openSession lets from and to splice session until relayPairTimeout
+// passes.
+func (rs *RendezvousServer) openSession(session, from, to string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if session == "" || rs.sessions[session] != nil {
+		return fmt.Errorf("relay session %q is taken", session)
+	}
+	waiting := 0
+	for _, s := range rs.sessions {
+		if s.from == from {
+			waiting++
+		}
+	}
+	if waiting >= maxRelaySessions {
+		return fmt.Errorf("too many relays waiting")
+	}
+
+	s := &relaySession{from: from, to: to}
+	rs.sessions[session] = s
+	time.AfterFunc(relayPairTimeout, func() {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		if rs.sessions[session] == s {
+			delete(rs.sessions, session)
+		}
+	})
+	return nil
+}
+
+// splice joins the relay connection of id, who proved it, to the other
+// half of session.
+func (rs *RendezvousServer) splice(conn net.Conn, reader *bufio.Reader, id, session string) {
+	refuse := func(reason string) {
+		writeRendezvousMessage(conn, &rendezvousMessage{Type: "error", Session: session, Error: reason})
+		conn.Close()
+	}
+
+	rs.mu.Lock()
+	s, exists := rs.sessions[session]
+	if !exists || (id != s.from && id != s.to) {
+		rs.mu.Unlock()
+		refuse("unknown relay session")
+		return
+	}
+	other, waiting := rs.relays[session]
+	if waiting && other.id == id {
+		rs.mu.Unlock()
+		refuse("already joined the relay")
+		return
+	}
+	if !waiting {
+		half := &relayHalf{id: id, conn: conn, reader: reader}
+		rs.relays[session] = half
+		rs.mu.Unlock()
+
+		time.AfterFunc(relayPairTimeout, func() {
+			rs.mu.Lock()
+			defer rs.mu.Unlock()
+			if rs.relays[session] == half {
+				delete(rs.relays, session)
+				conn.Close()
+			}
+		})
+		return
+	}
+	delete(rs.relays, session)
+	delete(rs.sessions, session)
+	rs.mu.Unlock()
+
+	// tell both sides they are through before any of the other's bytes
+	spliced := &rendezvousMessage{Type: "spliced", Session: session}
+	if writeRendezvousMessage(conn, spliced) != nil || writeRendezvousMessage(other.conn, spliced) != nil {
+		conn.Close()
+		other.conn.Close()
+		return
+	}
+
+	// copy from the readers, not the conns: either side may already have
+	// sent its handshake behind the splice line
+	go func() {
+		io.Copy(other.conn, reader)
+		other.conn.Close()
+	}()
+	io.Copy(conn, other.reader)
+	conn.Close()
+}
+
+func (c *rendezvousRegistration) send(msg *rendezvousMessage) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	writeRendezvousMessage(c.conn, msg)
+}
+
+// rendezvousClient keeps a registration open with a rendezvous server so
+// that other peers can ask to be introduced to us.
+type rendezvousClient struct {
+	network    *EnhancedP2PNetwork
+	serverAddr string
+	conn       net.Conn
+	localAddr  *net.TCPAddr
+	endpoint   string
+	pending    map[string]chan *rendezvousMessage
+	closed     bool // closed on purpose, so losing the server is expected
+	mu         sync.Mutex
+	writeMu    sync.Mutex
+}
+
+// UseRendezvous registers with the rendezvous server at addr. Afterwards
+// Connect falls back to hole punching and then relaying through it when a
+// direct dial fails.
+func (n *EnhancedP2PNetwork) UseRendezvous(addr string) error {
+	if transport.ProxyEnabled() {
+		return fmt.Errorf("rendezvous would reveal our address while dialing through a proxy")
+	}
+
+	dialer := net.Dialer{Timeout: rendezvousTimeout, Control: transport.ReuseControl}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	client := &rendezvousClient{
+		network:    n,
+		serverAddr: addr,
+		conn:       conn,
+		localAddr:  conn.LocalAddr().(*net.TCPAddr),
+		pending:    make(map[string]chan *rendezvousMessage),
+	}
+
+	listenAddr := ""
+	if n.listener != nil {
+		listenAddr = n.listener.Addr().String()
+	}
+
+	reader := bufio.NewReader(conn)
+	pubKey, err := n.identity.ExportPublicKey()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client.send(&rendezvousMessage{Type: "register", ID: n.identity.ID, Key: pubKey, Address: listenAddr})
+
+	conn.SetReadDeadline(time.Now().Add(rendezvousTimeout))
+	reply, err := readRendezvousMessage(reader)
+	if err == nil && reply.Type == "challenge" {
+		var signature []byte
+		signature, err = n.identity.Sign(registrationProof(n.identity.ID, reply.Nonce))
+		if err == nil {
+			err = client.send(&rendezvousMessage{Type: "prove", Signature: hex.EncodeToString(signature)})
+		}
+		if err == nil {
+			reply, err = readRendezvousMessage(reader)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("rendezvous registration failed: %v", err)
+	}
+	if reply.Type != "registered" {
+		conn.Close()
+		return fmt.Errorf("rendezvous registration failed: %s", reply.Error)
+	}
+	conn.SetReadDeadline(time.Time{})
+	client.endpoint = reply.Endpoint
+
+	n.mu.Lock()
+	if n.rendezvous != nil {
+		n.rendezvous.close()
+	}
+	n.rendezvous = client
+	n.mu.Unlock()
+
+	fmt.Printf("🛰️  Registered with rendezvous %s as %s\n", addr, client.endpoint)
+
+	go client.readLoop(reader)
+	return nil
+}
+
+func (rc *rendezvousClient) readLoop(reader *bufio.Reader) {
+	for {
+		msg, err := readRendezvousMessage(reader)
+		if err != nil {
+			break
+		}
+
+		rc.mu.Lock()
+		waiter, ours := rc.pending[msg.Session]
+		rc.mu.Unlock()
+
+		if ours {
+			// waiters take one answer; a duplicate must not stall the loop
+			select {
+			case waiter <- msg:
+			default:
+			}
+			continue
+		}
+
+		switch msg.Type {
+		case "peer":
+			go rc.acceptPunch(msg)
+		case "relay":
+			go rc.acceptRelay(msg)
+		}
+	}
+
+	rc.mu.Lock()
+	for session, waiter := range rc.pending {
+		close(waiter)
+		delete(rc.pending, session)
+	}
+	closed := rc.closed
+	rc.mu.Unlock()
+
+	if !closed {
+		fmt.Printf("⚠️  Lost rendezvous %s, registering again\n", rc.serverAddr)
+		go rc.network.reregister(rc)
+	}
+}
+
+// reregister registers with the server of old again, backing off between
+// attempts, until it works or old is closed or replaced.
+func (n *EnhancedP2PNetwork) reregister(old *rendezvousClient) {
+	wait := time.Second
+	for {
+		time.Sleep(wait)
+
+		old.mu.Lock()
+		closed := old.closed
+		old.mu.Unlock()
+		n.mu.RLock()
+		current := n.rendezvous == old
+		n.mu.RUnlock()
+		if closed || !current {
+			return
+		}
+
+		if err := n.UseRendezvous(old.serverAddr); err == nil {
+			return
+		}
+		if wait *= 2; wait > reregisterMax {
+			wait = reregisterMax
+		}
+	}
+}
+
+// request sends msg under a fresh session and waits for the server's answer.
+func (rc *rendezvousClient) request(msg *rendezvousMessage) (*rendezvousMessage, error) {
+	msg.Session = newSessionID()
+	waiter := make(chan *rendezvousMessage, 1)
+
+	rc.mu.Lock()
+	rc.pending[msg.Session] = waiter
+	rc.mu.Unlock()
+
+	defer func() {
+		rc.mu.Lock()
+		delete(rc.pending, msg.Session)
+		rc.mu.Unlock()
+	}()
+
+	if err := rc.send(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-waiter:
+		if !ok {
+			return nil, fmt.Errorf("rendezvous connection closed")
+		}
+		if reply.Type == "error" {
+			return nil, fmt.Errorf("rendezvous: %s", reply.Error)
+		}
+		return reply, nil
+	case <-time.After(rendezvousTimeout):
+		return nil, fmt.Errorf("rendezvous request timed out")
+	}
+}
+
+// punch asks the server to introduce us to target and then dials the
+// endpoint it reports while the other side dials us back.
+func (rc *rendezvousClient) punch(target string) (net.Conn, error) {
+	reply, err := rc.request(&rendezvousMessage{Type: "punch", Target: target})
+	if err != nil {
+		return nil, err
+	}
+	return rc.simultaneousOpen(reply.Endpoint)
+}
+
+func (rc *rendezvousClient) acceptPunch(msg *rendezvousMessage) {
+	conn, err := rc.simultaneousOpen(msg.Endpoint)
+	if err != nil {
+		fmt.Printf("Hole punch from %s failed: %v\n", msg.ID, err)
+		return
+	}
+	rc.network.handleConnection(conn, false)
+}
+
+// simultaneousOpen repeatedly dials endpoint from the port registered with
+// the rendezvous server, so that both NATs see outbound traffic for the
+// pair and let the crossing SYNs through.
+func (rc *rendezvousClient) simultaneousOpen(endpoint string) (net.Conn, error) {
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: rc.localAddr.IP, Port: rc.localAddr.Port},
+		Timeout:   punchAttemptWindow,
+		Control:   transport.ReuseControl,
+	}
+
+	deadline := time.Now().Add(punchTimeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		conn, err := dialer.Dial("tcp", endpoint)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		time.Sleep(punchAttemptWindow / 5)
+	}
+	return nil, fmt.Errorf("hole punch to %s failed: %v", endpoint, lastErr)
+}
+
+// relay asks the server to splice us to target and returns our half of the
+// relayed connection once the server confirms the other half joined.
+func (rc *rendezvousClient) relay(target string) (net.Conn, error) {
+	reply, err := rc.request(&rendezvousMessage{Type: "relay", Target: target})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := rc.dialRelay(reply.Session)
+	if err == nil {
+		err = awaitSplice(conn, reply.Session)
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (rc *rendezvousClient) acceptRelay(msg *rendezvousMessage) {
+	conn, err := rc.dialRelay(msg.Session)
+	if err == nil {
+		err = awaitSplice(conn, msg.Session)
+	}
+	if err != nil {
+		fmt.Printf("Relay from %s failed: %v\n", msg.ID, err)
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	rc.network.handleConnection(conn, false)
+}
+
+// awaitSplice waits for the server to acknowledge that both halves of
+// session are joined.
+func awaitSplice(conn net.Conn, session string) error {
+	conn.SetReadDeadline(time.Now().Add(relayPairTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	msg, err := readRelayMessage(conn)
+	if err != nil {
+		return fmt.Errorf("relay not joined: %v", err)
+	}
+	if msg.Type == "error" {
+		return fmt.Errorf("rendezvous: %s", msg.Error)
+	}
+	if msg.Type != "spliced" || msg.Session != session {
+		return fmt.Errorf("unexpected %q from relay", msg.Type)
+	}
+	return nil
+}
+
+// dialRelay opens our relay connection for session and proves to the
+// server that we are one of its two peers.
+func (rc *rendezvousClient) dialRelay(session string) (net.Conn, error) {
+	id := rc.network.identity
+	pubKey, err := id.ExportPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", rc.serverAddr, rendezvousTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(rendezvousTimeout))
+	err = writeRendezvousMessage(conn, &rendezvousMessage{Type: "splice", ID: id.ID, Key: pubKey, Session: session})
+	var challenge *rendezvousMessage
+	if err == nil {
+		challenge, err = readRelayMessage(conn)
+	}
+	if err == nil && challenge.Type != "challenge" {
+		err = fmt.Errorf("rendezvous: %s", challenge.Error)
+	}
+	var signature []byte
+	if err == nil {
+		signature, err = id.Sign(registrationProof(id.ID, challenge.Nonce))
+	}
+	if err == nil {
+		err = writeRendezvousMessage(conn, &rendezvousMessage{Type: "prove", Signature: hex.EncodeToString(signature)})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("relay refused: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, nil
+}
+
+// readRelayMessage reads one message from a relay connection byte by byte,
+// so nothing the other side sent after it is consumed.
+func readRelayMessage(conn net.Conn) (*rendezvousMessage, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxRendezvousLine {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			var msg rendezvousMessage
+			if err := json.Unmarshal(line, &msg); err != nil {
+				return nil, err
+			}
+			return &msg, nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, errRendezvousLineTooLong
+}
+
+func (rc *rendezvousClient) send(msg *rendezvousMessage) error {
+	rc.writeMu.Lock()
+	defer rc.writeMu.Unlock()
+	return writeRendezvousMessage(rc.conn, msg)
+}
+
+func (rc *rendezvousClient) close() {
+	rc.mu.Lock()
+	rc.closed = true
+	rc.mu.Unlock()
+	rc.conn.Close()
+}
+
+// errRendezvousLineTooLong reports a line over maxRendezvousLine.
+var errRendezvousLineTooLong = errors.New("rendezvous line too long")
+
+// readRendezvousMessage reads one line of at most maxRendezvousLine bytes
+// from reader, which may hold bytes after it.
+func readRendezvousMessage(reader *bufio.Reader) (*rendezvousMessage, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxRendezvousLine {
+			return nil, errRendezvousLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	var msg rendezvousMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func writeRendezvousMessage(w io.Writer, msg *rendezvousMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,278 @@
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"p2p-chat-app/internal/identity"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestNetwork(t *testing.T, name string) *EnhancedP2PNetwork {
+	t.Helper()
+	id, err := identity.NewIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewEnhancedP2PNetwork(id, 0)
+	n.setRunning(true)
+	t.Cleanup(n.Stop)
+	return n
+}
+
+func newTestRendezvous(t *testing.T) (*RendezvousServer, string) {
+	t.Helper()
+	rs := NewRendezvousServer()
+	if err := rs.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rs.Close)
+	return rs, rs.listener.Addr().String()
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// rawChallenge opens a connection with first, a register or splice, and
+// answers the challenge by hand, signing it with signer. It returns the
+// server's final answer.
+func rawChallenge(t *testing.T, addr string, first *rendezvousMessage, signer *identity.Identity) *rendezvousMessage {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	writeRendezvousMessage(conn, first)
+	reply, err := readRendezvousMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "challenge" {
+		return reply
+	}
+	signature, err := signer.Sign(registrationProof(first.ID, reply.Nonce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRendezvousMessage(conn, &rendezvousMessage{Type: "prove", Signature: hex.EncodeToString(signature)})
+	reply, err = readRendezvousMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestRendezvousRegistrationNeedsKey(t *testing.T) {
+	rs, addr := newTestRendezvous(t)
+	alice := newTestNetwork(t, "alice")
+	if err := alice.UseRendezvous(addr); err != nil {
+		t.Fatal(err)
+	}
+	registered := rs.lookup(alice.identity.ID)
+	if registered == nil {
+		t.Fatal("alice is not registered")
+	}
+
+	mallory, err := identity.NewIdentity("mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceKey, _ := alice.identity.ExportPublicKey()
+	malloryKey, _ := mallory.ExportPublicKey()
+
+	tests := []struct {
+		name   string
+		key    string
+		signer *identity.Identity
+	}{
+		{"someone else's key", malloryKey, mallory},
+		{"right key, wrong signer", aliceKey, mallory},
+		{"no key", "", mallory},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := rawChallenge(t, addr, &rendezvousMessage{Type: "register", ID: alice.identity.ID, Key: tt.key}, tt.signer)
+			if reply.Type != "error" {
+				t.Fatalf("got %q, want error", reply.Type)
+			}
+		})
+	}
+
+	if rs.lookup(alice.identity.ID) != registered {
+		t.Fatal("a failed registration replaced alice's")
+	}
+}
+
+func TestReadRendezvousMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"message", `{"type":"register","id":"alice"}` + "\n", true},
+		{"message with more behind it", `{"type":"splice"}` + "\nhandshake", true},
+		{"longest line", `{"type":"register","id":"` + strings.Repeat("a", maxRendezvousLine-28) + `"}` + "\n", true},
+		{"line too long", `{"type":"register","id":"` + strings.Repeat("a", maxRendezvousLine-27) + `"}` + "\n", false},
+		{"endless line", strings.Repeat("a", 10*maxRendezvousLine), false},
+		{"no newline", `{"type":"register"}`, false},
+		{"not json", "register\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readRendezvousMessage(bufio.NewReader(strings.NewReader(tt.data)))
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestRendezvousDropsLongLines(t *testing.T) {
+	_, addr := newTestRendezvous(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the server stops reading and hangs up long before the line ends
+	go conn.Write([]byte(strings.Repeat("a", 1<<20)))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("connection still open: %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestSpliceNeedsProof(t *testing.T) {
+	rs, addr := newTestRendezvous(t)
+	alice := newTestNetwork(t, "alice")
+	bob := newTestNetwork(t, "bob")
+	mallory, err := identity.NewIdentity("mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceKey, _ := alice.identity.ExportPublicKey()
+	malloryKey, _ := mallory.ExportPublicKey()
+	if err := rs.openSession("alice-bob", alice.identity.ID, bob.identity.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		key     string
+		session string
+		signer  *identity.Identity
+	}{
+		{"unknown session", alice.identity.ID, aliceKey, "nobody", alice.identity},
+		{"no session", alice.identity.ID, aliceKey, "", alice.identity},
+		{"someone else's session", mallory.ID, malloryKey, "alice-bob", mallory},
+		{"someone else's key", alice.identity.ID, malloryKey, "alice-bob", mallory},
+		{"right key, wrong signer", alice.identity.ID, aliceKey, "alice-bob", mallory},
+		{"no key", alice.identity.ID, "", "alice-bob", alice.identity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := &rendezvousMessage{Type: "splice", ID: tt.id, Key: tt.key, Session: tt.session}
+			if reply := rawChallenge(t, addr, first, tt.signer); reply.Type != "error" {
+				t.Fatalf("got %q, want error", reply.Type)
+			}
+			rs.mu.Lock()
+			waiting := len(rs.relays)
+			rs.mu.Unlock()
+			if waiting != 0 {
+				t.Fatalf("%d relay halves waiting", waiting)
+			}
+		})
+	}
+}
+
+func TestRelaySessionCap(t *testing.T) {
+	rs := NewRendezvousServer()
+	for i := 0; i < maxRelaySessions; i++ {
+		if err := rs.openSession(fmt.Sprint("alice-", i), "alice", "bob"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rs.openSession("alice-0", "carol", "bob"); err == nil {
+		t.Error("took over a session")
+	}
+	if err := rs.openSession("one-more", "alice", "bob"); err == nil {
+		t.Errorf("opened more than %d sessions", maxRelaySessions)
+	}
+	if err := rs.openSession("bob-0", "bob", "alice"); err != nil {
+		t.Errorf("alice's sessions held up bob's: %v", err)
+	}
+}
+
+func TestRelayToUnknownTargetFails(t *testing.T) {
+	_, addr := newTestRendezvous(t)
+	alice := newTestNetwork(t, "alice")
+	if err := alice.UseRendezvous(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if conn, err := alice.rendezvous.relay("nobody"); err == nil {
+		conn.Close()
+		t.Fatal("relay to an unregistered peer succeeded")
+	}
+}
+
+// TestConnectBehindNAT connects two peers that have no listener at all, as
+// if both sat behind NATs, so the only ways through are a hole punch or
+// the relay.
+func TestConnectBehindNAT(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the hole punch to time out")
+	}
+	_, addr := newTestRendezvous(t)
+	alice := newTestNetwork(t, "alice")
+	bob := newTestNetwork(t, "bob")
+	for _, n := range []*EnhancedP2PNetwork{alice, bob} {
+		if err := n.UseRendezvous(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := alice.Connect(bob.identity.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "both sides to connect", func() bool {
+		return alice.isConnected(bob.identity.ID) && bob.isConnected(alice.identity.ID)
+	})
+}
+
+func TestReregisterAfterServerDrop(t *testing.T) {
+	rs, addr := newTestRendezvous(t)
+	alice := newTestNetwork(t, "alice")
+	if err := alice.UseRendezvous(addr); err != nil {
+		t.Fatal(err)
+	}
+	first := rs.lookup(alice.identity.ID)
+	first.conn.Close()
+
+	waitFor(t, 5*time.Second, "alice to register again", func() bool {
+		current := rs.lookup(alice.identity.ID)
+		return current != nil && current != first
+	})
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"p2p-chat-app/internal/discovery"
+	"p2p-chat-app/internal/mux"
+	"p2p-chat-app/internal/transport"
+	"strconv"
+	"time"
+)
+
+const (
+	pexInterval    = 1 * time.Minute
+	bootstrapRetry = 1 * time.Minute
+	// maxPEXBytes bounds what we read from one exchange
+	maxPEXBytes = 256 * 1024
+)
+
+// SetBootstrap sets the peers dialed at Start to find the rest of the
+// network when there is nobody in our broadcast domain. Peers that cannot
+// be reached are retried until they can.
+func (n *EnhancedP2PNetwork) SetBootstrap(addrs []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.bootstrap = addrs
+}
+
+func (n *EnhancedP2PNetwork) bootstrapLoop(addrs []string) {
+	// which user each bootstrap address turned out to be
+	known := make(map[string]string)
+
+	for n.isRunning() {
+		for _, addr := range addrs {
+			if userID, seen := known[addr]; seen && n.isConnected(userID) {
+				continue
+			}
+
+			peer, err := n.connect(addr)
+			if err != nil {
+				fmt.Printf("Bootstrap peer %s unreachable: %v\n", addr, err)
+				continue
+			}
+			known[addr] = peer.User.ID
+		}
+		time.Sleep(bootstrapRetry)
+	}
+}
+
+func (n *EnhancedP2PNetwork) isConnected(userID string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	_, connected := n.peers[userID]
+	return connected
+}
+
+// pexLoop periodically shares the contact records we know with every
+// connected peer.
+func (n *EnhancedP2PNetwork) pexLoop() {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for n.isRunning() {
+		<-ticker.C
+
+		records := n.discovery.Contacts()
+		if len(records) == 0 {
+			continue
+		}
+		n.mu.RLock()
+		for _, peer := range n.peers {
+			go n.sendPEX(peer, records)
+		}
+		n.mu.RUnlock()
+	}
+}
+
+func (n *EnhancedP2PNetwork) sendPEX(peer *EnhancedPeer, records []*discovery.DiscoveryMessage) {
+	if len(records) == 0 {
+		return
+	}
+
+	stream, err := peer.Session.Open(StreamPEX, streamPriority(StreamPEX))
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	stream.SetWriteDeadline(time.Now().Add(pingTimeout))
+	if err := json.NewEncoder(stream).Encode(records); err != nil {
+		fmt.Printf("Peer exchange with %s failed: %v\n", peer.User.Username, err)
+	}
+}
+
+func (n *EnhancedP2PNetwork) handlePEXStream(peer *EnhancedPeer, stream *mux.Stream) {
+	defer stream.Close()
+
+	// behind a proxy we neither share nor collect addresses
+	if transport.ProxyEnabled() {
+		return
+	}
+	if !n.reputation.Allow(peer.User.ID, peer.fingerprint) {
+		n.penalize(peer, PenaltySpam, "peer exchange rate limit exceeded")
+		return
+	}
+
+	var records []*discovery.DiscoveryMessage
+	stream.SetReadDeadline(time.Now().Add(pingTimeout))
+	if err := json.NewDecoder(io.LimitReader(stream, maxPEXBytes)).Decode(&records); err != nil {
+		n.penalize(peer, PenaltyInvalidFrame, "malformed peer exchange")
+		return
+	}
+
+	added, forged := n.discovery.AddContacts(records)
+	if forged > 0 {
+		// honest peers only relay records they verified
+		n.penalize(peer, PenaltyBadSignature, fmt.Sprintf("relayed %d forged contact records", forged))
+	}
+	if added > 0 {
+		fmt.Printf("📇 Learned %d peers from %s\n", added, peer.User.Username)
+	}
+}
+
+// contactAddresses lists where peers outside our network segment can reach
+// us: the advertised address if we have one, else every address of the
+// interfaces the tcp listener is on.
+func (n *EnhancedP2PNetwork) contactAddresses() []string {
+	n.mu.RLock()
+	advertised := n.advertised
+	advertisePort := n.advertPort
+	n.mu.RUnlock()
+
+	if advertised != "" {
+		return []string{advertised}
+	}
+
+	tcpAddr, ok := n.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	port := tcpAddr.Port
+	if advertisePort != 0 {
+		port = advertisePort
+	}
+	if !tcpAddr.IP.IsUnspecified() {
+		return []string{net.JoinHostPort(tcpAddr.IP.String(), strconv.Itoa(port))}
+	}
+
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, addr := range ifaceAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		// an ipv4 listener can't take ipv6 connections
+		if tcpAddr.IP.To4() != nil && ipNet.IP.To4() == nil {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port)))
+	}
+	return addrs
+}
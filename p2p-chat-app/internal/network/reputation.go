@@ -0,0 +1,402 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Penalty is how many points a misbehaving peer loses.
+type Penalty int
+
+const (
+	PenaltyInvalidFrame Penalty = 10
+	PenaltyBadSignature Penalty = 25
+	PenaltySpam         Penalty = 5
+)
+
+const (
+	initialScore = 100
+	// peers recover a point per minute of good behaviour
+	scoreRecoveryInterval = time.Minute
+	tempBanDuration       = time.Hour
+	// the third automatic ban of the same peer is permanent
+	maxTempBans = 3
+
+	rateLimitPerSecond = 5.0
+	rateLimitBurst     = 20.0
+)
+
+// PeerScore is a snapshot of a peer's standing, as shown by /peers --scores.
+type PeerScore struct {
+	UserID        string    `json:"user_id"`
+	Score         int       `json:"score"`
+	Violations    int       `json:"violations"`
+	LastViolation time.Time `json:"last_violation,omitempty"`
+	Banned        bool      `json:"banned"`
+}
+
+// Ban keeps a peer from connecting. A zero Until means permanent.
+//
+// Peers are banned by the fingerprint of the key they proved in the
+// handshake, so neither a new ID for the same key nor someone merely
+// claiming the ID escapes or triggers it. Bans of users whose key we never
+// saw, and those saved before fingerprints were recorded, match the ID.
+type Ban struct {
+	UserID      string    `json:"user_id"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Reason      string    `json:"reason"`
+	Until       time.Time `json:"until,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (b *Ban) Permanent() bool {
+	return b.Until.IsZero()
+}
+
+func (b *Ban) active() bool {
+	return b.Permanent() || time.Now().Before(b.Until)
+}
+
+// subject is what the ban is filed under.
+func (b *Ban) subject() string {
+	if b.Fingerprint != "" {
+		return b.Fingerprint
+	}
+	return b.UserID
+}
+
+type peerStanding struct {
+	userID        string
+	score         int
+	violations    int
+	lastViolation time.Time
+	lastRecovery  time.Time
+	tempBans      int
+
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Reputation scores peers on how well they behave, rate limits their
+// frames with a token bucket and keeps the ban list. Standings are kept per
+// key fingerprint, which the handshake makes peers prove.
+type Reputation struct {
+	standings map[string]*peerStanding
+	bans      map[string]*Ban
+	path      string
+	mu        sync.Mutex
+}
+
+func NewReputation() *Reputation {
+	return &Reputation{
+		standings: make(map[string]*peerStanding),
+		bans:      make(map[string]*Ban),
+	}
+}
+
+// Load reads the ban list from path and persists future changes there.
+// A missing file is not an error.
+func (r *Reputation) Load(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var bans []*Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return err
+	}
+	for _, ban := range bans {
+		if ban.active() {
+			r.bans[ban.subject()] = ban
+		}
+	}
+	return nil
+}
+
+// Allow takes a token from the bucket of the peer with key fingerprint,
+// reporting false when it is sending faster than the rate limit.
+func (r *Reputation) Allow(userID, fingerprint string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.standing(userID, fingerprint)
+	now := time.Now()
+	s.tokens += now.Sub(s.lastRefill).Seconds() * rateLimitPerSecond
+	if s.tokens > rateLimitBurst {
+		s.tokens = rateLimitBurst
+	}
+	s.lastRefill = now
+
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// Penalize lowers the peer's score. When it reaches zero the peer is
+// banned, temporarily at first and permanently after repeat offences; the
+// returned ban is non-nil in that case.
+func (r *Reputation) Penalize(userID, fingerprint string, penalty Penalty, reason string) (int, *Ban) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.standing(userID, fingerprint)
+	r.recover(s)
+	s.score -= int(penalty)
+	s.violations++
+	s.lastViolation = time.Now()
+
+	if s.score > 0 {
+		return s.score, nil
+	}
+
+	s.tempBans++
+	s.score = initialScore
+	duration := tempBanDuration
+	if s.tempBans >= maxTempBans {
+		duration = 0
+	}
+	return 0, r.ban(userID, fingerprint, duration, "automatic: "+reason)
+}
+
+// Ban bans a peer for duration, or permanently when duration is zero.
+// fingerprint is that of the peer's key, or empty if we never saw it.
+func (r *Reputation) Ban(userID, fingerprint string, duration time.Duration, reason string) *Ban {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ban(userID, fingerprint, duration, reason)
+}
+
+func (r *Reputation) ban(userID, fingerprint string, duration time.Duration, reason string) *Ban {
+	ban := &Ban{
+		UserID:      userID,
+		Fingerprint: fingerprint,
+		Reason:      reason,
+		CreatedAt:   time.Now(),
+	}
+	if duration > 0 {
+		ban.Until = ban.CreatedAt.Add(duration)
+	}
+	r.bans[ban.subject()] = ban
+
+	if err := r.save(); err != nil {
+		fmt.Printf("Error saving ban list: %v\n", err)
+	}
+	return ban
+}
+
+// Unban lifts the bans of a user ID or key fingerprint and gives the peer
+// a fresh score.
+func (r *Reputation) Unban(user string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lifted := false
+	for subject, ban := range r.bans {
+		if ban.UserID == user || ban.Fingerprint == user {
+			delete(r.bans, subject)
+			delete(r.standings, subject)
+			lifted = true
+		}
+	}
+	if !lifted {
+		return false
+	}
+
+	if err := r.save(); err != nil {
+		fmt.Printf("Error saving ban list: %v\n", err)
+	}
+	return true
+}
+
+// IsBanned reports whether the peer with key fingerprint is banned, or the
+// user ID by a ban that predates knowing its key. fingerprint may be empty
+// for a peer that has not proven a key yet.
+func (r *Reputation) IsBanned(userID, fingerprint string) (*Ban, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, subject := range []string{fingerprint, userID} {
+		ban, exists := r.bans[subject]
+		if subject == "" || !exists {
+			continue
+		}
+		if !ban.active() {
+			delete(r.bans, subject)
+			r.save()
+			continue
+		}
+		return ban, true
+	}
+	return nil, false
+}
+
+func (r *Reputation) Bans() []*Ban {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var bans []*Ban
+	for _, ban := range r.bans {
+		if ban.active() {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].CreatedAt.Before(bans[j].CreatedAt)
+	})
+	return bans
+}
+
+// Scores returns every peer seen so far, lowest score first.
+func (r *Reputation) Scores() []PeerScore {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var scores []PeerScore
+	for subject, s := range r.standings {
+		r.recover(s)
+		ban, banned := r.bans[subject]
+		scores = append(scores, PeerScore{
+			UserID:        s.userID,
+			Score:         s.score,
+			Violations:    s.violations,
+			LastViolation: s.lastViolation,
+			Banned:        banned && ban.active(),
+		})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].Score < scores[j].Score
+	})
+	return scores
+}
+
+func (r *Reputation) standing(userID, fingerprint string) *peerStanding {
+	s, exists := r.standings[fingerprint]
+	if !exists {
+		now := time.Now()
+		s = &peerStanding{
+			userID:       userID,
+			score:        initialScore,
+			lastRecovery: now,
+			tokens:       rateLimitBurst,
+			lastRefill:   now,
+		}
+		r.standings[fingerprint] = s
+	}
+	return s
+}
+
+func (r *Reputation) recover(s *peerStanding) {
+	points := int(time.Since(s.lastRecovery) / scoreRecoveryInterval)
+	if points == 0 {
+		return
+	}
+	s.lastRecovery = s.lastRecovery.Add(time.Duration(points) * scoreRecoveryInterval)
+	s.score += points
+	if s.score > initialScore {
+		s.score = initialScore
+	}
+}
+
+func (r *Reputation) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	var bans []*Ban
+	for _, ban := range r.bans {
+		bans = append(bans, ban)
+	}
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.path, data, 0600)
+}
+
+// LoadBans restores the persisted ban list and keeps it saved at path.
+func (n *EnhancedP2PNetwork) LoadBans(path string) error {
+	return n.reputation.Load(path)
+}
+
+func (n *EnhancedP2PNetwork) Reputation() *Reputation {
+	return n.reputation
+}
+
+// penalize records a violation and disconnects the peer if it got banned.
+func (n *EnhancedP2PNetwork) penalize(peer *EnhancedPeer, penalty Penalty, reason string) {
+	score, ban := n.reputation.Penalize(peer.User.ID, peer.fingerprint, penalty, reason)
+	if ban == nil {
+		fmt.Printf("⚠️  %s: %s (score %d)\n", peer.User.Username, reason, score)
+		return
+	}
+
+	fmt.Printf("🚫 Banned %s (%s): %s\n", peer.User.Username, peer.User.ID, describeBan(ban))
+	peer.Session.Close()
+}
+
+// BanPeer bans userID for duration (zero for permanent) and drops any
+// connection to it. The ban holds the key the peer proved when connected,
+// else the one pinned in its contact.
+func (n *EnhancedP2PNetwork) BanPeer(userID string, duration time.Duration, reason string) *Ban {
+	ban := n.reputation.Ban(userID, n.knownFingerprint(userID), duration, reason)
+	n.DisconnectPeer(userID)
+	return ban
+}
+
+func (n *EnhancedP2PNetwork) knownFingerprint(userID string) string {
+	n.mu.RLock()
+	peer, connected := n.peers[userID]
+	n.mu.RUnlock()
+	if connected {
+		return peer.fingerprint
+	}
+	if contact, exists := n.contacts.Get(userID); exists {
+		return contact.Fingerprint
+	}
+	return ""
+}
+
+func (n *EnhancedP2PNetwork) UnbanPeer(userID string) bool {
+	return n.reputation.Unban(userID)
+}
+
+func (n *EnhancedP2PNetwork) ListPeerScores() {
+	fmt.Println("📊 Peer scores:")
+	for _, score := range n.reputation.Scores() {
+		status := ""
+		if score.Banned {
+			status = " 🚫 banned"
+		}
+		fmt.Printf("  %3d  %s (%d violations)%s\n", score.Score, score.UserID, score.Violations, status)
+	}
+
+	bans := n.reputation.Bans()
+	if len(bans) > 0 {
+		fmt.Println("🚫 Bans:")
+		for _, ban := range bans {
+			fmt.Printf("  %s - %s\n", ban.UserID, describeBan(ban))
+		}
+	}
+}
+
+func describeBan(ban *Ban) string {
+	if ban.Permanent() {
+		return "permanent, " + ban.Reason
+	}
+	return fmt.Sprintf("until %s, %s", ban.Until.Format("2006-01-02 15:04"), ban.Reason)
+}
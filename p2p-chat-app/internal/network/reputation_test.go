@@ -0,0 +1,92 @@
+package network
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReputationBans(t *testing.T) {
+	tests := []struct {
+		name string
+		// the ban
+		userID, fingerprint string
+		// the peer checked against it
+		peerID, peerFingerprint string
+		banned                  bool
+	}{
+		{"same key", "alice", "key-a", "alice", "key-a", true},
+		{"same key, new ID", "alice", "key-a", "alice2", "key-a", true},
+		{"same ID, other key", "alice", "key-a", "alice", "key-b", false},
+		{"ID ban, key unknown", "alice", "", "alice", "key-a", true},
+		{"ID ban, other ID", "alice", "", "bob", "key-b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReputation()
+			r.Ban(tt.userID, tt.fingerprint, 0, "test")
+			if _, banned := r.IsBanned(tt.peerID, tt.peerFingerprint); banned != tt.banned {
+				t.Fatalf("banned = %v, want %v", banned, tt.banned)
+			}
+		})
+	}
+}
+
+func TestReputationPenalties(t *testing.T) {
+	r := NewReputation()
+	var ban *Ban
+	for i := 0; ban == nil; i++ {
+		if i > initialScore {
+			t.Fatal("never banned")
+		}
+		_, ban = r.Penalize("alice", "key-a", PenaltyBadSignature, "bad signature")
+	}
+	if ban.Fingerprint != "key-a" || ban.Permanent() {
+		t.Fatalf("got %+v, want a temporary ban of key-a", ban)
+	}
+	// another ID claiming the same key is the same peer
+	if _, banned := r.IsBanned("alice2", "key-a"); !banned {
+		t.Fatal("the key escaped its ban under another ID")
+	}
+	if !r.Unban("alice") {
+		t.Fatal("unban by ID found nothing")
+	}
+	if _, banned := r.IsBanned("alice", "key-a"); banned {
+		t.Fatal("still banned after unban")
+	}
+}
+
+func TestReputationRateLimit(t *testing.T) {
+	r := NewReputation()
+	for i := 0; i < int(rateLimitBurst); i++ {
+		if !r.Allow("alice", "key-a") {
+			t.Fatalf("frame %d refused within the burst", i)
+		}
+	}
+	if r.Allow("alice2", "key-a") {
+		t.Fatal("a new ID got a fresh bucket for the same key")
+	}
+	if !r.Allow("bob", "key-b") {
+		t.Fatal("another key shares the bucket")
+	}
+}
+
+func TestReputationPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	r := NewReputation()
+	if err := r.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	r.Ban("alice", "key-a", time.Hour, "test")
+	r.Ban("bob", "", 0, "test")
+
+	loaded := NewReputation()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range []struct{ id, fingerprint string }{{"alice", "key-a"}, {"bob", "key-b"}} {
+		if _, banned := loaded.IsBanned(peer.id, peer.fingerprint); !banned {
+			t.Fatalf("ban of %s lost on reload", peer.id)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"p2p-chat-app/internal/mux"
+	"time"
+)
+
+// Stream kinds opened over a peer's multiplexed connection.
+const (
+	StreamChat = "chat"
+	StreamFile = "file"
+	StreamSync = "sync"
+	StreamPing = "ping"
+	// StreamPEX carries signed contact records for peer exchange
+	StreamPEX = "pex"
+)
+
+const (
+	keepAliveInterval = 1 * time.Minute
+	pingTimeout       = 30 * time.Second
+)
+
+// StreamHandler serves a stream the remote peer opened. The stream is
+// closed by the handler when it is done with it.
+type StreamHandler func(peer *EnhancedPeer, stream *mux.Stream)
+
+// streamPriority keeps interactive traffic ahead of bulk transfers that
+// share the connection.
+func streamPriority(kind string) mux.Priority {
+	switch kind {
+	case StreamPing, StreamChat:
+		return mux.PriorityHigh
+	case StreamFile:
+		return mux.PriorityLow
+	default:
+		return mux.PriorityNormal
+	}
+}
+
+// HandleStream registers the handler for streams of the given kind,
+// replacing any previous one.
+func (n *EnhancedP2PNetwork) HandleStream(kind string, handler StreamHandler) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers[kind] = handler
+}
+
+// OpenStream opens a new stream of the given kind to a connected peer.
+func (n *EnhancedP2PNetwork) OpenStream(userID string, kind string) (*mux.Stream, error) {
+	n.mu.RLock()
+	peer, exists := n.peers[userID]
+	n.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("peer %s not connected", userID)
+	}
+	return peer.Session.Open(kind, streamPriority(kind))
+}
+
+// Ping measures the round trip to a connected peer over a ping stream.
+func (n *EnhancedP2PNetwork) Ping(userID string) (time.Duration, error) {
+	stream, err := n.OpenStream(userID, StreamPing)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(pingTimeout))
+	start := time.Now()
+	if _, err := fmt.Fprintln(stream, start.UnixNano()); err != nil {
+		return 0, err
+	}
+	if _, err := bufio.NewReader(stream).ReadString('\n'); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func (n *EnhancedP2PNetwork) handleChatStream(peer *EnhancedPeer, stream *mux.Stream) {
+	defer stream.Close()
+
+	reader := bufio.NewReader(stream)
+	for n.isRunning() {
+		message, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		peer.touch()
+
+		if !n.reputation.Allow(peer.User.ID, peer.fingerprint) {
+			n.penalize(peer, PenaltySpam, "rate limit exceeded")
+			continue
+		}
+
+		if n.chat != nil {
+			if err := n.chat.ProcessIncomingMessage(peer.User.ID, message); err != nil {
+				n.penalize(peer, PenaltyInvalidFrame, err.Error())
+			}
+		}
+	}
+}
+
+func (n *EnhancedP2PNetwork) handlePingStream(peer *EnhancedPeer, stream *mux.Stream) {
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(pingTimeout))
+	line, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return
+	}
+	peer.touch()
+	stream.Write([]byte(line))
+}
+
+// keepAlive replaces the old per-connection read deadline: a peer that
+// stops answering pings is disconnected.
+func (n *EnhancedP2PNetwork) keepAlive(peer *EnhancedPeer) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := n.Ping(peer.User.ID); err != nil {
+				fmt.Printf("Ping to %s failed: %v\n", peer.User.Username, err)
+				peer.Session.Close()
+				return
+			}
+			peer.touch()
+		case <-peer.Session.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package notify tells the user about messages meant for them: private
+// messages, messages mentioning them with @name and messages containing
+// one of their highlight keywords. The Dispatcher hands each notification
+// to every sink, which may ring the terminal bell, pop up a desktop
+// notification, call a webhook or queue it for the mobile app. Rooms can
+// be muted, for a while or for good.
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// queueSize bounds the notifications waiting for slow sinks
+	queueSize   = 64
+	maxKeywords = 32
+	maxKeyword  = 64
+)
+
+type Kind string
+
+const (
+	KindDirect  Kind = "direct"
+	KindMention Kind = "mention"
+	KindKeyword Kind = "keyword"
+)
+
+type Notification struct {
+	Kind      Kind      `json:"kind"`
+	MessageID string    `json:"message_id"`
+	From      string    `json:"from"`
+	FromName  string    `json:"from_name"`
+	Room      string    `json:"room,omitempty"` // empty for private messages
+	Keyword   string    `json:"keyword,omitempty"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+	// Disappearing is set for messages with a disappearing timer, whose
+	// content is left out so no sink keeps it past the message
+	Disappearing bool `json:"disappearing,omitempty"`
+}
+
+// Title is the one line summary sinks show above the content.
+func (n *Notification) Title() string {
+	switch n.Kind {
+	case KindDirect:
+		return "Message from " + n.FromName
+	case KindMention:
+		return n.FromName + " mentioned you in " + n.Room
+	default:
+		return fmt.Sprintf("%s said %q in %s", n.FromName, n.Keyword, n.Room)
+	}
+}
+
+// Body is the text sinks show under the title.
+func (n *Notification) Body() string {
+	if n.Disappearing {
+		return "Disappearing message"
+	}
+	return n.Content
+}
+
+// Sink delivers notifications somewhere the user will see them.
+type Sink interface {
+	Name() string
+	Notify(n *Notification) error
+}
+
+// Settings are the user's keywords and muted rooms. A room is muted until
+// the time it maps to, or for good if that is zero.
+type Settings struct {
+	Keywords []string             `json:"keywords"`
+	Muted    map[string]time.Time `json:"muted"`
+}
+
+type Dispatcher struct {
+	settings Settings
+	sinks    []Sink
+	queue    chan *Notification
+	path     string
+	mu       sync.Mutex
+}
+
+func NewDispatcher() *Dispatcher {
+	d := &Dispatcher{
+		settings: Settings{Muted: make(map[string]time.Time)},
+		queue:    make(chan *Notification, queueSize),
+	}
+	go d.run()
+	return d
+}
+
+// Load reads the settings from path and persists future changes there. A
+// missing file is not an error.
+func (d *Dispatcher) Load(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var settings Settings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	if settings.Muted == nil {
+		settings.Muted = make(map[string]time.Time)
+	}
+	d.settings = settings
+	return nil
+}
+
+// AddSink delivers future notifications to s as well.
+func (d *Dispatcher) AddSink(s Sink) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sinks = append(d.sinks, s)
+}
+
+// Sinks names the sinks notifications go to.
+func (d *Dispatcher) Sinks() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	names := make([]string, 0, len(d.sinks))
+	for _, s := range d.sinks {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// Settings returns a copy of the settings with expired mutes left out.
+func (d *Dispatcher) Settings() Settings {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	settings := Settings{
+		Keywords: append([]string{}, d.settings.Keywords...),
+		Muted:    make(map[string]time.Time),
+	}
+	for room, until := range d.settings.Muted {
+		if mutedUntil(until) {
+			settings.Muted[room] = until
+		}
+	}
+	return settings
+}
+
+// AddKeyword highlights messages containing keyword as a whole word,
+// whatever its case.
+func (d *Dispatcher) AddKeyword(keyword string) error {
+	keyword = strings.TrimSpace(keyword)
+	if keyword == "" || len(keyword) > maxKeyword {
+		return fmt.Errorf("keywords are 1 to %d bytes", maxKeyword)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, known := range d.settings.Keywords {
+		if strings.EqualFold(known, keyword) {
+			return nil
+		}
+	}
+	if len(d.settings.Keywords) >= maxKeywords {
+		return fmt.Errorf("at most %d keywords", maxKeywords)
+	}
+	d.settings.Keywords = append(d.settings.Keywords, keyword)
+	sort.Strings(d.settings.Keywords)
+	d.saveLocked()
+	return nil
+}
+
+// RemoveKeyword stops highlighting keyword. It reports whether it was one.
+func (d *Dispatcher) RemoveKeyword(keyword string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, known := range d.settings.Keywords {
+		if strings.EqualFold(known, keyword) {
+			d.settings.Keywords = append(d.settings.Keywords[:i], d.settings.Keywords[i+1:]...)
+			d.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// Keyword returns the first keyword content contains.
+func (d *Dispatcher) Keyword(content string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, keyword := range d.settings.Keywords {
+		if containsWord(content, keyword) {
+			return keyword, true
+		}
+	}
+	return "", false
+}
+
+// Mute silences room for duration, or until unmuted if duration is zero.
+func (d *Dispatcher) Mute(room string, duration time.Duration) {
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.settings.Muted[room] = until
+	d.saveLocked()
+}
+
+// Unmute lets room notify again. It reports whether it was muted.
+func (d *Dispatcher) Unmute(room string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, exists := d.settings.Muted[room]
+	delete(d.settings.Muted, room)
+	d.saveLocked()
+	return exists && mutedUntil(until)
+}
+
+// Muted reports whether room is muted right now.
+func (d *Dispatcher) Muted(room string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, exists := d.settings.Muted[room]
+	return exists && mutedUntil(until)
+}
+
+func mutedUntil(until time.Time) bool {
+	return until.IsZero() || time.Now().Before(until)
+}
+
+// Notify queues n for every sink unless its room is muted. It never
+// blocks: with the queue full n is dropped.
+func (d *Dispatcher) Notify(n *Notification) {
+	if n.Room != "" && d.Muted(n.Room) {
+		return
+	}
+	select {
+	case d.queue <- n:
+	default:
+		fmt.Println("Notification queue full, dropping notification")
+	}
+}
+
+func (d *Dispatcher) run() {
+	for n := range d.queue {
+		d.mu.Lock()
+		sinks := append([]Sink(nil), d.sinks...)
+		d.mu.Unlock()
+
+		for _, s := range sinks {
+			if err := s.Notify(n); err != nil {
+				fmt.Printf("Notification via %s failed: %v\n", s.Name(), err)
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) saveLocked() {
+	if d.path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(&d.settings, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(d.path, data, 0600)
+	}
+	if err != nil {
+		fmt.Printf("Error saving notification settings: %v\n", err)
+	}
+}
+
+// containsWord reports whether word appears in s, ignoring case, with no
+// letter or digit right before or after it.
+func containsWord(s, word string) bool {
+	s, word = strings.ToLower(s), strings.ToLower(word)
+	for start := 0; start < len(s); {
+		i := strings.Index(s[start:], word)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(word)
+		if !wordRuneBefore(s, i) && !wordRuneAt(s, end) {
+			return true
+		}
+		start = i + 1
+	}
+	return false
+}
+
+func wordRuneBefore(s string, i int) bool {
+	if i == 0 {
+		return false
+	}
+	r := []rune(s[:i])
+	return isWordRune(r[len(r)-1])
+}
+
+func wordRuneAt(s string, i int) bool {
+	if i >= len(s) {
+		return false
+	}
+	return isWordRune([]rune(s[i:])[0])
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDesktopArgs(t *testing.T) {
+	long := strings.Repeat("é", maxPreview+10)
+	tests := []struct {
+		name string
+		n    Notification
+		want []string
+	}{
+		{
+			"direct",
+			Notification{Kind: KindDirect, FromName: "alice", Content: "hi"},
+			[]string{"--app-name=p2pchat", "--urgency=critical", "--", "Message from alice", "hi"},
+		},
+		{
+			"options in the content",
+			Notification{Kind: KindDirect, FromName: "alice", Content: "--urgency=low"},
+			[]string{"--app-name=p2pchat", "--urgency=critical", "--", "Message from alice", "--urgency=low"},
+		},
+		{
+			"options in the name",
+			Notification{Kind: KindKeyword, FromName: "--help", Keyword: "go", Room: "general", Content: "-u low"},
+			[]string{"--app-name=p2pchat", "--urgency=normal", "--", `--help said "go" in general`, "-u low"},
+		},
+		{
+			"long content",
+			Notification{Kind: KindMention, FromName: "alice", Room: "general", Content: long},
+			[]string{"--app-name=p2pchat", "--urgency=critical", "--", "alice mentioned you in general", string([]rune(long)[:maxPreview]) + "…"},
+		},
+		{
+			"disappearing message",
+			Notification{Kind: KindDirect, FromName: "alice", Disappearing: true},
+			[]string{"--app-name=p2pchat", "--urgency=critical", "--", "Message from alice", "Disappearing message"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := desktopArgs(&tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package protocol
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // MessageType represents different types of messages
@@ -18,6 +20,40 @@ const (
 	DeliveredMessage  MessageType = "delivered"
 	ReadMessage       MessageType = "read"
 	UserListMessage   MessageType = "userlist"
+	RoomAdvertMessage MessageType = "room_advert"
+	ModerationMessage MessageType = "moderation"
+	PresenceMessage   MessageType = "presence"
+	ReactionMessage   MessageType = "reaction"
+	ExpiryMessage     MessageType = "expiry"
+)
+
+// Presence states. Offline is announced when a user leaves and assumed once
+// their presence is too old.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceBusy    = "busy"
+	PresenceOffline = "offline"
+)
+
+// Typing states carried by typing messages
+const (
+	TypingStart = "start"
+	TypingStop  = "stop"
+)
+
+// Room moderation actions
+const (
+	ActionCreate  = "create"
+	ActionKick    = "kick"
+	ActionBan     = "ban"
+	ActionUnban   = "unban"
+	ActionMute    = "mute"
+	ActionUnmute  = "unmute"
+	ActionTopic   = "topic"
+	ActionPromote = "promote"
+	ActionAdmit   = "admit"
+	ActionExpiry  = "expiry"
 )
 
 type Message struct {
@@ -30,6 +66,22 @@ type Message struct {
 	Timestamp time.Time   `json:"timestamp"`
 	Encrypted bool        `json:"encrypted"`
 	FileInfo  *FileInfo   `json:"file_info,omitempty"`
+	Rooms     []RoomInfo  `json:"rooms,omitempty"`
+	Members   []string    `json:"members,omitempty"`
+	Actions   []RoomAction `json:"actions,omitempty"`
+	Mentions  []string    `json:"mentions,omitempty"` // user IDs named with @
+	Read      *ReadMarker `json:"read,omitempty"`
+	Presence  []Presence  `json:"presence,omitempty"`
+	Typing    string      `json:"typing,omitempty"`
+	Reaction  *Reaction   `json:"reaction,omitempty"`
+	// Reactions holds, on stored messages, who reacted with each emoji
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	// ReactedAt holds, on stored messages, when each reaction was last
+	// added or taken back, by ReactionKey
+	ReactedAt map[string]time.Time `json:"reacted_at,omitempty"`
+	// ExpiresAt is when a disappearing message is deleted everywhere
+	ExpiresAt time.Time      `json:"expires_at,omitempty"`
+	Expiry    *ExpirySetting `json:"expiry,omitempty"`
 }
 
 type FileInfo struct {
@@ -39,18 +91,126 @@ type FileInfo struct {
 	Checksum string `json:"checksum"`
 }
 
+// RoomInfo describes a public room in room advertisements. Each entry is
+// signed by the member that advertised it and passed on unchanged.
+type RoomInfo struct {
+	Name          string    `json:"name"`
+	Topic         string    `json:"topic,omitempty"`
+	Members       int       `json:"members"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	AdvertisedBy  string    `json:"advertised_by,omitempty"`
+	AdvertiserKey string    `json:"advertiser_key,omitempty"`
+	Signature     string    `json:"signature,omitempty"`
+}
+
+// RoomAction is a change to a room's owner, admins, bans, mutes, topic or
+// message expiry, signed by the member who made it so every peer can check
+// it was allowed.
+type RoomAction struct {
+	Room      string        `json:"room"`
+	Action    string        `json:"action"`
+	Actor     string        `json:"actor"`
+	ActorKey  string        `json:"actor_key"`
+	Target    string        `json:"target,omitempty"`
+	Role      string        `json:"role,omitempty"`
+	Topic     string        `json:"topic,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	Until     time.Time     `json:"until,omitempty"` // zero means permanent
+	Mode      string        `json:"mode,omitempty"`
+	Token     string        `json:"token,omitempty"` // invite used to be admitted
+	Proof     string        `json:"proof,omitempty"` // password proof of admission
+	TTL       time.Duration `json:"ttl,omitempty"`   // how long messages last, zero for ever
+	Timestamp time.Time     `json:"timestamp"`
+	Signature string        `json:"signature,omitempty"`
+}
+
+// RoomInvite lets its holder into an invite-only room. It is signed by the
+// room admin who issued it. An empty Invitee lets anyone holding it in and
+// MaxUses 0 means unlimited.
+type RoomInvite struct {
+	Room       string    `json:"room"`
+	Inviter    string    `json:"inviter"`
+	InviterKey string    `json:"inviter_key"`
+	Invitee    string    `json:"invitee,omitempty"`
+	Expires    time.Time `json:"expires"`
+	MaxUses    int       `json:"max_uses,omitempty"`
+	Nonce      string    `json:"nonce"`
+	Signature  string    `json:"signature,omitempty"`
+}
+
+// ReadMarker records that Reader has read a conversation up to and
+// including the message MessageID, sent at ReadUpTo. Conversation is the
+// storage key: room:<name> or private:<user>:<user>.
+type ReadMarker struct {
+	Conversation string    `json:"conversation"`
+	Reader       string    `json:"reader"`
+	MessageID    string    `json:"message_id"`
+	ReadUpTo     time.Time `json:"read_up_to"`
+	ReadAt       time.Time `json:"read_at"`
+}
+
+// ExpirySetting is how long messages in the private conversation
+// Conversation last before they disappear, zero for ever. Either side may
+// change it; the latest change wins on both.
+type ExpirySetting struct {
+	Conversation string        `json:"conversation"`
+	TTL          time.Duration `json:"ttl"`
+	SetBy        string        `json:"set_by"`
+	SetAt        time.Time     `json:"set_at"`
+}
+
+// Reaction adds Emoji to the message MessageID, or takes it back when
+// Removed is set. It is signed by the user who reacted.
+// ReactionKey is what ReactedAt keeps userID's reaction with emoji under.
+func ReactionKey(userID, emoji string) string {
+	return userID + " " + emoji
+}
+
+type Reaction struct {
+	MessageID  string    `json:"message_id"`
+	Emoji      string    `json:"emoji"`
+	Reactor    string    `json:"reactor"`
+	ReactorKey string    `json:"reactor_key"`
+	Removed    bool      `json:"removed,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	Signature  string    `json:"signature,omitempty"`
+}
+
+// Presence is a user's state and status text. It is signed by the user, so
+// it can be passed on by peers that cannot change it.
+type Presence struct {
+	UserID     string    `json:"user_id"`
+	UserKey    string    `json:"user_key"`
+	State      string    `json:"state"`
+	Status     string    `json:"status,omitempty"`
+	Idle       bool      `json:"idle,omitempty"` // away for lack of activity
+	LastActive time.Time `json:"last_active"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Signature  string    `json:"signature,omitempty"`
+}
+
 type User struct {
 	ID        string `json:"id"`
 	Username  string `json:"username"`
 	PublicKey string `json:"public_key"`
 	Address   string `json:"address"`
 	Online    bool   `json:"online"`
+	Presence  string `json:"presence,omitempty"`
+	Status    string `json:"status,omitempty"`
 }
 
 type HandshakeData struct {
 	User      User   `json:"user"`
 	Version   string `json:"version"`
 	Timestamp time.Time `json:"timestamp"`
+	// Nonce is what the other side must sign to prove it holds User's key
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+// HandshakeProof follows the handshakes: a signature over the other side's
+// nonce, made with the key of the User we sent.
+type HandshakeProof struct {
+	Signature string `json:"signature"`
 }
 
 func SerializeMessage(msg *Message) ([]byte, error) {
@@ -89,6 +249,35 @@ func NewFileMessage(from, filename string, size int64, mimeType, checksum string
 	}
 }
 
+// ParseMentions returns the names written as @name in content, in order and
+// without repeats. A name runs over letters, digits, '_', '-' and '.', and
+// a trailing '.' ends the sentence rather than the name.
+func ParseMentions(content string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	runes := []rune(content)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' || (i > 0 && isNameRune(runes[i-1])) {
+			continue
+		}
+		end := i + 1
+		for end < len(runes) && isNameRune(runes[end]) {
+			end++
+		}
+		name := strings.TrimRight(string(runes[i+1:end]), ".")
+		if name != "" && !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+		i = end - 1
+	}
+	return names
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
 func GenerateMessageID() string {
 	return time.Now().Format("20060102150405") + "-" + randomString(8)
 }
@@ -0,0 +1,331 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Expected values come from the tables and worked examples of ISO/IEC 18004
+// and the tutorials that follow it, not from this package.
+
+func TestReedSolomon(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		ecc  []byte
+	}{
+		{
+			"HELLO WORLD at 1-M",
+			[]byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17},
+			[]byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23},
+		},
+		{
+			"first block at 5-Q",
+			[]byte{67, 85, 70, 134, 87, 38, 85, 194, 119, 50, 6, 18, 6, 103, 38},
+			[]byte{213, 199, 11, 45, 115, 247, 241, 223, 229, 248, 154, 117, 154, 111, 86, 161, 111, 39},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rsRemainder(tt.data, rsDivisor(len(tt.ecc)))
+			if !bytes.Equal(got, tt.ecc) {
+				t.Fatalf("got %v, want %v", got, tt.ecc)
+			}
+		})
+	}
+}
+
+func TestEncodeData(t *testing.T) {
+	want := []byte{0x40, 0x56, 0x86, 0x56, 0xC6, 0xC6, 0xF0,
+		0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	if got := encodeData(1, []byte("hello")); !bytes.Equal(got, want) {
+		t.Fatalf("got % X, want % X", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	// level L, by mask
+	want := []string{
+		"111011111000100", "111001011110011", "111110110101010", "111100010011101",
+		"110011000101111", "110001100011000", "110110001000001", "110100101110110",
+	}
+	for mask, bits := range want {
+		t.Run(fmt.Sprint("mask ", mask), func(t *testing.T) {
+			c := newCode(1)
+			c.drawFormatBits(mask)
+			first, second := readFormat(c)
+			if first != bits || second != bits {
+				t.Fatalf("read %s and %s, want %s", first, second, bits)
+			}
+			if !c.Dark(8, c.Size-8) {
+				t.Fatal("the module by the bottom left finder is light")
+			}
+		})
+	}
+}
+
+func TestVersionBits(t *testing.T) {
+	tests := []struct {
+		version int
+		bits    string
+	}{
+		{7, "000111110010010100"},
+		{8, "001000010110111100"},
+		{9, "001001101010011001"},
+		{10, "001010010011010011"},
+		{40, "101000110001101001"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint("version ", tt.version), func(t *testing.T) {
+			c := newCode(tt.version)
+			c.drawVersion()
+			var above, left strings.Builder
+			for i := 17; i >= 0; i-- {
+				a, b := c.Size-11+i%3, i/3
+				above.WriteString(bit(c.Dark(a, b)))
+				left.WriteString(bit(c.Dark(b, a)))
+			}
+			if above.String() != tt.bits || left.String() != tt.bits {
+				t.Fatalf("read %s and %s, want %s", above.String(), left.String(), tt.bits)
+			}
+		})
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	tests := []struct {
+		version   int
+		positions []int
+	}{
+		{1, nil},
+		{2, []int{6, 18}},
+		{7, []int{6, 22, 38}},
+		{14, []int{6, 26, 46, 66}},
+		{15, []int{6, 26, 48, 70}},
+		{32, []int{6, 34, 60, 86, 112, 138}},
+		{36, []int{6, 24, 50, 76, 102, 128, 154}},
+		{40, []int{6, 30, 58, 86, 114, 142, 170}},
+	}
+	for _, tt := range tests {
+		if got := newCode(tt.version).alignmentPositions(); !reflect.DeepEqual(got, tt.positions) {
+			t.Errorf("version %d: got %v, want %v", tt.version, got, tt.positions)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	// the most bytes each version holds at level L
+	tests := []struct {
+		version, bytes int
+	}{
+		{1, 17}, {2, 32}, {3, 53}, {4, 78}, {5, 106},
+		{6, 134}, {7, 154}, {8, 192}, {9, 230}, {10, 271},
+		{40, 2953},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint("version ", tt.version), func(t *testing.T) {
+			c, err := Encode(make([]byte, tt.bytes))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Version != tt.version || c.Size != 17+4*tt.version {
+				t.Fatalf("%d bytes got version %d of size %d", tt.bytes, c.Version, c.Size)
+			}
+			if tt.version == 40 {
+				if _, err := Encode(make([]byte, tt.bytes+1)); err != ErrTooLong {
+					t.Fatalf("one byte more got %v", err)
+				}
+				return
+			}
+			if c, _ := Encode(make([]byte, tt.bytes+1)); c.Version != tt.version+1 {
+				t.Fatalf("one byte more got version %d", c.Version)
+			}
+		})
+	}
+}
+
+func TestEncodeReadsBack(t *testing.T) {
+	tests := []string{
+		"",
+		"hello",
+		"p2pchat://peer?id=0123456789abcdef&fp=fedcba9876543210",
+		strings.Repeat("p2pchat ", 40),
+		strings.Repeat("0123456789", 295),
+	}
+	for _, data := range tests {
+		t.Run(fmt.Sprint(len(data), " bytes"), func(t *testing.T) {
+			c, err := Encode([]byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decode(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != data {
+				t.Fatalf("read back %q", got)
+			}
+		})
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	c, err := Encode([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(), "\n"), "\n")
+	if len(lines) != (c.Size+2*quietZone+1)/2 {
+		t.Fatalf("%d lines for a symbol of size %d", len(lines), c.Size)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, terminalColors) || !strings.HasSuffix(line, terminalReset) {
+			t.Fatalf("line %q doesn't set its own colors", line)
+		}
+	}
+
+	// the quiet zone is blank and the top left finder starts dark
+	first := []rune(strings.TrimPrefix(lines[0], terminalColors))
+	if strings.TrimSpace(string(first[:c.Size+2*quietZone])) != "" {
+		t.Fatalf("quiet zone drawn: %q", lines[0])
+	}
+	finder := []rune(strings.TrimPrefix(lines[quietZone/2], terminalColors))
+	if finder[quietZone] != '█' {
+		t.Fatalf("finder corner drawn as %q", finder[quietZone])
+	}
+}
+
+func bit(dark bool) string {
+	if dark {
+		return "1"
+	}
+	return "0"
+}
+
+// readFormat reads both copies of the format bits, most significant first,
+// from where the standard puts them.
+func readFormat(c *Code) (string, string) {
+	first := make([]string, 15)
+	second := make([]string, 15)
+	for i := 0; i <= 5; i++ {
+		first[i] = bit(c.Dark(8, i))
+	}
+	first[6] = bit(c.Dark(8, 7))
+	first[7] = bit(c.Dark(8, 8))
+	first[8] = bit(c.Dark(7, 8))
+	for i := 9; i < 15; i++ {
+		first[i] = bit(c.Dark(14-i, 8))
+	}
+	for i := 0; i < 8; i++ {
+		second[i] = bit(c.Dark(c.Size-1-i, 8))
+	}
+	for i := 8; i < 15; i++ {
+		second[i] = bit(c.Dark(8, c.Size-15+i))
+	}
+
+	reverse := func(bits []string) string {
+		var b strings.Builder
+		for i := len(bits) - 1; i >= 0; i-- {
+			b.WriteString(bits[i])
+		}
+		return b.String()
+	}
+	return reverse(first), reverse(second)
+}
+
+// decode reads a code back the way a reader would: mask from the format
+// bits, codewords in zigzag order, blocks checked against their error
+// correction, then the byte mode segment.
+func decode(c *Code) ([]byte, error) {
+	format, _ := readFormat(c)
+	var bits int
+	fmt.Sscanf(format, "%b", &bits)
+	bits ^= 0x5412
+	if bits>>13 != eccLevelBits {
+		return nil, fmt.Errorf("format %s is not level L", format)
+	}
+	mask := bits >> 10 & 7
+
+	var raw []byte
+	var n int
+	var cur byte
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upwards := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upwards {
+				y = c.Size - 1 - vert
+			}
+			for x := right; x >= right-1; x-- {
+				if c.isFunction[y][x] {
+					continue
+				}
+				dark := c.Dark(x, y) != maskBit(mask, x, y)
+				cur <<= 1
+				if dark {
+					cur |= 1
+				}
+				if n++; n%8 == 0 {
+					raw = append(raw, cur)
+					cur = 0
+				}
+			}
+		}
+	}
+
+	numBlocks := eccBlocks[c.Version]
+	ecc := eccPerBlock[c.Version]
+	total := rawDataModules(c.Version) / 8
+	raw = raw[:total]
+	numShort := numBlocks - total%numBlocks
+	shortData := total/numBlocks - ecc
+
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= shortData; i++ {
+		for j := range blocks {
+			if i < shortData || j >= numShort {
+				blocks[j] = append(blocks[j], raw[k])
+				k++
+			}
+		}
+	}
+	eccs := make([][]byte, numBlocks)
+	for i := 0; i < ecc; i++ {
+		for j := range eccs {
+			eccs[j] = append(eccs[j], raw[k])
+			k++
+		}
+	}
+
+	var data []byte
+	for j, block := range blocks {
+		if !bytes.Equal(rsRemainder(block, rsDivisor(ecc)), eccs[j]) {
+			return nil, fmt.Errorf("block %d fails its error correction", j)
+		}
+		data = append(data, block...)
+	}
+
+	if data[0]>>4 != 0x4 {
+		return nil, fmt.Errorf("mode %x is not byte mode", data[0]>>4)
+	}
+	// the count starts four bits in, so each byte straddles two codewords
+	at := func(i int) int { return int(data[i]&0x0F)<<4 | int(data[i+1]>>4) }
+	length := at(0)
+	start := 1
+	if charCountBits(c.Version) == 16 {
+		length = length<<8 | at(1)
+		start = 2
+	}
+	result := make([]byte, length)
+	for i := range result {
+		result[i] = byte(at(start + i))
+	}
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package qrcode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// quietZone is the light border readers need around the symbol.
+const quietZone = 4
+
+// terminalColors sets black on bright white for the symbol, so it reads the
+// same whatever colors the terminal uses; terminalReset undoes it.
+const (
+	terminalColors = "\x1b[30;107m"
+	terminalReset  = "\x1b[0m"
+)
+
+// Terminal renders the code with half block characters, two module rows per
+// line, drawing dark modules in black on a white background of its own.
+func (c *Code) Terminal() string {
+	var b strings.Builder
+	for y := -quietZone; y < c.Size+quietZone; y += 2 {
+		b.WriteString(terminalColors)
+		for x := -quietZone; x < c.Size+quietZone; x++ {
+			top, bottom := c.Dark(x, y), c.Dark(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(terminalReset + "\n")
+	}
+	return b.String()
+}
+
+// Image renders the code with scale pixels per module.
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	side := (c.Size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			v := color.Gray{Y: 255}
+			if c.Dark(x/scale-quietZone, y/scale-quietZone) {
+				v = color.Gray{Y: 0}
+			}
+			img.SetGray(x, y, v)
+		}
+	}
+	return img
+}
+
+// PNG encodes the code as a PNG image with scale pixels per module.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.Image(scale)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
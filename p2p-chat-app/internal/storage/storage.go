@@ -2,6 +2,7 @@ package storage
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"p2p-chat-app/internal/protocol"
@@ -11,10 +12,22 @@ import (
 	"time"
 )
 
+const (
+	// readMarkersFile holds every read marker, by conversation and reader.
+	readMarkersFile = "read_markers.json"
+	// expiryFile holds the disappearing message settings of private
+	// conversations.
+	expiryFile = "expiry.json"
+)
+
 type MessageStore struct {
-	dataDir  string
-	messages map[string][]*protocol.Message 
-	mu       sync.RWMutex
+	dataDir      string
+	messages     map[string][]*protocol.Message
+	markers      map[string]map[string]protocol.ReadMarker
+	markersDirty bool // markers moved since SaveMarkers
+	expiry       map[string]protocol.ExpirySetting
+	nextExpiry   time.Time // earliest ExpiresAt of a stored message, zero if none
+	mu           sync.RWMutex
 }
 
 func NewMessageStore(dataDir string) (*MessageStore, error) {
@@ -25,11 +38,19 @@ func NewMessageStore(dataDir string) (*MessageStore, error) {
 	store := &MessageStore{
 		dataDir:  dataDir,
 		messages: make(map[string][]*protocol.Message),
+		markers:  make(map[string]map[string]protocol.ReadMarker),
+		expiry:   make(map[string]protocol.ExpirySetting),
 	}
 
 	if err := store.loadMessages(); err != nil {
 		return nil, err
 	}
+	if err := store.loadMarkers(); err != nil {
+		return nil, err
+	}
+	if err := store.loadExpiry(); err != nil {
+		return nil, err
+	}
 
 	return store, nil
 }
@@ -40,6 +61,7 @@ func (ms *MessageStore) StoreMessage(msg *protocol.Message) error {
 
 	key := ms.getStorageKey(msg)
 	ms.messages[key] = append(ms.messages[key], msg)
+	ms.noteExpiry(msg)
 
 	sort.Slice(ms.messages[key], func(i, j int) bool {
 		return ms.messages[key][i].Timestamp.Before(ms.messages[key][j].Timestamp)
@@ -95,43 +117,321 @@ func (ms *MessageStore) SearchMessages(query string, roomOrUser string) ([]*prot
 	return results, nil
 }
 
-func (ms *MessageStore) DeleteOldMessages(olderThan time.Duration) error {
+// DeleteExpired deletes the messages whose ExpiresAt is not after now, from
+// memory and disk, and returns how many there were.
+func (ms *MessageStore) DeleteExpired(now time.Time) (int, error) {
+	ms.mu.RLock()
+	due := !ms.nextExpiry.IsZero() && !ms.nextExpiry.After(now)
+	ms.mu.RUnlock()
+	if !due {
+		return 0, nil
+	}
+	return ms.deleteWhere(func(msg *protocol.Message) bool {
+		return !msg.ExpiresAt.IsZero() && !msg.ExpiresAt.After(now)
+	})
+}
+
+// deleteWhere deletes the messages doomed returns true for and rewrites
+// the files of the conversations they were in. A conversation left empty
+// loses its file. A conversation that can't be saved keeps its messages,
+// and nextExpiry stays where it was, so the next call tries again.
+func (ms *MessageStore) deleteWhere(doomed func(msg *protocol.Message) bool) (int, error) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
-	cutoff := time.Now().Add(-olderThan)
-
+	deleted := 0
+	var next time.Time
 	for key, messages := range ms.messages {
 		var kept []*protocol.Message
 		for _, msg := range messages {
-			if msg.Timestamp.After(cutoff) {
-				kept = append(kept, msg)
+			if doomed(msg) {
+				continue
 			}
+			kept = append(kept, msg)
+			next = earliestExpiry(next, msg)
 		}
-		ms.messages[key] = kept
-		if err := ms.saveMessages(key); err != nil {
-			return err
+		if len(kept) == len(messages) {
+			continue
 		}
+
+		if len(kept) > 0 {
+			ms.messages[key] = kept
+			if err := ms.saveMessages(key); err != nil {
+				ms.messages[key] = messages
+				return deleted, err
+			}
+		} else {
+			err := os.Remove(ms.messagesFile(key))
+			if err != nil && !os.IsNotExist(err) {
+				return deleted, err
+			}
+			delete(ms.messages, key)
+		}
+		deleted += len(messages) - len(kept)
 	}
+	ms.nextExpiry = next
+	return deleted, nil
+}
 
-	return nil
+// noteExpiry keeps nextExpiry up to date with msg. Callers hold ms.mu.
+func (ms *MessageStore) noteExpiry(msg *protocol.Message) {
+	ms.nextExpiry = earliestExpiry(ms.nextExpiry, msg)
+}
+
+// earliestExpiry returns whichever of next and msg's ExpiresAt comes
+// first, zero standing for none.
+func earliestExpiry(next time.Time, msg *protocol.Message) time.Time {
+	if !msg.ExpiresAt.IsZero() && (next.IsZero() || msg.ExpiresAt.Before(next)) {
+		return msg.ExpiresAt
+	}
+	return next
+}
+
+// Message returns the message id in key.
+func (ms *MessageStore) Message(key, id string) (*protocol.Message, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for _, msg := range ms.messages[key] {
+		if msg.ID == id {
+			return msg, true
+		}
+	}
+	return nil, false
+}
+
+// FindMessage looks for the message id in every conversation and returns
+// it with the key of the conversation it is in.
+func (ms *MessageStore) FindMessage(id string) (string, *protocol.Message, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for key, messages := range ms.messages {
+		for _, msg := range messages {
+			if msg.ID == id {
+				return key, msg, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// React adds userID to those who reacted with emoji to the message id in
+// key, or takes them off when removed is set, as of at. It reports whether
+// that changed anything; a change no newer than the last one to the same
+// reaction is ignored, so an old one can't be replayed.
+func (ms *MessageStore) React(key, id, userID, emoji string, removed bool, at time.Time) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for i, msg := range ms.messages[key] {
+		if msg.ID != id {
+			continue
+		}
+		reaction := protocol.ReactionKey(userID, emoji)
+		if last, exists := msg.ReactedAt[reaction]; exists && !at.After(last) {
+			return false, nil
+		}
+
+		var users []string
+		reacted := false
+		for _, user := range msg.Reactions[emoji] {
+			if user == userID {
+				reacted = true
+			} else {
+				users = append(users, user)
+			}
+		}
+		if !removed {
+			users = append(users, userID)
+		}
+
+		// replace rather than change msg, which callers may be reading
+		updated := *msg
+		updated.Reactions = make(map[string][]string, len(msg.Reactions)+1)
+		for e, u := range msg.Reactions {
+			updated.Reactions[e] = u
+		}
+		if len(users) > 0 {
+			updated.Reactions[emoji] = users
+		} else {
+			delete(updated.Reactions, emoji)
+		}
+		updated.ReactedAt = make(map[string]time.Time, len(msg.ReactedAt)+1)
+		for r, t := range msg.ReactedAt {
+			updated.ReactedAt[r] = t
+		}
+		updated.ReactedAt[reaction] = at
+		ms.messages[key][i] = &updated
+		if err := ms.saveMessages(key); err != nil {
+			return false, err
+		}
+		return reacted == removed, nil
+	}
+	return false, fmt.Errorf("no message %s in %s", id, key)
 }
 
 func (ms *MessageStore) getStorageKey(msg *protocol.Message) string {
 	if msg.Room != "" {
-		return "room:" + msg.Room
+		return RoomKey(msg.Room)
 	}
 	if msg.To != "" {
-		if msg.From < msg.To {
-			return "private:" + msg.From + ":" + msg.To
-		}
-		return "private:" + msg.To + ":" + msg.From
+		return PrivateKey(msg.From, msg.To)
 	}
 	return "global"
 }
 
+// RoomKey is the storage key of a room's messages.
+func RoomKey(room string) string {
+	return "room:" + room
+}
+
+// PrivateKey is the storage key of the private conversation between two
+// users, the same whichever way round they are given.
+func PrivateKey(a, b string) string {
+	if a < b {
+		return "private:" + a + ":" + b
+	}
+	return "private:" + b + ":" + a
+}
+
+// MarkRead moves the read marker of m.Reader in m.Conversation forward to
+// m. It reports whether the marker moved; an older marker changes nothing.
+// Markers move often, so they are only written out by SaveMarkers.
+func (ms *MessageStore) MarkRead(m protocol.ReadMarker) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if known, exists := ms.markers[m.Conversation][m.Reader]; exists && !m.ReadUpTo.After(known.ReadUpTo) {
+		return false
+	}
+	if ms.markers[m.Conversation] == nil {
+		ms.markers[m.Conversation] = make(map[string]protocol.ReadMarker)
+	}
+	ms.markers[m.Conversation][m.Reader] = m
+	ms.markersDirty = true
+	return true
+}
+
+// SaveMarkers writes the read markers out if any moved since the last save.
+func (ms *MessageStore) SaveMarkers() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if !ms.markersDirty {
+		return nil
+	}
+	if err := ms.saveMarkers(); err != nil {
+		return err
+	}
+	ms.markersDirty = false
+	return nil
+}
+
+// ReadMarker returns how far reader has read the conversation key.
+func (ms *MessageStore) ReadMarker(key, reader string) (protocol.ReadMarker, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	m, exists := ms.markers[key][reader]
+	return m, exists
+}
+
+// Unread returns the messages in key after reader's read marker that
+// someone else sent.
+func (ms *MessageStore) Unread(key, reader string) []*protocol.Message {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	marker := ms.markers[key][reader]
+	var unread []*protocol.Message
+	for _, msg := range ms.messages[key] {
+		if msg.From != reader && msg.Timestamp.After(marker.ReadUpTo) {
+			unread = append(unread, msg)
+		}
+	}
+	return unread
+}
+
+// Latest returns the newest message in key.
+func (ms *MessageStore) Latest(key string) (*protocol.Message, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	messages := ms.messages[key]
+	if len(messages) == 0 {
+		return nil, false
+	}
+	return messages[len(messages)-1], true
+}
+
+// SetExpiry replaces the disappearing message setting of s.Conversation
+// with s unless the one we have is newer. It reports whether s was taken.
+func (ms *MessageStore) SetExpiry(s protocol.ExpirySetting) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if known, exists := ms.expiry[s.Conversation]; exists && !s.SetAt.After(known.SetAt) {
+		return false, nil
+	}
+	ms.expiry[s.Conversation] = s
+	return true, ms.saveExpiry()
+}
+
+// Expiry returns the disappearing message setting of the private
+// conversation key.
+func (ms *MessageStore) Expiry(key string) (protocol.ExpirySetting, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	s, exists := ms.expiry[key]
+	return s, exists
+}
+
+func (ms *MessageStore) saveExpiry() error {
+	data, err := json.MarshalIndent(ms.expiry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(ms.dataDir, expiryFile), data, 0644)
+}
+
+func (ms *MessageStore) loadExpiry() error {
+	data, err := ioutil.ReadFile(filepath.Join(ms.dataDir, expiryFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &ms.expiry)
+}
+
+func (ms *MessageStore) saveMarkers() error {
+	data, err := json.MarshalIndent(ms.markers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(ms.dataDir, readMarkersFile), data, 0644)
+}
+
+func (ms *MessageStore) loadMarkers() error {
+	data, err := ioutil.ReadFile(filepath.Join(ms.dataDir, readMarkersFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &ms.markers)
+}
+
+func (ms *MessageStore) messagesFile(key string) string {
+	return filepath.Join(ms.dataDir, sanitizeFilename(key)+".json")
+}
+
 func (ms *MessageStore) saveMessages(key string) error {
-	filename := filepath.Join(ms.dataDir, sanitizeFilename(key)+".json")
+	filename := ms.messagesFile(key)
 	data, err := json.MarshalIndent(ms.messages[key], "", "  ")
 	if err != nil {
 		return err
@@ -146,7 +446,7 @@ func (ms *MessageStore) loadMessages() error {
 	}
 
 	for _, file := range files {
-		if filepath.Ext(file.Name()) != ".json" {
+		if filepath.Ext(file.Name()) != ".json" || file.Name() == readMarkersFile || file.Name() == expiryFile {
 			continue
 		}
 
@@ -161,9 +461,13 @@ func (ms *MessageStore) loadMessages() error {
 			continue 
 		}
 
-		key := file.Name()[:len(file.Name())-5] 
-		key = unsanitizeFilename(key)
-		ms.messages[key] = messages
+		// file names lose the ':' of keys, so take the key from the
+		// messages; read markers and lookups use the real one
+		for _, msg := range messages {
+			key := ms.getStorageKey(msg)
+			ms.messages[key] = append(ms.messages[key], msg)
+			ms.noteExpiry(msg)
+		}
 	}
 
 	return nil
@@ -181,10 +485,6 @@ func sanitizeFilename(s string) string {
 	return safe
 }
 
-func unsanitizeFilename(s string) string {
-	return s
-}
-
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || 
 		len(s) > len(substr) && 
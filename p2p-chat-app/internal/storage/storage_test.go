@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"os"
+	"p2p-chat-app/internal/protocol"
+	"testing"
+	"time"
+)
+
+func TestDeleteExpired(t *testing.T) {
+	now := time.Now()
+	at := func(seconds int) time.Time { return now.Add(time.Duration(seconds) * time.Second) }
+
+	tests := []struct {
+		name string
+		// expires holds when each stored message expires, zero for never
+		expires []time.Time
+		deleted int
+		next    time.Time
+	}{
+		{"nothing expires", []time.Time{{}, {}}, 0, time.Time{}},
+		{"nothing due", []time.Time{at(10), {}}, 0, at(10)},
+		{"one due", []time.Time{at(-10), at(20), at(10)}, 1, at(10)},
+		{"all due", []time.Time{at(-10), at(0)}, 2, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms, err := NewMessageStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, expires := range tt.expires {
+				msg := &protocol.Message{ID: protocol.GenerateMessageID(), From: "alice", To: "bob", Timestamp: at(i - 60), ExpiresAt: expires}
+				if err := ms.StoreMessage(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deleted, err := ms.DeleteExpired(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != tt.deleted {
+				t.Fatalf("deleted %d, want %d", deleted, tt.deleted)
+			}
+			if !ms.nextExpiry.Equal(tt.next) {
+				t.Fatalf("next expiry %v, want %v", ms.nextExpiry, tt.next)
+			}
+
+			reloaded, err := NewMessageStore(ms.dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := len(reloaded.messages[PrivateKey("alice", "bob")]); kept != len(tt.expires)-tt.deleted {
+				t.Fatalf("%d messages left on disk", kept)
+			}
+		})
+	}
+}
+
+func TestDeleteExpiredRetries(t *testing.T) {
+	ms, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, msg := range []*protocol.Message{
+		{ID: "gone", Room: "a", Timestamp: now.Add(-time.Minute), ExpiresAt: now.Add(-time.Second)},
+		{ID: "kept", Room: "a", Timestamp: now.Add(-time.Minute)},
+		{ID: "later", Room: "b", Timestamp: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)},
+	} {
+		if err := ms.StoreMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a directory where room a's file goes makes saving it fail
+	file := ms.messagesFile(RoomKey("a"))
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(file, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.DeleteExpired(now); err == nil {
+		t.Fatal("saving into a directory worked")
+	}
+	if !ms.nextExpiry.Equal(now.Add(-time.Second)) {
+		t.Fatalf("next expiry moved to %v after a failed save", ms.nextExpiry)
+	}
+	if _, found := ms.Message(RoomKey("a"), "gone"); !found {
+		t.Fatal("deleted from memory what is still on disk")
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.DeleteExpired(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := ms.Message(RoomKey("a"), "gone"); found {
+		t.Fatal("expired message kept")
+	}
+	reloaded, err := NewMessageStore(ms.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := reloaded.Message(RoomKey("a"), "gone"); found {
+		t.Fatal("expired message kept on disk")
+	}
+	if !ms.nextExpiry.Equal(now.Add(time.Hour)) {
+		t.Fatalf("next expiry %v, want an hour from now", ms.nextExpiry)
+	}
+}
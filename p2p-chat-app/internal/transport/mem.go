@@ -0,0 +1,262 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MemTransport connects nodes living in the same process, so multi-node
+// setups can run deterministically without touching the network.
+type MemTransport struct{}
+
+// memBufferSize bounds what one direction of a mem connection holds before
+// writers wait for the reader, like a socket buffer.
+const memBufferSize = 256 * 1024
+
+var (
+	memListeners = make(map[string]*memListener)
+	memMu        sync.Mutex
+)
+
+func (t *MemTransport) Scheme() string { return "mem" }
+
+func (t *MemTransport) Dial(name string, timeout time.Duration) (net.Conn, error) {
+	memMu.Lock()
+	l, exists := memListeners[name]
+	memMu.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("mem://%s: connection refused", name)
+	}
+
+	local, remote := memPipe(memAddr("dialer"), memAddr(name))
+	select {
+	case l.accepted <- remote:
+		return local, nil
+	case <-l.done:
+		return nil, fmt.Errorf("mem://%s: connection refused", name)
+	case <-deadlineChan(timeout):
+		return nil, fmt.Errorf("mem://%s: dial timeout", name)
+	}
+}
+
+func (t *MemTransport) Listen(name string) (net.Listener, error) {
+	memMu.Lock()
+	defer memMu.Unlock()
+
+	if _, exists := memListeners[name]; exists {
+		return nil, fmt.Errorf("mem://%s: address in use", name)
+	}
+	l := &memListener{
+		name:     name,
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	memListeners[name] = l
+	return l, nil
+}
+
+type memListener struct {
+	name     string
+	accepted chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		memMu.Lock()
+		delete(memListeners, l.name)
+		memMu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.name)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return "mem://" + string(a) }
+
+// memPipe is like net.Pipe but buffered, so both ends may write their
+// handshake before either reads. Each direction holds up to memBufferSize.
+func memPipe(localAddr, remoteAddr net.Addr) (net.Conn, net.Conn) {
+	ab := newMemBuffer()
+	ba := newMemBuffer()
+	a := &memConn{in: ba, out: ab, local: localAddr, remote: remoteAddr}
+	b := &memConn{in: ab, out: ba, local: remoteAddr, remote: localAddr}
+	return a, b
+}
+
+type memBuffer struct {
+	mu       sync.Mutex
+	data     []byte
+	closed   bool
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newMemBuffer() *memBuffer {
+	return &memBuffer{readable: make(chan struct{}, 1), writable: make(chan struct{}, 1)}
+}
+
+// write appends p, waiting for the reader whenever the buffer is full.
+func (b *memBuffer) write(p []byte, deadline time.Time) (int, error) {
+	written := 0
+	for written < len(p) {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if room := memBufferSize - len(b.data); room > 0 {
+			if room > len(p)-written {
+				room = len(p) - written
+			}
+			b.data = append(b.data, p[written:written+room]...)
+			written += room
+			notify(b.readable)
+			b.mu.Unlock()
+			continue
+		}
+		b.mu.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, errTimeout
+		}
+		select {
+		case <-b.writable:
+		case <-deadlineChan(time.Until(deadline)):
+			if !deadline.IsZero() {
+				return written, errTimeout
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *memBuffer) read(p []byte, deadline time.Time) (int, error) {
+	for {
+		b.mu.Lock()
+		if len(b.data) > 0 {
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			notify(b.writable)
+			b.mu.Unlock()
+			return n, nil
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		b.mu.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, errTimeout
+		}
+		select {
+		case <-b.readable:
+		case <-deadlineChan(time.Until(deadline)):
+			if !deadline.IsZero() {
+				return 0, errTimeout
+			}
+		}
+	}
+}
+
+func (b *memBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	notify(b.readable)
+	notify(b.writable)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+type memConn struct {
+	in, out       *memBuffer
+	local, remote net.Addr
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	return c.in.read(p, deadline)
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	return c.out.write(p, deadline)
+}
+
+func (c *memConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.in.readable)
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.out.writable)
+	return nil
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var errTimeout net.Error = &timeoutError{}
+
+func deadlineChan(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return time.After(d)
+}
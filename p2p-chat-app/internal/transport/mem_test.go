@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// memPair returns both ends of a connection made through a mem listener.
+func memPair(t *testing.T, name string) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := Listen("mem://" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	dialed, err := Dial("mem://"+name, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listened := <-accepted
+	t.Cleanup(func() {
+		dialed.Close()
+		listened.Close()
+	})
+	return dialed, listened
+}
+
+func TestMemRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"small", 5},
+		{"exactly one buffer", memBufferSize},
+		// more than the buffer holds, so the writer waits for the reader
+		{"several buffers", 3*memBufferSize + 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialed, listened := memPair(t, "roundtrip")
+			data := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+
+			go func() {
+				dialed.Write(data)
+				dialed.Close()
+			}()
+			got, err := io.ReadAll(listened)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes, want the %d written", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestMemAddresses(t *testing.T) {
+	l, err := Listen("mem://taken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := Listen("mem://taken"); err == nil {
+		t.Fatal("listened twice on the same name")
+	}
+	if _, err := Dial("mem://nobody", time.Second); err == nil {
+		t.Fatal("dialed a name nobody listens on")
+	}
+
+	l.Close()
+	if _, err := Dial("mem://taken", time.Second); err == nil {
+		t.Fatal("dialed a closed listener")
+	}
+	again, err := Listen("mem://taken")
+	if err != nil {
+		t.Fatalf("name not freed by Close: %v", err)
+	}
+	again.Close()
+}
+
+func TestMemDeadlines(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(conn net.Conn) error
+	}{
+		{"read with nothing sent", func(conn net.Conn) error {
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, err := conn.Read(make([]byte, 1))
+			return err
+		}},
+		{"write to a full buffer", func(conn net.Conn) error {
+			conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+			_, err := conn.Write(make([]byte, memBufferSize+1))
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialed, _ := memPair(t, "deadlines")
+			done := make(chan error, 1)
+			go func() { done <- tt.op(dialed) }()
+
+			select {
+			case err := <-done:
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					t.Fatalf("got %v, want a timeout", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("deadline did not fire")
+			}
+		})
+	}
+}
+
+func TestMemCloseWakesBlockedWriter(t *testing.T) {
+	dialed, listened := memPair(t, "close")
+	done := make(chan error, 1)
+	go func() {
+		_, err := dialed.Write(make([]byte, 2*memBufferSize))
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	listened.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("write to a closed connection succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still blocked after the reader closed")
+	}
+}
@@ -0,0 +1,5 @@
+package transport
+
+import "golang.org/x/sys/unix"
+
+const soReusePort = unix.SO_REUSEPORT
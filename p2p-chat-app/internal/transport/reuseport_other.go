@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package transport
+
+import "syscall"
+
+// Without port reuse the punched dial leaves from a fresh port, so punching
+// only succeeds behind endpoint-independent NATs and usually falls back to
+// the relay.
+var ReuseControl func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,234 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	socksVersion     = 0x05
+	socksCmdConnect  = 0x01
+	socksAuthNone    = 0x00
+	socksAuthPass    = 0x02
+	socksAuthNoMatch = 0xff
+	socksAtypIPv4    = 0x01
+	socksAtypDomain  = 0x03
+	socksAtypIPv6    = 0x04
+)
+
+var socksReplies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "ttl expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5Dialer connects through a SOCKS5 proxy such as Tor. Host names are
+// passed to the proxy unresolved, so DNS lookups never leave through the
+// local resolver.
+type SOCKS5Dialer struct {
+	ProxyAddr string
+	Username  string
+	Password  string
+}
+
+// ParseProxy reads socks5://[user:pass@]host:port. socks5h:// is accepted as
+// a synonym since names are always resolved by the proxy.
+func ParseProxy(proxyURL string) (*SOCKS5Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy address missing in %q", proxyURL)
+	}
+
+	d := &SOCKS5Dialer{ProxyAddr: u.Host}
+	if u.User != nil {
+		d.Username = u.User.Username()
+		d.Password, _ = u.User.Password()
+	}
+	return d, nil
+}
+
+func (d *SOCKS5Dialer) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.ProxyAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy %s: %v", d.ProxyAddr, err)
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := d.connect(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 connect to %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (d *SOCKS5Dialer) connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{socksAuthNone}
+	if d.Username != "" {
+		methods = []byte{socksAuthNone, socksAuthPass}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("proxy is not socks5")
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPass:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	case socksAuthNoMatch:
+		return errors.New("proxy rejected all authentication methods")
+	default:
+		return fmt.Errorf("proxy chose unsupported auth method %d", reply[1])
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socksAtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socksAtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("proxy replied with version %d", header[0])
+	}
+	if header[1] != 0x00 {
+		if msg, known := socksReplies[header[1]]; known {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("proxy error %d", header[1])
+	}
+
+	// skip the bound address, we have no use for it
+	var skip int
+	switch header[3] {
+	case socksAtypIPv4:
+		skip = net.IPv4len
+	case socksAtypIPv6:
+		skip = net.IPv6len
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("proxy replied with unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("proxy credentials too long")
+	}
+
+	req := []byte{0x01, byte(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, byte(len(d.Password)))
+	req = append(req, d.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x01 || reply[1] != 0x00 {
+		return errors.New("proxy authentication failed")
+	}
+	return nil
+}
+
+// IsOnion reports whether addr (host or host:port) is a Tor onion service.
+func IsOnion(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// ValidOnionAddress accepts a v3 onion host with a port, e.g.
+// <56 base32 chars>.onion:9000.
+func ValidOnionAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(host), ".onion")
+	if name == strings.ToLower(host) {
+		return fmt.Errorf("%s is not an onion address", host)
+	}
+	if len(name) != 56 {
+		return fmt.Errorf("%s is not a v3 onion address", host)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z') && !(r >= '2' && r <= '7') {
+			return fmt.Errorf("%s is not a v3 onion address", host)
+		}
+	}
+	return nil
+}
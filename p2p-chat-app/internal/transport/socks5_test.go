@@ -0,0 +1,230 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testProxy is a minimal SOCKS5 server. It connects every request to
+// target, whatever host was asked for, and records that host so tests can
+// see names arrive unresolved.
+type testProxy struct {
+	listener net.Listener
+	target   string
+	username string
+	password string
+	// replyVersion and replyCode are what the CONNECT reply carries
+	replyVersion byte
+	replyCode    byte
+	requested    chan string
+}
+
+func newTestProxy(t *testing.T, target string) *testProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return &testProxy{
+		listener:     l,
+		target:       target,
+		replyVersion: socksVersion,
+		requested:    make(chan string, 1),
+	}
+}
+
+func (p *testProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *testProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	if p.username == "" {
+		conn.Write([]byte{socksVersion, socksAuthNone})
+	} else {
+		conn.Write([]byte{socksVersion, socksAuthPass})
+		header := make([]byte, 2)
+		io.ReadFull(r, header)
+		user := make([]byte, header[1])
+		io.ReadFull(r, user)
+		length := make([]byte, 1)
+		io.ReadFull(r, length)
+		pass := make([]byte, length[0])
+		io.ReadFull(r, pass)
+		if string(user) != p.username || string(pass) != p.password {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case socksAtypIPv6:
+		ip := make([]byte, net.IPv6len)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		io.ReadFull(r, length)
+		name := make([]byte, length[0])
+		io.ReadFull(r, name)
+		host = string(name)
+	}
+	io.ReadFull(r, make([]byte, 2))
+	p.requested <- host
+
+	conn.Write([]byte{p.replyVersion, p.replyCode, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	if p.replyVersion != socksVersion || p.replyCode != 0x00 {
+		return
+	}
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, r)
+	io.Copy(conn, upstream)
+}
+
+// echoServer answers every connection with what it reads.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSOCKS5Dial(t *testing.T) {
+	target := echoServer(t)
+	tests := []struct {
+		name         string
+		dialer       SOCKS5Dialer
+		username     string
+		password     string
+		replyVersion byte
+		replyCode    byte
+		addr         string
+		ok           bool
+	}{
+		{name: "host name", addr: "peer.example:9000", ok: true},
+		{name: "onion", addr: "abcdefghijklmnopqrstuvwxyz234567abcdefghijklmnopqrstuvwx.onion:9000", ok: true},
+		{name: "ip address", addr: "10.1.2.3:9000", ok: true},
+		{name: "password", dialer: SOCKS5Dialer{Username: "u", Password: "p"}, username: "u", password: "p", addr: "peer.example:9000", ok: true},
+		{name: "wrong password", dialer: SOCKS5Dialer{Username: "u", Password: "x"}, username: "u", password: "p", addr: "peer.example:9000"},
+		{name: "refused", replyCode: 0x05, addr: "peer.example:9000"},
+		{name: "reply not socks5", replyVersion: 0x04, addr: "peer.example:9000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, target)
+			proxy.username, proxy.password = tt.username, tt.password
+			proxy.replyCode = tt.replyCode
+			if tt.replyVersion != 0 {
+				proxy.replyVersion = tt.replyVersion
+			}
+			go proxy.serve()
+
+			d := tt.dialer
+			d.ProxyAddr = proxy.listener.Addr().String()
+			conn, err := d.Dial(tt.addr, 2*time.Second)
+			if !tt.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("dial succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			host, _, _ := net.SplitHostPort(tt.addr)
+			if got := <-proxy.requested; got != host {
+				t.Fatalf("proxy was asked for %q, want %q", got, host)
+			}
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 4)
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+				t.Fatalf("echo got %q, %v", reply, err)
+			}
+		})
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	tests := []struct {
+		url  string
+		want SOCKS5Dialer
+		ok   bool
+	}{
+		{"socks5://127.0.0.1:9050", SOCKS5Dialer{ProxyAddr: "127.0.0.1:9050"}, true},
+		{"socks5h://u:p@localhost:1080", SOCKS5Dialer{ProxyAddr: "localhost:1080", Username: "u", Password: "p"}, true},
+		{"http://127.0.0.1:8080", SOCKS5Dialer{}, false},
+		{"socks5://", SOCKS5Dialer{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			d, err := ParseProxy(tt.url)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("parsed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *d != tt.want {
+				t.Fatalf("got %+v, want %+v", *d, tt.want)
+			}
+		})
+	}
+}
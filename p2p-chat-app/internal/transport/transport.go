@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport dials and listens for peer connections on one address scheme.
+// Addresses are written multiaddr-style as scheme://rest, for example
+// tcp://10.0.0.5:9000, unix:///tmp/p2pchat.sock, mem://alice or
+// ws://chat.example.com:8443/p2p. A bare host:port means tcp.
+type Transport interface {
+	Scheme() string
+	// Dial and Listen receive the address with the scheme stripped, except
+	// for ws where the full URL is needed.
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+var (
+	transports = make(map[string]Transport)
+	proxy      *SOCKS5Dialer
+	mu         sync.RWMutex
+)
+
+func init() {
+	Register(&TCPTransport{})
+	Register(&UnixTransport{})
+	Register(&MemTransport{})
+	Register(&WebSocketTransport{})
+	Register(&WebSocketTransport{secure: true})
+}
+
+// Register makes t available for its scheme, replacing any previous one.
+func Register(t Transport) {
+	mu.Lock()
+	defer mu.Unlock()
+	transports[t.Scheme()] = t
+}
+
+// Get returns the transport registered for scheme.
+func Get(scheme string) (Transport, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	t, exists := transports[scheme]
+	if !exists {
+		return nil, fmt.Errorf("unknown transport %q", scheme)
+	}
+	return t, nil
+}
+
+// SetProxy routes every outbound tcp and ws dial through the SOCKS5 proxy
+// at proxyURL (socks5://[user:pass@]host:port). An empty URL dials directly.
+func SetProxy(proxyURL string) error {
+	var d *SOCKS5Dialer
+	if proxyURL != "" {
+		var err error
+		if d, err = ParseProxy(proxyURL); err != nil {
+			return err
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	proxy = d
+	return nil
+}
+
+// ProxyEnabled reports whether dials go through a SOCKS5 proxy. Callers use
+// it to avoid anything that would reveal our address, like hole punching.
+func ProxyEnabled() bool {
+	return currentProxy() != nil
+}
+
+func currentProxy() *SOCKS5Dialer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return proxy
+}
+
+// Parse splits addr into its scheme and the transport-specific remainder.
+func Parse(addr string) (scheme string, rest string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "tcp", addr
+}
+
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	t, rest, err := resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.Dial(rest, timeout)
+}
+
+func Listen(addr string) (net.Listener, error) {
+	t, rest, err := resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(rest)
+}
+
+func resolve(addr string) (Transport, string, error) {
+	scheme, rest := Parse(addr)
+	t, err := Get(scheme)
+	if err != nil {
+		return nil, "", err
+	}
+	if scheme == "ws" || scheme == "wss" {
+		rest = addr
+	}
+	return t, rest, nil
+}
+
+type TCPTransport struct{}
+
+func (t *TCPTransport) Scheme() string { return "tcp" }
+
+func (t *TCPTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if p := currentProxy(); p != nil {
+		return p.Dial(addr, timeout)
+	}
+	if IsOnion(addr) {
+		return nil, fmt.Errorf("%s is an onion address, configure a socks5 proxy to reach it", addr)
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// UnixTransport connects peers on the same host through a socket file.
+type UnixTransport struct{}
+
+func (t *UnixTransport) Scheme() string { return "unix" }
+
+func (t *UnixTransport) Dial(path string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", path, timeout)
+}
+
+func (t *UnixTransport) Listen(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
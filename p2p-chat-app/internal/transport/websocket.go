@@ -0,0 +1,189 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketTransport tunnels peer connections through WebSocket so they can
+// pass HTTP-only proxies. Dialing honours HTTP_PROXY/HTTPS_PROXY. The wss
+// variant only dials; serve TLS through a reverse proxy in front of ws.
+type WebSocketTransport struct {
+	secure bool
+}
+
+func (t *WebSocketTransport) Scheme() string {
+	if t.secure {
+		return "wss"
+	}
+	return "ws"
+}
+
+func (t *WebSocketTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: timeout,
+	}
+	if p := currentProxy(); p != nil {
+		dialer.Proxy = nil
+		dialer.NetDial = func(network, addr string) (net.Conn, error) {
+			return p.Dial(addr, timeout)
+		}
+	}
+	ws, _, err := dialer.Dial(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{ws: ws}, nil
+}
+
+// Listen serves WebSocket upgrades on the host and path of addr.
+func (t *WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	if t.secure {
+		return nil, fmt.Errorf("wss listeners are not supported, listen on ws behind a TLS proxy")
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	tcp, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &wsListener{
+		tcp:      tcp,
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		select {
+		case l.accepted <- &wsConn{ws: ws}:
+		case <-l.done:
+			ws.Close()
+		}
+	})
+	l.server = &http.Server{Handler: mux}
+	go l.server.Serve(tcp)
+
+	return l, nil
+}
+
+type wsListener struct {
+	tcp      net.Listener
+	server   *http.Server
+	accepted chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.server.Close()
+	})
+	return nil
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.tcp.Addr()
+}
+
+// wsConn presents a WebSocket as a byte stream, one binary message per
+// Write.
+type wsConn struct {
+	ws      *websocket.Conn
+	reader  io.Reader
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		if c.reader == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.writeMu.Lock()
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
@@ -5,7 +5,12 @@ import (
 	"html/template"
 	"net/http"
 	"p2p-chat-app/internal/chat"
+	"p2p-chat-app/internal/discovery"
+	"p2p-chat-app/internal/invite"
 	"p2p-chat-app/internal/network"
+	"p2p-chat-app/internal/notify"
+	"p2p-chat-app/internal/qrcode"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,7 +18,7 @@ import (
 )
 
 type WebServer struct {
-	port     string
+	addr     string
 	chat     *chat.EnhancedChat
 	network  *network.EnhancedP2PNetwork
 	clients  map[*websocket.Conn]bool
@@ -28,11 +33,22 @@ type WebMessage struct {
 	To        string    `json:"to,omitempty"`
 	Room      string    `json:"room,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
+	Data      interface{} `json:"data,omitempty"`
 }
 
-func NewWebServer(port string, chat *chat.EnhancedChat, network *network.EnhancedP2PNetwork) *WebServer {
+// webPeer is how the browser sees a discovered or connected peer.
+type webPeer struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Address  string `json:"address,omitempty"`
+	Online   bool   `json:"online"`
+	Presence string `json:"presence,omitempty"`
+	Status   string `json:"status,omitempty"`
+}
+
+func NewWebServer(addr string, chat *chat.EnhancedChat, network *network.EnhancedP2PNetwork) *WebServer {
 	return &WebServer{
-		port:    port,
+		addr:    addr,
 		chat:    chat,
 		network: network,
 		clients: make(map[*websocket.Conn]bool),
@@ -43,14 +59,99 @@ func NewWebServer(port string, chat *chat.EnhancedChat, network *network.Enhance
 }
 
 func (ws *WebServer) Start() error {
-	http.HandleFunc("/", ws.handleHome)
-	http.HandleFunc("/ws", ws.handleWebSocket)
-	http.HandleFunc("/api/rooms", ws.handleRooms)
-	http.HandleFunc("/api/peers", ws.handlePeers)
-	http.HandleFunc("/api/messages", ws.handleMessages)
-	http.HandleFunc("/static/", ws.handleStatic)
+	// own mux so the web ui and mobile api can run in the same process
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ws.handleHome)
+	mux.HandleFunc("/ws", ws.handleWebSocket)
+	mux.HandleFunc("/api/rooms", ws.handleRooms)
+	mux.HandleFunc("/api/read", ws.handleRead)
+	mux.HandleFunc("/api/rooms/directory", ws.handleRoomDirectory)
+	mux.HandleFunc("/api/rooms/subscriptions", ws.handleSubscriptions)
+	mux.HandleFunc("/api/rooms/focus", ws.handleFocus)
+	mux.HandleFunc("/api/rooms/moderation", ws.handleModeration)
+	mux.HandleFunc("/api/rooms/create", ws.handleCreateRoom)
+	mux.HandleFunc("/api/rooms/invite", ws.handleInvite)
+	mux.HandleFunc("/api/invite/link", ws.handleInviteLink)
+	mux.HandleFunc("/api/invite/qr.png", ws.handleInviteQR)
+	mux.HandleFunc("/api/contacts", ws.handleContacts)
+	mux.HandleFunc("/api/contacts/verify", ws.handleVerify)
+	mux.HandleFunc("/api/notifications/settings", ws.handleNotificationSettings)
+	mux.HandleFunc("/api/peers", ws.handlePeers)
+	mux.HandleFunc("/api/presence", ws.handlePresence)
+	mux.HandleFunc("/api/reactions", ws.handleReactions)
+	mux.HandleFunc("/api/disappearing", ws.handleDisappearing)
+	mux.HandleFunc("/api/messages", ws.handleMessages)
+	mux.HandleFunc("/api/metrics", ws.handleMetrics)
+	mux.HandleFunc("/static/", ws.handleStatic)
+
+	go ws.forwardPeerEvents()
+	go ws.forwardTyping()
+	ws.chat.Notifier().AddSink(notify.SinkFunc{SinkName: "web", Func: ws.forwardNotification})
+
+	return http.ListenAndServe(ws.addr, mux)
+}
+
+// forwardPeerEvents pushes discovery changes to every browser as they
+// happen.
+func (ws *WebServer) forwardPeerEvents() {
+	events, cancel := ws.network.Discovery().Subscribe()
+	defer cancel()
+
+	for event := range events {
+		ws.BroadcastMessage(&WebMessage{
+			Type:      event.Type.String(),
+			Timestamp: time.Now(),
+			Data:      ws.webPeer(&event.Peer),
+		})
+	}
+}
+
+// forwardTyping shows who starts and stops typing in every browser.
+func (ws *WebServer) forwardTyping() {
+	events, cancel := ws.chat.SubscribeTyping()
+	defer cancel()
+
+	for event := range events {
+		ws.BroadcastMessage(&WebMessage{
+			Type:      "typing",
+			From:      event.From,
+			Room:      event.Room,
+			Timestamp: time.Now(),
+			Data:      event,
+		})
+	}
+}
+
+// forwardNotification shows a notification in every browser.
+func (ws *WebServer) forwardNotification(n *notify.Notification) error {
+	ws.BroadcastMessage(&WebMessage{
+		Type:      "notification",
+		Content:   n.Body(),
+		From:      n.From,
+		Room:      n.Room,
+		Timestamp: n.Timestamp,
+		Data:      map[string]string{"kind": string(n.Kind), "title": n.Title()},
+	})
+	return nil
+}
 
-	return http.ListenAndServe(":"+ws.port, nil)
+func (ws *WebServer) webPeer(peer *discovery.PeerInfo) webPeer {
+	return webPeer{
+		ID:       peer.User.ID,
+		Username: peer.User.Username,
+		Address:  peer.Address,
+		Online:   peer.Online,
+		Presence: peer.User.Presence,
+		Status:   peer.User.Status,
+	}
+}
+
+func (ws *WebServer) peerSnapshot() []webPeer {
+	peers := []webPeer{}
+	for _, peer := range ws.network.GetDiscoveredPeers() {
+		peers = append(peers, ws.webPeer(peer))
+	}
+	return peers
 }
 
 func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
@@ -71,6 +172,9 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
         .room-item, .peer-item { padding: 8px; cursor: pointer; border-radius: 4px; margin: 2px 0; }
         .room-item:hover, .peer-item:hover { background: #444; }
         .room-item.active { background: #0066cc; }
+        .room-topic { font-size: 12px; opacity: 0.7; }
+        .unread { float: right; background: #cc6600; border-radius: 8px; padding: 0 6px; font-size: 12px; }
+        .unread.mention { background: #cc0000; margin-left: 4px; }
         .message { margin: 8px 0; padding: 8px; border-radius: 6px; background: #333; }
         .message.own { background: #0066cc; margin-left: 50px; }
         .message.private { background: #cc6600; }
@@ -80,8 +184,18 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
         button:hover { background: #0052a3; }
         .section-title { padding: 10px; font-weight: bold; border-bottom: 1px solid #444; }
         .status { padding: 5px 10px; font-size: 12px; background: #444; }
+        .invite { position: fixed; top: 60px; right: 20px; width: 340px; padding: 15px; background: #2d2d2d; border: 1px solid #444; border-radius: 6px; }
+        .invite img { width: 100%; image-rendering: pixelated; }
+        .safety { font-family: monospace; font-size: 18px; letter-spacing: 2px; margin: 10px 0; }
+        .key-warning { position: fixed; top: 0; left: 0; right: 0; bottom: 0; background: rgba(120, 0, 0, 0.95); padding: 60px; }
         .online { color: #4CAF50; }
         .offline { color: #f44336; }
+        .away { color: #ffb300; }
+        .busy { color: #ff5722; }
+        .peer-status { font-size: 12px; opacity: 0.7; }
+        .chip { display: inline-block; margin: 4px 4px 0 0; padding: 0 6px; border: 1px solid #555; border-radius: 10px; font-size: 13px; cursor: pointer; }
+        .chip.mine { border-color: #0066cc; background: #1a3a5c; }
+        .typing { padding: 0 15px; height: 18px; font-size: 12px; opacity: 0.7; }
     </style>
 </head>
 <body>
@@ -89,6 +203,10 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
         <div class="sidebar">
             <div class="section-title">rooms</div>
             <div class="room-list" id="roomList"></div>
+            <div class="section-title">network rooms</div>
+            <div class="room-list" id="directoryList"></div>
+            <div class="section-title">contacts</div>
+            <div class="peer-list" id="contactList"></div>
             <div class="section-title">peers</div>
             <div class="peer-list" id="peerList"></div>
             <div class="status" id="status">connecting...</div>
@@ -97,11 +215,39 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
             <div class="header">
                 <span id="currentRoom">general</span>
                 <button onclick="joinRoom()">join room</button>
+                <button onclick="leaveRoom()">leave room</button>
                 <button onclick="connectPeer()">connect peer</button>
+                <button onclick="showInvite()">invite link</button>
+                <button id="muteButton" onclick="toggleMute()">mute room</button>
+                <button id="presenceButton" onclick="setPresence()">online</button>
+                <button id="expiryButton" onclick="setExpiry()">disappearing: off</button>
+            </div>
+            <div class="invite" id="contactPanel" style="display: none">
+                <div id="contactName"></div>
+                <div class="safety" id="contactSafety"></div>
+                <div id="contactVerified"></div>
+                <button onclick="verifyContact('confirm')">mark verified</button>
+                <button onclick="verifyContact('reset')">unverify</button>
+                <button onclick="renameContact()">rename</button>
+                <button onclick="hideContact()">close</button>
+            </div>
+            <div class="key-warning" id="keyWarning" style="display: none">
+                <h2>⚠️ key changed</h2>
+                <div id="keyWarningText"></div>
+                <p>someone may be impersonating them, so they stay blocked until you decide. compare this safety number with them over a channel you trust:</p>
+                <div class="safety" id="keyWarningSafety"></div>
+                <button onclick="decideKey('accept')">accept new key</button>
+                <button onclick="decideKey('reject')">keep blocked</button>
+            </div>
+            <div class="invite" id="invitePanel" style="display: none">
+                <img id="inviteQR" alt="invite qr code">
+                <input type="text" id="inviteLink" readonly onclick="this.select()">
+                <button onclick="hideInvite()">close</button>
             </div>
             <div class="messages" id="messages"></div>
+            <div class="typing" id="typing"></div>
             <div class="input-area">
-                <input type="text" id="messageInput" placeholder="type message..." onkeypress="handleKeyPress(event)">
+                <input type="text" id="messageInput" placeholder="type message..." onkeypress="handleKeyPress(event)" oninput="handleInput()" onblur="stopTyping()">
                 <button onclick="sendMessage()">send</button>
             </div>
         </div>
@@ -111,9 +257,22 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
         let ws;
         let currentRoom = 'general';
         let username = '';
+        let peers = {};
+        let names = {};
+        let selectedContact = null;
+        let changedContact = null;
+        let muted = {};
+        let contactList = [];
+        let privateUnread = {};
+        let presences = {};
+        let typing = {};
+        let myID = '';
+        let typingSent = 0;
+        let typingTimer = null;
+        let roomExpiry = 'off';
 
         function connect() {
-            ws = new WebSocket('ws://localhost:8080/ws');
+            ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/ws');
             
             ws.onopen = function() {
                 document.getElementById('status').innerHTML = '<span class="online">connected</span>';
@@ -133,11 +292,57 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
         function handleMessage(msg) {
             if (msg.type === 'message') {
                 addMessage(msg);
-            } else if (msg.type === 'rooms') {
-                updateRooms(msg.data);
             } else if (msg.type === 'peers') {
-                updatePeers(msg.data);
+                peers = {};
+                msg.data.forEach(peer => peers[peer.id] = peer);
+                updatePeers();
+            } else if (msg.type === 'peer_appeared' || msg.type === 'peer_updated') {
+                peers[msg.data.id] = msg.data;
+                updatePeers();
+            } else if (msg.type === 'peer_lost') {
+                delete peers[msg.data.id];
+                updatePeers();
+            } else if (msg.type === 'notification') {
+                showNotification(msg);
+            } else if (msg.type === 'typing') {
+                const room = msg.room || '';
+                typing[room] = typing[room] || {};
+                if (msg.data.typing) {
+                    typing[room][msg.from] = msg.data.name;
+                } else {
+                    delete typing[room][msg.from];
+                }
+                showTyping();
+            }
+        }
+
+        function showNotification(msg) {
+            loadRooms();
+            if (document.hasFocus() && msg.room === currentRoom) return;
+            if (window.Notification && Notification.permission === 'granted') {
+                new Notification(msg.data.title, {body: msg.content, tag: msg.room || msg.from});
+            }
+        }
+
+        function loadNotificationSettings() {
+            fetch('/api/notifications/settings')
+                .then(response => response.json())
+                .then(settings => {
+                    muted = settings.muted || {};
+                    document.getElementById('muteButton').textContent = muted[currentRoom] !== undefined ? 'unmute room' : 'mute room';
+                })
+                .catch(() => {});
+        }
+
+        function toggleMute() {
+            if (window.Notification && Notification.permission === 'default') {
+                Notification.requestPermission();
             }
+            fetch('/api/notifications/settings', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({action: muted[currentRoom] !== undefined ? 'unmute' : 'mute', room: currentRoom})
+            }).then(loadNotificationSettings);
         }
 
         function addMessage(msg) {
@@ -149,13 +354,71 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
             div.className = 'message' + (isOwn ? ' own' : '') + (isPrivate ? ' private' : '');
             
             const time = new Date(msg.timestamp).toLocaleTimeString();
-            const prefix = isPrivate ? (isOwn ? 'to ' + msg.to : 'from ' + msg.from) : msg.from;
+            const prefix = isPrivate ? (isOwn ? 'to ' + displayName(msg.to) : 'from ' + displayName(msg.from)) : displayName(msg.from);
             
-            div.innerHTML = '<div class="message-info">' + time + ' - ' + prefix + '</div>' + msg.content;
+            const expires = msg.expires_at ? new Date(msg.expires_at) : null;
+            const disappears = expires && expires.getFullYear() > 1;
+            div.innerHTML = '<div class="message-info">' + time + ' - ' + prefix + (disappears ? ' ⏳' : '') + '</div>' + msg.content;
+            if (msg.id) div.appendChild(reactionChips(msg));
             messages.appendChild(div);
+            // timers further out than setTimeout allows wait for the next reload
+            if (disappears && expires - Date.now() < 2147483647) {
+                div.title = 'disappears ' + expires.toLocaleString();
+                setTimeout(() => div.remove(), Math.max(0, expires - Date.now()));
+            }
             messages.scrollTop = messages.scrollHeight;
         }
 
+        function reactionChips(msg) {
+            const chips = document.createElement('div');
+            Object.entries(msg.reactions || {}).forEach(([emoji, users]) => {
+                const chip = document.createElement('span');
+                chip.className = 'chip' + (users.includes(myID) ? ' mine' : '');
+                chip.textContent = emoji + ' ' + users.length;
+                chip.title = users.map(displayName).join(', ');
+                chip.onclick = () => react(msg.id, emoji);
+                chips.appendChild(chip);
+            });
+            const add = document.createElement('span');
+            add.className = 'chip';
+            add.textContent = '+';
+            add.title = 'react';
+            add.onclick = () => {
+                const emoji = prompt('react with:', '👍');
+                if (emoji) react(msg.id, emoji.trim());
+            };
+            chips.appendChild(add);
+            return chips;
+        }
+
+        function react(messageID, emoji) {
+            fetch('/api/reactions', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({message_id: messageID, emoji: emoji})
+            }).then(response => response.ok ? showRoom(currentRoom) : response.text().then(text => alert(text)));
+        }
+
+        function loadExpiry() {
+            fetch('/api/disappearing?room=' + encodeURIComponent(currentRoom))
+                .then(response => response.json())
+                .then(e => {
+                    roomExpiry = e.expiry;
+                    document.getElementById('expiryButton').textContent = 'disappearing: ' + e.expiry;
+                })
+                .catch(() => {});
+        }
+
+        function setExpiry() {
+            const expiry = prompt('make new messages in ' + currentRoom + ' disappear after (e.g. 10m, 1h, 168h, or off):', roomExpiry);
+            if (!expiry) return;
+            fetch('/api/disappearing', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({room: currentRoom, expiry: expiry.trim()})
+            }).then(response => response.ok ? loadExpiry() : response.text().then(text => alert(text)));
+        }
+
         function sendMessage() {
             const input = document.getElementById('messageInput');
             const content = input.value.trim();
@@ -169,6 +432,39 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
 
             ws.send(JSON.stringify(msg));
             input.value = '';
+            clearTimeout(typingTimer);
+            typingSent = 0;
+        }
+
+        // the server throttles what goes to peers; this only spares the socket
+        function handleInput() {
+            const input = document.getElementById('messageInput');
+            clearTimeout(typingTimer);
+            if (input.value === '') {
+                stopTyping();
+                return;
+            }
+            if (Date.now() - typingSent > 1000) {
+                typingSent = Date.now();
+                ws.send(JSON.stringify({type: 'typing', room: currentRoom, typing: true}));
+            }
+            typingTimer = setTimeout(stopTyping, 5000);
+        }
+
+        function stopTyping() {
+            clearTimeout(typingTimer);
+            if (typingSent === 0) return;
+            typingSent = 0;
+            ws.send(JSON.stringify({type: 'typing', room: currentRoom, typing: false}));
+        }
+
+        function showTyping() {
+            const who = Object.values(typing[currentRoom] || {});
+            let text = '';
+            if (who.length === 1) text = who[0] + ' is typing...';
+            else if (who.length > 1 && who.length < 4) text = who.join(', ') + ' are typing...';
+            else if (who.length >= 4) text = 'several people are typing...';
+            document.getElementById('typing').textContent = text;
         }
 
         function handleKeyPress(event) {
@@ -180,48 +476,316 @@ func (ws *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
         function joinRoom() {
             const room = prompt('enter room name:');
             if (room) {
-                currentRoom = room;
-                document.getElementById('currentRoom').textContent = room;
-                ws.send(JSON.stringify({type: 'join', room: room}));
+                enterRoom(room);
             }
         }
 
+        function enterRoom(room) {
+            showRoom(room);
+            ws.send(JSON.stringify({type: 'join', room: room}));
+            setTimeout(loadRooms, 200);
+            loadDirectory();
+        }
+
+        function leaveRoom() {
+            ws.send(JSON.stringify({type: 'leave', room: currentRoom}));
+            setTimeout(loadRooms, 200);
+        }
+
+        function switchRoom(room) {
+            showRoom(room);
+            ws.send(JSON.stringify({type: 'switch', room: room}));
+            setTimeout(loadRooms, 200);
+        }
+
+        function showRoom(room) {
+            stopTyping();
+            currentRoom = room;
+            showTyping();
+            document.getElementById('currentRoom').textContent = room;
+            loadNotificationSettings();
+            loadExpiry();
+            document.getElementById('messages').innerHTML = '';
+            fetch('/api/messages?room=' + encodeURIComponent(room))
+                .then(response => response.json())
+                .then(messages => (messages || []).forEach(addMessage))
+                .catch(() => {});
+        }
+
+        function loadRooms() {
+            fetch('/api/rooms/subscriptions')
+                .then(response => response.json())
+                .then(updateRooms)
+                .catch(() => {});
+            fetch('/api/rooms')
+                .then(response => response.json())
+                .then(conversations => {
+                    privateUnread = {};
+                    conversations.filter(c => c.user).forEach(c => privateUnread[c.user] = c);
+                    updateContacts(contactList);
+                })
+                .catch(() => {});
+        }
+
+        function unreadBadges(div, unread, mentions) {
+            if (mentions > 0) {
+                const badge = document.createElement('span');
+                badge.className = 'unread mention';
+                badge.textContent = '@' + mentions;
+                div.appendChild(badge);
+            }
+            if (unread > 0) {
+                const badge = document.createElement('span');
+                badge.className = 'unread';
+                badge.textContent = unread;
+                div.appendChild(badge);
+            }
+        }
+
+        function loadDirectory() {
+            fetch('/api/rooms/directory')
+                .then(response => response.json())
+                .then(updateDirectory)
+                .catch(() => {});
+        }
+
+        function updateDirectory(rooms) {
+            const list = document.getElementById('directoryList');
+            list.innerHTML = '';
+            rooms.forEach(room => {
+                const div = document.createElement('div');
+                div.className = 'room-item';
+                if (room.name === currentRoom) div.className += ' active';
+                div.textContent = room.name + ' (' + room.members + ')';
+                if (room.topic) {
+                    const topic = document.createElement('div');
+                    topic.className = 'room-topic';
+                    topic.textContent = room.topic;
+                    div.appendChild(topic);
+                }
+                div.onclick = () => enterRoom(room.name);
+                list.appendChild(div);
+            });
+        }
+
         function connectPeer() {
-            const address = prompt('enter peer address (host:port):');
+            const address = prompt('enter peer address (host:port, tcp:// unix:// ws:// address, or p2pchat:// invite link):');
             if (address) {
                 ws.send(JSON.stringify({type: 'connect', address: address}));
             }
         }
 
+        function showInvite() {
+            const room = currentRoom === 'general' ? '' : currentRoom;
+            fetch('/api/invite/link?room=' + encodeURIComponent(room))
+                .then(response => response.ok ? response.json() : response.text().then(text => Promise.reject(text)))
+                .then(invite => {
+                    document.getElementById('inviteLink').value = invite.uri;
+                    document.getElementById('inviteQR').src = '/api/invite/qr.png?uri=' + encodeURIComponent(invite.uri);
+                    document.getElementById('invitePanel').style.display = 'block';
+                })
+                .catch(error => alert('no invite link: ' + error));
+        }
+
+        function hideInvite() {
+            document.getElementById('invitePanel').style.display = 'none';
+        }
+
         function updateRooms(rooms) {
             const list = document.getElementById('roomList');
             list.innerHTML = '';
             rooms.forEach(room => {
+                if (room.focused && room.name !== currentRoom) showRoom(room.name);
                 const div = document.createElement('div');
                 div.className = 'room-item';
-                if (room === currentRoom) div.className += ' active';
-                div.textContent = room;
-                div.onclick = () => {
-                    currentRoom = room;
-                    document.getElementById('currentRoom').textContent = room;
-                    updateRooms(rooms);
-                };
+                if (room.focused) div.className += ' active';
+                div.textContent = room.name;
+                unreadBadges(div, room.unread, room.mentions);
+                div.onclick = () => switchRoom(room.name);
+                list.appendChild(div);
+            });
+        }
+
+        function displayName(userID) {
+            return names[userID] || userID;
+        }
+
+        function loadContacts() {
+            fetch('/api/contacts')
+                .then(response => response.json())
+                .then(updateContacts)
+                .catch(() => {});
+        }
+
+        function updateContacts(contacts) {
+            const list = document.getElementById('contactList');
+            list.innerHTML = '';
+            contactList = contacts;
+            names = {};
+            contacts.forEach(contact => {
+                names[contact.user_id] = contact.nickname || contact.username || contact.user_id;
+                const div = document.createElement('div');
+                div.className = 'peer-item';
+                div.textContent = names[contact.user_id] + (contact.new_key ? ' ⚠️' : contact.verified ? ' ✅' : '');
+                div.title = contact.user_id + (contact.notes ? '\n' + contact.notes : '');
+                const conversation = privateUnread[contact.user_id];
+                if (conversation) unreadBadges(div, conversation.unread, conversation.mentions);
+                div.onclick = () => showContact(contact);
                 list.appendChild(div);
             });
+
+            const changed = contacts.find(contact => contact.new_key);
+            if (changed) {
+                warnKeyChanged(changed);
+            } else {
+                document.getElementById('keyWarning').style.display = 'none';
+            }
+        }
+
+        function loadVerification(userID) {
+            return fetch('/api/contacts/verify?user=' + encodeURIComponent(userID))
+                .then(response => response.ok ? response.json() : response.text().then(text => Promise.reject(text)));
+        }
+
+        function showContact(contact) {
+            selectedContact = contact;
+            if (privateUnread[contact.user_id] && privateUnread[contact.user_id].unread > 0) {
+                fetch('/api/read', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({user: contact.user_id})
+                }).then(loadRooms);
+            }
+            loadVerification(contact.user_id).then(v => {
+                document.getElementById('contactName').textContent = v.name + ' (' + v.user_id + ')';
+                document.getElementById('contactSafety').textContent = v.safety_number || 'no key yet, connect to them first';
+                document.getElementById('contactVerified').textContent = v.verified ? '✅ verified' : 'not verified: compare the safety number with what they see';
+                document.getElementById('contactPanel').style.display = 'block';
+            }).catch(error => alert(error));
+        }
+
+        function hideContact() {
+            document.getElementById('contactPanel').style.display = 'none';
+        }
+
+        function verifyContact(action) {
+            postVerify(selectedContact.user_id, action).then(() => showContact(selectedContact));
+        }
+
+        function postVerify(userID, action) {
+            return fetch('/api/contacts/verify', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({user: userID, action: action})
+            }).then(response => response.ok ? response.json() : response.text().then(text => Promise.reject(text)))
+                .catch(error => alert(error))
+                .finally(loadContacts);
+        }
+
+        function warnKeyChanged(contact) {
+            changedContact = contact;
+            loadVerification(contact.user_id).then(v => {
+                document.getElementById('keyWarningText').textContent = v.name + ' (' + v.user_id + ') connected with a different key than before.';
+                document.getElementById('keyWarningSafety').textContent = v.new_safety_number;
+                document.getElementById('keyWarning').style.display = 'block';
+            });
+        }
+
+        function decideKey(action) {
+            postVerify(changedContact.user_id, action);
+        }
+
+        function renameContact() {
+            const contact = selectedContact;
+            const nickname = prompt('nickname for ' + contact.user_id + ':', contact.nickname || '');
+            if (nickname === null) return;
+            fetch('/api/contacts', {
+                method: 'PUT',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({user: contact.user_id, nickname: nickname, notes: contact.notes || ''})
+            }).then(loadContacts);
+        }
+
+        function loadPresence() {
+            fetch('/api/peers')
+                .then(response => response.json())
+                .then(list => {
+                    presences = {};
+                    list.forEach(p => presences[p.user_id] = p);
+                    updatePeers();
+                })
+                .catch(() => {});
+            fetch('/api/presence')
+                .then(response => response.json())
+                .then(showOwnPresence)
+                .catch(() => {});
+        }
+
+        function showOwnPresence(p) {
+            myID = p.user_id;
+            document.getElementById('presenceButton').textContent = p.state + (p.status ? ': ' + p.status : '');
+        }
+
+        function setPresence() {
+            const answer = prompt('online, away or busy, optionally followed by a status:', 'online');
+            if (answer === null) return;
+            const words = answer.trim().split(/\s+/);
+            const state = ['online', 'away', 'busy'].includes(words[0]) ? words.shift() : 'online';
+            fetch('/api/presence', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({state: state, status: words.join(' ')})
+            }).then(response => response.ok ? response.json() : response.text().then(text => Promise.reject(text)))
+                .then(showOwnPresence)
+                .catch(error => alert(error));
+        }
+
+        function lastActive(p) {
+            if (!p || !p.last_active || p.last_active.startsWith('0001')) return '';
+            const minutes = Math.floor((Date.now() - new Date(p.last_active)) / 60000);
+            if (minutes < 1) return 'active just now';
+            if (minutes < 60) return 'active ' + minutes + 'm ago';
+            if (minutes < 1440) return 'active ' + Math.floor(minutes / 60) + 'h ago';
+            return 'active ' + new Date(p.last_active).toLocaleDateString();
         }
 
-        function updatePeers(peers) {
+        function updatePeers() {
             const list = document.getElementById('peerList');
             list.innerHTML = '';
-            peers.forEach(peer => {
+            const ids = new Set(Object.keys(peers).concat(Object.keys(presences)));
+            ids.forEach(id => {
+                const peer = peers[id] || {};
+                const p = presences[id];
+                const state = p ? p.state : (peer.presence || (peer.online ? 'online' : 'offline'));
+                const status = p ? p.status : peer.status;
                 const div = document.createElement('div');
                 div.className = 'peer-item';
-                div.innerHTML = '<span class="' + (peer.online ? 'online' : 'offline') + '">●</span> ' + peer.username;
+                div.innerHTML = '<span class="' + state + '">●</span> ';
+                div.appendChild(document.createTextNode(names[id] || (p && p.name) || peer.username || id));
+                div.title = state + (p && p.idle ? ' (idle)' : '') + (lastActive(p) ? ', ' + lastActive(p) : '');
+                const detail = [status, state !== 'online' ? lastActive(p) : ''].filter(Boolean).join(' · ');
+                if (detail) {
+                    const line = document.createElement('div');
+                    line.className = 'peer-status';
+                    line.textContent = detail;
+                    div.appendChild(line);
+                }
                 list.appendChild(div);
             });
         }
 
         connect();
+        if (window.Notification && Notification.permission === 'default') {
+            document.addEventListener('click', () => Notification.requestPermission(), {once: true});
+        }
+        loadContacts();
+        setInterval(loadContacts, 30000);
+        loadRooms();
+        setInterval(loadRooms, 5000);
+        loadDirectory();
+        setInterval(loadDirectory, 30000);
+        loadPresence();
+        setInterval(loadPresence, 10000);
     </script>
 </body>
 </html>`
@@ -237,7 +801,9 @@ func (ws *WebServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
+	// send the current peers under the lock so no event slips in between
 	ws.mu.Lock()
+	conn.WriteJSON(&WebMessage{Type: "peers", Timestamp: time.Now(), Data: ws.peerSnapshot()})
 	ws.clients[conn] = true
 	ws.mu.Unlock()
 
@@ -256,23 +822,368 @@ func (ws *WebServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 		switch msg["type"] {
 		case "send":
-			ws.chat.SendMessage(msg["content"].(string), "")
+			if room, ok := msg["room"].(string); ok && room != "" {
+				ws.chat.SendRoomMessage(room, msg["content"].(string))
+			} else {
+				ws.chat.SendMessage(msg["content"].(string), "")
+			}
 		case "join":
 			ws.chat.JoinRoom(msg["room"].(string))
+		case "leave":
+			ws.chat.LeaveRoom(msg["room"].(string))
+		case "switch":
+			ws.chat.SwitchRoom(msg["room"].(string))
+		case "typing":
+			room, _ := msg["room"].(string)
+			to, _ := msg["to"].(string)
+			typing, _ := msg["typing"].(bool)
+			ws.chat.SetTyping(chat.TypingRequest{Room: room, User: to, Typing: typing})
 		case "connect":
 			ws.network.Connect(msg["address"].(string))
 		}
 	}
 }
 
+// handleRooms lists our rooms and private conversations with their unread
+// and mention counts.
 func (ws *WebServer) handleRooms(w http.ResponseWriter, r *http.Request) {
-	rooms := ws.chat.GetRooms()
+	json.NewEncoder(w).Encode(ws.chat.Conversations())
+}
+
+// handleRead marks the room or private conversation in POST
+// chat.ReadRequest read.
+func (ws *WebServer) handleRead(w http.ResponseWriter, r *http.Request) {
+	var req chat.ReadRequest
+	if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "POST {room} or {user} expected", http.StatusBadRequest)
+		return
+	}
+	if err := ws.chat.MarkRead(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(ws.chat.Conversations())
+}
+
+func (ws *WebServer) handleRoomDirectory(w http.ResponseWriter, r *http.Request) {
+	rooms := ws.chat.RoomDirectory()
 	json.NewEncoder(w).Encode(rooms)
 }
 
+func (ws *WebServer) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req["room"] == "" {
+			http.Error(w, "room name required", http.StatusBadRequest)
+			return
+		}
+		credential := req["token"]
+		if credential == "" {
+			credential = req["password"]
+		}
+		if err := ws.chat.SubscribeWith(req["room"], credential); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	case "DELETE":
+		if err := ws.chat.LeaveRoom(r.URL.Query().Get("room")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(ws.chat.Subscriptions())
+}
+
+func (ws *WebServer) handleFocus(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if err := ws.chat.SwitchRoom(req["room"]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]string{"room": ws.chat.CurrentRoom()})
+}
+
+func (ws *WebServer) handleModeration(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	if r.Method == "POST" {
+		var req chat.ModerationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if err := ws.chat.Moderate(req); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		room = req.Room
+	}
+	if room == "" {
+		room = ws.chat.CurrentRoom()
+	}
+	json.NewEncoder(w).Encode(ws.chat.Moderation(room))
+}
+
+func (ws *WebServer) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "POST {room, mode, password} expected", http.StatusBadRequest)
+		return
+	}
+	mode := chat.RoomMode(req["mode"])
+	if mode == "" {
+		mode = chat.ModePublic
+	}
+	if err := ws.chat.CreateRoom(req["room"], mode, req["password"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"room": req["room"], "mode": string(mode)})
+}
+
+func (ws *WebServer) handleInvite(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "POST {room, invitee, duration, uses} expected", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if req["duration"] != "" {
+		d, err := time.ParseDuration(req["duration"])
+		if err != nil {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	uses, _ := strconv.Atoi(req["uses"])
+
+	token, err := ws.chat.Invite(req["room"], req["invitee"], ttl, uses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"room": req["room"], "token": token})
+}
+
+// handleInviteLink returns our invite link, for the room given if any.
+func (ws *WebServer) handleInviteLink(w http.ResponseWriter, r *http.Request) {
+	link, err := ws.network.InviteLink(r.URL.Query().Get("room"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"uri": link.String(), "link": link})
+}
+
+// handleInviteQR draws the invite link passed as uri, or a fresh one, as a
+// QR code.
+func (ws *WebServer) handleInviteQR(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		link, err := ws.network.InviteLink(r.URL.Query().Get("room"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		uri = link.String()
+	} else if _, err := invite.Parse(uri); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code, err := qrcode.Encode([]byte(uri))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	image, err := code.PNG(8)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(image)
+}
+
+// handleContacts lists contacts on GET, adds one on POST {user, nickname,
+// notes} where user may be an invite link, updates one on PUT and removes
+// ?user= on DELETE.
+func (ws *WebServer) handleContacts(w http.ResponseWriter, r *http.Request) {
+	var req chat.ContactRequest
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.User == "" {
+			http.Error(w, "user required", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if r.Method == "POST" {
+			_, err = ws.chat.AddContact(req.User, req.Nickname, req.Notes)
+		} else {
+			err = ws.chat.UpdateContact(req)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		if !ws.chat.RemoveContact(r.URL.Query().Get("user")) {
+			http.Error(w, "not a contact", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(ws.chat.Contacts().List())
+}
+
+// handleVerify returns the safety numbers of ?user= on GET and changes
+// their verification on POST chat.VerifyRequest.
+func (ws *WebServer) handleVerify(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req chat.VerifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "POST {user, action} expected", http.StatusBadRequest)
+			return
+		}
+		if err := ws.chat.Verify(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user = req.User
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	verification, err := ws.chat.Verification(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(verification)
+}
+
+// handleNotificationSettings returns the notification settings on GET and
+// changes them on POST chat.NotifyRequest.
+func (ws *WebServer) handleNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req chat.NotifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "POST {action, keyword, room, duration} expected", http.StatusBadRequest)
+			return
+		}
+		if err := ws.chat.ConfigureNotifications(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(ws.chat.NotificationSettings())
+}
+
+// handlePeers lists everyone we are connected to or heard from lately with
+// their presence.
 func (ws *WebServer) handlePeers(w http.ResponseWriter, r *http.Request) {
-	peers := ws.network.GetConnectedPeers()
-	json.NewEncoder(w).Encode(peers)
+	json.NewEncoder(w).Encode(ws.chat.Presences())
+}
+
+// handleReactions counts the reactions on the message ?message=, toggling
+// ours first on POST chat.ReactRequest.
+func (ws *WebServer) handleReactions(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("message")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req chat.ReactRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "POST {message_id, emoji} expected", http.StatusBadRequest)
+			return
+		}
+		if _, err := ws.chat.React(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id = req.MessageID
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	counts, err := ws.chat.Reactions(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(counts)
+}
+
+// handleDisappearing returns the disappearing message timer of ?room= or
+// ?user=, setting it first on POST chat.ExpiryRequest.
+func (ws *WebServer) handleDisappearing(w http.ResponseWriter, r *http.Request) {
+	req := chat.ExpiryRequest{Room: r.URL.Query().Get("room"), User: r.URL.Query().Get("user")}
+	switch r.Method {
+	case "GET":
+		if req.Room == "" && req.User == "" {
+			http.Error(w, "room or user required", http.StatusBadRequest)
+			return
+		}
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "POST {room or user, expiry} expected", http.StatusBadRequest)
+			return
+		}
+		if err := ws.chat.SetExpiry(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(ws.chat.Expiry(req))
+}
+
+// handlePresence returns our presence, setting it first on POST
+// chat.PresenceRequest.
+func (ws *WebServer) handlePresence(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req chat.PresenceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "POST {state, status} expected", http.StatusBadRequest)
+			return
+		}
+		if err := ws.chat.SetPresence(req.State, req.Status); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(ws.chat.OwnPresence())
 }
 
 func (ws *WebServer) handleMessages(w http.ResponseWriter, r *http.Request) {
@@ -285,6 +1196,14 @@ func (ws *WebServer) handleMessages(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(messages)
 }
 
+func (ws *WebServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := map[string]interface{}{
+		"send_queues":     ws.chat.QueueStats(),
+		"discovery_drops": ws.network.Discovery().DropStats(),
+	}
+	json.NewEncoder(w).Encode(metrics)
+}
+
 func (ws *WebServer) handleStatic(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "web/"+r.URL.Path[8:])
 }